@@ -12,16 +12,20 @@ Required environment variables:
 
 Optional environment variables (that do not usually need to be set):
   CSS_PORT_EXTERNAL:          Docker external port number for the Cloud Sync Service (CSS) container.
-  EXCHANGE_INTERNAL_INTERVAL: The number of seconds to wait between attempts to connect to the exchange during startup
-  EXCHANGE_INTERNAL_RETRIES:  The maximum number of times to try connecting to the exchange during startup to verify the connection info.
+  BOOTSTRAP_MAX_BACKOFF:      The maximum number of seconds the OCS API waits between retries of its startup tasks (connecting to the exchange and setting up the owner service). Default is 300.
+  EXCHANGE_INTERNAL_INTERVAL: The number of seconds to wait before the 1st retry of the OCS API startup tasks. The wait doubles after each failure.
+  EXCHANGE_INTERNAL_RETRIES:  The number of failed attempts of the OCS API startup tasks after which failures are logged as errors. The OCS API keeps retrying, but is not ready until they succeed.
   EXCHANGE_INTERNAL_URL:      Docker internal network path to the Exchange container. Used for authentication and authorization with the Exchange.
   EXCHANGE_PORT_EXTERNAL:     Docker external port number for the Exchange container.
   FDO_DB_URL:                 Docker internal network path to database.
   FDO_GET_PKGS_FROM:          Where to have the edge devices get the horizon packages from. If set to css:, it will be expanded to css:/api/v1/objects/IBM/agent_files. Or it can be set to something like https://github.com/open-horizon/anax/releases/latest/download (which is the default).
   FDO_GET_CFG_FILE_FROM:      Where to have the edge devices get the agent-install.cfg file from. If set to css: (the default), it will be expanded to css:/api/v1/objects/IBM/agent_files/agent-install.cfg. Or it can set to agent-install.cfg, which means using the file that the FDO Owner Service creates.
+  FDO_LABELS_AS_NODE_PROPERTIES: Set to true to have the labels of a device set as properties of its exchange node when it registers. Default is false.
   FDO_OCS_DB_HOST_DIR:
   FDO_OCS_DB_CONTAINER_DIR:
   FDO_OWN_COMP_SVC_PORT:      Docker external port number for the FDO Owner Companion Service (OCS).
+  CERT_EXPIRY_WARNING_DAYS:   The OCS API /readyz route warns when its certificate or an owner certificate expires in fewer than this many days. Default is 14.
+  EXCHANGE_AUTH_CACHE_TTL:    Number of seconds the OCS API caches successful exchange authentications. 0 disables the cache. Default is 60.
   FDO_OWN_DB:                 Database name for the FDO Owner Service's database.
   FDO_OWN_DB_PASSWORD:        Database user's password for the FDO Owner Service's database. Default is generated.
   FDO_OWN_DB_PORT:            Docker external port number for the FDO Owner Service's database.
@@ -30,13 +34,39 @@ Optional environment variables (that do not usually need to be set):
   FDO_OWN_SVC_AUTH:           FDO Owner Service API credentials. Default is generated. Format: apiUser:<password>
   FDO_OWN_SVC_CERT_PATH:      Path that the directory holding the certificate and key files is mounted to within the container. Default is /home/fdouser/ocs-api-dir/keys .
   FDO_OWN_SVC_PORT:           Docker external port number for the FDO Owner Service.
+  FDO_STATE_POLL_INTERVAL:    Number of seconds between OCS API polls of the owner service for device onboarding states. 0 disables polling. Default is 300.
+  FDO_OWNER_CERT_CHECK_INTERVAL: Number of seconds between OCS API checks of the owner certificate expiry dates. 0 disables the checks. Default is 3600.
+  FDO_OWNER_MESSAGE_SIZE:     The max message size (1300 - 65535) the OCS API sets in the owner service at startup. Default is to leave the owner service value.
+  FDO_OWNER_SVI_SIZE:         The service info MTU (1300 - 65535, at most FDO_OWNER_MESSAGE_SIZE) the OCS API sets in the owner service at startup, for large service info payloads. Default is to leave the owner service value.
+  FDO_RV_SERVERS:             Comma separated list of <name>=<url> of the rendezvous servers (e.g. rv1=http://rv.example.com:8040) whose owner allow and deny lists the OCS API /api/fdo/rv routes manage. Default is none.
+  FDO_RV_SVC_AUTH:            The API credentials of the rendezvous servers in FDO_RV_SERVERS. Format: apiUser:<password>
   FDO_RV_VOUCHER_TTL:         Tell the rendezvous server to persist vouchers for this number of seconds. Default is 7200.
+  FDO_TRUSTED_BUNDLE_KEYS:    Path (inside the container, for example in the OCS DB volume) of a PEM file with the public keys of the other OCS API instances whose exported device bundles can be imported. Get a key from GET /api/fdo/instance-key of that instance.
+  HTTP_IDLE_TIMEOUT:          Number of seconds the OCS API keeps idle client connections open. Default is 120.
+  HTTP_READ_TIMEOUT:          Number of seconds the OCS API allows for reading a request. Default is 60.
+  HTTP_WRITE_TIMEOUT:         Number of seconds the OCS API allows for handling a request and writing the response. Default is 120.
+  IDEMPOTENCY_KEY_TTL:        Number of hours the OCS API remembers the Idempotency-Key of a voucher import. Default is 24.
   HZN_DOCK_NET:               Docker internal network name of Open Horizon's Management Hub.
   HZN_EXCHANGE_URL:           Host network path to the Exchange. Appended to the agent-install.cfg.
   HZN_FSS_CSSURL:             Host network path to the Cloud Sync Service (CSS). Appended to the agent-install.cfg.
   HZN_LISTEN_IP:              Domain or IP Address of the Open Horizon Management Hub.
   HZN_TRANSPORT:              http or https. Only http is currently supported.
+  JOB_RETENTION:              Number of hours the OCS API keeps finished jobs, checked hourly. Default is 168.
+  JOB_WORKERS:                Number of jobs the OCS API runs at the same time. Default is 2.
+  LOG_FORMAT:                 The format of the OCS API log: text (the default) or json.
+  LOG_LEVEL:                  The OCS API log level: debug, info (the default), warn, or error.
+  LOG_MAX_PAYLOAD_BYTES:      Longer values in the OCS API log are truncated to this many bytes. Default is 512.
+  METRICS_PORT:               Port in the container that the OCS API serves its Prometheus /metrics on. Default is unset, which doesn't serve them. The metrics are not authenticated, so only publish this port to the network they are scraped from.
+  OCS_DB_ACTIVE_KEY_ID:       The id of the OCS DB key (from OCS_DB_KEYS) used to encrypt node tokens and vouchers. Default is the 1st key listed.
+  OCS_DB_ALLOW_LOCAL_KEY:     Set to true to use a key generated in the OCS DB volume when OCS_DB_KEYS is not set. Not recommended, because the key is stored with the values it encrypts.
+  OCS_DB_KEYS:                Comma separated list of <key-id>=<base64 32 byte key> used to encrypt sensitive OCS DB values. Required, unless OCS_DB_ALLOW_LOCAL_KEY is true. After changing the active key, and once after upgrading to bind the values encrypted by earlier versions to their files, run: ocs-api reencrypt <ocs-db-path>
+  OTEL_EXPORTER_OTLP_ENDPOINT: OTLP/HTTP endpoint (e.g. http://otel-collector:4318) the OCS API sends trace spans to. Default is unset, which disables exporting spans. The other standard OTEL_* env vars are also honored.
+  OTEL_SERVICE_NAME:          The service name in the OCS API trace spans. Default is ocs-api.
   POSTGRES_IMAGE_TAG:         Postgresql version to pull from Dockerhub.
+  SHUTDOWN_DELAY:             Number of seconds the OCS API keeps serving (while not ready) when it is stopped, so load balancers stop sending it requests. Default is 5.
+  SHUTDOWN_TIMEOUT:           Number of seconds the OCS API waits for in-flight requests to finish when it is stopped. Default is 30.
+  SHUTDOWN_TRACING_TIMEOUT:   Number of seconds the OCS API waits to flush its trace spans when it is stopped. Default is 5.
+  SHUTDOWN_WORKERS_TIMEOUT:   Number of seconds the OCS API waits for its background workers to stop when it is stopped. Default is 10.
   VERBOSE:                    set to 1 or 'true' for more verbose output.
 EndOfMessage
     exit 1
@@ -159,19 +189,50 @@ docker run -d \
            -e "EXCHANGE_INTERNAL_CERT=$EXCHANGE_INTERNAL_CERT" \
            -e "EXCHANGE_INTERNAL_RETRIES=$EXCHANGE_INTERNAL_RETRIES" \
            -e "EXCHANGE_INTERNAL_INTERVAL=$EXCHANGE_INTERNAL_INTERVAL" \
+           -e "BOOTSTRAP_MAX_BACKOFF=$BOOTSTRAP_MAX_BACKOFF" \
            -e "HZN_FSS_CSSURL=$HZN_FSS_CSSURL" \
            -e "HZN_MGMT_HUB_CERT=$HZN_MGMT_HUB_CERT" \
            -e "FDO_GET_PKGS_FROM=$FDO_GET_PKGS_FROM" \
            -e "FDO_GET_CFG_FILE_FROM=$FDO_GET_CFG_FILE_FROM" \
            -e "FDO_RV_VOUCHER_TTL=$FDO_RV_VOUCHER_TTL" \
+           -e "FDO_RV_SERVERS=$FDO_RV_SERVERS" \
+           -e "FDO_RV_SVC_AUTH=$FDO_RV_SVC_AUTH" \
+           -e "FDO_STATE_POLL_INTERVAL=$FDO_STATE_POLL_INTERVAL" \
+           -e "FDO_OWNER_CERT_CHECK_INTERVAL=$FDO_OWNER_CERT_CHECK_INTERVAL" \
+           -e "FDO_OWNER_MESSAGE_SIZE=$FDO_OWNER_MESSAGE_SIZE" \
+           -e "FDO_OWNER_SVI_SIZE=$FDO_OWNER_SVI_SIZE" \
+           -e "FDO_LABELS_AS_NODE_PROPERTIES=$FDO_LABELS_AS_NODE_PROPERTIES" \
+           -e "FDO_TRUSTED_BUNDLE_KEYS=$FDO_TRUSTED_BUNDLE_KEYS" \
+           -e "EXCHANGE_AUTH_CACHE_TTL=$EXCHANGE_AUTH_CACHE_TTL" \
+           -e "CERT_EXPIRY_WARNING_DAYS=$CERT_EXPIRY_WARNING_DAYS" \
+           -e "IDEMPOTENCY_KEY_TTL=$IDEMPOTENCY_KEY_TTL" \
+           -e "JOB_WORKERS=$JOB_WORKERS" \
+           -e "JOB_RETENTION=$JOB_RETENTION" \
+           -e "LOG_FORMAT=$LOG_FORMAT" \
+           -e "LOG_LEVEL=$LOG_LEVEL" \
+           -e "LOG_MAX_PAYLOAD_BYTES=$LOG_MAX_PAYLOAD_BYTES" \
+           -e "METRICS_PORT=$METRICS_PORT" \
+           -e "OCS_DB_KEYS=$OCS_DB_KEYS" \
+           -e "OCS_DB_ACTIVE_KEY_ID=$OCS_DB_ACTIVE_KEY_ID" \
+           -e "OCS_DB_ALLOW_LOCAL_KEY=$OCS_DB_ALLOW_LOCAL_KEY" \
+           -e "OTEL_EXPORTER_OTLP_ENDPOINT=$OTEL_EXPORTER_OTLP_ENDPOINT" \
+           -e "OTEL_SERVICE_NAME=${OTEL_SERVICE_NAME:-ocs-api}" \
+           -e "HTTP_IDLE_TIMEOUT=$HTTP_IDLE_TIMEOUT" \
+           -e "HTTP_READ_TIMEOUT=$HTTP_READ_TIMEOUT" \
+           -e "HTTP_WRITE_TIMEOUT=$HTTP_WRITE_TIMEOUT" \
+           -e "SHUTDOWN_DELAY=$SHUTDOWN_DELAY" \
+           -e "SHUTDOWN_TIMEOUT=$SHUTDOWN_TIMEOUT" \
+           -e "SHUTDOWN_WORKERS_TIMEOUT=$SHUTDOWN_WORKERS_TIMEOUT" \
+           -e "SHUTDOWN_TRACING_TIMEOUT=$SHUTDOWN_TRACING_TIMEOUT" \
            -e "VERBOSE=$VERBOSE" \
+           --stop-timeout "$(( ${SHUTDOWN_DELAY:-5} + ${SHUTDOWN_TIMEOUT:-30} + ${SHUTDOWN_WORKERS_TIMEOUT:-10} + ${SHUTDOWN_TRACING_TIMEOUT:-5} + 5 ))" \
            --mount "type=volume,src=fdo-ocs-db,dst=$FDO_OCS_DB_CONTAINER_DIR" \
            --name "$FDO_DOCKER_IMAGE" \
            --network="$HZN_DOCK_NET" \
            --health-interval=15s \
            --health-retries=3 \
            --health-timeout=5s \
-           --health-cmd="curl --fail $HZN_TRANSPORT://$HZN_LISTEN_IP:$FDO_OWN_COMP_SVC_PORT/api/version || exit 1" \
+           --health-cmd="curl --fail $HZN_TRANSPORT://$HZN_LISTEN_IP:$FDO_OWN_COMP_SVC_PORT/healthz || exit 1" \
            -p "$FDO_OWN_SVC_PORT":8042 \
            -p "$FDO_OWN_COMP_SVC_PORT":9008 \
            "$DOCKER_REGISTRY/$FDO_DOCKER_IMAGE:$VERSION"
@@ -241,5 +241,6 @@ echo ""
 
 
 echo "Starting ocs-api service..."
-./ocs-api/linux/ocs-api $ocsApiPort $ocsDbDir
+# exec so ocs-api gets the SIGTERM from docker stop, and can finish in-flight requests before exiting
+exec ./ocs-api/linux/ocs-api $ocsApiPort $ocsDbDir
 
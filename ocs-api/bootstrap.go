@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+	"github.com/open-horizon/FDO-support/ocs-api/tracing"
+)
+
+/*
+Startup tasks that depend on the exchange and the owner service. They run in the background, so the http server comes up
+immediately (not ready) and stays up if a dependency is slow to start. The tasks are retried with exponential backoff (starting
+at EXCHANGE_INTERNAL_INTERVAL seconds, up to BOOTSTRAP_MAX_BACKOFF seconds) until they all succeed, and then ocs-api is ready.
+
+The owner service settings (the TO2 redirect, the message and SVI sizes, and the common resources) are reconciled: each is read from the owner service and
+only uploaded if its content hash differs from what it should be, and then read again to verify it.
+*/
+
+const DefaultBootstrapMaxBackoffS = 300
+
+// The resources in the owner service that every device's service info uses
+var bootstrapResources = []string{"agent-install.crt", "agent-install.cfg", "agent-install-wrapper.sh"}
+
+var bootstrapComplete atomic.Bool
+
+// The reconcile states of an owner service setting
+const (
+	BootstrapItemPending   = "pending"   // not checked yet
+	BootstrapItemUnchanged = "unchanged" // the owner service already had the right content
+	BootstrapItemUpdated   = "updated"   // the content was uploaded and verified
+	BootstrapItemFailed    = "failed"
+)
+
+type BootstrapItemStatus struct {
+	Name          string `json:"name"`
+	State         string `json:"state"`
+	DesiredSha256 string `json:"desiredSha256,omitempty"`
+	CurrentSha256 string `json:"currentSha256,omitempty"` // before it was updated
+	Verified      bool   `json:"verified"`
+	Error         string `json:"error,omitempty"`
+}
+
+type BootstrapStatus struct {
+	Ready       bool                  `json:"ready"`
+	Attempts    int                   `json:"attempts"`
+	LastAttempt string                `json:"lastAttempt,omitempty"`
+	LastError   string                `json:"lastError,omitempty"`
+	CompletedAt string                `json:"completedAt,omitempty"`
+	Items       []BootstrapItemStatus `json:"items"`
+}
+
+// An owner service setting that the bootstrap reconciles
+type bootstrapItem struct {
+	name      string
+	getUrl    string
+	postUrl   string
+	desired   []byte
+	normalize func([]byte) []byte // so equivalent content has the same hash, can be nil
+}
+
+var bootstrapStatus BootstrapStatus
+var bootstrapStatusLock sync.RWMutex
+
+// Returns true once the startup tasks have completed
+func IsReady() bool {
+	return bootstrapComplete.Load()
+}
+
+// Returns a copy of the current bootstrap status
+func getBootstrapStatus() BootstrapStatus {
+	bootstrapStatusLock.RLock()
+	defer bootstrapStatusLock.RUnlock()
+	status := bootstrapStatus
+	status.Ready = IsReady()
+	status.Items = append([]BootstrapItemStatus{}, bootstrapStatus.Items...)
+	return status
+}
+
+// Record the reconcile status of this owner service setting
+func setBootstrapItemStatus(itemStatus BootstrapItemStatus) {
+	bootstrapStatusLock.Lock()
+	defer bootstrapStatusLock.Unlock()
+	for i := range bootstrapStatus.Items {
+		if bootstrapStatus.Items[i].Name == itemStatus.Name {
+			bootstrapStatus.Items[i] = itemStatus
+			return
+		}
+	}
+	bootstrapStatus.Items = append(bootstrapStatus.Items, itemStatus)
+}
+
+// Run the startup tasks until they succeed, or ctx is canceled
+func superviseBootstrap(ctx context.Context, to2Host, to2Port string) {
+	backoff := time.Duration(ExchangeInternalInterval) * time.Second
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	maxBackoff := time.Duration(outils.GetEnvVarIntWithDefault("BOOTSTRAP_MAX_BACKOFF", DefaultBootstrapMaxBackoffS)) * time.Second
+
+	for attempt := 1; ; attempt++ {
+		err := runBootstrapSafely(ctx, to2Host, to2Port)
+		now := time.Now().UTC().Format(time.RFC3339)
+		bootstrapStatusLock.Lock()
+		bootstrapStatus.Attempts = attempt
+		bootstrapStatus.LastAttempt = now
+		if err == nil {
+			bootstrapStatus.LastError = ""
+			bootstrapStatus.CompletedAt = now
+		} else {
+			bootstrapStatus.LastError = err.Error()
+		}
+		bootstrapStatusLock.Unlock()
+
+		if err == nil {
+			bootstrapComplete.Store(true)
+			outils.Log.Info("startup tasks completed, ocs-api is ready", "attempts", attempt)
+			return
+		}
+		if attempt >= ExchangeInternalRetries {
+			outils.Log.Error("startup tasks are still failing, ocs-api is not ready", "attempt", attempt, "error", err, "retry_in", backoff.String())
+		} else {
+			outils.Log.Warn("startup tasks failed", "attempt", attempt, "error", err, "retry_in", backoff.String())
+		}
+		if !sleepCtx(ctx, backoff) {
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Run the startup tasks, turning a panic into an error so the supervisor retries
+func runBootstrapSafely(ctx context.Context, to2Host, to2Port string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic during startup tasks: %v", r)
+		}
+	}()
+	return runBootstrap(ctx, to2Host, to2Port)
+}
+
+// Verify the exchange connection, and reconcile the TO2 address, the sizes, and the common resources in the owner service
+func runBootstrap(ctx context.Context, to2Host, to2Port string) (err error) {
+	ctx, span := tracing.Start(ctx, "bootstrap")
+	defer func() { tracing.End(span, err) }()
+
+	outils.Log.Info("verifying connection to the exchange", "url", ExchangeInternalUrl)
+	if err := outils.CheckExchangeConnection(ctx, ExchangeInternalUrl, ExchangeInternalCertPath); err != nil {
+		return err
+	}
+	outils.Log.Info("successfully connected to the exchange", "url", ExchangeInternalUrl)
+
+	items, err := getBootstrapItems(to2Host, to2Port)
+	if err != nil {
+		return err
+	}
+	username, password := outils.GetOwnerServiceApiKey()
+	client := outils.NewOwnerServiceClient(username, password)
+	for _, item := range items {
+		itemStatus, err := reconcileBootstrapItem(ctx, client, item)
+		if err != nil {
+			itemStatus.State = BootstrapItemFailed
+			itemStatus.Error = err.Error()
+		}
+		setBootstrapItemStatus(itemStatus)
+		if err != nil {
+			return fmt.Errorf("reconciling %s: %v", item.name, err)
+		}
+	}
+	return nil
+}
+
+// Returns the owner service settings that every device's onboarding depends on, with the content they should have
+func getBootstrapItems(to2Host, to2Port string) ([]bootstrapItem, error) {
+	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
+	to2Address, err := newTo2Address(to2Host, to2Port)
+	if err != nil {
+		return nil, err
+	}
+	items := []bootstrapItem{{
+		name:      "redirect",
+		getUrl:    fdoOwnerURL + "/api/v1/owner/redirect",
+		postUrl:   fdoOwnerURL + "/api/v1/owner/redirect",
+		desired:   []byte(encodeTo2Addresses([]To2Address{to2Address})),
+		normalize: normalizeTo2Addresses,
+	}}
+
+	sizeItems, err := getOwnerSizeBootstrapItems()
+	if err != nil {
+		return nil, err
+	}
+	items = append(items, sizeItems...)
+
+	valuesDir := filepath.Join(OcsDbDir, "v1", "values")
+	for _, resource := range bootstrapResources {
+		fileName := filepath.Join(valuesDir, resource)
+		content, err := os.ReadFile(fileName)
+		if os.IsNotExist(err) {
+			continue // agent-install.crt is only created if HZN_MGMT_HUB_CERT is set
+		} else if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", fileName, err)
+		}
+		resourceUrl := fdoOwnerURL + "/api/v1/owner/resource?filename=" + resource
+		items = append(items, bootstrapItem{name: resource, getUrl: resourceUrl, postUrl: resourceUrl, desired: content})
+	}
+
+	// Show all of the items as pending until they are reconciled
+	bootstrapStatusLock.Lock()
+	defer bootstrapStatusLock.Unlock()
+	if len(bootstrapStatus.Items) == 0 {
+		for _, item := range items {
+			bootstrapStatus.Items = append(bootstrapStatus.Items, BootstrapItemStatus{Name: item.name, State: BootstrapItemPending})
+		}
+	}
+	return items, nil
+}
+
+// Upload this setting to the owner service if its content there is different, and verify it
+func reconcileBootstrapItem(ctx context.Context, client *http.Client, item bootstrapItem) (BootstrapItemStatus, error) {
+	itemStatus := BootstrapItemStatus{Name: item.name, DesiredSha256: contentHash(item.desired, item.normalize)}
+
+	current, err := getFromOwnerService(ctx, client, item.getUrl)
+	if err != nil {
+		return itemStatus, err
+	}
+	if current != nil {
+		itemStatus.CurrentSha256 = contentHash(current, item.normalize)
+	}
+	if itemStatus.CurrentSha256 == itemStatus.DesiredSha256 {
+		outils.Log.Info("owner service setting is already up to date", "name", item.name)
+		itemStatus.State = BootstrapItemUnchanged
+		itemStatus.Verified = true
+		return itemStatus, nil
+	}
+
+	outils.Log.Info("updating owner service setting", "name", item.name, "current_sha256", itemStatus.CurrentSha256, "desired_sha256", itemStatus.DesiredSha256)
+	if err := postToOwnerService(ctx, client, item.postUrl, item.desired); err != nil {
+		return itemStatus, err
+	}
+
+	// Read it back to make sure the owner service has what we sent
+	updated, err := getFromOwnerService(ctx, client, item.getUrl)
+	if err != nil {
+		return itemStatus, fmt.Errorf("verifying: %v", err)
+	}
+	if updatedHash := contentHash(updated, item.normalize); updatedHash != itemStatus.DesiredSha256 {
+		return itemStatus, fmt.Errorf("verifying: the owner service content has hash %s instead of %s", updatedHash, itemStatus.DesiredSha256)
+	}
+	itemStatus.State = BootstrapItemUpdated
+	itemStatus.Verified = true
+	return itemStatus, nil
+}
+
+// Returns the hex sha256 of this content, after normalizing it
+func contentHash(content []byte, normalize func([]byte) []byte) string {
+	if normalize != nil {
+		content = normalize(content)
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the compact form of this json, so differences in white space don't count. Content that isn't json is returned as is.
+func normalizeJson(content []byte) []byte {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, bytes.TrimSpace(content)); err != nil {
+		return content
+	}
+	return buf.Bytes()
+}
+
+// GET this setting from the owner service. Returns nil (and no error) if it doesn't exist.
+func getFromOwnerService(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	resp, err := outils.HttpGet(ctx, client, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound || (resp.StatusCode == http.StatusOK && len(respBodyBytes) == 0) {
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("owner service returned HTTP code %d for %s", resp.StatusCode, outils.SafeUrl(url))
+	}
+	return respBodyBytes, nil
+}
+
+// POST this body to the owner service and check the response status
+func postToOwnerService(ctx context.Context, client *http.Client, url string, body []byte) error {
+	resp, err := outils.HttpPost(ctx, client, url, "text/plain", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("owner service returned HTTP code %d for %s: %s", resp.StatusCode, outils.SafeUrl(url), string(respBodyBytes))
+	}
+	return nil
+}
+
+// ============= GET /api/fdo/bootstrap =============
+// Returns the state of the startup tasks, including the reconcile state of each owner service setting. Only the exchange root
+// user can do this, because the settings are for the whole service.
+func getFdoBootstrapHandler(w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("GET /api/fdo/bootstrap")
+
+	if authenticated, httpErr := outils.ExchangeAuthenticateRoot(r, ExchangeInternalUrl, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided or the user is not the exchange root user", http.StatusUnauthorized)
+		return
+	}
+
+	outils.WriteJsonResponse(http.StatusOK, w, getBootstrapStatus())
+}
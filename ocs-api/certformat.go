@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+)
+
+/*
+The formats the owner certificates can be returned in, so manufacturers can use whichever their tooling needs, and confirm the
+certificate out-of-band with its SHA-256 fingerprint (sha256 in the json format). The format is negotiated with the Accept
+header, or chosen with ?format=.
+*/
+
+// The certificate formats
+const (
+	CertFormatPem  = "pem"
+	CertFormatDer  = "der"
+	CertFormatJwk  = "jwk"
+	CertFormatJson = "json"
+)
+
+// The media types of each format. The first one is returned as the Content-Type.
+var certFormatMediaTypes = map[string][]string{
+	CertFormatPem:  {"text/plain", "application/x-pem-file", "application/pem-certificate-chain"},
+	CertFormatDer:  {"application/pkix-cert", "application/x-x509-ca-cert", "application/octet-stream"},
+	CertFormatJwk:  {"application/jwk+json"},
+	CertFormatJson: {"application/json"},
+}
+
+// The public key of an owner certificate as a JWK (RFC 7517), with the certificate in x5c
+type Jwk struct {
+	Kty     string   `json:"kty"`
+	Kid     string   `json:"kid"` // the owner key type
+	Use     string   `json:"use"`
+	Crv     string   `json:"crv,omitempty"`
+	X       string   `json:"x,omitempty"`
+	Y       string   `json:"y,omitempty"`
+	N       string   `json:"n,omitempty"`
+	E       string   `json:"e,omitempty"`
+	X5c     []string `json:"x5c"`
+	X5tS256 string   `json:"x5t#S256"`
+}
+
+// The details of an owner certificate, with the certificate itself
+type OwnerCertificateDetail struct {
+	OwnerCertificate
+	SerialNumber       string `json:"serialNumber,omitempty"`
+	SignatureAlgorithm string `json:"signatureAlgorithm,omitempty"`
+	Certificate        string `json:"certificate,omitempty"` // PEM
+	Jwk                *Jwk   `json:"jwk,omitempty"`
+}
+
+// Choose the format of the certificate from ?format=, or else the Accept header. Returns the format and the media type to respond
+// with. Without either, the certificate is returned as text/plain PEM, like it always was.
+func negotiateCertFormat(r *http.Request) (string, string, *outils.HttpError) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		mediaTypes, ok := certFormatMediaTypes[format]
+		if !ok {
+			return "", "", outils.NewHttpError(http.StatusBadRequest, "format must be one of pem, der, jwk, json")
+		}
+		return format, mediaTypes[0], nil
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return CertFormatPem, "text/plain", nil
+	}
+
+	// Try the accepted media types from the highest quality to the lowest, in the order given for equal qualities
+	type acceptedType struct {
+		mediaType string
+		quality   float64
+	}
+	accepted := []acceptedType{}
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		a := acceptedType{mediaType: strings.ToLower(strings.TrimSpace(params[0])), quality: 1}
+		for _, param := range params[1:] {
+			if name, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.EqualFold(name, "q") {
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					a.quality = q
+				}
+			}
+		}
+		if a.quality > 0 {
+			accepted = append(accepted, a)
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool { return accepted[i].quality > accepted[j].quality })
+	for _, a := range accepted {
+		switch a.mediaType {
+		case "*/*", "text/*":
+			return CertFormatPem, "text/plain", nil
+		case "application/*":
+			return CertFormatPem, "application/x-pem-file", nil
+		}
+		for _, format := range []string{CertFormatPem, CertFormatDer, CertFormatJwk, CertFormatJson} {
+			for _, mediaType := range certFormatMediaTypes[format] {
+				if a.mediaType == mediaType {
+					return format, mediaType, nil
+				}
+			}
+		}
+	}
+	return "", "", outils.NewHttpError(http.StatusNotAcceptable, "the certificate can be returned as text/plain or application/x-pem-file (PEM), application/pkix-cert (DER), application/jwk+json (JWK), or application/json")
+}
+
+// Returns the public key of the owner certificate as a JWK
+func newJwk(alias string, cert *x509.Certificate) (*Jwk, error) {
+	fingerprint := sha256.Sum256(cert.Raw)
+	jwk := &Jwk{
+		Kid:     alias,
+		Use:     "sig",
+		X5c:     []string{base64.StdEncoding.EncodeToString(cert.Raw)},
+		X5tS256: base64.RawURLEncoding.EncodeToString(fingerprint[:]),
+	}
+	switch key := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		var crv string
+		switch key.Curve {
+		case elliptic.P256():
+			crv = "P-256"
+		case elliptic.P384():
+			crv = "P-384"
+		case elliptic.P521():
+			crv = "P-521"
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", key.Curve.Params().Name)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = crv
+		jwk.X = base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size)))
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	default:
+		return nil, fmt.Errorf("unsupported public key algorithm %s", cert.PublicKeyAlgorithm.String())
+	}
+	return jwk, nil
+}
+
+// Returns the details of the owner certificate, with the certificate as PEM and JWK. If it could not be read, only the alias and
+// the error are set.
+func newOwnerCertificateDetail(ownerCert OwnerCertificate) OwnerCertificateDetail {
+	detail := OwnerCertificateDetail{OwnerCertificate: ownerCert}
+	if ownerCert.cert == nil {
+		return detail
+	}
+	detail.SerialNumber = ownerCert.cert.SerialNumber.Text(16)
+	detail.SignatureAlgorithm = ownerCert.cert.SignatureAlgorithm.String()
+	detail.Certificate = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ownerCert.cert.Raw}))
+	if jwk, err := newJwk(ownerCert.Alias, ownerCert.cert); err == nil {
+		detail.Jwk = jwk
+	}
+	return detail
+}
+
+// Write the owner certificate in the negotiated format. The certificate must have been parsed.
+func writeOwnerCertificate(w http.ResponseWriter, ownerCert OwnerCertificate, format, mediaType string) {
+	alias, cert := ownerCert.Alias, ownerCert.cert
+	w.Header().Set("Vary", "Accept")
+	switch format {
+	case CertFormatDer:
+		w.Header().Set("Content-Type", mediaType)
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+alias+".der\"")
+		outils.WriteResponse(http.StatusOK, w, cert.Raw)
+	case CertFormatJwk:
+		jwk, err := newJwk(alias, cert)
+		if err != nil {
+			http.Error(w, "the "+alias+" owner certificate can't be returned as a JWK: "+err.Error(), http.StatusNotAcceptable)
+			return
+		}
+		jwkBytes, err := json.Marshal(jwk)
+		if err != nil {
+			http.Error(w, "Internal Server Error (could not encode json response)", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", mediaType)
+		outils.WriteResponse(http.StatusOK, w, jwkBytes)
+	case CertFormatJson:
+		outils.WriteJsonResponse(http.StatusOK, w, newOwnerCertificateDetail(ownerCert))
+	default:
+		w.Header().Set("Content-Type", mediaType)
+		outils.WriteResponse(http.StatusOK, w, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	}
+}
+
+// ============= GET /api/orgs/{org-id}/fdo/certificates =============
+// Returns the details of the owner certificates of all of the owner key types, with each certificate as PEM and JWK. The key
+// types whose certificate could not be read have an error instead.
+func getFdoOwnerCertificatesHandler(orgId string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("GET /api/orgs/{org-id}/fdo/certificates", "org", orgId)
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	if authenticated, _, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
+		return
+	}
+
+	ownerCerts := refreshOwnerCertificates(r.Context())
+	details := make([]OwnerCertificateDetail, 0, len(ownerCerts))
+	for _, ownerCert := range ownerCerts {
+		details = append(details, newOwnerCertificateDetail(ownerCert))
+	}
+	outils.WriteJsonResponse(http.StatusOK, w, details)
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-horizon/FDO-support/ocs-api/ocsdb"
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+)
+
+/*
+An in-memory index of the devices, so the voucher list can be filtered, sorted, and paged without reading every device
+directory. It is built from the OCS DB when ocs-api starts, and kept up to date when devices are imported or change state.
+The parts of the voucher that are indexed are saved in v1/devices/<uuid>/device.json when the voucher is imported, so building
+the index doesn't have to decrypt and parse every voucher.
+*/
+
+const MaxVoucherListLimit = 1000
+
+// The voucher list sort fields
+const (
+	SortByUuid         = "uuid"
+	SortByImported     = "imported"
+	SortByState        = "state"
+	SortBySerialNumber = "serialNumber"
+	SortByManufacturer = "manufacturer"
+)
+
+// Saved in device.json when the voucher is imported
+type DeviceRecord struct {
+	Imported     string `json:"imported"`
+	ImportedBy   string `json:"importedBy,omitempty"` // the exchange user that imported the voucher
+	Manufacturer string `json:"manufacturer,omitempty"`
+	SerialNumber string `json:"serialNumber,omitempty"`
+	DeviceInfo   string `json:"deviceInfo,omitempty"`
+	OwnerKeyType string `json:"ownerKeyType,omitempty"`
+}
+
+type DeviceIndexEntry struct {
+	Uuid  string
+	OrgId string
+	DeviceState
+	DeviceRecord
+	Labels map[string]string // from metadata.json
+}
+
+// The TO2 statuses in the voucher details
+const (
+	To2StatusPending   = "pending"
+	To2StatusCompleted = "completed"
+)
+
+// A device in the voucher list, when ?detail=true
+type VoucherDetail struct {
+	Guid             string            `json:"guid"`
+	OrgId            string            `json:"orgId"`
+	Imported         string            `json:"imported"`
+	ImportedBy       string            `json:"importedBy,omitempty"`
+	SerialNumber     string            `json:"serialNumber,omitempty"`
+	Manufacturer     string            `json:"manufacturer,omitempty"`
+	DeviceInfo       string            `json:"deviceInfo,omitempty"`
+	OwnerKeyType     string            `json:"ownerKeyType,omitempty"`
+	State            string            `json:"state"`
+	To0Expiry        string            `json:"to0Expiry,omitempty"`
+	To2Status        string            `json:"to2Status"`
+	To2CompletedOn   string            `json:"to2CompletedOn,omitempty"`
+	ExchangeNodeName string            `json:"exchangeNodeName"`
+	Labels           map[string]string `json:"labels"`
+}
+
+var deviceIndex = map[string]*DeviceIndexEntry{}
+var deviceIndexLock sync.RWMutex
+
+func getDeviceRecordFileName(deviceUuid string) string {
+	return filepath.Clean(filepath.Join(OcsDbDir, "v1", "devices", deviceUuid, "device.json"))
+}
+
+// Save the indexed parts of this voucher with the device
+func saveDeviceRecord(ctx context.Context, deviceUuid string, voucherHeader *outils.VoucherHeader, importedBy string, imported time.Time) *outils.HttpError {
+	record := DeviceRecord{
+		Imported:     imported.UTC().Format(time.RFC3339),
+		ImportedBy:   importedBy,
+		Manufacturer: voucherHeader.Manufacturer,
+		SerialNumber: voucherHeader.SerialNumber,
+		DeviceInfo:   voucherHeader.DeviceInfo,
+		OwnerKeyType: voucherHeader.OwnerKeyType,
+	}
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "Error marshaling the record of device %s: %v", deviceUuid, err)
+	}
+	fileName := getDeviceRecordFileName(deviceUuid)
+	if err := ocsdb.WriteFile(ctx, fileName, recordBytes, 0644); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
+	}
+	return nil
+}
+
+// Read the record of this device. Devices imported before the records were saved get one created from their voucher, without
+// the importing user, because it wasn't recorded.
+func getDeviceRecord(ctx context.Context, deviceUuid string) (*DeviceRecord, *outils.HttpError) {
+	fileName := getDeviceRecordFileName(deviceUuid)
+	if !outils.PathExists(fileName) {
+		voucherFileName := filepath.Join(filepath.Dir(fileName), "ownership_voucher.txt")
+		voucherBytes, err := ocsdb.ReadFile(voucherFileName)
+		if err != nil {
+			return nil, outils.NewHttpError(http.StatusInternalServerError, "Error reading %s: %v", voucherFileName, err)
+		}
+		voucherHeader, err := outils.ParseVoucher(voucherBytes)
+		if err != nil {
+			voucherHeader = &outils.VoucherHeader{} // still list it, just without the voucher fields
+		}
+		imported := time.Now() // the best guess of when it was imported is when the voucher file was written
+		if info, err := os.Stat(voucherFileName); err == nil {
+			imported = info.ModTime()
+		}
+		if httpErr := saveDeviceRecord(ctx, deviceUuid, voucherHeader, "", imported); httpErr != nil {
+			return nil, httpErr
+		}
+	}
+	recordBytes, err := ocsdb.ReadFile(fileName)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error reading %s: %v", fileName, err)
+	}
+	record := &DeviceRecord{}
+	if err := json.Unmarshal(recordBytes, record); err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error parsing %s: %v", fileName, err)
+	}
+	return record, nil
+}
+
+// Read the labels of this device from metadata.json, or nil if it has none
+func getDeviceLabels(deviceUuid string) (map[string]string, *outils.HttpError) {
+	fileName := getDeviceMetadataFileName(deviceUuid)
+	if !outils.PathExists(fileName) {
+		return nil, nil
+	}
+	labelBytes, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error reading %s: %v", fileName, err)
+	}
+	labels := map[string]string{}
+	if err := json.Unmarshal(labelBytes, &labels); err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error parsing %s: %v", fileName, err)
+	}
+	return labels, nil
+}
+
+// Read the index entry of this device from its files
+func loadDeviceIndexEntry(ctx context.Context, deviceUuid string) (*DeviceIndexEntry, *outils.HttpError) {
+	orgId, httpErr := getOrgidTxtStr(deviceUuid)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	state, httpErr := getDeviceState(deviceUuid)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	record, httpErr := getDeviceRecord(ctx, deviceUuid)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	labels, httpErr := getDeviceLabels(deviceUuid)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	return &DeviceIndexEntry{Uuid: deviceUuid, OrgId: orgId, DeviceState: *state, DeviceRecord: *record, Labels: labels}, nil
+}
+
+// Build the index from the device directories in the OCS DB
+func buildDeviceIndex(ctx context.Context) error {
+	start := time.Now()
+	devicesDir := filepath.Join(OcsDbDir, "v1", "devices")
+	deviceDirs, err := os.ReadDir(devicesDir)
+	if err != nil {
+		return err
+	}
+	index := map[string]*DeviceIndexEntry{}
+	for _, dir := range deviceDirs {
+		if !dir.IsDir() {
+			continue
+		}
+		entry, httpErr := loadDeviceIndexEntry(ctx, dir.Name())
+		if httpErr != nil {
+			outils.Log.Warn("could not index device", "device", dir.Name(), "error", httpErr.Error())
+			continue
+		}
+		index[dir.Name()] = entry
+	}
+	deviceIndexLock.Lock()
+	deviceIndex = index
+	deviceIndexLock.Unlock()
+	outils.Log.Info("built the device index", "devices", len(index), "duration", time.Since(start).String())
+	return nil
+}
+
+// Add or update this device in the index, from its files
+func indexDevice(ctx context.Context, deviceUuid string) {
+	entry, httpErr := loadDeviceIndexEntry(ctx, deviceUuid)
+	if httpErr != nil {
+		outils.LogCtx(ctx).Warn("could not index device", "device", deviceUuid, "error", httpErr.Error())
+		return
+	}
+	deviceIndexLock.Lock()
+	defer deviceIndexLock.Unlock()
+	deviceIndex[deviceUuid] = entry
+}
+
+// Remove this device from the index
+func unindexDevice(deviceUuid string) {
+	deviceIndexLock.Lock()
+	defer deviceIndexLock.Unlock()
+	delete(deviceIndex, deviceUuid)
+}
+
+// Update the state of this device in the index, if it is indexed
+func setIndexedDeviceState(deviceUuid string, state *DeviceState) {
+	deviceIndexLock.Lock()
+	defer deviceIndexLock.Unlock()
+	if entry, ok := deviceIndex[deviceUuid]; ok {
+		entry.DeviceState = *state
+	}
+}
+
+// The filters, sort order, and page of a voucher list request
+type VoucherListQuery struct {
+	States         []string
+	ImportedAfter  time.Time
+	ImportedBefore time.Time
+	Manufacturer   string
+	SerialNumber   string
+	Tags           []string // label keys, or key=value
+	Sort           string
+	Descending     bool
+	Limit          int // 0 means all
+	Cursor         *voucherListCursor
+}
+
+// Where the previous page ended. It is opaque to clients.
+type voucherListCursor struct {
+	Sort       string `json:"s"`
+	Descending bool   `json:"d"`
+	Value      string `json:"v"`
+	Uuid       string `json:"u"`
+}
+
+// Parse the voucher list query params:
+// ?state=<state>[,<state>]&importedAfter=<RFC3339>&importedBefore=<RFC3339>&manufacturer=<m>&serialNumber=<sn>&tag=<key>[=<value>]
+// &sort=[-]<field>&limit=<n>&cursor=<cursor>
+func parseVoucherListQuery(params url.Values) (*VoucherListQuery, *outils.HttpError) {
+	q := &VoucherListQuery{Sort: SortByUuid}
+	for _, states := range params["state"] {
+		for _, state := range strings.Split(states, ",") {
+			if state != DeviceStateImported && state != DeviceStateTo0Registered && state != DeviceStateOnboarded && state != DeviceStateTransferred {
+				return nil, outils.NewHttpError(http.StatusBadRequest, "invalid state %s, must be %s, %s, %s, or %s", state, DeviceStateImported, DeviceStateTo0Registered, DeviceStateOnboarded, DeviceStateTransferred)
+			}
+			q.States = append(q.States, state)
+		}
+	}
+	for name, t := range map[string]*time.Time{"importedAfter": &q.ImportedAfter, "importedBefore": &q.ImportedBefore} {
+		if value := params.Get(name); value != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				return nil, outils.NewHttpError(http.StatusBadRequest, "invalid %s %s, must be an RFC3339 timestamp", name, value)
+			}
+		}
+	}
+	q.Manufacturer = params.Get("manufacturer")
+	q.SerialNumber = params.Get("serialNumber")
+	q.Tags = params["tag"]
+
+	if sortParam := params.Get("sort"); sortParam != "" {
+		q.Sort = strings.TrimPrefix(sortParam, "-")
+		q.Descending = strings.HasPrefix(sortParam, "-")
+		if q.Sort != SortByUuid && q.Sort != SortByImported && q.Sort != SortByState && q.Sort != SortBySerialNumber && q.Sort != SortByManufacturer {
+			return nil, outils.NewHttpError(http.StatusBadRequest, "invalid sort %s, must be %s, %s, %s, %s, or %s, optionally preceded by - for descending order", sortParam, SortByUuid, SortByImported, SortByState, SortBySerialNumber, SortByManufacturer)
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 1 {
+			return nil, outils.NewHttpError(http.StatusBadRequest, "invalid limit %s, must be a positive integer", limit)
+		}
+		q.Limit = min(q.Limit, MaxVoucherListLimit)
+	}
+	if cursor := params.Get("cursor"); cursor != "" {
+		q.Cursor = &voucherListCursor{}
+		cursorBytes, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err == nil {
+			err = json.Unmarshal(cursorBytes, q.Cursor)
+		}
+		if err != nil {
+			return nil, outils.NewHttpError(http.StatusBadRequest, "invalid cursor")
+		}
+		if q.Cursor.Sort != q.Sort || q.Cursor.Descending != q.Descending {
+			return nil, outils.NewHttpError(http.StatusBadRequest, "the cursor is from a list with a different sort order")
+		}
+	}
+	return q, nil
+}
+
+// Returns the details of this device for the voucher list
+func (e *DeviceIndexEntry) detail() VoucherDetail {
+	d := VoucherDetail{
+		Guid:             e.Uuid,
+		OrgId:            e.OrgId,
+		Imported:         e.Imported,
+		ImportedBy:       e.ImportedBy,
+		SerialNumber:     e.SerialNumber,
+		Manufacturer:     e.Manufacturer,
+		DeviceInfo:       e.DeviceInfo,
+		OwnerKeyType:     e.OwnerKeyType,
+		State:            e.State,
+		To0Expiry:        e.To0Expiry,
+		To2Status:        To2StatusPending,
+		To2CompletedOn:   e.To2CompletedOn,
+		ExchangeNodeName: e.Uuid, // the agent is installed with the device uuid as the node id
+		Labels:           e.Labels,
+	}
+	if e.State == DeviceStateOnboarded {
+		d.To2Status = To2StatusCompleted
+	}
+	if d.Labels == nil {
+		d.Labels = map[string]string{}
+	}
+	return d
+}
+
+// Returns the value of the sort field of this entry
+func (e *DeviceIndexEntry) sortValue(field string) string {
+	switch field {
+	case SortByImported:
+		return e.Imported
+	case SortByState:
+		return e.State
+	case SortBySerialNumber:
+		return e.SerialNumber
+	case SortByManufacturer:
+		return e.Manufacturer
+	}
+	return e.Uuid
+}
+
+// Returns true if this entry matches the filters of the query
+func (e *DeviceIndexEntry) matches(q *VoucherListQuery) bool {
+	if len(q.States) > 0 && !slices.Contains(q.States, e.State) {
+		return false
+	}
+	if !q.ImportedAfter.IsZero() || !q.ImportedBefore.IsZero() {
+		imported, err := time.Parse(time.RFC3339, e.Imported)
+		if err != nil || (!q.ImportedAfter.IsZero() && imported.Before(q.ImportedAfter)) || (!q.ImportedBefore.IsZero() && imported.After(q.ImportedBefore)) {
+			return false
+		}
+	}
+	if q.Manufacturer != "" && !strings.EqualFold(q.Manufacturer, e.Manufacturer) {
+		return false
+	}
+	if q.SerialNumber != "" && !strings.EqualFold(q.SerialNumber, e.SerialNumber) {
+		return false
+	}
+	for _, tag := range q.Tags {
+		key, value, hasValue := strings.Cut(tag, "=")
+		if v, ok := e.Labels[key]; !ok || (hasValue && v != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns copies of the indexed devices of this org that match the query, in the sort order, starting after the cursor. If
+// there are more, also returns the cursor of the next page.
+func listIndexedDevices(orgId string, q *VoucherListQuery) ([]DeviceIndexEntry, string) {
+	deviceIndexLock.RLock()
+	entries := []DeviceIndexEntry{}
+	for _, entry := range deviceIndex {
+		if entry.OrgId == orgId && entry.matches(q) {
+			entries = append(entries, *entry)
+		}
+	}
+	deviceIndexLock.RUnlock()
+
+	// Sort by the sort field, and then the uuid, so the order is the same for every page
+	less := func(aValue, aUuid, bValue, bUuid string) bool {
+		if aValue != bValue {
+			return (aValue < bValue) != q.Descending
+		} else if aUuid != bUuid {
+			return (aUuid < bUuid) != q.Descending
+		}
+		return false
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return less(entries[i].sortValue(q.Sort), entries[i].Uuid, entries[j].sortValue(q.Sort), entries[j].Uuid)
+	})
+	if q.Cursor != nil {
+		start := sort.Search(len(entries), func(i int) bool {
+			return less(q.Cursor.Value, q.Cursor.Uuid, entries[i].sortValue(q.Sort), entries[i].Uuid)
+		})
+		entries = entries[start:]
+	}
+
+	if q.Limit == 0 || len(entries) <= q.Limit {
+		return entries, ""
+	}
+	entries = entries[:q.Limit]
+	last := entries[len(entries)-1]
+	cursorBytes, _ := json.Marshal(voucherListCursor{Sort: q.Sort, Descending: q.Descending, Value: last.sortValue(q.Sort), Uuid: last.Uuid})
+	return entries, base64.RawURLEncoding.EncodeToString(cursorBytes)
+}
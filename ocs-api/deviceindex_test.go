@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Replace the device index with these entries for the test
+func setTestDeviceIndex(t *testing.T, entries ...*DeviceIndexEntry) {
+	t.Helper()
+	deviceIndexLock.Lock()
+	saved := deviceIndex
+	deviceIndex = map[string]*DeviceIndexEntry{}
+	deviceIndexLock.Unlock()
+	for _, e := range entries {
+		addTestDevice(e)
+	}
+	t.Cleanup(func() {
+		deviceIndexLock.Lock()
+		deviceIndex = saved
+		deviceIndexLock.Unlock()
+	})
+}
+
+func addTestDevice(e *DeviceIndexEntry) {
+	deviceIndexLock.Lock()
+	defer deviceIndexLock.Unlock()
+	deviceIndex[e.Uuid] = e
+}
+
+// Returns a device of myorg, imported i minutes after 2024-01-01, with a serial number that sorts in the reverse order
+func newTestDevice(i int) *DeviceIndexEntry {
+	e := &DeviceIndexEntry{Uuid: fmt.Sprintf("0a1b2c3d-0000-1111-2222-%012d", i), OrgId: "myorg"}
+	e.State = DeviceStateImported
+	e.Imported = time.Date(2024, 1, 1, 0, i, 0, 0, time.UTC).Format(time.RFC3339)
+	e.SerialNumber = fmt.Sprintf("sn%04d", 9999-i)
+	e.Manufacturer = []string{"acme", "globex"}[i%2]
+	return e
+}
+
+// Parse this query, failing the test if it is invalid
+func mustParseVoucherListQuery(t *testing.T, query string) *VoucherListQuery {
+	t.Helper()
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatalf("url.ParseQuery(%q) returned error: %v", query, err)
+	}
+	q, httpErr := parseVoucherListQuery(params)
+	if httpErr != nil {
+		t.Fatalf("parseVoucherListQuery(%q) returned error: %v", query, httpErr.Error())
+	}
+	return q
+}
+
+// List all of the pages of this query, returning the uuids in order
+func listAllPages(t *testing.T, query string) []string {
+	t.Helper()
+	uuids := []string{}
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatalf("the list of %q did not end after %d pages", query, pages)
+		}
+		pageQuery := query
+		if cursor != "" {
+			pageQuery += "&cursor=" + cursor
+		}
+		entries, next := listIndexedDevices("myorg", mustParseVoucherListQuery(t, pageQuery))
+		for _, e := range entries {
+			uuids = append(uuids, e.Uuid)
+		}
+		if next == "" {
+			return uuids
+		}
+		cursor = next
+	}
+}
+
+func TestParseVoucherListQuery(t *testing.T) {
+	otherSortCursor := base64.RawURLEncoding.EncodeToString([]byte(`{"s":"imported","d":false,"v":"x","u":"y"}`))
+	descendingCursor := base64.RawURLEncoding.EncodeToString([]byte(`{"s":"uuid","d":true,"v":"x","u":"y"}`))
+	uuidCursor := base64.RawURLEncoding.EncodeToString([]byte(`{"s":"uuid","d":false,"v":"x","u":"y"}`))
+	tests := []struct {
+		name      string
+		query     string
+		wantLimit int
+		wantErr   string // a substring of the error, or "" if it must be valid
+	}{
+		{"no params", "", 0, ""},
+		{"limit 1", "limit=1", 1, ""},
+		{"max limit", "limit=1000", MaxVoucherListLimit, ""},
+		{"limit above the max", "limit=1001", MaxVoucherListLimit, ""},
+		{"huge limit", "limit=1000000000", MaxVoucherListLimit, ""},
+		{"limit 0", "limit=0", 0, "invalid limit 0"},
+		{"negative limit", "limit=-1", 0, "invalid limit -1"},
+		{"limit not a number", "limit=ten", 0, "invalid limit ten"},
+		{"valid cursor", "cursor=" + uuidCursor, 0, ""},
+		{"cursor not base64", "cursor=not*base64", 0, "invalid cursor"},
+		{"cursor not json", "cursor=" + base64.RawURLEncoding.EncodeToString([]byte("uuid")), 0, "invalid cursor"},
+		{"padded cursor", "cursor=" + base64.URLEncoding.EncodeToString([]byte(`{"s":"uuid","d":false}`)), 0, "invalid cursor"},
+		{"cursor of another sort", "cursor=" + otherSortCursor, 0, "different sort order"},
+		{"cursor of another direction", "cursor=" + descendingCursor, 0, "different sort order"},
+		{"cursor with its sort", "sort=-uuid&cursor=" + descendingCursor, 0, ""},
+		{"invalid sort", "sort=name", 0, "invalid sort name"},
+		{"invalid state", "state=imported,lost", 0, "invalid state lost"},
+		{"invalid timestamp", "importedAfter=2024-01-01", 0, "invalid importedAfter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatalf("url.ParseQuery(%q) returned error: %v", tt.query, err)
+			}
+			q, httpErr := parseVoucherListQuery(params)
+			if tt.wantErr != "" {
+				if httpErr == nil || !strings.Contains(httpErr.Error(), tt.wantErr) {
+					t.Fatalf("parseVoucherListQuery(%q) returned error %v, want an error containing %q", tt.query, httpErr, tt.wantErr)
+				}
+				if httpErr.Code != http.StatusBadRequest {
+					t.Errorf("parseVoucherListQuery(%q) returned code %d, want %d", tt.query, httpErr.Code, http.StatusBadRequest)
+				}
+				return
+			}
+			if httpErr != nil {
+				t.Fatalf("parseVoucherListQuery(%q) returned error: %v", tt.query, httpErr.Error())
+			}
+			if q.Limit != tt.wantLimit {
+				t.Errorf("parseVoucherListQuery(%q).Limit = %d, want %d", tt.query, q.Limit, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestListIndexedDevicesPages(t *testing.T) {
+	devices := []*DeviceIndexEntry{}
+	for i := 0; i < 25; i++ {
+		devices = append(devices, newTestDevice(i))
+	}
+	other := newTestDevice(99)
+	other.OrgId = "otherorg"
+	setTestDeviceIndex(t, append(devices, other)...)
+
+	ascending := make([]string, len(devices))
+	for i, e := range devices {
+		ascending[i] = e.Uuid
+	}
+	descending := slices.Clone(ascending)
+	slices.Reverse(descending)
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"by uuid", "sort=uuid&limit=10", ascending},
+		{"by uuid descending", "sort=-uuid&limit=10", descending},
+		{"by imported", "sort=imported&limit=7", ascending},
+		{"by serial number", "sort=serialNumber&limit=4", descending},
+		{"by serial number descending", "sort=-serialNumber&limit=4", ascending},
+		{"1 per page", "limit=1", ascending},
+		{"exactly 1 page", "limit=25", ascending},
+		{"no limit", "", ascending},
+		{"filtered", "manufacturer=acme&limit=3", []string{
+			ascending[0], ascending[2], ascending[4], ascending[6], ascending[8], ascending[10], ascending[12],
+			ascending[14], ascending[16], ascending[18], ascending[20], ascending[22], ascending[24],
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := listAllPages(t, tt.query); !slices.Equal(got, tt.want) {
+				t.Errorf("listing the pages of %q returned %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+// Devices that share the value of the sort field are ordered by uuid, so a page can end in the middle of them
+func TestListIndexedDevicesEqualSortValues(t *testing.T) {
+	devices := []*DeviceIndexEntry{}
+	want := []string{}
+	for i := 0; i < 10; i++ {
+		e := newTestDevice(i)
+		e.Manufacturer = "acme"
+		devices = append(devices, e)
+		want = append(want, e.Uuid)
+	}
+	setTestDeviceIndex(t, devices...)
+
+	if got := listAllPages(t, "sort=manufacturer&limit=3"); !slices.Equal(got, want) {
+		t.Errorf("listing the pages returned %v, want %v", got, want)
+	}
+}
+
+func TestListIndexedDevicesCursorStableAcrossInserts(t *testing.T) {
+	tests := []struct {
+		name   string
+		sort   string
+		insert []int // the devices added after the first page
+		want   []int // the devices of the second page
+	}{
+		// The first page is devices 10, 20, 30 (50, 40, 30 descending), so the ones inserted before 30 in the sort order are not
+		// listed, and the ones after it are
+		{"by uuid", "uuid", []int{5, 25, 35, 55}, []int{35, 40, 50}},
+		{"by uuid descending", "-uuid", []int{5, 25, 45, 55}, []int{25, 20, 10}},
+		{"by imported", "imported", []int{15, 45}, []int{40, 45, 50}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestDeviceIndex(t, newTestDevice(10), newTestDevice(20), newTestDevice(30), newTestDevice(40), newTestDevice(50))
+			query := "sort=" + tt.sort + "&limit=3"
+			first, cursor := listIndexedDevices("myorg", mustParseVoucherListQuery(t, query))
+			if len(first) != 3 || cursor == "" {
+				t.Fatalf("the first page has %d devices and cursor %q, want 3 devices and a cursor", len(first), cursor)
+			}
+
+			for _, i := range tt.insert {
+				addTestDevice(newTestDevice(i))
+			}
+			second, _ := listIndexedDevices("myorg", mustParseVoucherListQuery(t, query+"&cursor="+cursor))
+			got := []string{}
+			for _, e := range second {
+				got = append(got, e.Uuid)
+			}
+			want := []string{}
+			for _, i := range tt.want {
+				want = append(want, newTestDevice(i).Uuid)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("the second page is %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// A cursor still works after the device it ended on is removed
+func TestListIndexedDevicesCursorAfterRemove(t *testing.T) {
+	setTestDeviceIndex(t, newTestDevice(1), newTestDevice(2), newTestDevice(3), newTestDevice(4))
+	first, cursor := listIndexedDevices("myorg", mustParseVoucherListQuery(t, "limit=2"))
+	if len(first) != 2 {
+		t.Fatalf("the first page has %d devices, want 2", len(first))
+	}
+	unindexDevice(first[1].Uuid)
+
+	second, next := listIndexedDevices("myorg", mustParseVoucherListQuery(t, "limit=2&cursor="+cursor))
+	if len(second) != 2 || second[0].Uuid != newTestDevice(3).Uuid || second[1].Uuid != newTestDevice(4).Uuid || next != "" {
+		t.Errorf("the second page is %v with cursor %q, want devices 3 and 4 and no cursor", second, next)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/open-horizon/FDO-support/ocs-api/ocsdb"
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+)
+
+/*
+User defined labels of a device (asset ids, site, customer, etc.), stored as a flat json object in v1/devices/<uuid>/metadata.json.
+They can be used to filter the voucher list (?tag=<key>[=<value>]). If FDO_LABELS_AS_NODE_PROPERTIES is true, they are also
+put in the device exec file as a node policy, so the exchange node gets them as properties when the agent registers it.
+*/
+
+const (
+	MaxDeviceLabels         = 100
+	MaxDeviceLabelKeyLen    = 128
+	MaxDeviceLabelValueLen  = 1024
+	MaxDeviceMetadataBodyKB = 256
+)
+
+// The node policy file the device exec file creates for agent-install.sh, when the labels are propagated
+const nodePolicyFileName = "node_policy.json"
+
+// Serializes the read-modify-write of the metadata files
+var deviceMetadataLock sync.Mutex
+
+func getDeviceMetadataFileName(deviceUuid string) string {
+	return filepath.Clean(filepath.Join(OcsDbDir, "v1", "devices", deviceUuid, "metadata.json"))
+}
+
+// Returns true if the labels should be set as properties of the exchange node when the device registers
+func labelsAsNodeProperties() bool {
+	return outils.GetEnvVarBoolWithDefault("FDO_LABELS_AS_NODE_PROPERTIES", false)
+}
+
+// Return an error if these labels can't be stored. The keys can't contain =, because the list filter uses it as the separator.
+func validateDeviceLabels(labels map[string]string) *outils.HttpError {
+	if len(labels) > MaxDeviceLabels {
+		return outils.NewHttpError(http.StatusBadRequest, "a device can have at most %d labels", MaxDeviceLabels)
+	}
+	for key, value := range labels {
+		if key == "" || len(key) > MaxDeviceLabelKeyLen || strings.Contains(key, "=") {
+			return outils.NewHttpError(http.StatusBadRequest, "invalid label key %q, it must be 1 to %d characters and not contain =", key, MaxDeviceLabelKeyLen)
+		} else if len(value) > MaxDeviceLabelValueLen {
+			return outils.NewHttpError(http.StatusBadRequest, "the value of label %s is longer than %d characters", key, MaxDeviceLabelValueLen)
+		}
+	}
+	return nil
+}
+
+// Save the labels of this device, update the index, and if the labels are propagated to the exchange node and the device has not
+// onboarded yet, update its exec file
+func saveDeviceLabels(ctx context.Context, deviceUuid, deviceOrgId string, labels map[string]string) *outils.HttpError {
+	labelBytes, err := json.Marshal(labels)
+	if err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "Error marshaling the labels of device %s: %v", deviceUuid, err)
+	}
+	fileName := getDeviceMetadataFileName(deviceUuid)
+	if err := ocsdb.WriteFile(ctx, fileName, labelBytes, 0644); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
+	}
+	indexDevice(ctx, deviceUuid)
+
+	if !labelsAsNodeProperties() {
+		return nil
+	}
+	state, httpErr := getDeviceState(deviceUuid)
+	if httpErr != nil {
+		return httpErr
+	} else if state.State == DeviceStateOnboarded {
+		outils.LogCtx(ctx).Info("device already onboarded, its labels will not be set on the exchange node", "device", deviceUuid)
+		return nil
+	}
+	nodeToken, httpErr := getNodeTokenTxtStr(deviceUuid)
+	if httpErr != nil {
+		return httpErr
+	}
+	if httpErr := createDeviceExecFile(ctx, deviceUuid, nodeToken, deviceOrgId); httpErr != nil {
+		return httpErr
+	}
+	return postDeviceExecResource(ctx, deviceUuid)
+}
+
+// Returns the shell commands that write the node policy file with these labels as the node properties, or "" if there are none
+func nodePolicyCommands(labels map[string]string) (string, error) {
+	if len(labels) == 0 {
+		return "", nil
+	}
+	type property struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	policy := struct {
+		Properties []property `json:"properties"`
+	}{}
+	for key, value := range labels {
+		policy.Properties = append(policy.Properties, property{Name: key, Value: value})
+	}
+	sort.Slice(policy.Properties, func(i, j int) bool { return policy.Properties[i].Name < policy.Properties[j].Name })
+	policyBytes, err := json.Marshal(policy)
+	if err != nil {
+		return "", err
+	}
+	// The json is on 1 line, so it can't contain the here-document delimiter line
+	return fmt.Sprintf("cat > %s <<'END_OF_NODE_POLICY'\n%s\nEND_OF_NODE_POLICY\n", nodePolicyFileName, policyBytes), nil
+}
+
+// ============= GET /api/orgs/{ord-id}/fdo/vouchers/{deviceUuid}/metadata =============
+// Returns the labels of this device
+func getFdoVoucherMetadataHandler(orgId string, deviceUuid string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("GET /api/orgs/{org-id}/fdo/vouchers/{device-id}/metadata", "org", orgId, "device", deviceUuid)
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Authenticate this user with the exchange
+	if authenticated, _, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
+		return
+	}
+
+	if httpErr := verifyDeviceInOrg(deviceUuid, deviceOrgId); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	labels, httpErr := getDeviceLabels(deviceUuid)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	outils.WriteJsonResponse(http.StatusOK, w, labels)
+}
+
+// ============= PUT and PATCH /api/orgs/{ord-id}/fdo/vouchers/{deviceUuid}/metadata =============
+// PUT replaces all of the labels of this device with the ones in the body ({"<key>": "<value>", ...}). PATCH merges the body
+// into the existing labels, and a null value removes that label. Returns the resulting labels.
+func putFdoVoucherMetadataHandler(orgId string, deviceUuid string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug(r.Method+" /api/orgs/{org-id}/fdo/vouchers/{device-id}/metadata", "org", orgId, "device", deviceUuid)
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Authenticate this user with the exchange
+	if authenticated, _, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
+		return
+	}
+
+	if httpErr := verifyDeviceInOrg(deviceUuid, deviceOrgId); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Verify content type
+	if httpErr := outils.IsValidPostJson(r); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	bodyBytes, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxDeviceMetadataBodyKB*1024))
+	if err != nil {
+		http.Error(w, "Error reading the request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	changes := map[string]*string{}
+	if httpErr := outils.ParseJsonString(bodyBytes, &changes); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	deviceMetadataLock.Lock()
+	defer deviceMetadataLock.Unlock()
+	labels := map[string]string{}
+	if r.Method == http.MethodPatch {
+		existing, httpErr := getDeviceLabels(deviceUuid)
+		if httpErr != nil {
+			http.Error(w, httpErr.Error(), httpErr.Code)
+			return
+		}
+		for key, value := range existing {
+			labels[key] = value
+		}
+	}
+	for key, value := range changes {
+		if value == nil {
+			delete(labels, key)
+		} else {
+			labels[key] = *value
+		}
+	}
+	if httpErr := validateDeviceLabels(labels); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	if httpErr := saveDeviceLabels(r.Context(), deviceUuid, deviceOrgId, labels); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	outils.LogFor(r).Info("device labels updated", "org", deviceOrgId, "device", deviceUuid, "labels", len(labels))
+	outils.WriteJsonResponse(http.StatusOK, w, labels)
+}
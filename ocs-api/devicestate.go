@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-horizon/FDO-support/ocs-api/metrics"
+	"github.com/open-horizon/FDO-support/ocs-api/ocsdb"
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+Tracking of the onboarding state of each device, stored in v1/devices/<uuid>/state.json. The state is set when a voucher is
+imported and when TO0 is initiated, and a background poller asks the owner service whether TO2 has completed. The number of
+devices in each state is exposed as a gauge on /metrics.
+*/
+
+// The onboarding states of a device
+const (
+	DeviceStateImported      = "imported"       // the voucher was imported, but TO0 has not been initiated
+	DeviceStateTo0Registered = "to0_registered" // TO0 was successfully initiated with the rendezvous server
+	DeviceStateOnboarded     = "onboarded"      // the owner service reports that TO2 completed
+	DeviceStateTransferred   = "transferred"    // the voucher was extended to another owner (resold), so this owner won't onboard it
+)
+
+const DefaultStatePollIntervalS = 300
+
+type DeviceState struct {
+	State          string `json:"state"`
+	To0Expiry      string `json:"to0Expiry,omitempty"`
+	To2CompletedOn string `json:"to2CompletedOn,omitempty"`
+	Updated        string `json:"updated"`
+}
+
+var deviceStateLock sync.Mutex
+
+func getDeviceStateFileName(deviceUuid string) string {
+	return filepath.Clean(filepath.Join(OcsDbDir, "v1", "devices", deviceUuid, "state.json"))
+}
+
+// Read the state of this device. Devices imported before the state was tracked are reported as imported.
+func getDeviceState(deviceUuid string) (*DeviceState, *outils.HttpError) {
+	fileName := getDeviceStateFileName(deviceUuid)
+	if !outils.PathExists(fileName) {
+		return &DeviceState{State: DeviceStateImported}, nil
+	}
+	stateBytes, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error reading %s: %v", fileName, err)
+	}
+	state := &DeviceState{}
+	if err := json.Unmarshal(stateBytes, state); err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error parsing %s: %v", fileName, err)
+	}
+	return state, nil
+}
+
+// Set the state of this device. The to0Expiry and to2CompletedOn values are only changed if non-empty.
+func setDeviceState(ctx context.Context, deviceUuid, newState, to0Expiry, to2CompletedOn string) *outils.HttpError {
+	deviceStateLock.Lock()
+	defer deviceStateLock.Unlock()
+	state, httpErr := getDeviceState(deviceUuid)
+	if httpErr != nil {
+		return httpErr
+	}
+	state.State = newState
+	if to0Expiry != "" {
+		state.To0Expiry = to0Expiry
+	}
+	if to2CompletedOn != "" {
+		state.To2CompletedOn = to2CompletedOn
+	}
+	state.Updated = time.Now().UTC().Format(time.RFC3339)
+
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "Error marshaling the state of device %s: %v", deviceUuid, err)
+	}
+	fileName := getDeviceStateFileName(deviceUuid)
+	if err := ocsdb.WriteFile(ctx, fileName, stateBytes, 0644); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
+	}
+	setIndexedDeviceState(deviceUuid, state)
+	return nil
+}
+
+// Periodically ask the owner service which devices have completed TO2. The interval is set by FDO_STATE_POLL_INTERVAL (in
+// seconds), and 0 disables polling.
+func startDeviceStatePoller(ctx context.Context) {
+	interval := outils.GetEnvVarIntWithDefault("FDO_STATE_POLL_INTERVAL", DefaultStatePollIntervalS)
+	if interval <= 0 {
+		outils.Log.Info("device state polling is disabled")
+		return
+	}
+	startBackgroundWorker(ctx, "device state poller", func(ctx context.Context) {
+		for {
+			pollDeviceStates(ctx)
+			if !sleepCtx(ctx, time.Duration(interval)*time.Second) {
+				return
+			}
+		}
+	})
+}
+
+// Query the owner service for each device that has not been onboarded yet, and record the devices that have completed TO2
+func pollDeviceStates(ctx context.Context) {
+	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
+	devicesDir := filepath.Join(OcsDbDir, "v1", "devices")
+	deviceDirs, err := os.ReadDir(devicesDir)
+	if err != nil {
+		outils.Log.Warn("could not read the devices directory to poll device states", "dir", devicesDir, "error", err)
+		return
+	}
+	username, password := outils.GetOwnerServiceApiKey()
+	client := outils.NewOwnerServiceClient(username, password)
+	for _, dir := range deviceDirs {
+		if !dir.IsDir() {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		deviceUuid := dir.Name()
+		state, httpErr := getDeviceState(deviceUuid)
+		if httpErr != nil {
+			outils.Log.Warn("could not get device state", "device", deviceUuid, "error", httpErr.Error())
+			continue
+		} else if state.State == DeviceStateOnboarded || state.State == DeviceStateTransferred {
+			continue
+		}
+
+		if err := pollDeviceState(ctx, client, fdoOwnerURL, deviceUuid); err != nil {
+			outils.Log.Warn("could not get the device state from the owner service", "device", deviceUuid, "error", err)
+			return // the owner service is probably down, so try again next time
+		}
+	}
+}
+
+// Ask the owner service whether this device has completed TO2, and if so record that it is onboarded. An error is only returned
+// if the owner service could not be reached.
+func pollDeviceState(ctx context.Context, client *http.Client, fdoOwnerURL, deviceUuid string) error {
+	resp, err := outils.HttpGet(ctx, client, fdoOwnerURL+"/api/v1/owner/state/"+deviceUuid)
+	if err != nil {
+		return err
+	}
+	respBodyBytes, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		outils.Log.Debug("no device state from the owner service", "device", deviceUuid, "status", resp.StatusCode)
+		return nil
+	}
+
+	to0Expiry, to2CompletedOn := parseOwnerDeviceState(respBodyBytes)
+	if to2CompletedOn != "" {
+		outils.Log.Info("device onboarded", "device", deviceUuid, "to2_completed_on", to2CompletedOn)
+		if httpErr := setDeviceState(ctx, deviceUuid, DeviceStateOnboarded, to0Expiry, to2CompletedOn); httpErr != nil {
+			outils.Log.Warn("could not set device state", "device", deviceUuid, "error", httpErr.Error())
+		}
+	}
+	return nil
+}
+
+// Get the to0 expiry and to2 completion time from the owner service device state. Different owner service versions use
+// slightly different field names, so match them loosely.
+func parseOwnerDeviceState(stateBytes []byte) (string, string) {
+	ownerState := map[string]interface{}{}
+	if err := json.Unmarshal(stateBytes, &ownerState); err != nil {
+		return "", ""
+	}
+	var to0Expiry, to2CompletedOn string
+	for k, v := range ownerState {
+		if v == nil {
+			continue
+		}
+		value := strings.TrimSpace(strings.Trim(jsonValueString(v), `"`))
+		if value == "" || value == "null" {
+			continue
+		}
+		switch strings.ToLower(strings.ReplaceAll(k, "_", "")) {
+		case "to0expiry":
+			to0Expiry = value
+		case "to2completedon", "to2completed":
+			to2CompletedOn = value
+		}
+	}
+	return to0Expiry, to2CompletedOn
+}
+
+func jsonValueString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// Prometheus collector that counts the devices in each org and onboarding state in the device index, each time the metrics are
+// scraped
+type deviceStateCollector struct {
+	desc *prometheus.Desc
+}
+
+func newDeviceStateCollector() *deviceStateCollector {
+	return &deviceStateCollector{
+		desc: prometheus.NewDesc("ocs_api_devices", "Number of devices, by org and onboarding state.", []string{"org", "state"}, nil),
+	}
+}
+
+func (c *deviceStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *deviceStateCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := map[[2]string]int{}
+	deviceIndexLock.RLock()
+	for _, e := range deviceIndex {
+		counts[[2]string{e.OrgId, e.State}]++
+	}
+	deviceIndexLock.RUnlock()
+	for k, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), k[0], k[1])
+	}
+}
+
+func init() {
+	metrics.RegisterCollector(newDeviceStateCollector())
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/open-horizon/FDO-support/ocs-api/ocsdb"
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+)
+
+/*
+The voucher or bundle given out when a device is resold or exported (handed off). The device is marked as transferred, or deleted,
+when it is handed off, so a client that didn't get the response (e.g. the connection dropped) couldn't get it again. So it is saved
+in v1/handoffs/<uuid>/handoff.json before the device is marked, and a repeat of the same resell or export by the same org returns
+it. It is kept until the device is handed off again.
+*/
+
+// The ways a device is handed off
+const (
+	DeviceHandoffResell = "resell"
+	DeviceHandoffExport = "export"
+)
+
+type DeviceHandoff struct {
+	Type            string        `json:"type"`
+	OrgId           string        `json:"orgId"` // the org the device was in
+	Created         string        `json:"created"`
+	OwnerCertSha256 string        `json:"ownerCertSha256,omitempty"` // resell: the owner certificate the voucher was extended to
+	Voucher         string        `json:"voucher,omitempty"`         // resell: the extended voucher (PEM)
+	Bundle          *DeviceBundle `json:"bundle,omitempty"`          // export: the content of the bundle, it is signed when returned
+}
+
+func getDeviceHandoffFileName(deviceUuid string) string {
+	return filepath.Clean(filepath.Join(OcsDbDir, "v1", "handoffs", deviceUuid, "handoff.json"))
+}
+
+// Read the handoff of this device. Returns nil if it was never handed off.
+func getDeviceHandoff(deviceUuid string) (*DeviceHandoff, *outils.HttpError) {
+	fileName := getDeviceHandoffFileName(deviceUuid)
+	if !outils.PathExists(fileName) {
+		return nil, nil
+	}
+	handoffBytes, err := ocsdb.ReadFile(fileName)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error reading %s: %v", fileName, err)
+	}
+	handoff := &DeviceHandoff{}
+	if err := json.Unmarshal(handoffBytes, handoff); err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error parsing %s: %v", fileName, err)
+	}
+	return handoff, nil
+}
+
+// Save the handoff of this device, before it is marked as transferred or deleted. Must be called with the import lock of the
+// device held.
+func saveDeviceHandoff(ctx context.Context, deviceUuid string, handoff *DeviceHandoff) *outils.HttpError {
+	handoff.Created = time.Now().UTC().Format(time.RFC3339)
+	handoffBytes, err := json.Marshal(handoff)
+	if err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "Error marshaling the handoff of device %s: %v", deviceUuid, err)
+	}
+	fileName := getDeviceHandoffFileName(deviceUuid)
+	if err := os.MkdirAll(filepath.Dir(fileName), 0750); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create directory %s: %v", filepath.Dir(fileName), err)
+	}
+	if err := ocsdb.WriteFile(ctx, fileName, handoffBytes, 0600); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
+	}
+	return nil
+}
+
+// Returns the handoff of this type if the device was already handed off by this org (it is transferred, or was deleted with
+// ?delete=true), so a repeat of the request can return it, or nil if the device can be handed off now. Returns an error if the
+// device doesn't exist or isn't in the org, or was handed off another way. Must be called with the import lock of the device held.
+func getRepeatedDeviceHandoff(deviceUuid, orgId, handoffType string) (*DeviceHandoff, *outils.HttpError) {
+	handoff, httpErr := getDeviceHandoff(deviceUuid)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	if httpErr := verifyDeviceInOrg(deviceUuid, orgId); httpErr != nil {
+		if httpErr.Code == http.StatusNotFound && handoff != nil && handoff.OrgId == orgId && handoff.Type == handoffType {
+			return handoff, nil // it was deleted when it was handed off
+		}
+		return nil, httpErr
+	}
+	if state, httpErr := getDeviceState(deviceUuid); httpErr != nil {
+		return nil, httpErr
+	} else if state.State != DeviceStateTransferred {
+		return nil, nil
+	}
+	if handoff == nil || handoff.OrgId != orgId || handoff.Type != handoffType {
+		return nil, outils.NewHttpError(http.StatusConflict, "device %s was already transferred to another owner or instance", deviceUuid)
+	}
+	return handoff, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+)
+
+/*
+Liveness and readiness probes, e.g. for Kubernetes. /healthz only reports that the process is serving requests. /readyz checks
+each dependency and returns 503 if any of them is not ok, with the result of each check in the response body.
+*/
+
+const (
+	ReadyCheckTimeoutS           = 5
+	DefaultCertExpiryWarningDays = 14
+)
+
+const (
+	CheckStatusOk      = "ok"
+	CheckStatusWarning = "warning" // does not make ocs-api not ready
+	CheckStatusFailed  = "failed"
+	CheckStatusSkipped = "skipped"
+)
+
+var ListenCertPath string // the cert ocs-api serves https with, or "" if it serves http
+
+type CheckResult struct {
+	Status    string `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	LatencyMs int64  `json:"latencyMs"`
+}
+
+type ReadyResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// The readiness checks, by dependency name
+var readyChecks = map[string]func(context.Context) (string, string){
+	"bootstrap":    checkBootstrap,
+	"shutdown":     checkShutdown,
+	"ownerService": checkOwnerService,
+	"exchange":     checkExchange,
+	"ocsDb":        checkOcsDb,
+	"tlsCert":      checkTlsCert,
+	"ownerCerts":   checkOwnerCerts,
+}
+
+// ============= GET /healthz =============
+// Returns 200 if the process is alive
+func getHealthzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method "+r.Method+" not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	outils.WriteJsonResponse(http.StatusOK, w, map[string]string{"status": CheckStatusOk})
+}
+
+// ============= GET /readyz =============
+// Checks all of the dependencies and returns 200 if ocs-api is ready to serve requests, otherwise 503
+func getReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method "+r.Method+" not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), ReadyCheckTimeoutS*time.Second)
+	defer cancel()
+
+	resp := ReadyResponse{Status: "ready", Checks: map[string]CheckResult{}}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range readyChecks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) (string, string)) {
+			defer wg.Done()
+			start := time.Now()
+			status, detail := check(ctx)
+			lock.Lock()
+			defer lock.Unlock()
+			resp.Checks[name] = CheckResult{Status: status, Detail: detail, LatencyMs: time.Since(start).Milliseconds()}
+		}(name, check)
+	}
+	wg.Wait()
+
+	code := http.StatusOK
+	for name, result := range resp.Checks {
+		if result.Status == CheckStatusFailed {
+			resp.Status = "not ready"
+			code = http.StatusServiceUnavailable
+			outils.LogFor(r).Debug("readiness check failed", "check", name, "detail", result.Detail)
+		}
+	}
+	outils.WriteJsonResponse(code, w, resp)
+}
+
+// Check that the startup tasks have completed
+func checkBootstrap(_ context.Context) (string, string) {
+	if IsReady() {
+		return CheckStatusOk, ""
+	}
+	status := getBootstrapStatus()
+	if status.LastError == "" {
+		return CheckStatusFailed, "startup tasks are running"
+	}
+	return CheckStatusFailed, fmt.Sprintf("startup tasks failed %d times, last error: %s", status.Attempts, status.LastError)
+}
+
+// Check that ocs-api is not shutting down, so no new requests are sent to it
+func checkShutdown(_ context.Context) (string, string) {
+	if IsShuttingDown() {
+		return CheckStatusFailed, "ocs-api is shutting down"
+	}
+	return CheckStatusOk, ""
+}
+
+// Check the owner service /health route
+func checkOwnerService(ctx context.Context) (string, string) {
+	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
+	if fdoOwnerURL == "" {
+		return CheckStatusFailed, "HZN_FDO_API_URL is not set"
+	}
+	resp, err := outils.HttpGet(ctx, http.DefaultClient, fdoOwnerURL+"/health")
+	if err != nil {
+		return CheckStatusFailed, err.Error()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return CheckStatusFailed, fmt.Sprintf("owner service /health returned HTTP code %d", resp.StatusCode)
+	}
+	return CheckStatusOk, ""
+}
+
+// Check that we can reach the exchange
+func checkExchange(ctx context.Context) (string, string) {
+	if ExchangeInternalUrl == "" {
+		return CheckStatusFailed, "the exchange url is not set"
+	}
+	if err := outils.CheckExchangeConnection(ctx, ExchangeInternalUrl, ExchangeInternalCertPath); err != nil {
+		return CheckStatusFailed, err.Error()
+	}
+	return CheckStatusOk, ""
+}
+
+// Check that we can write to the OCS DB
+func checkOcsDb(_ context.Context) (string, string) {
+	devicesDir := filepath.Join(OcsDbDir, "v1", "devices")
+	f, err := os.CreateTemp(devicesDir, ".readyz-*")
+	if err != nil {
+		return CheckStatusFailed, fmt.Sprintf("could not create a file in %s: %v", devicesDir, err)
+	}
+	fileName := f.Name()
+	_, err = f.Write([]byte("ok"))
+	f.Close()
+	os.Remove(fileName)
+	if err != nil {
+		return CheckStatusFailed, fmt.Sprintf("could not write to %s: %v", fileName, err)
+	}
+	return CheckStatusOk, ""
+}
+
+// Check that the cert we serve https with has not expired. It is only a warning if it expires soon, so operators have time to
+// replace it. The warning period is set by CERT_EXPIRY_WARNING_DAYS.
+func checkTlsCert(_ context.Context) (string, string) {
+	if ListenCertPath == "" {
+		return CheckStatusSkipped, "ocs-api is listening on http"
+	}
+	certBytes, err := os.ReadFile(ListenCertPath)
+	if err != nil {
+		return CheckStatusFailed, fmt.Sprintf("could not read %s: %v", ListenCertPath, err)
+	}
+	block, _ := pem.Decode(certBytes)
+	if block == nil {
+		return CheckStatusFailed, fmt.Sprintf("%s does not contain a PEM certificate", ListenCertPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return CheckStatusFailed, fmt.Sprintf("could not parse %s: %v", ListenCertPath, err)
+	}
+
+	remaining := time.Until(cert.NotAfter)
+	warningDays := outils.GetEnvVarIntWithDefault("CERT_EXPIRY_WARNING_DAYS", DefaultCertExpiryWarningDays)
+	expires := "expires " + cert.NotAfter.UTC().Format(time.RFC3339)
+	if remaining <= 0 {
+		return CheckStatusFailed, "certificate expired " + cert.NotAfter.UTC().Format(time.RFC3339)
+	} else if remaining < time.Duration(warningDays)*24*time.Hour {
+		return CheckStatusWarning, "certificate " + expires
+	}
+	return CheckStatusOk, "certificate " + expires
+}
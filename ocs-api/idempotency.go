@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/open-horizon/FDO-support/ocs-api/ocsdb"
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+)
+
+/*
+Idempotency-Key header support for voucher imports. When a client sends an Idempotency-Key with an import, the result is saved
+in v1/idempotency, and a retry with the same key and the same request gets the same response instead of being imported again.
+The node token is not saved in the record, it is read from the device when the response is replayed. Reusing a key with a
+different request is an error, and so is reusing a key after its device was deleted or moved to another org. Records expire after
+IDEMPOTENCY_KEY_TTL hours.
+*/
+
+const DefaultIdempotencyKeyTtlH = 24
+
+type idempotencyRecord struct {
+	RequestHash string `json:"requestHash"`
+	DeviceUuid  string `json:"deviceUuid"`
+	Created     string `json:"created"`
+}
+
+// The keys are chosen by the clients, so hash them (with the org) to get a safe file name
+func getIdempotencyRecordFileName(orgId, key string) string {
+	sum := sha256.Sum256([]byte(orgId + "\n" + key))
+	return filepath.Join(OcsDbDir, "v1", "idempotency", hex.EncodeToString(sum[:])+".json")
+}
+
+// Returns the hash of the parts of an import request that determine its result
+func hashImportRequest(voucherBytes []byte, replace bool) string {
+	h := sha256.New()
+	h.Write(voucherBytes)
+	if replace {
+		h.Write([]byte("\nreplace"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns the record saved for this key, or nil if there isn't one or it has expired
+func getIdempotencyRecord(orgId, key string) (*idempotencyRecord, *outils.HttpError) {
+	fileName := getIdempotencyRecordFileName(orgId, key)
+	if !outils.PathExists(fileName) {
+		return nil, nil
+	}
+	recordBytes, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error reading %s: %v", fileName, err)
+	}
+	record := &idempotencyRecord{}
+	if err := json.Unmarshal(recordBytes, record); err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error parsing %s: %v", fileName, err)
+	}
+
+	ttl := time.Duration(outils.GetEnvVarIntWithDefault("IDEMPOTENCY_KEY_TTL", DefaultIdempotencyKeyTtlH)) * time.Hour
+	created, err := time.Parse(time.RFC3339, record.Created)
+	if err != nil || time.Since(created) > ttl {
+		return nil, nil // the caller will overwrite it
+	}
+	return record, nil
+}
+
+// Verify the device imported with this key is still in this org, so the response isn't replayed (with its node token) after the
+// device was deleted or moved to another org. Returns 410 if the device was deleted, and 409 if it was moved.
+func verifyIdempotencyRecordDevice(record *idempotencyRecord, orgId string) *outils.HttpError {
+	httpErr := verifyDeviceInOrg(record.DeviceUuid, orgId)
+	if httpErr == nil {
+		return nil
+	}
+	switch httpErr.Code {
+	case http.StatusNotFound:
+		return outils.NewHttpError(http.StatusGone, "device %s imported with this Idempotency-Key was deleted, use a new Idempotency-Key to import it again", record.DeviceUuid)
+	case http.StatusForbidden:
+		return outils.NewHttpError(http.StatusConflict, "device %s imported with this Idempotency-Key was moved to another org", record.DeviceUuid)
+	}
+	return httpErr
+}
+
+// Save the result of the import done with this key
+func saveIdempotencyRecord(ctx context.Context, orgId, key, requestHash, deviceUuid string) *outils.HttpError {
+	fileName := getIdempotencyRecordFileName(orgId, key)
+	if err := os.MkdirAll(filepath.Dir(fileName), 0750); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create directory %s: %v", filepath.Dir(fileName), err)
+	}
+	record := idempotencyRecord{RequestHash: requestHash, DeviceUuid: deviceUuid, Created: time.Now().UTC().Format(time.RFC3339)}
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "Error marshaling the idempotency record: %v", err)
+	}
+	if err := ocsdb.WriteFile(ctx, fileName, recordBytes, 0644); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
+	}
+	return nil
+}
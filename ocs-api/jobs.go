@@ -0,0 +1,812 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/open-horizon/FDO-support/ocs-api/metrics"
+	"github.com/open-horizon/FDO-support/ocs-api/ocsdb"
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+	"github.com/open-horizon/FDO-support/ocs-api/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+/*
+Asynchronous jobs, for operations on many devices that can take minutes (bulk imports, mass TO0, state reconciliation). The
+route that starts the operation returns 202 with the job id, and the job is run by a pool of JOB_WORKERS background workers.
+Each job is a list of items (usually devices) that are processed one at a time, and the result of each item is saved in
+v1/jobs/<id>/job.json as it completes, so GET /api/orgs/{org-id}/fdo/jobs/{job-id} can report progress. Jobs that were queued
+or running when ocs-api stopped are resumed when it starts, skipping the items that were already done. Finished jobs are
+removed after JOB_RETENTION hours, checked at startup and then every hour.
+*/
+
+const (
+	DefaultJobWorkers    = 2
+	DefaultJobRetentionH = 168
+	MaxJobItems          = 10000
+	MaxQueuedJobs        = 1000
+	JobPruneInterval     = time.Hour
+)
+
+// The job types
+const (
+	JobTypeImport            = "import"            // import many vouchers, the items are the device guids
+	JobTypeTo0               = "to0"               // initiate TO0 for many devices
+	JobTypeReconcile         = "reconcile"         // ask the owner service for the onboarding state of many devices
+	JobTypeManufacturerPull  = "manufacturerPull"  // import the vouchers of new devices from a manufacturer service
+	JobTypeKeyRotationExtend = "keyRotationExtend" // extend the vouchers of many devices to the new owner key of a key rotation
+	JobTypeKeyRotationImport = "keyRotationImport" // import the extended vouchers of many devices after the old owner key is retired
+)
+
+// The job states
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded" // all of the items succeeded
+	JobStatusFailed    = "failed"    // some of the items failed
+	JobStatusCanceled  = "canceled"
+)
+
+// The job item states
+const (
+	JobItemPending   = "pending"
+	JobItemSucceeded = "succeeded"
+	JobItemFailed    = "failed"
+)
+
+type JobItem struct {
+	Id     string            `json:"id"`
+	Status string            `json:"status"`
+	Error  string            `json:"error,omitempty"`
+	Result map[string]string `json:"result,omitempty"`
+}
+
+type Job struct {
+	Id              string    `json:"id"`
+	OrgId           string    `json:"orgId"`
+	CreatedBy       string    `json:"createdBy,omitempty"` // the exchange user that created the job
+	Type            string    `json:"type"`
+	Status          string    `json:"status"`
+	Created         string    `json:"created"`
+	Started         string    `json:"started,omitempty"`
+	Finished        string    `json:"finished,omitempty"`
+	Total           int       `json:"total"`
+	Succeeded       int       `json:"succeeded"`
+	Failed          int       `json:"failed"`
+	CancelRequested bool      `json:"cancelRequested,omitempty"`
+	Items           []JobItem `json:"items,omitempty"`
+}
+
+// Returns true if the job will not run anymore
+func (j *Job) isFinished() bool {
+	return j.Status == JobStatusSucceeded || j.Status == JobStatusFailed || j.Status == JobStatusCanceled
+}
+
+// Returns true if the job finished longer ago than the retention
+func (j *Job) isExpired(retention time.Duration) bool {
+	finished, err := time.Parse(time.RFC3339, j.Finished)
+	return err == nil && time.Since(finished) > retention
+}
+
+// Runs 1 item of a job of a certain type. The user is the one that created the job. The input is the data saved for this item
+// when the job was created (nil if none). Returns values to save in the item result.
+type jobItemRunner func(ctx context.Context, orgId, user, itemId string, input []byte) (map[string]string, *outils.HttpError)
+
+var jobItemRunners = map[string]jobItemRunner{
+	JobTypeImport:            runImportJobItem,
+	JobTypeTo0:               runTo0JobItem,
+	JobTypeReconcile:         runReconcileJobItem,
+	JobTypeManufacturerPull:  runManufacturerPullJobItem,
+	JobTypeKeyRotationExtend: runKeyRotationExtendJobItem,
+	JobTypeKeyRotationImport: runKeyRotationImportJobItem,
+}
+
+var errJobCanceled = errors.New("the job was canceled")
+
+// The jobs, by id. The running jobs also have a cancel func. All access to them is under jobsLock.
+var jobs = map[string]*Job{}
+var jobCancels = map[string]context.CancelCauseFunc{}
+var jobsLock sync.Mutex
+var jobQueue = make(chan string, MaxQueuedJobs)
+
+func getJobDir(jobId string) string {
+	return filepath.Join(OcsDbDir, "v1", "jobs", jobId)
+}
+
+// Create a job with these items, save it, and queue it to be run. The inputs (if not nil) are the data each item needs,
+// by item id. They are encrypted, because they can contain vouchers.
+func createJob(ctx context.Context, orgId, user, jobType string, itemIds []string, inputs map[string][]byte) (*Job, *outils.HttpError) {
+	if len(itemIds) == 0 {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "there is nothing to do for this job")
+	} else if len(itemIds) > MaxJobItems {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "a job can have at most %d items, this one has %d", MaxJobItems, len(itemIds))
+	}
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "could not generate a job id: %v", err)
+	}
+	job := &Job{
+		Id:        hex.EncodeToString(idBytes),
+		OrgId:     orgId,
+		CreatedBy: user,
+		Type:      jobType,
+		Status:    JobStatusQueued,
+		Created:   time.Now().UTC().Format(time.RFC3339),
+		Total:     len(itemIds),
+	}
+	for _, id := range itemIds {
+		job.Items = append(job.Items, JobItem{Id: id, Status: JobItemPending})
+	}
+
+	jobDir := getJobDir(job.Id)
+	if err := os.MkdirAll(jobDir, 0750); err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "could not create directory %s: %v", jobDir, err)
+	}
+	if len(inputs) > 0 {
+		inputBytes, err := json.Marshal(inputs)
+		if err != nil {
+			return nil, outils.NewHttpError(http.StatusInternalServerError, "Error marshaling the job input: %v", err)
+		}
+		fileName := filepath.Join(jobDir, "job_input.json")
+		if err := ocsdb.WriteFile(ctx, fileName, inputBytes, 0600); err != nil {
+			return nil, outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
+		}
+	}
+
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	if httpErr := saveJob(ctx, job); httpErr != nil {
+		os.RemoveAll(jobDir)
+		return nil, httpErr
+	}
+	select {
+	case jobQueue <- job.Id:
+	default:
+		os.RemoveAll(jobDir)
+		return nil, outils.NewHttpError(http.StatusServiceUnavailable, "there are already %d jobs waiting to run, try again later", MaxQueuedJobs)
+	}
+	jobs[job.Id] = job
+	outils.LogCtx(ctx).Info("job created", "job", job.Id, "org", orgId, "type", jobType, "items", job.Total)
+	return copyJob(job), nil
+}
+
+// Save the job in the OCS DB. Must be called with jobsLock held.
+func saveJob(ctx context.Context, job *Job) *outils.HttpError {
+	jobBytes, err := json.Marshal(job)
+	if err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "Error marshaling job %s: %v", job.Id, err)
+	}
+	fileName := filepath.Join(getJobDir(job.Id), "job.json")
+	if err := ocsdb.WriteFile(ctx, fileName, jobBytes, 0644); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
+	}
+	return nil
+}
+
+// Returns a copy of the job, so it can be used without holding jobsLock
+func copyJob(job *Job) *Job {
+	c := *job
+	c.Items = append([]JobItem(nil), job.Items...)
+	return &c
+}
+
+// Returns a copy of this job, or nil if it doesn't exist in this org
+func getJob(orgId, jobId string) *Job {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	job, ok := jobs[jobId]
+	if !ok || job.OrgId != orgId {
+		return nil
+	}
+	return copyJob(job)
+}
+
+// Returns the ids of the items that are still to be run by these jobs, i.e. the pending items of the jobs that are not finished.
+// The jobs that were removed are finished.
+func getUnfinishedJobItems(jobIds []string) map[string]bool {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	itemIds := map[string]bool{}
+	for _, jobId := range jobIds {
+		if job, ok := jobs[jobId]; ok && !job.isFinished() {
+			for _, item := range job.Items {
+				if item.Status == JobItemPending {
+					itemIds[item.Id] = true
+				}
+			}
+		}
+	}
+	return itemIds
+}
+
+// Returns copies of the jobs of this org, without their items, newest first
+func listJobs(orgId string) []*Job {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	list := []*Job{}
+	for _, job := range jobs {
+		if job.OrgId == orgId {
+			c := *job
+			c.Items = nil
+			list = append(list, &c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created > list[j].Created })
+	return list
+}
+
+// Cancel this job. A queued job is canceled right away, a running job stops after the item it is working on.
+func cancelJob(ctx context.Context, orgId, jobId string) (*Job, *outils.HttpError) {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	job, ok := jobs[jobId]
+	if !ok || job.OrgId != orgId {
+		return nil, outils.NewHttpError(http.StatusNotFound, "job %s not found in org %s", jobId, orgId)
+	} else if job.isFinished() {
+		return nil, outils.NewHttpError(http.StatusConflict, "job %s has already finished", jobId)
+	}
+	job.CancelRequested = true
+	if cancel, ok := jobCancels[jobId]; ok {
+		cancel(errJobCanceled)
+	} else {
+		job.Status = JobStatusCanceled
+		job.Finished = time.Now().UTC().Format(time.RFC3339)
+	}
+	if httpErr := saveJob(ctx, job); httpErr != nil {
+		return nil, httpErr
+	}
+	outils.LogCtx(ctx).Info("job cancel requested", "job", jobId, "org", orgId)
+	return copyJob(job), nil
+}
+
+// Load the saved jobs, queue the unfinished ones, and start the job workers, and the pruner that removes the finished jobs
+// older than JOB_RETENTION hours. The number of workers is set by JOB_WORKERS.
+func startJobWorkers(ctx context.Context) {
+	retention := time.Duration(outils.GetEnvVarIntWithDefault("JOB_RETENTION", DefaultJobRetentionH)) * time.Hour
+	if overflow := loadJobs(ctx, retention); len(overflow) > 0 {
+		// More jobs were unfinished than the queue holds, so queue the rest as the workers make room
+		startBackgroundWorker(ctx, "job requeuer", func(ctx context.Context) {
+			for _, jobId := range overflow {
+				select {
+				case <-ctx.Done():
+					return
+				case jobQueue <- jobId:
+					outils.Log.Info("resuming job", "job", jobId)
+				}
+			}
+		})
+	}
+	numWorkers := outils.GetEnvVarIntWithDefault("JOB_WORKERS", DefaultJobWorkers)
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	for i := 0; i < numWorkers; i++ {
+		startBackgroundWorker(ctx, "job worker", func(ctx context.Context) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case jobId := <-jobQueue:
+					runJob(ctx, jobId)
+				}
+			}
+		})
+	}
+	startBackgroundWorker(ctx, "job pruner", func(ctx context.Context) {
+		for sleepCtx(ctx, JobPruneInterval) {
+			pruneJobs(retention)
+		}
+	})
+}
+
+// Read the jobs saved in the OCS DB, removing the finished ones older than the retention, and queue the unfinished ones.
+// Returns the ids of the unfinished jobs that did not fit in the queue, oldest first.
+func loadJobs(ctx context.Context, retention time.Duration) []string {
+	jobsDir := filepath.Join(OcsDbDir, "v1", "jobs")
+	jobDirs, err := os.ReadDir(jobsDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			outils.Log.Warn("could not read the jobs directory", "dir", jobsDir, "error", err)
+		}
+		return nil
+	}
+	var unfinished []*Job
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	for _, dir := range jobDirs {
+		fileName := filepath.Join(jobsDir, dir.Name(), "job.json")
+		jobBytes, err := ocsdb.ReadFile(fileName)
+		if err != nil {
+			outils.Log.Warn("could not read job", "file", fileName, "error", err)
+			continue
+		}
+		job := &Job{}
+		if err := json.Unmarshal(jobBytes, job); err != nil {
+			outils.Log.Warn("could not parse job", "file", fileName, "error", err)
+			continue
+		}
+		if job.isFinished() {
+			if job.isExpired(retention) {
+				outils.Log.Debug("removing old job", "job", job.Id)
+				os.RemoveAll(filepath.Join(jobsDir, dir.Name()))
+				continue
+			}
+		} else {
+			job.Status = JobStatusQueued // it was running when we stopped, so resume it
+			unfinished = append(unfinished, job)
+		}
+		jobs[job.Id] = job
+	}
+
+	sort.Slice(unfinished, func(i, j int) bool { return unfinished[i].Created < unfinished[j].Created })
+	var overflow []string
+	for _, job := range unfinished {
+		select {
+		case jobQueue <- job.Id:
+			outils.Log.Info("resuming job", "job", job.Id, "org", job.OrgId, "type", job.Type)
+		default:
+			overflow = append(overflow, job.Id)
+		}
+	}
+	if len(overflow) > 0 {
+		outils.Log.Warn("the job queue is full, the remaining jobs will be queued as it empties", "jobs", len(overflow))
+	}
+	return overflow
+}
+
+// Remove the finished jobs older than the retention
+func pruneJobs(retention time.Duration) {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	for jobId, job := range jobs {
+		if job.isFinished() && job.isExpired(retention) {
+			outils.Log.Debug("removing old job", "job", jobId)
+			if err := os.RemoveAll(getJobDir(jobId)); err != nil {
+				outils.Log.Warn("could not remove job", "job", jobId, "error", err)
+				continue
+			}
+			delete(jobs, jobId)
+		}
+	}
+}
+
+// Run the pending items of this job, saving the result of each one
+// Run a job item, turning a panic into a failure of the item so the rest of the job and the worker keep running
+func runJobItemSafely(ctx context.Context, runItem jobItemRunner, orgId, user, itemId string, input []byte) (result map[string]string, httpErr *outils.HttpError) {
+	defer func() {
+		if r := recover(); r != nil {
+			outils.LogCtx(ctx).Error("job item panicked", "item", itemId, "panic", r, "stack", string(debug.Stack()))
+			result, httpErr = nil, outils.NewHttpError(http.StatusInternalServerError, "panic while processing %s: %v", itemId, r)
+		}
+	}()
+	return runItem(ctx, orgId, user, itemId, input)
+}
+
+func runJob(ctx context.Context, jobId string) {
+	jobsLock.Lock()
+	job, ok := jobs[jobId]
+	if !ok || job.Status != JobStatusQueued {
+		jobsLock.Unlock()
+		return // it was canceled while it was queued
+	}
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	jobCancels[jobId] = cancel
+	job.Status = JobStatusRunning
+	if job.Started == "" {
+		job.Started = time.Now().UTC().Format(time.RFC3339)
+	}
+	if httpErr := saveJob(ctx, job); httpErr != nil {
+		outils.Log.Warn("could not save job", "job", jobId, "error", httpErr.Error())
+	}
+	orgId, user, jobType := job.OrgId, job.CreatedBy, job.Type
+	jobsLock.Unlock()
+
+	jobCtx, span := tracing.Start(jobCtx, "job", attribute.String("job.id", jobId), attribute.String("job.type", jobType), attribute.String("org", orgId))
+	log := outils.LogCtx(jobCtx).With("job", jobId, "org", orgId, "type", jobType)
+	log.Info("job started")
+
+	inputs := map[string][]byte{}
+	inputFileName := filepath.Join(getJobDir(jobId), "job_input.json")
+	var jobErr error
+	if outils.PathExists(inputFileName) {
+		if inputBytes, err := ocsdb.ReadFile(inputFileName); err != nil {
+			jobErr = err
+		} else if err := json.Unmarshal(inputBytes, &inputs); err != nil {
+			jobErr = err
+		}
+	}
+	runItem, ok := jobItemRunners[jobType]
+	if !ok {
+		jobErr = errors.New("unknown job type " + jobType)
+	}
+
+	for i := 0; ; i++ {
+		jobsLock.Lock()
+		if i >= len(job.Items) || jobCtx.Err() != nil {
+			jobsLock.Unlock()
+			break
+		}
+		item := job.Items[i]
+		jobsLock.Unlock()
+		if item.Status != JobItemPending {
+			continue // done before a restart
+		}
+
+		var result map[string]string
+		var httpErr *outils.HttpError
+		if jobErr != nil {
+			httpErr = outils.NewHttpError(http.StatusInternalServerError, "%v", jobErr)
+		} else {
+			result, httpErr = runJobItemSafely(jobCtx, runItem, orgId, user, item.Id, inputs[item.Id])
+		}
+		if httpErr != nil && jobCtx.Err() != nil {
+			break // the item was interrupted, so leave it pending
+		}
+
+		jobsLock.Lock()
+		if httpErr != nil {
+			job.Items[i].Status = JobItemFailed
+			job.Items[i].Error = httpErr.Error()
+			job.Failed++
+			log.Debug("job item failed", "item", item.Id, "error", httpErr.Error())
+		} else {
+			job.Items[i].Status = JobItemSucceeded
+			job.Items[i].Result = result
+			job.Succeeded++
+		}
+		if httpErr := saveJob(ctx, job); httpErr != nil {
+			log.Warn("could not save job", "error", httpErr.Error())
+		}
+		jobsLock.Unlock()
+	}
+
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	delete(jobCancels, jobId)
+	if errors.Is(context.Cause(jobCtx), errJobCanceled) {
+		job.Status = JobStatusCanceled
+	} else if ctx.Err() != nil {
+		job.Status = JobStatusQueued // ocs-api is shutting down, so resume it when it starts again
+		log.Info("job interrupted by shutdown, it will be resumed", "succeeded", job.Succeeded, "failed", job.Failed, "total", job.Total)
+		if httpErr := saveJob(context.WithoutCancel(ctx), job); httpErr != nil {
+			log.Warn("could not save job", "error", httpErr.Error())
+		}
+		tracing.End(span, ctx.Err())
+		return
+	} else if job.Failed > 0 {
+		job.Status = JobStatusFailed
+	} else {
+		job.Status = JobStatusSucceeded
+	}
+	job.Finished = time.Now().UTC().Format(time.RFC3339)
+	if httpErr := saveJob(context.WithoutCancel(ctx), job); httpErr != nil {
+		log.Warn("could not save job", "error", httpErr.Error())
+	}
+	if job.Failed > 0 {
+		tracing.End(span, errors.New("some job items failed"))
+	} else {
+		tracing.End(span, nil)
+	}
+	log.Info("job finished", "status", job.Status, "succeeded", job.Succeeded, "failed", job.Failed, "total", job.Total)
+	if job.Type == JobTypeImport {
+		os.Remove(inputFileName) // the vouchers are in the device dirs now
+	}
+}
+
+// Import 1 voucher of a bulk import
+func runImportJobItem(ctx context.Context, orgId, user, itemId string, input []byte) (map[string]string, *outils.HttpError) {
+	deviceUuid, _, existing, httpErr := importVoucher(ctx, orgId, user, input, false)
+	if httpErr != nil {
+		metrics.VoucherImports.WithLabelValues(orgId, metrics.ResultFailure).Inc()
+		return nil, httpErr
+	}
+	metrics.VoucherImports.WithLabelValues(orgId, metrics.ResultSuccess).Inc()
+	result := map[string]string{"deviceUuid": deviceUuid}
+	if existing {
+		result["existing"] = "true"
+	}
+	return result, nil
+}
+
+// Initiate TO0 for 1 device
+func runTo0JobItem(ctx context.Context, orgId, _, deviceUuid string, _ []byte) (map[string]string, *outils.HttpError) {
+	if httpErr := verifyDeviceInOrg(deviceUuid, orgId); httpErr != nil {
+		return nil, httpErr
+	}
+	respBodyBytes, statusCode, httpErr := initiateTo0(ctx, deviceUuid)
+	if httpErr != nil {
+		return nil, httpErr
+	} else if statusCode != http.StatusOK {
+		return nil, outils.NewHttpError(http.StatusBadGateway, "owner service returned HTTP code %d for TO0 of device %s: %s", statusCode, deviceUuid, string(respBodyBytes))
+	}
+	return map[string]string{"state": DeviceStateTo0Registered}, nil
+}
+
+// Get the onboarding state of 1 device from the owner service
+func runReconcileJobItem(ctx context.Context, orgId, _, deviceUuid string, _ []byte) (map[string]string, *outils.HttpError) {
+	if httpErr := verifyDeviceInOrg(deviceUuid, orgId); httpErr != nil {
+		return nil, httpErr
+	}
+	username, password := outils.GetOwnerServiceApiKey()
+	client := outils.NewOwnerServiceClient(username, password)
+	if err := pollDeviceState(ctx, client, os.Getenv("HZN_FDO_API_URL"), deviceUuid); err != nil {
+		return nil, outils.NewHttpError(http.StatusBadGateway, "could not get the state of device %s from the owner service: %v", deviceUuid, err)
+	}
+	state, httpErr := getDeviceState(deviceUuid)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	return map[string]string{"state": state.State}, nil
+}
+
+// Returns the devices in this org, optionally only the ones in one of these states
+func listOrgDevices(orgId string, states ...string) ([]string, *outils.HttpError) {
+	devicesDir := filepath.Join(OcsDbDir, "v1", "devices")
+	deviceDirs, err := os.ReadDir(devicesDir)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error reading the devices directory %s: %v", devicesDir, err)
+	}
+	deviceUuids := []string{}
+	for _, dir := range deviceDirs {
+		if !dir.IsDir() {
+			continue
+		}
+		if orgidTxtStr, httpErr := getOrgidTxtStr(dir.Name()); httpErr != nil || orgidTxtStr != orgId {
+			continue
+		}
+		if len(states) > 0 {
+			state, httpErr := getDeviceState(dir.Name())
+			if httpErr != nil || !slices.Contains(states, state.State) {
+				continue
+			}
+		}
+		deviceUuids = append(deviceUuids, dir.Name())
+	}
+	return deviceUuids, nil
+}
+
+// The optional body of the routes that start a job on many devices
+type DevicesJobRequest struct {
+	Devices []string `json:"devices"`
+}
+
+// Get the devices from the request body, or if the body is empty, the devices of the org in one of these states
+func getJobDevices(orgId string, r *http.Request, defaultStates ...string) ([]string, *outils.HttpError) {
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "Error reading the request body: %v", err)
+	}
+	if len(bytes.TrimSpace(bodyBytes)) == 0 {
+		return listOrgDevices(orgId, defaultStates...)
+	}
+	body := DevicesJobRequest{}
+	if httpErr := outils.ParseJsonString(bodyBytes, &body); httpErr != nil {
+		return nil, httpErr
+	}
+	for _, deviceUuid := range body.Devices {
+		if !deviceGuidRegex.MatchString(deviceUuid) {
+			return nil, outils.NewHttpError(http.StatusBadRequest, "invalid device id: %s", deviceUuid)
+		}
+	}
+	return body.Devices, nil
+}
+
+// Respond that this job was started
+func writeJobAccepted(w http.ResponseWriter, job *Job) {
+	job.Items = nil
+	w.Header().Set("Location", "/api/orgs/"+job.OrgId+"/fdo/jobs/"+job.Id)
+	outils.WriteJsonResponse(http.StatusAccepted, w, job)
+}
+
+// ============= POST /api/orgs/{ord-id}/fdo/vouchers/bulk =============
+// Imports all of the vouchers in the body (concatenated PEM blocks) in a job. Returns 202 with the job.
+func postFdoVouchersBulkHandler(orgId string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("POST /api/orgs/{org-id}/fdo/vouchers/bulk", "org", orgId)
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Authenticate this user with the exchange
+	authenticated, user, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
+		return
+	}
+
+	// Verify content type
+	if httpErr := outils.IsValidPostPlainTxt(r); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading the request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Split the body into the vouchers, and check each one, so the job only fails for problems with the owner service
+	itemIds := []string{}
+	inputs := map[string][]byte{}
+	for rest := bodyBytes; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		} else if block.Type != outils.VoucherPemType {
+			continue
+		}
+		voucherBytes := pem.EncodeToMemory(block)
+		voucherHeader, err := outils.ParseVoucher(voucherBytes)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid ownership voucher number %d: %v", len(itemIds)+1, err), http.StatusBadRequest)
+			return
+		} else if _, ok := inputs[voucherHeader.Guid]; ok {
+			http.Error(w, "the request contains more than 1 voucher for device "+voucherHeader.Guid, http.StatusBadRequest)
+			return
+		}
+		itemIds = append(itemIds, voucherHeader.Guid)
+		inputs[voucherHeader.Guid] = voucherBytes
+	}
+
+	job, httpErr := createJob(r.Context(), deviceOrgId, user, JobTypeImport, itemIds, inputs)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	writeJobAccepted(w, job)
+}
+
+// ============= POST /api/orgs/{ord-id}/fdo/to0 =============
+// Initiates TO0 in a job for the devices in the body ({"devices": [...]}), or if there is no body, for all of the devices in
+// the org that have not been registered with the rendezvous server yet. Returns 202 with the job.
+func postFdoTo0Handler(orgId string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("POST /api/orgs/{org-id}/fdo/to0", "org", orgId)
+	postDevicesJob(orgId, JobTypeTo0, []string{DeviceStateImported}, w, r)
+}
+
+// ============= POST /api/orgs/{ord-id}/fdo/reconcile =============
+// Gets the onboarding state of the devices in the body ({"devices": [...]}) from the owner service in a job, or if there is no
+// body, of all of the devices in the org that have not been onboarded yet. Returns 202 with the job.
+func postFdoReconcileHandler(orgId string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("POST /api/orgs/{org-id}/fdo/reconcile", "org", orgId)
+	postDevicesJob(orgId, JobTypeReconcile, []string{DeviceStateImported, DeviceStateTo0Registered}, w, r)
+}
+
+// Start a job of this type for the devices in the request, or the devices of the org in one of the default states
+func postDevicesJob(orgId, jobType string, defaultStates []string, w http.ResponseWriter, r *http.Request) {
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Authenticate this user with the exchange
+	authenticated, user, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
+		return
+	}
+
+	deviceUuids, httpErr := getJobDevices(deviceOrgId, r, defaultStates...)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	job, httpErr := createJob(r.Context(), deviceOrgId, user, jobType, deviceUuids, nil)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	writeJobAccepted(w, job)
+}
+
+// ============= GET /api/orgs/{ord-id}/fdo/jobs =============
+// Returns the jobs of the org (without their items), newest first
+func getFdoJobsHandler(orgId string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("GET /api/orgs/{org-id}/fdo/jobs", "org", orgId)
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Authenticate this user with the exchange
+	if authenticated, _, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
+		return
+	}
+
+	outils.WriteJsonResponse(http.StatusOK, w, listJobs(deviceOrgId))
+}
+
+// ============= GET /api/orgs/{ord-id}/fdo/jobs/{jobId} =============
+// Returns the job with the result of each item. The results of import jobs have the device uuids, but not the node tokens, which
+// org admins can get with GET /api/orgs/{org-id}/fdo/vouchers/{device-id}/nodetoken.
+func getFdoJobHandler(orgId string, jobId string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("GET /api/orgs/{org-id}/fdo/jobs/{job-id}", "org", orgId, "job", jobId)
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Authenticate this user with the exchange
+	if authenticated, _, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
+		return
+	}
+
+	job := getJob(deviceOrgId, jobId)
+	if job == nil {
+		http.Error(w, "job "+jobId+" not found in org "+deviceOrgId, http.StatusNotFound)
+		return
+	}
+
+	outils.WriteJsonResponse(http.StatusOK, w, job)
+}
+
+// ============= POST /api/orgs/{ord-id}/fdo/jobs/{jobId}/cancel =============
+// Cancels the job. The items that were already done are not undone.
+func postFdoJobCancelHandler(orgId string, jobId string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("POST /api/orgs/{org-id}/fdo/jobs/{job-id}/cancel", "org", orgId, "job", jobId)
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Authenticate this user with the exchange
+	if authenticated, _, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
+		return
+	}
+
+	job, httpErr := cancelJob(r.Context(), deviceOrgId, jobId)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	job.Items = nil
+	outils.WriteJsonResponse(http.StatusOK, w, job)
+}
@@ -0,0 +1,848 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/open-horizon/FDO-support/ocs-api/ocsdb"
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+)
+
+/*
+Rotation of an owner key. The vouchers of the devices that have not been onboarded yet are extended to the current owner key, so
+when the key is replaced they would no longer work. A rotation of the key of 1 owner key type (alias) is done in 3 steps:
+
+ 1. POST /api/fdo/keyrotations/{alias} with the new owner certificate. While the owner service still has the old key, the voucher
+    of each device that has not been onboarded is extended (resold) to the new owner certificate, in a job per org.
+ 2. POST /api/fdo/keyrotations/{alias}/retire with the PKCS12 keystore that has the new key. This is refused until the vouchers of
+    all of the devices have been extended, because the old key is needed to extend them. The keystore replaces the old key in the
+    owner service.
+ 3. The retire route starts a job per org that replaces each device's voucher in the owner service with the extended one, and
+    initiates TO0 again for the devices that were registered with the rendezvous server with the old key. The devices whose
+    voucher could not be imported are retried with POST /api/fdo/keyrotations/{alias}/import.
+
+The rotation and the migration state of each device are in v1/keyrotations/<alias>/rotation.json, and the extended vouchers are
+in v1/keyrotations/<alias>/vouchers/<uuid>/ until they are imported.
+*/
+
+// The rotation states
+const (
+	KeyRotationExtending = "extending" // the vouchers are being extended to the new owner certificate
+	KeyRotationRetired   = "retired"   // the owner service has the new key, the extended vouchers are being imported
+	KeyRotationCompleted = "completed" // all of the extended vouchers were imported
+)
+
+// The migration states of a device
+const (
+	KeyRotationDevicePending  = "pending"  // waiting for its voucher to be extended
+	KeyRotationDeviceExtended = "extended" // its voucher was extended to the new owner certificate, waiting for the retire
+	KeyRotationDeviceSkipped  = "skipped"  // it was onboarded or transferred, or its voucher is for another key type
+	KeyRotationDeviceFailed   = "failed"   // its voucher could not be extended
+	KeyRotationDeviceMigrated = "migrated" // the extended voucher was imported
+
+	KeyRotationDeviceImportFailed = "importFailed" // the extended voucher could not be imported after the retire
+)
+
+// The public key each owner key type must have, as publicKeyDescription returns it
+var ownerKeyTypePublicKeys = map[string]string{
+	"SECP256R1":    "ECDSA P-256",
+	"SECP384R1":    "ECDSA P-384",
+	"RSAPKCS3072":  "RSA 3072",
+	"RSAPKCS2048":  "RSA 2048",
+	"RSA2048RESTR": "RSA 2048",
+}
+
+type KeyRotationDevice struct {
+	OrgId  string `json:"orgId"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type KeyRotation struct {
+	Alias          string                        `json:"alias"`
+	Status         string                        `json:"status"`
+	NewCertificate string                        `json:"newCertificate"` // PEM
+	NewCertSha256  string                        `json:"newCertSha256"`
+	OldCertSha256  string                        `json:"oldCertSha256,omitempty"`
+	CreatedBy      string                        `json:"createdBy,omitempty"`
+	Created        string                        `json:"created"`
+	Retired        string                        `json:"retired,omitempty"`
+	Jobs           []string                      `json:"jobs"`
+	Counts         map[string]int                `json:"counts"` // the number of devices in each migration state
+	Devices        map[string]*KeyRotationDevice `json:"devices,omitempty"`
+}
+
+// Serializes the changes to each rotation, by alias
+var keyRotationLocks = newKeyedMutex()
+
+func getKeyRotationDir(alias string) string {
+	return filepath.Clean(filepath.Join(OcsDbDir, "v1", "keyrotations", alias))
+}
+
+func getRotatedVoucherFileName(alias, deviceUuid string) string {
+	return filepath.Join(getKeyRotationDir(alias), "vouchers", deviceUuid, "ownership_voucher.txt")
+}
+
+// Read the rotation of this alias. Returns 404 if there isn't one.
+func getKeyRotation(alias string) (*KeyRotation, *outils.HttpError) {
+	fileName := filepath.Join(getKeyRotationDir(alias), "rotation.json")
+	if !outils.PathExists(fileName) {
+		return nil, outils.NewHttpError(http.StatusNotFound, "there is no key rotation for %s", alias)
+	}
+	rotationBytes, err := ocsdb.ReadFile(fileName)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error reading %s: %v", fileName, err)
+	}
+	rotation := &KeyRotation{}
+	if err := json.Unmarshal(rotationBytes, rotation); err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error parsing %s: %v", fileName, err)
+	}
+	rotation.Counts = map[string]int{}
+	var unfinished map[string]bool
+	for deviceUuid, device := range rotation.Devices {
+		if device.Status == KeyRotationDevicePending {
+			// A device whose extend job was canceled, or could not be started, would be pending forever, so it is failed and can
+			// be retried with the extend route
+			if unfinished == nil {
+				unfinished = getUnfinishedJobItems(rotation.Jobs)
+			}
+			if !unfinished[deviceUuid] {
+				device.Status = KeyRotationDeviceFailed
+				device.Error = "the job that extends its voucher stopped before it was extended"
+			}
+		}
+		rotation.Counts[device.Status]++
+	}
+	if rotation.Status == KeyRotationRetired && rotation.Counts[KeyRotationDeviceExtended] == 0 && rotation.Counts[KeyRotationDeviceImportFailed] == 0 {
+		rotation.Status = KeyRotationCompleted
+	}
+	return rotation, nil
+}
+
+// Save the rotation. Must be called with the lock of its alias held.
+func saveKeyRotation(ctx context.Context, rotation *KeyRotation) *outils.HttpError {
+	rotationBytes, err := json.Marshal(rotation)
+	if err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "Error marshaling the key rotation of %s: %v", rotation.Alias, err)
+	}
+	fileName := filepath.Join(getKeyRotationDir(rotation.Alias), "rotation.json")
+	if err := ocsdb.WriteFile(ctx, fileName, rotationBytes, 0644); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
+	}
+	return nil
+}
+
+// Set the migration state of a device of this rotation
+func setKeyRotationDevice(ctx context.Context, alias, deviceUuid, status, errorMsg string) *outils.HttpError {
+	unlock := keyRotationLocks.lock(alias)
+	defer unlock()
+	rotation, httpErr := getKeyRotation(alias)
+	if httpErr != nil {
+		return httpErr
+	}
+	device, ok := rotation.Devices[deviceUuid]
+	if !ok {
+		return outils.NewHttpError(http.StatusNotFound, "device %s is not part of the key rotation of %s", deviceUuid, alias)
+	}
+	device.Status = status
+	device.Error = errorMsg
+	return saveKeyRotation(ctx, rotation)
+}
+
+// Returns the devices, by org, that have not been onboarded and whose voucher may be extended to this owner key type. The owner
+// key type in the voucher doesn't have the RSA key size, so the job items ask the owner service to be sure.
+func listKeyRotationCandidates(alias string) map[string][]string {
+	deviceIndexLock.RLock()
+	defer deviceIndexLock.RUnlock()
+	candidates := map[string][]string{}
+	for _, e := range deviceIndex {
+		if e.State != DeviceStateImported && e.State != DeviceStateTo0Registered {
+			continue
+		}
+		if e.OwnerKeyType != "" && !strings.HasPrefix(alias, e.OwnerKeyType) {
+			continue
+		}
+		candidates[e.OrgId] = append(candidates[e.OrgId], e.Uuid)
+	}
+	return candidates
+}
+
+// Start a job in each org for these devices, and record them in the rotation. Must be called with the lock of its alias held.
+func startKeyRotationJobs(ctx context.Context, rotation *KeyRotation, user, jobType string, devicesByOrg map[string][]string) ([]*Job, *outils.HttpError) {
+	orgIds := make([]string, 0, len(devicesByOrg))
+	for orgId := range devicesByOrg {
+		orgIds = append(orgIds, orgId)
+	}
+	sort.Strings(orgIds)
+	started := []*Job{}
+	for _, orgId := range orgIds {
+		inputs := map[string][]byte{}
+		for _, deviceUuid := range devicesByOrg[orgId] {
+			inputs[deviceUuid] = []byte(rotation.Alias)
+		}
+		job, httpErr := createJob(ctx, orgId, user, jobType, devicesByOrg[orgId], inputs)
+		if httpErr != nil {
+			return started, httpErr
+		}
+		rotation.Jobs = append(rotation.Jobs, job.Id)
+		started = append(started, job)
+	}
+	return started, nil
+}
+
+// Have the owner service tell which owner key type the voucher of this device is extended to
+func getDeviceOwnerKeyType(ctx context.Context, deviceUuid string) (string, *outils.HttpError) {
+	client, certificateUrl, httpErr := ownerCertificateApi()
+	if httpErr != nil {
+		return "", httpErr
+	}
+	respBodyBytes, httpErr := ownerServiceRequest(ctx, client, http.MethodGet, certificateUrl+"?uuid="+deviceUuid, nil)
+	if httpErr != nil {
+		return "", httpErr
+	}
+	return strings.TrimSpace(string(respBodyBytes)), nil
+}
+
+// Extend the voucher of 1 device to the new owner certificate of the rotation, and save it until the old key is retired
+func runKeyRotationExtendJobItem(ctx context.Context, orgId, _, deviceUuid string, input []byte) (map[string]string, *outils.HttpError) {
+	alias := string(input)
+	unlock := lockDevice(deviceUuid)
+	defer unlock()
+
+	result, httpErr := extendRotatedDevice(ctx, alias, orgId, deviceUuid)
+	if httpErr != nil {
+		if setErr := setKeyRotationDevice(ctx, alias, deviceUuid, KeyRotationDeviceFailed, httpErr.Error()); setErr != nil {
+			outils.LogCtx(ctx).Warn("could not record the key rotation of device", "device", deviceUuid, "error", setErr.Error())
+		}
+		return nil, httpErr
+	}
+	if httpErr := setKeyRotationDevice(ctx, alias, deviceUuid, result["status"], result["reason"]); httpErr != nil {
+		return nil, httpErr
+	}
+	return result, nil
+}
+
+func extendRotatedDevice(ctx context.Context, alias, orgId, deviceUuid string) (map[string]string, *outils.HttpError) {
+	if httpErr := verifyDeviceInOrg(deviceUuid, orgId); httpErr != nil {
+		return nil, httpErr
+	}
+	if state, httpErr := getDeviceState(deviceUuid); httpErr != nil {
+		return nil, httpErr
+	} else if state.State != DeviceStateImported && state.State != DeviceStateTo0Registered {
+		return map[string]string{"status": KeyRotationDeviceSkipped, "reason": "the device is " + state.State}, nil
+	}
+	keyType, httpErr := getDeviceOwnerKeyType(ctx, deviceUuid)
+	if httpErr != nil {
+		return nil, httpErr
+	} else if keyType != alias {
+		return map[string]string{"status": KeyRotationDeviceSkipped, "reason": "the voucher is for owner key type " + keyType}, nil
+	}
+
+	rotation, httpErr := getKeyRotation(alias)
+	if httpErr != nil {
+		return nil, httpErr
+	} else if rotation.Status != KeyRotationExtending {
+		return nil, outils.NewHttpError(http.StatusConflict, "the old %s key was already retired", alias)
+	}
+	voucherBytes, httpErr := resellDevice(ctx, deviceUuid, []byte(rotation.NewCertificate))
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	fileName := getRotatedVoucherFileName(alias, deviceUuid)
+	if err := os.MkdirAll(filepath.Dir(fileName), 0750); err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "could not create directory %s: %v", filepath.Dir(fileName), err)
+	}
+	if err := ocsdb.WriteFile(ctx, fileName, voucherBytes, 0644); err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
+	}
+	return map[string]string{"status": KeyRotationDeviceExtended}, nil
+}
+
+// Replace the voucher of 1 device in the owner service and the OCS DB with the one extended to the new owner key, and initiate
+// TO0 again if the device was registered with the rendezvous server. If it fails, the device is import failed, so the import
+// route can retry it.
+func runKeyRotationImportJobItem(ctx context.Context, orgId, _, deviceUuid string, input []byte) (map[string]string, *outils.HttpError) {
+	alias := string(input)
+	unlock := lockDevice(deviceUuid)
+	defer unlock()
+
+	result, httpErr := importRotatedDevice(ctx, alias, orgId, deviceUuid)
+	if httpErr != nil {
+		if setErr := setKeyRotationDevice(ctx, alias, deviceUuid, KeyRotationDeviceImportFailed, httpErr.Error()); setErr != nil {
+			outils.LogCtx(ctx).Warn("could not record the key rotation of device", "device", deviceUuid, "error", setErr.Error())
+		}
+		return nil, httpErr
+	}
+	return result, nil
+}
+
+func importRotatedDevice(ctx context.Context, alias, orgId, deviceUuid string) (map[string]string, *outils.HttpError) {
+	fileName := getRotatedVoucherFileName(alias, deviceUuid)
+	if httpErr := verifyDeviceInOrg(deviceUuid, orgId); httpErr != nil && httpErr.Code == http.StatusNotFound {
+		// It was deleted after its voucher was extended, so there is nothing to import
+		os.RemoveAll(filepath.Dir(fileName))
+		if httpErr := setKeyRotationDevice(ctx, alias, deviceUuid, KeyRotationDeviceSkipped, "the device was deleted"); httpErr != nil {
+			return nil, httpErr
+		}
+		return map[string]string{"status": KeyRotationDeviceSkipped}, nil
+	} else if httpErr != nil {
+		return nil, httpErr
+	}
+	state, httpErr := getDeviceState(deviceUuid)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	if state.State != DeviceStateImported && state.State != DeviceStateTo0Registered {
+		// It was onboarded with the old key before it was retired, so the extended voucher isn't needed
+		os.RemoveAll(filepath.Dir(fileName))
+		if httpErr := setKeyRotationDevice(ctx, alias, deviceUuid, KeyRotationDeviceSkipped, "the device is "+state.State); httpErr != nil {
+			return nil, httpErr
+		}
+		return map[string]string{"status": KeyRotationDeviceSkipped}, nil
+	}
+	voucherBytes, err := ocsdb.ReadFile(fileName)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error reading %s: %v", fileName, err)
+	}
+	if httpErr := replaceOwnerVoucher(ctx, deviceUuid, voucherBytes); httpErr != nil {
+		return nil, httpErr
+	}
+	if httpErr := setDeviceState(ctx, deviceUuid, DeviceStateImported, "", ""); httpErr != nil {
+		return nil, httpErr
+	}
+	if httpErr := setKeyRotationDevice(ctx, alias, deviceUuid, KeyRotationDeviceMigrated, ""); httpErr != nil {
+		return nil, httpErr
+	}
+	os.RemoveAll(filepath.Dir(fileName))
+	outils.LogCtx(ctx).Info("device migrated to the new owner key", "org", orgId, "device", deviceUuid, "alias", alias)
+
+	result := map[string]string{"status": KeyRotationDeviceMigrated, "state": DeviceStateImported}
+	if state.State == DeviceStateTo0Registered {
+		// The rendezvous server has the TO0 registration signed with the old key, so register it again. If this fails, the
+		// device is left imported, so POST /api/orgs/{org-id}/fdo/to0 can retry it.
+		if respBodyBytes, statusCode, httpErr := initiateTo0(ctx, deviceUuid); httpErr != nil {
+			result["to0Error"] = httpErr.Error()
+		} else if statusCode != http.StatusOK {
+			result["to0Error"] = "owner service returned HTTP code " + http.StatusText(statusCode) + ": " + string(respBodyBytes)
+		} else {
+			result["state"] = DeviceStateTo0Registered
+		}
+	}
+	return result, nil
+}
+
+// Replace the voucher of this device in the owner service and the OCS DB, keeping its node token and exec resource. If the new
+// voucher can't be imported, the old one is put back.
+func replaceOwnerVoucher(ctx context.Context, deviceUuid string, voucherBytes []byte) (httpErr *outils.HttpError) {
+	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
+	username, password := outils.GetOwnerServiceApiKey()
+	client := outils.NewOwnerServiceClient(username, password)
+	deviceDir := filepath.Clean(filepath.Join(OcsDbDir, "v1", "devices", deviceUuid))
+	voucherFileName := filepath.Join(deviceDir, "ownership_voucher.txt")
+	oldVoucherBytes, err := ocsdb.ReadFile(voucherFileName)
+	if err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "Error reading %s: %v", voucherFileName, err)
+	}
+
+	s := &saga{ctx: ctx, name: "voucher replacement"}
+	defer func() {
+		if httpErr != nil {
+			s.rollback()
+		}
+	}()
+	if _, httpErr := ownerServiceRequest(ctx, client, http.MethodDelete, fdoOwnerURL+"/api/v1/owner/vouchers/"+deviceUuid, nil); httpErr != nil {
+		return httpErr
+	}
+	s.done("delete the old voucher from the owner service", func(ctx context.Context) error {
+		_, httpErr := ownerServiceRequest(ctx, client, http.MethodPost, fdoOwnerURL+"/api/v1/owner/vouchers", oldVoucherBytes)
+		return httpErrOrNil(httpErr)
+	})
+	respBodyBytes, httpErr := ownerServiceRequest(ctx, client, http.MethodPost, fdoOwnerURL+"/api/v1/owner/vouchers", voucherBytes)
+	if httpErr != nil {
+		return httpErr
+	}
+	s.done("import the new voucher in the owner service", func(ctx context.Context) error {
+		_, httpErr := ownerServiceRequest(ctx, client, http.MethodDelete, fdoOwnerURL+"/api/v1/owner/vouchers/"+deviceUuid, nil)
+		return httpErrOrNil(httpErr)
+	})
+	if guid := strings.TrimSpace(string(respBodyBytes)); !strings.EqualFold(guid, deviceUuid) {
+		return outils.NewHttpError(http.StatusBadGateway, "the owner service returned device guid %s for the voucher of device %s", guid, deviceUuid)
+	}
+
+	// The exec resource is posted again, in case the owner service removed it with the old voucher
+	if httpErr := postDeviceExecResource(ctx, deviceUuid); httpErr != nil {
+		return httpErr
+	}
+	if err := ocsdb.WriteFile(ctx, voucherFileName, voucherBytes, 0644); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", voucherFileName, err)
+	}
+	return nil
+}
+
+// Returns the devices, by org, that have not been onboarded, may have a voucher for this owner key type, and are not part of the
+// rotation yet or failed to be extended
+func getKeyRotationRemaining(rotation *KeyRotation) map[string][]string {
+	remaining := map[string][]string{}
+	for orgId, deviceUuids := range listKeyRotationCandidates(rotation.Alias) {
+		for _, deviceUuid := range deviceUuids {
+			if device, ok := rotation.Devices[deviceUuid]; !ok || device.Status == KeyRotationDeviceFailed {
+				remaining[orgId] = append(remaining[orgId], deviceUuid)
+			}
+		}
+	}
+	return remaining
+}
+
+// Add these devices to the rotation as pending, and start the jobs that extend their vouchers. Must be called with the lock of
+// the alias held.
+func extendKeyRotation(ctx context.Context, rotation *KeyRotation, user string, devicesByOrg map[string][]string) ([]*Job, *outils.HttpError) {
+	for orgId, deviceUuids := range devicesByOrg {
+		for _, deviceUuid := range deviceUuids {
+			rotation.Devices[deviceUuid] = &KeyRotationDevice{OrgId: orgId, Status: KeyRotationDevicePending}
+		}
+	}
+	started, httpErr := startKeyRotationJobs(ctx, rotation, user, JobTypeKeyRotationExtend, devicesByOrg)
+	if httpErr != nil && len(started) == 0 {
+		return nil, httpErr
+	}
+	// Save the jobs that were started, even if some of them could not be
+	if saveErr := saveKeyRotation(ctx, rotation); saveErr != nil {
+		return nil, saveErr
+	}
+	return started, httpErr
+}
+
+// Returns the devices, by org, of a retired rotation whose extended voucher still has to be imported, and the number of them
+// whose import job is still running
+func getKeyRotationUnimported(rotation *KeyRotation) (map[string][]string, int) {
+	unimported := map[string][]string{}
+	unfinished := getUnfinishedJobItems(rotation.Jobs)
+	running := 0
+	for deviceUuid, device := range rotation.Devices {
+		if device.Status != KeyRotationDeviceExtended && device.Status != KeyRotationDeviceImportFailed {
+			continue
+		} else if unfinished[deviceUuid] {
+			running++
+			continue
+		}
+		unimported[device.OrgId] = append(unimported[device.OrgId], deviceUuid)
+	}
+	for _, deviceUuids := range unimported {
+		sort.Strings(deviceUuids)
+	}
+	return unimported, running
+}
+
+// Start the jobs that import the extended vouchers of these devices, and save the rotation. Must be called with the lock of the
+// alias held.
+func importKeyRotation(ctx context.Context, rotation *KeyRotation, user string, devicesByOrg map[string][]string) ([]*Job, *outils.HttpError) {
+	started, httpErr := startKeyRotationJobs(ctx, rotation, user, JobTypeKeyRotationImport, devicesByOrg)
+	// Save the jobs that were started, even if some of them could not be
+	if saveErr := saveKeyRotation(ctx, rotation); saveErr != nil {
+		return nil, saveErr
+	}
+	return started, httpErr
+}
+
+// Respond with the rotation: 202 if jobs were started for it (they are in its jobs), or 200 if there was nothing to migrate
+func writeKeyRotationAccepted(w http.ResponseWriter, rotation *KeyRotation, started []*Job) {
+	if len(started) == 0 {
+		outils.WriteJsonResponse(http.StatusOK, w, rotation)
+		return
+	}
+	w.Header().Set("Location", "/api/fdo/keyrotations/"+rotation.Alias)
+	outils.WriteJsonResponse(http.StatusAccepted, w, rotation)
+}
+
+// Authenticate the exchange root user and validate the alias of the key rotation routes. Returns the user, or false if the
+// response was already written.
+func authenticateKeyRotation(alias string, w http.ResponseWriter, r *http.Request) (string, bool) {
+	authenticated, httpErr := outils.ExchangeAuthenticateRoot(r, ExchangeInternalUrl, ExchangeInternalCertPath)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return "", false
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided or the user is not the exchange root user", http.StatusUnauthorized)
+		return "", false
+	}
+	if alias != "" && !slices.Contains(ownerKeyTypes, alias) {
+		http.Error(w, "Public key type must be one of these supported alias': SECP256R1, SECP384R1, RSAPKCS3072, RSAPKCS2048, RSA2048RESTR", http.StatusBadRequest)
+		return "", false
+	}
+	_, user, _, _ := outils.GetBasicAuth(r)
+	return user, true
+}
+
+// ============= GET /api/fdo/keyrotations =============
+// Returns the key rotations, without their devices. Only the exchange root user can do this.
+func getFdoKeyRotationsHandler(w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("GET /api/fdo/keyrotations")
+
+	if _, ok := authenticateKeyRotation("", w, r); !ok {
+		return
+	}
+
+	rotations := []*KeyRotation{}
+	for _, alias := range ownerKeyTypes {
+		rotation, httpErr := getKeyRotation(alias)
+		if httpErr != nil && httpErr.Code == http.StatusNotFound {
+			continue
+		} else if httpErr != nil {
+			http.Error(w, httpErr.Error(), httpErr.Code)
+			return
+		}
+		rotation.Devices = nil
+		rotations = append(rotations, rotation)
+	}
+	outils.WriteJsonResponse(http.StatusOK, w, rotations)
+}
+
+// ============= GET /api/fdo/keyrotations/{alias} =============
+// Returns the key rotation of this owner key type, with the migration state of each device. Only the exchange root user can do
+// this.
+func getFdoKeyRotationHandler(alias string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("GET /api/fdo/keyrotations/{alias}", "alias", alias)
+
+	if _, ok := authenticateKeyRotation(alias, w, r); !ok {
+		return
+	}
+
+	rotation, httpErr := getKeyRotation(alias)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	outils.WriteJsonResponse(http.StatusOK, w, rotation)
+}
+
+// ============= POST /api/fdo/keyrotations/{alias} =============
+// Starts the rotation of the key of this owner key type to the key of the new owner certificate (PEM) in the body. The vouchers
+// of the devices that have not been onboarded are extended to it in a job per org. Returns 202 with the rotation, or 200 if there
+// are no devices to migrate. Only the exchange root user can do this.
+func postFdoKeyRotationHandler(alias string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("POST /api/fdo/keyrotations/{alias}", "alias", alias)
+
+	user, ok := authenticateKeyRotation(alias, w, r)
+	if !ok {
+		return
+	}
+
+	// Verify content type
+	if httpErr := outils.IsValidPostPlainTxt(r); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	bodyBytes, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxOwnerCertBodyKB*1024))
+	if err != nil {
+		http.Error(w, "Error reading the request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	newCertBytes := bytes.TrimSpace(bodyBytes)
+	newCert, httpErr := parseOwnerCertificate(newCertBytes)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	if publicKey := publicKeyDescription(newCert); publicKey != ownerKeyTypePublicKeys[alias] {
+		http.Error(w, "the new owner certificate has a "+publicKey+" key, but "+alias+" needs a "+ownerKeyTypePublicKeys[alias]+" key", http.StatusBadRequest)
+		return
+	}
+	fingerprint := sha256.Sum256(newCert.Raw)
+	newCertSha256 := hex.EncodeToString(fingerprint[:])
+	oldCertBytes, httpErr := getOwnerCertificate(r.Context(), alias)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	oldCertSha256 := ownerCertificateSha256(oldCertBytes)
+	if oldCertSha256 == newCertSha256 {
+		http.Error(w, "the new owner certificate is the current "+alias+" owner certificate", http.StatusBadRequest)
+		return
+	}
+
+	unlock := keyRotationLocks.lock(alias)
+	defer unlock()
+	if existing, httpErr := getKeyRotation(alias); httpErr == nil && existing.Status != KeyRotationCompleted {
+		http.Error(w, "the key rotation of "+alias+" is "+existing.Status+", it must be completed or deleted before another one is started", http.StatusConflict)
+		return
+	} else if httpErr != nil && httpErr.Code != http.StatusNotFound {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	rotationDir := getKeyRotationDir(alias)
+	if err := os.RemoveAll(rotationDir); err != nil {
+		http.Error(w, "could not remove the completed key rotation "+rotationDir+": "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.MkdirAll(rotationDir, 0750); err != nil {
+		http.Error(w, "could not create directory "+rotationDir+": "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rotation := &KeyRotation{
+		Alias:          alias,
+		Status:         KeyRotationExtending,
+		NewCertificate: string(newCertBytes) + "\n",
+		NewCertSha256:  newCertSha256,
+		OldCertSha256:  oldCertSha256,
+		CreatedBy:      user,
+		Created:        time.Now().UTC().Format(time.RFC3339),
+		Jobs:           []string{},
+		Devices:        map[string]*KeyRotationDevice{},
+	}
+	if httpErr := saveKeyRotation(r.Context(), rotation); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	started, httpErr := extendKeyRotation(r.Context(), rotation, user, listKeyRotationCandidates(alias))
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	outils.LogFor(r).Info("key rotation started", "alias", alias, "new_owner", newCert.Subject.String(), "new_owner_sha256", newCertSha256, "devices", len(rotation.Devices))
+
+	rotation, httpErr = getKeyRotation(alias)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	writeKeyRotationAccepted(w, rotation, started)
+}
+
+// ============= POST /api/fdo/keyrotations/{alias}/extend =============
+// Extends the vouchers of the devices that were imported since the rotation started, and retries the ones that failed. Returns
+// 202 with the rotation, or 200 if there are no devices left to extend. Only the exchange root user can do this.
+func postFdoKeyRotationExtendHandler(alias string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("POST /api/fdo/keyrotations/{alias}/extend", "alias", alias)
+
+	user, ok := authenticateKeyRotation(alias, w, r)
+	if !ok {
+		return
+	}
+
+	unlock := keyRotationLocks.lock(alias)
+	defer unlock()
+	rotation, httpErr := getKeyRotation(alias)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if rotation.Status != KeyRotationExtending {
+		http.Error(w, "the old "+alias+" key was already retired", http.StatusConflict)
+		return
+	} else if rotation.Counts[KeyRotationDevicePending] > 0 {
+		http.Error(w, "the vouchers of some devices are still being extended, wait for the jobs of the rotation to finish", http.StatusConflict)
+		return
+	}
+	started, httpErr := extendKeyRotation(r.Context(), rotation, user, getKeyRotationRemaining(rotation))
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	rotation, httpErr = getKeyRotation(alias)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	writeKeyRotationAccepted(w, rotation, started)
+}
+
+// ============= POST /api/fdo/keyrotations/{alias}/retire?filename={filename} =============
+// Retires the old key by uploading the PKCS12 keystore (application/octet-stream) that has the new key to the owner service,
+// and starts the jobs that import the extended vouchers. This is refused until the vouchers of all of the devices have been
+// extended. If the owner service doesn't then have the new owner certificate, the old keystore is put back. Returns 202 with the
+// rotation. Only the exchange root user can do this.
+func postFdoKeyRotationRetireHandler(alias string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("POST /api/fdo/keyrotations/{alias}/retire", "alias", alias)
+
+	user, ok := authenticateKeyRotation(alias, w, r)
+	if !ok {
+		return
+	}
+	fileName := r.URL.Query().Get("filename")
+	if !keystoreFileNameRegex.MatchString(fileName) {
+		http.Error(w, "the filename parameter must be the keystore file name, that ends in .p12 and only contains letters, numbers, '.', '_', and '-'", http.StatusBadRequest)
+		return
+	}
+
+	// Verify content type
+	if httpErr := outils.IsValidPostBinary(r); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	keystoreBytes, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxKeystoreBodyKB*1024))
+	if err != nil {
+		http.Error(w, "Error reading the request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if httpErr := validateKeystore(keystoreBytes); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	unlock := keyRotationLocks.lock(alias)
+	defer unlock()
+	rotation, httpErr := getKeyRotation(alias)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if rotation.Status != KeyRotationExtending {
+		http.Error(w, "the old "+alias+" key was already retired", http.StatusConflict)
+		return
+	} else if n := rotation.Counts[KeyRotationDevicePending]; n > 0 {
+		http.Error(w, "the vouchers of "+strconv.Itoa(n)+" devices are still being extended, wait for the jobs of the rotation to finish", http.StatusConflict)
+		return
+	} else if n := rotation.Counts[KeyRotationDeviceFailed]; n > 0 {
+		http.Error(w, "the vouchers of "+strconv.Itoa(n)+" devices could not be extended, retry them with POST /api/fdo/keyrotations/"+alias+"/extend", http.StatusConflict)
+		return
+	}
+	remaining := getKeyRotationRemaining(rotation)
+	if n := countDevices(remaining); n > 0 {
+		http.Error(w, strconv.Itoa(n)+" devices were imported after the rotation started, extend their vouchers with POST /api/fdo/keyrotations/"+alias+"/extend", http.StatusConflict)
+		return
+	}
+
+	// Keep the current keystore, so it can be put back if the new one doesn't have the new key
+	client, certificateUrl, httpErr := ownerCertificateApi()
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	oldKeystoreBytes, err := getFromOwnerService(r.Context(), client, certificateUrl+"?filename="+fileName)
+	if err != nil {
+		// Without the old keystore it couldn't be put back, so it must not be replaced. nil means the owner service doesn't have it.
+		http.Error(w, "could not get the current keystore "+fileName+" from the owner service: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	if _, httpErr := ownerServiceRequest(r.Context(), client, http.MethodPost, certificateUrl+"?filename="+fileName, keystoreBytes); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	certBytes, httpErr := getOwnerCertificate(r.Context(), alias)
+	if httpErr != nil || ownerCertificateSha256(certBytes) != rotation.NewCertSha256 {
+		restoreCtx := context.WithoutCancel(r.Context())
+		if oldKeystoreBytes != nil {
+			_, httpErr = ownerServiceRequest(restoreCtx, client, http.MethodPost, certificateUrl+"?filename="+fileName, oldKeystoreBytes)
+		} else {
+			_, httpErr = ownerServiceRequest(restoreCtx, client, http.MethodDelete, certificateUrl+"?filename="+fileName, nil)
+		}
+		if httpErr != nil {
+			outils.LogFor(r).Error("could not put the old keystore back in the owner service, manual cleanup may be needed", "filename", fileName, "error", httpErr.Error())
+		}
+		http.Error(w, "after uploading the keystore, the owner service does not have the new "+alias+" owner certificate, so the old keystore was put back", http.StatusConflict)
+		return
+	}
+	outils.LogFor(r).Info("old owner key retired", "alias", alias, "filename", fileName, "new_owner_sha256", rotation.NewCertSha256)
+	refreshOwnerCertificates(r.Context())
+
+	rotation.Status = KeyRotationRetired
+	rotation.Retired = time.Now().UTC().Format(time.RFC3339)
+	extended, _ := getKeyRotationUnimported(rotation)
+	started, httpErr := importKeyRotation(r.Context(), rotation, user, extended)
+	if httpErr != nil {
+		// The devices whose job could not be started stay extended, so the import route can start it
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	rotation, httpErr = getKeyRotation(alias)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	writeKeyRotationAccepted(w, rotation, started)
+}
+
+// ============= POST /api/fdo/keyrotations/{alias}/import =============
+// Retries the import of the extended vouchers that could not be imported after the old key was retired, or whose job was
+// canceled. Returns 202 with the rotation, or 200 if there are no vouchers left to import. Only the exchange root user can do
+// this.
+func postFdoKeyRotationImportHandler(alias string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("POST /api/fdo/keyrotations/{alias}/import", "alias", alias)
+
+	user, ok := authenticateKeyRotation(alias, w, r)
+	if !ok {
+		return
+	}
+
+	unlock := keyRotationLocks.lock(alias)
+	defer unlock()
+	rotation, httpErr := getKeyRotation(alias)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if rotation.Status == KeyRotationExtending {
+		http.Error(w, "the old "+alias+" key was not retired yet, retire it with POST /api/fdo/keyrotations/"+alias+"/retire", http.StatusConflict)
+		return
+	}
+	unimported, running := getKeyRotationUnimported(rotation)
+	if running > 0 {
+		http.Error(w, "the vouchers of "+strconv.Itoa(running)+" devices are still being imported, wait for the jobs of the rotation to finish", http.StatusConflict)
+		return
+	}
+	started, httpErr := importKeyRotation(r.Context(), rotation, user, unimported)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	rotation, httpErr = getKeyRotation(alias)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	writeKeyRotationAccepted(w, rotation, started)
+}
+
+// ============= DELETE /api/fdo/keyrotations/{alias} =============
+// Deletes the key rotation of this owner key type, with the vouchers that were extended for it. A rotation can't be deleted while
+// the vouchers are being extended (cancel its jobs first), or the extended vouchers are being imported. Only the exchange root
+// user can do this.
+func deleteFdoKeyRotationHandler(alias string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("DELETE /api/fdo/keyrotations/{alias}", "alias", alias)
+
+	if _, ok := authenticateKeyRotation(alias, w, r); !ok {
+		return
+	}
+
+	unlock := keyRotationLocks.lock(alias)
+	defer unlock()
+	rotation, httpErr := getKeyRotation(alias)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if rotation.Counts[KeyRotationDevicePending] > 0 {
+		http.Error(w, "the vouchers of some devices are still being extended, cancel the jobs of the rotation first", http.StatusConflict)
+		return
+	} else if rotation.Status == KeyRotationRetired {
+		http.Error(w, "the old "+alias+" key was retired, so the extended vouchers must be imported before the rotation can be deleted, retry the ones that failed with POST /api/fdo/keyrotations/"+alias+"/import", http.StatusConflict)
+		return
+	}
+	rotationDir := getKeyRotationDir(alias)
+	if err := os.RemoveAll(rotationDir); err != nil {
+		http.Error(w, "could not remove "+rotationDir+": "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	outils.LogFor(r).Info("key rotation deleted", "alias", alias, "status", rotation.Status)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func countDevices(devicesByOrg map[string][]string) int {
+	n := 0
+	for _, deviceUuids := range devicesByOrg {
+		n += len(deviceUuids)
+	}
+	return n
+}
@@ -2,19 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
 
-	dab "github.com/Snawoot/go-http-digest-auth-client"
+	"github.com/open-horizon/FDO-support/ocs-api/metrics"
+	"github.com/open-horizon/FDO-support/ocs-api/ocsdb"
 	"github.com/open-horizon/FDO-support/ocs-api/outils"
+	"github.com/open-horizon/FDO-support/ocs-api/tracing"
 )
 
 /*
@@ -27,6 +30,7 @@ var OrgFDOVersionRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/version$`)
 var OrgFDOVouchersRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/vouchers$`)        // used for both GET and POST
 var GetFDOVoucherRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/vouchers/([^/]+)$`) // backward compat
 var OrgFDOKeyRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/certificate/([^/]+)$`)  // used for GET , THIS NEEDS TO BE UPDATED IN ORDER TO RECOGNIZE KEY TYPE
+var OrgFDOKeysRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/certificates$`)        // used for GET
 var OrgFDORedirectRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/redirect$`)        // used for GET
 var GetFDOTo0Regex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/to0/([^/]+)$`)
 var OrgFDOResourceRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/resource/([^/]+)$`) //used for both GET and POST
@@ -34,31 +38,112 @@ var OrgFDOServiceInfoRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/svi$`)
 var ExchangeUrl string                                                                   // the external url, that the device needs
 var ExchangeInternalUrl string                                                           // will default to ExchangeUrl
 var ExchangeInternalCertPath string                                                      // will default to /home/sdouser/ocs-api-dir/keys/sdoapi.crt if not set by EXCHANGE_INTERNAL_CERT
-var ExchangeInternalRetries int                                                          // the number of times to retry connecting to the exchange during startup
-var ExchangeInternalInterval int                                                         // the number of seconds to wait before retrying again to connect to the exchange during startup
+var ExchangeInternalRetries int                                                          // the number of startup attempts before failures are logged as errors
+var ExchangeInternalInterval int                                                         // the number of seconds to wait before the 1st retry of the startup tasks
 var CssUrl string                                                                        // the external url, that the device needs
 var PkgsFrom string                                                                      // the argument to the agent-install.sh -i flag
 var CfgFileFrom string                                                                   // the argument to the agent-install.sh -k flag
 var KeyImportLock sync.RWMutex
 
+var OrgFDONodeTokenRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/vouchers/([^/]+)/nodetoken$`)              // used for GET
+var OrgFDONodeTokenRotateRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/vouchers/([^/]+)/nodetoken/rotate$`) // used for POST
+var OrgFDOVouchersBulkRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/vouchers/bulk$`)                        // used for POST
+var OrgFDOTo0Regex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/to0$`)                                           // used for POST
+var OrgFDOReconcileRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/reconcile$`)                               // used for POST
+var OrgFDOJobsRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/jobs$`)                                         // used for GET
+var OrgFDOJobRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/jobs/([^/]+)$`)                                  // used for GET
+var OrgFDOJobCancelRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/jobs/([^/]+)/cancel$`)                     // used for POST
+var OrgFDOVoucherMetadataRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/vouchers/([^/]+)/metadata$`)         // used for GET, PUT, and PATCH
+var OrgFDOVoucherTransferRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/vouchers/([^/]+)/transfer$`)         // used for POST
+var OrgFDOVoucherExportRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/vouchers/([^/]+)/export$`)             // used for POST
+var OrgFDOVouchersImportRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/vouchers/import$`)                    // used for POST
+var OrgFDOVoucherResellRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/vouchers/([^/]+)/resell$`)             // used for POST
+var OrgFDOVoucherLogsRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/vouchers/([^/]+)/logs$`)                 // used for GET
+var OrgFDOManufacturersRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/manufacturers$`)                       // used for GET
+var OrgFDOManufacturerRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/manufacturers/([^/]+)$`)                // used for GET, PUT, and DELETE
+var OrgFDOManufacturerPullRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/fdo/manufacturers/([^/]+)/pull$`)       // used for POST
+var FDORvAllowRegex = regexp.MustCompile(`^/api/fdo/rv/allow/([^/]+)$`)                                          // used for POST and DELETE
+var FDORvDenyRegex = regexp.MustCompile(`^/api/fdo/rv/deny/([^/]+)$`)                                            // used for POST
+var FDOKeystoreRegex = regexp.MustCompile(`^/api/fdo/certificates/keystores/([^/]+)$`)                           // used for POST
+var FDOKeyRotationRegex = regexp.MustCompile(`^/api/fdo/keyrotations/([^/]+)$`)                                  // used for GET, POST, and DELETE
+var FDOKeyRotationExtendRegex = regexp.MustCompile(`^/api/fdo/keyrotations/([^/]+)/extend$`)                     // used for POST
+var FDOKeyRotationRetireRegex = regexp.MustCompile(`^/api/fdo/keyrotations/([^/]+)/retire$`)                     // used for POST
+var FDOKeyRotationImportRegex = regexp.MustCompile(`^/api/fdo/keyrotations/([^/]+)/import$`)                     // used for POST
+
+// The route templates used as the route label in the request metrics, so the ids in the paths don't create unbounded label values
+var routeTemplates = []struct {
+	regex    *regexp.Regexp
+	template string
+}{
+	{OrgFDOVersionRegex, "/api/orgs/{org-id}/fdo/version"},
+	{OrgFDOVouchersRegex, "/api/orgs/{org-id}/fdo/vouchers"},
+	{OrgFDOVouchersBulkRegex, "/api/orgs/{org-id}/fdo/vouchers/bulk"},     // before the {device-id} route, which also matches it
+	{OrgFDOVouchersImportRegex, "/api/orgs/{org-id}/fdo/vouchers/import"}, // before the {device-id} route, which also matches it
+	{GetFDOVoucherRegex, "/api/orgs/{org-id}/fdo/vouchers/{device-id}"},
+	{OrgFDOKeyRegex, "/api/orgs/{org-id}/fdo/certificate/{alias}"},
+	{OrgFDOKeysRegex, "/api/orgs/{org-id}/fdo/certificates"},
+	{OrgFDORedirectRegex, "/api/orgs/{org-id}/fdo/redirect"},
+	{GetFDOTo0Regex, "/api/orgs/{org-id}/fdo/to0/{device-id}"},
+	{OrgFDOResourceRegex, "/api/orgs/{org-id}/fdo/resource/{resource-file}"},
+	{OrgFDOServiceInfoRegex, "/api/orgs/{org-id}/fdo/svi"},
+	{OrgFDONodeTokenRegex, "/api/orgs/{org-id}/fdo/vouchers/{device-id}/nodetoken"},
+	{OrgFDONodeTokenRotateRegex, "/api/orgs/{org-id}/fdo/vouchers/{device-id}/nodetoken/rotate"},
+	{OrgFDOTo0Regex, "/api/orgs/{org-id}/fdo/to0"},
+	{OrgFDOReconcileRegex, "/api/orgs/{org-id}/fdo/reconcile"},
+	{OrgFDOJobsRegex, "/api/orgs/{org-id}/fdo/jobs"},
+	{OrgFDOJobRegex, "/api/orgs/{org-id}/fdo/jobs/{job-id}"},
+	{OrgFDOJobCancelRegex, "/api/orgs/{org-id}/fdo/jobs/{job-id}/cancel"},
+	{OrgFDOVoucherMetadataRegex, "/api/orgs/{org-id}/fdo/vouchers/{device-id}/metadata"},
+	{OrgFDOVoucherTransferRegex, "/api/orgs/{org-id}/fdo/vouchers/{device-id}/transfer"},
+	{OrgFDOVoucherExportRegex, "/api/orgs/{org-id}/fdo/vouchers/{device-id}/export"},
+	{OrgFDOVoucherResellRegex, "/api/orgs/{org-id}/fdo/vouchers/{device-id}/resell"},
+	{OrgFDOVoucherLogsRegex, "/api/orgs/{org-id}/fdo/vouchers/{device-id}/logs"},
+	{OrgFDOManufacturersRegex, "/api/orgs/{org-id}/fdo/manufacturers"},
+	{OrgFDOManufacturerRegex, "/api/orgs/{org-id}/fdo/manufacturers/{name}"},
+	{OrgFDOManufacturerPullRegex, "/api/orgs/{org-id}/fdo/manufacturers/{name}/pull"},
+	{FDORvAllowRegex, "/api/fdo/rv/allow/{alias}"},
+	{FDORvDenyRegex, "/api/fdo/rv/deny/{alias}"},
+	{FDOKeystoreRegex, "/api/fdo/certificates/keystores/{filename}"},
+	{FDOKeyRotationRegex, "/api/fdo/keyrotations/{alias}"},
+	{FDOKeyRotationExtendRegex, "/api/fdo/keyrotations/{alias}/extend"},
+	{FDOKeyRotationRetireRegex, "/api/fdo/keyrotations/{alias}/retire"},
+	{FDOKeyRotationImportRegex, "/api/fdo/keyrotations/{alias}/import"},
+}
+
 func main() {
 	if len(os.Args) < 3 {
 		fmt.Println("Usage: ./ocs-api <port> <ocs-db-path>")
+		fmt.Println("       ./ocs-api reencrypt <ocs-db-path>")
 		os.Exit(1)
 	}
 
-	var fdoTo2URL string
-	var to2Body string
+	// Re-encrypt the sensitive values in the db with the active key, after a key rotation
+	if os.Args[1] == "reencrypt" {
+		outils.InitLogger()
+		OcsDbDir = filepath.Clean(os.Args[2])
+		if err := ocsdb.InitKeys(OcsDbDir); err != nil {
+			outils.Fatal(3, "initializing the OCS DB keys: %v", err)
+		}
+		count, err := ocsdb.ReEncrypt(OcsDbDir)
+		if err != nil {
+			outils.Fatal(3, "re-encrypting the OCS DB: %v", err)
+		}
+		fmt.Printf("Re-encrypted %d files in %s with key id %s\n", count, OcsDbDir, ocsdb.ActiveKeyId())
+		os.Exit(0)
+	}
 
 	// Process cmd line args and env vars
 	port := os.Args[1]
 	OcsDbDir = filepath.Clean(os.Args[2])
 	workingDir, err := os.Getwd()
 	if err != nil {
-		fmt.Println(err)
+		outils.Log.Error("could not get the working directory", "error", err)
+	}
+	outils.InitLogger()
+	if err := tracing.Init(context.Background(), OCS_API_VERSION); err != nil {
+		outils.Log.Error("could not initialize tracing, continuing without it", "error", err)
 	}
-	outils.SetVerbose()
-	ExchangeInternalRetries = outils.GetEnvVarIntWithDefault("EXCHANGE_INTERNAL_RETRIES", 12) // by default a total of 1 minute of trying
+	ExchangeInternalRetries = outils.GetEnvVarIntWithDefault("EXCHANGE_INTERNAL_RETRIES", 12)
 	ExchangeInternalInterval = outils.GetEnvVarIntWithDefault("EXCHANGE_INTERNAL_INTERVAL", 5)
 
 	// Ensure we can get to the db, and create the necessary subdirs, if necessary
@@ -72,151 +157,142 @@ func main() {
 		outils.Fatal(3, "could not create directory %s: %v", OcsDbDir+"/v1/creds/publicKeys", err)
 	}
 
-	// Create all of the common config files, if we have the necessary env vars to do so
-	if httpErr := createConfigFiles(); httpErr != nil {
-		outils.Fatal(3, "creating common config files: %s", httpErr.Error())
-
+	// Get the keys used to encrypt the sensitive values we store in the db
+	if err := ocsdb.InitKeys(OcsDbDir); err != nil {
+		outils.Fatal(3, "initializing the OCS DB keys: %v", err)
 	}
 
-	//http.HandleFunc("/", rootHandler)
-	http.HandleFunc("/api/", apiHandler)
-
-	// Set To2 Address on start up in FDO Owner Services
-	fdoTo2Host, fdoTo2Port := outils.GetTo2OwnerHost()
-	fmt.Println("Setting To2 Address as: " + fdoTo2Host + ":" + fdoTo2Port)
-	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
-	if fdoOwnerURL == "" {
-		log.Fatalln("HZN_FDO_API_URL is not set")
+	// Index the devices, so the device list doesn't have to read every device directory
+	if err := buildDeviceIndex(context.Background()); err != nil {
+		outils.Fatal(3, "building the device index: %v", err)
 	}
-	to2Body = (`[[null,"` + fdoTo2Host + `",` + fdoTo2Port + `,3]]`)
-	fdoTo2URL = fdoOwnerURL + "/api/v1/owner/redirect"
-	to2Byte := []byte(to2Body)
-	username, password := outils.GetOwnerServiceApiKey()
-	fmt.Println("This is the GET To2 Redirect API route: " + fdoTo2URL)
 
-	client := &http.Client{
-		Transport: dab.NewDigestTransport(username, password, http.DefaultTransport),
-	}
-	resp, err := client.Post(fdoTo2URL, "text/plain", bytes.NewReader(to2Byte))
-	if err != nil {
-		outils.NewHttpError(http.StatusInternalServerError, "Error setting To2 address: "+fdoTo2URL+": "+err.Error())
-		return
+	// Get the key that signs exported device bundles, and the keys of the instances whose bundles can be imported
+	if err := initBundleKeys(context.Background()); err != nil {
+		outils.Fatal(3, "initializing the device bundle keys: %v", err)
 	}
 
-	if resp.Body != nil {
-		defer resp.Body.Close()
+	// Get the RV servers whose allow and deny lists can be managed
+	if err := initRvServers(); err != nil {
+		outils.Fatal(1, "configuring the RV servers: %v", err)
 	}
 
-	// Create agent-install.crt
-	valuesDir := filepath.Join(OcsDbDir, "v1", "values")
-	fileName := filepath.Join(valuesDir, "agent-install.crt")
-	fmt.Println("Posting agent-install.crt package: " + fileName)
-	certFile, err := os.ReadFile(fileName)
-	if err != nil {
-		outils.NewHttpError(http.StatusInternalServerError, "Error reading "+fileName+": "+err.Error())
-		return
-	}
-	// Post agent-install.crt in FDO Owner Services
-	certResource := "agent-install.crt"
-	fdoCertURL := fdoOwnerURL + "/api/v1/owner/resource?filename=" + certResource
-	fmt.Println("URL for agent-install.crt: " + fdoCertURL)
+	// Create all of the common config files, if we have the necessary env vars to do so
+	if httpErr := createConfigFiles(); httpErr != nil {
+		outils.Fatal(3, "creating common config files: %s", httpErr.Error())
 
-	newResp, err := client.Post(fdoCertURL, "text/plain", bytes.NewReader(certFile))
-	if err != nil {
-		outils.NewHttpError(http.StatusInternalServerError, "Error posting "+certResource+" in SVI Database: "+err.Error())
-		return
-	}
-	if newResp.Body != nil {
-		defer newResp.Body.Close()
 	}
 
-	// Create agent-install.cfg
-	valuesDir = filepath.Join(OcsDbDir, "v1", "values")
-	fileName = filepath.Join(valuesDir, "agent-install.cfg")
-	fmt.Println("Posting agent-install.cfg package: " + fileName)
-	cfgFile, err := os.ReadFile(fileName)
-	if err != nil {
-		outils.NewHttpError(http.StatusInternalServerError, "Error reading "+fileName+": "+err.Error())
-		return
-	}
-	// Post agent-install.cfg in FDO Owner Services
-	configResource := "agent-install.cfg"
-	fdoCfgURL := fdoOwnerURL + "/api/v1/owner/resource?filename=" + configResource
-	fmt.Println("URL for agent-install.cfg: " + fdoCfgURL)
-	newResp, err = client.Post(fdoCfgURL, "text/plain", bytes.NewReader(cfgFile))
-	if err != nil {
-		outils.NewHttpError(http.StatusInternalServerError, "Error posting "+configResource+" in SVI Database: "+err.Error())
-		return
-	}
-	if newResp.Body != nil {
-		defer newResp.Body.Close()
-	}
+	//http.HandleFunc("/", rootHandler)
+	http.Handle("/api/", tracing.InstrumentHandler(routeTemplate, outils.WithRequestId(metrics.InstrumentHandler(routeTemplate, http.HandlerFunc(apiHandler)))))
+	http.HandleFunc("/healthz", getHealthzHandler)
+	http.HandleFunc("/readyz", getReadyzHandler)
 
-	// Create agent-install-wrapper
-	valuesDir = filepath.Join(OcsDbDir, "v1", "values")
-	fileName = valuesDir + "/agent-install-wrapper.sh"
-	fmt.Println("Setting SVI package: " + fileName)
-	wrapperFile, err := os.ReadFile(fileName)
-	if err != nil {
-		outils.NewHttpError(http.StatusInternalServerError, "Error reading "+fileName+": "+err.Error())
-		return
+	// Check the owner service settings now, because they are configuration errors that retrying won't fix
+	fdoTo2Host, fdoTo2Port := outils.GetTo2OwnerHost()
+	if _, err := newTo2Address(fdoTo2Host, fdoTo2Port); err != nil {
+		outils.Fatal(1, "%v", err)
 	}
-	// Post agent-install-wrapper in FDO Owner Services
-	wrapperResource := "agent-install-wrapper.sh"
-	fdoResourceURL := fdoOwnerURL + "/api/v1/owner/resource?filename=" + wrapperResource
-	fmt.Println("URL for agent-install-wrapper package: " + fdoResourceURL)
-
-	newResp, err = client.Post(fdoResourceURL, "text/plain", bytes.NewReader(wrapperFile))
-	if err != nil {
-		outils.NewHttpError(http.StatusInternalServerError, "Error posting "+wrapperResource+" in SVI Database: "+err.Error())
-		return
+	if err := checkOwnerSizeEnvVars(); err != nil {
+		outils.Fatal(1, "%v", err)
 	}
-	if newResp.Body != nil {
-		defer newResp.Body.Close()
+	if os.Getenv("HZN_FDO_API_URL") == "" {
+		outils.Fatal(1, "HZN_FDO_API_URL is not set")
 	}
+	outils.GetOwnerServiceApiKey()
 
 	// Get the cert to use when talking to the exchange for authentication, if set
 	if outils.IsEnvVarSet("EXCHANGE_INTERNAL_CERT") {
 		crtBytes, err := base64.StdEncoding.DecodeString(os.Getenv("EXCHANGE_INTERNAL_CERT"))
 		if err != nil {
-			outils.Verbose("Base64 decoding EXCHANGE_INTERNAL_CERT was unsuccessful (%s), using it as not encoded ...", err.Error())
+			outils.Log.Debug("base64 decoding EXCHANGE_INTERNAL_CERT was unsuccessful, using it as not encoded", "error", err)
 			// Note: supposedly we could instead use this regex to check for base64 encoding: ^([A-Za-z0-9+/]{4})*([A-Za-z0-9+/]{3}=|[A-Za-z0-9+/]{2}==)?$
 			crtBytes = []byte(os.Getenv("EXCHANGE_INTERNAL_CERT"))
 		}
 		ExchangeInternalCertPath = filepath.Clean(filepath.Join(workingDir, "agent-install.crt"))
-		outils.Verbose("Creating %s ...", ExchangeInternalCertPath)
+		outils.Log.Debug("creating file", "file", ExchangeInternalCertPath)
 		if err := os.WriteFile(ExchangeInternalCertPath, crtBytes, 0644); err != nil {
-			outils.Fatal(3, "could not create "+ExchangeInternalCertPath+": "+err.Error())
+			outils.Fatal(3, "could not create %s: %v", ExchangeInternalCertPath, err)
 		}
 	}
 
 	// Listen on the specified port and protocol
 	keysDir := outils.GetEnvVarWithDefault("SDO_API_CERT_PATH", "/ocs-api-dir/keys")
 	certBaseName := outils.GetEnvVarWithDefault("SDO_API_CERT_BASE_NAME", "sdoapi")
-	if outils.PathExists(keysDir+"/"+certBaseName+".crt") && outils.PathExists(keysDir+"/"+certBaseName+".key") {
+	certFile, keyFile := keysDir+"/"+certBaseName+".crt", keysDir+"/"+certBaseName+".key"
+	if outils.PathExists(certFile) && outils.PathExists(keyFile) {
+		ListenCertPath = certFile
 		if ExchangeInternalCertPath == "" {
-			ExchangeInternalCertPath = keysDir + "/" + certBaseName + ".crt" // if it wasn't set, default it to the same cert we are using for listening on our port
-			fmt.Printf("Environment variable EXCHANGE_INTERNAL_CERT is not set, defaulting to the certificate in %s\n", ExchangeInternalCertPath)
+			ExchangeInternalCertPath = certFile // if it wasn't set, default it to the same cert we are using for listening on our port
+			outils.Log.Info("environment variable EXCHANGE_INTERNAL_CERT is not set, defaulting to the listening certificate", "file", ExchangeInternalCertPath)
 		}
-		outils.VerifyExchangeConnection(ExchangeInternalUrl, ExchangeInternalCertPath, ExchangeInternalRetries, ExchangeInternalInterval)
-		fmt.Printf("Listening on HTTPS port %s and using ocs db %s\n", port, OcsDbDir)
-		log.Fatal(http.ListenAndServeTLS(":"+port, keysDir+"/"+certBaseName+".crt", keysDir+"/"+certBaseName+".key", nil))
+		serve(port, certFile, keyFile, fdoTo2Host, fdoTo2Port)
 	} else {
-		outils.VerifyExchangeConnection(ExchangeInternalUrl, ExchangeInternalCertPath, ExchangeInternalRetries, ExchangeInternalInterval)
-		fmt.Printf("Listening on HTTP port %s and using ocs db %s\n", port, OcsDbDir)
-		log.Fatal(http.ListenAndServe(":"+port, nil))
+		serve(port, "", "", fdoTo2Host, fdoTo2Port)
 	}
 } // end of main
 
 // API route dispatcher
 func apiHandler(w http.ResponseWriter, r *http.Request) {
-	outils.Verbose("Handling %s ...", r.URL.Path)
+	if !IsReady() && strings.HasPrefix(r.URL.Path, "/api/orgs/") {
+		// the owner service isn't set up yet, so vouchers imported now wouldn't work
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "ocs-api is starting up and not ready yet", http.StatusServiceUnavailable)
+		return
+	}
+
 	if r.Method == "GET" && r.URL.Path == "/api/version" {
 		getVersionHandler(w, r)
 	} else if r.Method == "GET" && r.URL.Path == "/api/fdo/version" {
 		getFdoVersionHandler(w, r)
+	} else if r.Method == "GET" && r.URL.Path == "/api/fdo/bootstrap" {
+		getFdoBootstrapHandler(w, r)
+	} else if r.Method == "GET" && r.URL.Path == "/api/fdo/instance-key" {
+		getFdoInstanceKeyHandler(w, r)
+	} else if r.Method == "GET" && r.URL.Path == "/api/fdo/rv" {
+		getFdoRvHandler(w, r)
+	} else if matches := FDORvAllowRegex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 2 { // POST /api/fdo/rv/allow/{alias}
+		postFdoRvKeyHandler(rvAllow, matches[1], w, r)
+	} else if matches := FDORvAllowRegex.FindStringSubmatch(r.URL.Path); r.Method == "DELETE" && len(matches) >= 2 { // DELETE /api/fdo/rv/allow/{alias}
+		postFdoRvKeyHandler(rvRemove, matches[1], w, r)
+	} else if matches := FDORvDenyRegex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 2 { // POST /api/fdo/rv/deny/{alias}
+		postFdoRvKeyHandler(rvDeny, matches[1], w, r)
+	} else if r.Method == "GET" && r.URL.Path == "/api/fdo/certificates" {
+		getFdoCertificatesHandler(w, r)
+	} else if r.Method == "GET" && r.URL.Path == "/api/fdo/certificates/validity" {
+		getFdoCertificateValidityHandler(w, r)
+	} else if r.Method == "PUT" && r.URL.Path == "/api/fdo/certificates/validity" {
+		putFdoCertificateValidityHandler(w, r)
+	} else if matches := FDOKeystoreRegex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 2 { // POST /api/fdo/certificates/keystores/{filename}
+		postFdoKeystoreHandler(matches[1], w, r)
+	} else if r.Method == "GET" && r.URL.Path == "/api/fdo/messagesize" {
+		getFdoOwnerSizeHandler(ownerMessageSize, w, r)
+	} else if r.Method == "PUT" && r.URL.Path == "/api/fdo/messagesize" {
+		putFdoOwnerSizeHandler(ownerMessageSize, w, r)
+	} else if r.Method == "GET" && r.URL.Path == "/api/fdo/svisize" {
+		getFdoOwnerSizeHandler(ownerSviSize, w, r)
+	} else if r.Method == "PUT" && r.URL.Path == "/api/fdo/svisize" {
+		putFdoOwnerSizeHandler(ownerSviSize, w, r)
+	} else if r.Method == "GET" && r.URL.Path == "/api/fdo/logs" {
+		getFdoLogsHandler(w, r)
+	} else if r.Method == "GET" && r.URL.Path == "/api/fdo/keyrotations" {
+		getFdoKeyRotationsHandler(w, r)
+	} else if matches := FDOKeyRotationRegex.FindStringSubmatch(r.URL.Path); r.Method == "GET" && len(matches) >= 2 { // GET /api/fdo/keyrotations/{alias}
+		getFdoKeyRotationHandler(matches[1], w, r)
+	} else if matches := FDOKeyRotationRegex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 2 { // POST /api/fdo/keyrotations/{alias}
+		postFdoKeyRotationHandler(matches[1], w, r)
+	} else if matches := FDOKeyRotationRegex.FindStringSubmatch(r.URL.Path); r.Method == "DELETE" && len(matches) >= 2 { // DELETE /api/fdo/keyrotations/{alias}
+		deleteFdoKeyRotationHandler(matches[1], w, r)
+	} else if matches := FDOKeyRotationExtendRegex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 2 { // POST /api/fdo/keyrotations/{alias}/extend
+		postFdoKeyRotationExtendHandler(matches[1], w, r)
+	} else if matches := FDOKeyRotationRetireRegex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 2 { // POST /api/fdo/keyrotations/{alias}/retire
+		postFdoKeyRotationRetireHandler(matches[1], w, r)
+	} else if matches := FDOKeyRotationImportRegex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 2 { // POST /api/fdo/keyrotations/{alias}/import
+		postFdoKeyRotationImportHandler(matches[1], w, r)
 	} else if matches := OrgFDOKeyRegex.FindStringSubmatch(r.URL.Path); r.Method == "GET" && len(matches) >= 2 { // GET /api/orgs/{ord-id}/fdo/certificate?alias=SECP256R1
 		getFdoPublicKeyHandler(matches[1], matches[2], w, r)
+	} else if matches := OrgFDOKeysRegex.FindStringSubmatch(r.URL.Path); r.Method == "GET" && len(matches) >= 2 { // GET /api/orgs/{ord-id}/fdo/certificates
+		getFdoOwnerCertificatesHandler(matches[1], w, r)
 	} else if matches := OrgFDOVouchersRegex.FindStringSubmatch(r.URL.Path); r.Method == "GET" && len(matches) >= 2 { // GET /api/orgs/{ord-id}/fdo/vouchers
 		getFdoVouchersHandler(matches[1], w, r)
 	} else if matches := GetFDOVoucherRegex.FindStringSubmatch(r.URL.Path); r.Method == "GET" && len(matches) >= 3 { // GET /api/orgs/{ord-id}/fdo/vouchers/{deviceUuid}
@@ -235,6 +311,46 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 		getFdoResourceHandler(matches[1], matches[2], w, r)
 	} else if matches := OrgFDOServiceInfoRegex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 2 { // POST /api/orgs/{ord-id}/fdo/redirect
 		postFdoSVIHandler(matches[1], w, r)
+	} else if matches := OrgFDONodeTokenRegex.FindStringSubmatch(r.URL.Path); r.Method == "GET" && len(matches) >= 3 { // GET /api/orgs/{ord-id}/fdo/vouchers/{deviceUuid}/nodetoken
+		getFdoNodeTokenHandler(matches[1], matches[2], w, r)
+	} else if matches := OrgFDONodeTokenRotateRegex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 3 { // POST /api/orgs/{ord-id}/fdo/vouchers/{deviceUuid}/nodetoken/rotate
+		postFdoNodeTokenRotateHandler(matches[1], matches[2], w, r)
+	} else if matches := OrgFDOVouchersBulkRegex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 2 { // POST /api/orgs/{ord-id}/fdo/vouchers/bulk
+		postFdoVouchersBulkHandler(matches[1], w, r)
+	} else if matches := OrgFDOTo0Regex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 2 { // POST /api/orgs/{ord-id}/fdo/to0
+		postFdoTo0Handler(matches[1], w, r)
+	} else if matches := OrgFDOReconcileRegex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 2 { // POST /api/orgs/{ord-id}/fdo/reconcile
+		postFdoReconcileHandler(matches[1], w, r)
+	} else if matches := OrgFDOJobsRegex.FindStringSubmatch(r.URL.Path); r.Method == "GET" && len(matches) >= 2 { // GET /api/orgs/{ord-id}/fdo/jobs
+		getFdoJobsHandler(matches[1], w, r)
+	} else if matches := OrgFDOJobRegex.FindStringSubmatch(r.URL.Path); r.Method == "GET" && len(matches) >= 3 { // GET /api/orgs/{ord-id}/fdo/jobs/{jobId}
+		getFdoJobHandler(matches[1], matches[2], w, r)
+	} else if matches := OrgFDOJobCancelRegex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 3 { // POST /api/orgs/{ord-id}/fdo/jobs/{jobId}/cancel
+		postFdoJobCancelHandler(matches[1], matches[2], w, r)
+	} else if matches := OrgFDOVoucherMetadataRegex.FindStringSubmatch(r.URL.Path); r.Method == "GET" && len(matches) >= 3 { // GET /api/orgs/{ord-id}/fdo/vouchers/{deviceUuid}/metadata
+		getFdoVoucherMetadataHandler(matches[1], matches[2], w, r)
+	} else if matches := OrgFDOVoucherMetadataRegex.FindStringSubmatch(r.URL.Path); (r.Method == "PUT" || r.Method == "PATCH") && len(matches) >= 3 { // PUT or PATCH /api/orgs/{ord-id}/fdo/vouchers/{deviceUuid}/metadata
+		putFdoVoucherMetadataHandler(matches[1], matches[2], w, r)
+	} else if matches := OrgFDOVoucherTransferRegex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 3 { // POST /api/orgs/{ord-id}/fdo/vouchers/{deviceUuid}/transfer
+		postFdoVoucherTransferHandler(matches[1], matches[2], w, r)
+	} else if matches := OrgFDOVoucherExportRegex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 3 { // POST /api/orgs/{ord-id}/fdo/vouchers/{deviceUuid}/export
+		postFdoVoucherExportHandler(matches[1], matches[2], w, r)
+	} else if matches := OrgFDOVouchersImportRegex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 2 { // POST /api/orgs/{ord-id}/fdo/vouchers/import
+		postFdoVouchersImportHandler(matches[1], w, r)
+	} else if matches := OrgFDOVoucherResellRegex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 3 { // POST /api/orgs/{ord-id}/fdo/vouchers/{deviceUuid}/resell
+		postFdoVoucherResellHandler(matches[1], matches[2], w, r)
+	} else if matches := OrgFDOVoucherLogsRegex.FindStringSubmatch(r.URL.Path); r.Method == "GET" && len(matches) >= 3 { // GET /api/orgs/{ord-id}/fdo/vouchers/{deviceUuid}/logs
+		getFdoVoucherLogsHandler(matches[1], matches[2], w, r)
+	} else if matches := OrgFDOManufacturersRegex.FindStringSubmatch(r.URL.Path); r.Method == "GET" && len(matches) >= 2 { // GET /api/orgs/{ord-id}/fdo/manufacturers
+		getFdoManufacturersHandler(matches[1], w, r)
+	} else if matches := OrgFDOManufacturerRegex.FindStringSubmatch(r.URL.Path); r.Method == "GET" && len(matches) >= 3 { // GET /api/orgs/{ord-id}/fdo/manufacturers/{name}
+		getFdoManufacturerHandler(matches[1], matches[2], w, r)
+	} else if matches := OrgFDOManufacturerRegex.FindStringSubmatch(r.URL.Path); r.Method == "PUT" && len(matches) >= 3 { // PUT /api/orgs/{ord-id}/fdo/manufacturers/{name}
+		putFdoManufacturerHandler(matches[1], matches[2], w, r)
+	} else if matches := OrgFDOManufacturerRegex.FindStringSubmatch(r.URL.Path); r.Method == "DELETE" && len(matches) >= 3 { // DELETE /api/orgs/{ord-id}/fdo/manufacturers/{name}
+		deleteFdoManufacturerHandler(matches[1], matches[2], w, r)
+	} else if matches := OrgFDOManufacturerPullRegex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 3 { // POST /api/orgs/{ord-id}/fdo/manufacturers/{name}/pull
+		postFdoManufacturerPullHandler(matches[1], matches[2], w, r)
 	} else {
 		http.Error(w, "Route "+r.URL.Path+" not found", http.StatusNotFound)
 	}
@@ -242,37 +358,52 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 	//		the container, but penetration testing deemed it a security exposure, because you can cause this service to do arbitrary DNS lookups.
 }
 
+// Returns the route template of this request, for the request metrics
+func routeTemplate(r *http.Request) string {
+	if r.URL.Path == "/api/version" || r.URL.Path == "/api/fdo/version" || r.URL.Path == "/api/fdo/bootstrap" || r.URL.Path == "/api/fdo/instance-key" || r.URL.Path == "/api/fdo/rv" || r.URL.Path == "/api/fdo/certificates" || r.URL.Path == "/api/fdo/certificates/validity" || r.URL.Path == "/api/fdo/keyrotations" || r.URL.Path == "/api/fdo/logs" || r.URL.Path == "/api/fdo/messagesize" || r.URL.Path == "/api/fdo/svisize" {
+		return r.URL.Path
+	}
+	for _, rt := range routeTemplates {
+		if rt.regex.MatchString(r.URL.Path) {
+			return rt.template
+		}
+	}
+	return "unmatched"
+}
+
 // Route Handlers --------------------------------------------------------------------------------------------------
 
 // ============= GET /api/version =============
 // Returns the ocs-api version (in plain text, not json)
 func getVersionHandler(w http.ResponseWriter, _ *http.Request) {
-	outils.Verbose("GET /api/version ...")
+	outils.Log.Debug("GET /api/version")
 
 	// Send voucher to client
 	w.WriteHeader(http.StatusOK) // seems like this has to be before writing the body
 	w.Header().Set("Content-Type", "text/plain")
 	_, err := w.Write([]byte(OCS_API_VERSION))
 	if err != nil {
-		outils.Error(err.Error())
+		outils.Log.Error("could not write response", "error", err)
 	}
 }
 
 // ============= GET /api/fdo/version =============
 // Returns the fdo Owner Service version (in plain text, not json)
-func getFdoVersionHandler(w http.ResponseWriter, _ *http.Request) {
-	outils.Verbose("GET /api/fdo/version ...")
+func getFdoVersionHandler(w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("GET /api/fdo/version")
 
 	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
 	if fdoOwnerURL == "" {
-		log.Fatalln("HZN_FDO_API_URL is not set")
+		http.Error(w, "HZN_FDO_API_URL is not set", http.StatusInternalServerError)
+		return
 	}
 
-	resp, err := http.Get(fdoOwnerURL + "/health")
+	resp, err := outils.HttpGet(r.Context(), http.DefaultClient, fdoOwnerURL+"/health")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		http.Error(w, "Error reading the response body: "+err.Error(), http.StatusBadRequest)
@@ -285,13 +416,11 @@ func getFdoVersionHandler(w http.ResponseWriter, _ *http.Request) {
 }
 
 // ============= GET /api/orgs/{ord-id}/fdo/certificate/<alias> =============
-// Reads/returns owner service public keys based off device alias
+// Reads/returns owner service public keys based off device alias. The certificate is returned as PEM, DER, a JWK, or json with its
+// SHA-256 fingerprint and key details, as negotiated with the Accept header or chosen with ?format=pem|der|jwk|json.
 func getFdoPublicKeyHandler(orgId string, publicKeyType string, w http.ResponseWriter, r *http.Request) {
-	outils.Verbose("GET /api/orgs/%s/fdo/certificate/%s ...", orgId)
+	outils.LogFor(r).Debug("GET /api/orgs/{org-id}/fdo/certificate/{alias}", "org", orgId, "alias", publicKeyType)
 
-	var respBodyBytes []byte
-	//var requestBodyBytes []byte
-	var fdoPublicKeyURL string
 	// Determine the org id to use for the device, based on various inputs
 	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
 	if httpErr != nil {
@@ -308,53 +437,36 @@ func getFdoPublicKeyHandler(orgId string, publicKeyType string, w http.ResponseW
 	}
 
 	//Only 5 public key alias types allowed
-	if (publicKeyType) != "SECP256R1" && (publicKeyType) != "SECP384R1" && (publicKeyType) != "RSAPKCS3072" && (publicKeyType) != "RSAPKCS2048" && (publicKeyType) != "RSA2048RESTR" {
+	if !slices.Contains(ownerKeyTypes, publicKeyType) {
 		http.Error(w, "Public key type must be one of these supported alias': SECP256R1, SECP384R1, RSAPKCS3072, RSAPKCS2048, RSA2048RESTR", http.StatusBadRequest)
 		return
 	}
 
-	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
-	if fdoOwnerURL == "" {
-		log.Fatalln("HZN_FDO_API_URL is not set")
-	}
-	fdoPublicKeyURL = fdoOwnerURL + "/api/v1/certificate?alias=" + publicKeyType
-	username, password := outils.GetOwnerServiceApiKey()
-
-	client := &http.Client{
-		Transport: dab.NewDigestTransport(username, password, http.DefaultTransport),
-	}
-	resp, err := client.Get(fdoPublicKeyURL)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	format, mediaType, httpErr := negotiateCertFormat(r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
 	}
 
-	if resp.Body != nil {
-		defer resp.Body.Close()
+	certBytes, httpErr := getOwnerCertificate(r.Context(), publicKeyType)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
 	}
-
-	respBodyBytes, err = io.ReadAll(resp.Body)
-	if err != nil {
-		http.Error(w, "Error reading the response body: "+err.Error(), http.StatusBadRequest)
+	ownerCert := describeOwnerCertificate(publicKeyType, certBytes)
+	if ownerCert.Error != "" {
+		http.Error(w, ownerCert.Error+" for "+publicKeyType, http.StatusBadGateway)
 		return
 	}
-	sb := string(respBodyBytes)
-	log.Print(sb)
-
-	w.WriteHeader(http.StatusOK) // seems like this has to be before writing the body
-	w.Header().Set("Content-Type", "text/plain")
-	outils.WriteResponse(http.StatusOK, w, respBodyBytes)
+	outils.LogFor(r).Debug("returning the owner certificate", "alias", publicKeyType, "format", format, "sha256", ownerCert.Sha256)
+	writeOwnerCertificate(w, ownerCert, format, mediaType)
 }
 
 // IMPORT VOUCHER
 // ============= POST /api/orgs/{ord-id}/fdo/vouchers and POST /api/fdo/vouchers =============
 // Imports a voucher
 func postFdoVoucherHandler(orgId string, w http.ResponseWriter, r *http.Request) {
-	outils.Verbose("POST /api/orgs/%s/fdo/vouchers ... ...", orgId)
-
-	var respBodyBytes []byte
-	var bodyBytes []byte
-	var fdoVoucherURL string
+	outils.LogFor(r).Debug("POST /api/orgs/{org-id}/fdo/vouchers", "org", orgId)
 
 	// Determine the org id to use for the device, based on various inputs
 	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
@@ -364,7 +476,8 @@ func postFdoVoucherHandler(orgId string, w http.ResponseWriter, r *http.Request)
 	}
 
 	// Authenticate this user with the exchange
-	if authenticated, _, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath); httpErr != nil {
+	authenticated, user, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath)
+	if httpErr != nil {
 		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
 	} else if !authenticated {
@@ -372,6 +485,10 @@ func postFdoVoucherHandler(orgId string, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Count the outcome of this import, now that we know the org is real
+	importResult := metrics.ResultFailure
+	defer func() { metrics.VoucherImports.WithLabelValues(deviceOrgId, importResult).Inc() }()
+
 	// Verify content type
 	if httpErr := outils.IsValidPostPlainTxt(r); httpErr != nil {
 		//http.Error(w, "Error: This API only accepts plain text", http.StatusBadRequest)
@@ -385,159 +502,72 @@ func postFdoVoucherHandler(orgId string, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
-	if fdoOwnerURL == "" {
-		log.Fatalln("HZN_FDO_API_URL is not set")
-	}
-	fdoVoucherURL = fdoOwnerURL + "/api/v1/owner/vouchers"
-	username, password := outils.GetOwnerServiceApiKey()
-
-	//Digest auth request to import voucher
-	client := &http.Client{
-		Transport: dab.NewDigestTransport(username, password, http.DefaultTransport),
-	}
-
-	resp, err := client.Post(fdoVoucherURL, "text/plain", bytes.NewReader(bodyBytes))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	if resp.Body != nil {
-		defer resp.Body.Close()
-	}
+	// ?replace=true re-imports a device that was already imported in this org, with a new node token
+	replace := r.URL.Query().Get("replace") == "true"
 
-	respBodyBytes, err = io.ReadAll(resp.Body)
-	if err != nil {
-		http.Error(w, "Error reading the response body: "+err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	//string device UUID
-	deviceUuid := string(respBodyBytes)
-	outils.Verbose("POST /api/orgs/%s/fdo/vouchers: device UUID: %s", deviceOrgId, deviceUuid)
-
-	// Create the device directory in the OCS DB
-	deviceDir := filepath.Clean(filepath.Join(OcsDbDir, "v1", "devices", deviceUuid))
-	if err := os.MkdirAll(deviceDir, 0750); err != nil {
-		http.Error(w, "could not create directory "+deviceDir+": "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Put the voucher in the OCS DB
-	fileName := filepath.Join(deviceDir, "ownership_voucher.txt")
-	outils.Verbose("POST /api/orgs/%s/fdo/vouchers: creating %s ...", deviceOrgId, fileName)
-	if err := os.WriteFile(fileName, bodyBytes, 0644); err != nil {
-		http.Error(w, "could not create "+fileName+": "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Create orgid.txt file to identify what org this device/voucher is part of
-	fileName = filepath.Join(deviceDir, "orgid.txt")
-	outils.Verbose("POST /api/orgs/%s/vouchers: creating %s with value: %s ...", deviceOrgId, fileName, deviceOrgId)
-	if err := os.WriteFile(fileName, []byte(deviceOrgId), 0644); err != nil {
-		http.Error(w, "could not create "+fileName+": "+err.Error(), http.StatusInternalServerError)
-		return
+	// If the client sent an Idempotency-Key, a retry of the same request gets the response of the first one
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	requestHash := hashImportRequest(bodyBytes, replace)
+	if idempotencyKey != "" {
+		unlock := lockIdempotencyKey(deviceOrgId, idempotencyKey)
+		defer unlock()
+		record, httpErr := getIdempotencyRecord(deviceOrgId, idempotencyKey)
+		if httpErr != nil {
+			http.Error(w, httpErr.Error(), httpErr.Code)
+			return
+		}
+		if record != nil {
+			if record.RequestHash != requestHash {
+				http.Error(w, "the Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+				return
+			}
+			if httpErr := verifyIdempotencyRecordDevice(record, deviceOrgId); httpErr != nil {
+				http.Error(w, httpErr.Error(), httpErr.Code)
+				return
+			}
+			nodeToken, httpErr := getNodeTokenTxtStr(record.DeviceUuid)
+			if httpErr != nil {
+				http.Error(w, httpErr.Error(), httpErr.Code)
+				return
+			}
+			outils.LogFor(r).Info("replaying voucher import response for Idempotency-Key", "org", deviceOrgId, "device", record.DeviceUuid)
+			importResult = metrics.ResultSuccess
+			w.Header().Set("Idempotent-Replayed", "true")
+			outils.WriteJsonResponse(http.StatusOK, w, map[string]interface{}{"deviceUuid": record.DeviceUuid, "nodeToken": nodeToken})
+			return
+		}
 	}
 
-	// Generate a node token
-	nodeToken, httpErr := outils.GenerateNodeToken()
+	// Import the voucher into the owner service and set up the device's onboarding files. If any step fails, it is all undone.
+	// If the device was already imported with this voucher, the existing device is returned.
+	deviceUuid, nodeToken, existing, httpErr := importVoucher(r.Context(), deviceOrgId, user, bodyBytes, replace)
 	if httpErr != nil {
 		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
 	}
-
-	// Create exec file
-	// Note: currently agent-install-wrapper.sh requires that the flags be in this order!!!!
-	execCmd := fmt.Sprintf("/bin/sh agent-install-wrapper.sh -i %s -a %s:%s -O %s -k %s", PkgsFrom, deviceUuid, nodeToken, deviceOrgId, CfgFileFrom)
-	fileName = filepath.Clean(filepath.Join(OcsDbDir, "v1", "values", deviceUuid+"_exec"))
-	outils.Verbose("POST /api/orgs/%s/vouchers: creating %s ...", deviceOrgId, fileName)
-	if err := os.WriteFile(fileName, []byte(execCmd), 0644); err != nil {
-		http.Error(w, "could not create "+fileName+": "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Post device specified exec file in FDO Owner Services
-	valuesDir := filepath.Join(OcsDbDir, "v1", "values")
-	fileName = filepath.Join(valuesDir, deviceUuid+"_exec")
-	fmt.Println("Device Specific Wrapper: " + fileName)
-	wrapperFile, err := os.ReadFile(fileName)
-	if err != nil {
-		http.Error(w, "Error reading "+fileName+": "+err.Error(), http.StatusNotFound)
-		return
-	}
-	// Create agent-install-wrapper
-	wrapperResource := deviceUuid + "_exec"
-	fdoResourceURL := fdoOwnerURL + "/api/v1/owner/resource?filename=" + wrapperResource
-	fmt.Println("URL for device specific exec file: " + fdoResourceURL)
-
-	newResp, err := client.Post(fdoResourceURL, "text/plain", bytes.NewReader(wrapperFile))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	if newResp.Body != nil {
-		defer resp.Body.Close()
+	if existing {
+		outils.LogFor(r).Info("voucher was already imported, returning the existing device", "org", deviceOrgId, "device", deviceUuid)
 	}
-
-	// Set SVI and agent-install-wrapper.sh arguments in FDO Owner Services
-	// post specified exec file
-
-	sviBody := (`[{"filedesc" : "agent-install.crt","resource" : "agent-install.crt"},
-            {"filedesc" : "agent-install.cfg","resource" : "agent-install.cfg"},
-            {"filedesc" : "agent-install-wrapper.sh","resource" : "agent-install-wrapper.sh"},
-            {"filedesc" : "setup.sh","resource" : "$(guid)_exec"},
-            {"exec" : ["bash","setup.sh"] }]`)
-
-	fmt.Println("SVI request body: " + sviBody)
-	sviByte := []byte(sviBody)
-
-	fdoSVIURL := fdoOwnerURL + "/api/v1/owner/svi"
-
-	client = &http.Client{
-		Transport: dab.NewDigestTransport(username, password, http.DefaultTransport),
-	}
-
-	postResponse, err := client.Post(fdoSVIURL, "text/plain", bytes.NewReader(sviByte))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	if postResponse.Body != nil {
-		defer resp.Body.Close()
-	}
-
-	respBodyBytes, err = io.ReadAll(postResponse.Body)
-	if err != nil {
-		http.Error(w, "Error reading the response body: "+err.Error(), http.StatusInternalServerError)
-		return
+	if idempotencyKey != "" {
+		if httpErr := saveIdempotencyRecord(r.Context(), deviceOrgId, idempotencyKey, requestHash, deviceUuid); httpErr != nil {
+			outils.LogFor(r).Warn("could not save the Idempotency-Key record", "org", deviceOrgId, "device", deviceUuid, "error", httpErr.Error())
+		}
 	}
 
-	lk := string(respBodyBytes)
-	log.Print(lk)
-
 	// Send response to client
 	respBody := map[string]interface{}{
 		"deviceUuid": deviceUuid,
 		"nodeToken":  nodeToken,
 	}
-
-	w.WriteHeader(http.StatusOK) // seems like this has to be before writing the body
-	w.Header().Set("Content-Type", "text/plain")
+	importResult = metrics.ResultSuccess
 	outils.WriteJsonResponse(http.StatusOK, w, respBody)
-
 }
 
 // ============= GET /api/orgs/{ord-id}/fdo/vouchers =============
-// Reads/returns all of the already imported vouchers
+// Reads/returns all of the already imported vouchers, or their details with ?detail=true
 func getFdoVouchersHandler(orgId string, w http.ResponseWriter, r *http.Request) {
-	outils.Verbose("GET /api/orgs/%s/fdo/vouchers ...", orgId)
+	outils.LogFor(r).Debug("GET /api/orgs/{org-id}/fdo/vouchers", "org", orgId)
 
-	//var respBodyBytes []byte
-	//var requestBodyBytes []byte
-	var fdoVoucherURL string
 	// Determine the org id to use for the device, based on various inputs
 	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
 	if httpErr != nil {
@@ -553,74 +583,41 @@ func getFdoVouchersHandler(orgId string, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
-	if fdoOwnerURL == "" {
-		log.Fatalln("HZN_FDO_API_URL is not set")
-	}
-	fdoVoucherURL = fdoOwnerURL + "/api/v1/owner/vouchers"
-
-	username, password := outils.GetOwnerServiceApiKey()
-
-	client := &http.Client{
-		Transport: dab.NewDigestTransport(username, password, http.DefaultTransport),
-	}
-	resp, err := client.Get(fdoVoucherURL)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	// Get the devices of this org from the index, filtered, sorted, and paged as requested
+	query, httpErr := parseVoucherListQuery(r.URL.Query())
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
 	}
-	if resp.Body != nil {
-		defer resp.Body.Close()
+	devices, nextCursor := listIndexedDevices(deviceOrgId, query)
+	if nextCursor != "" {
+		params := r.URL.Query()
+		params.Set("cursor", nextCursor)
+		w.Header().Set("X-Next-Cursor", nextCursor)
+		w.Header().Set("Link", "<"+r.URL.Path+"?"+params.Encode()+`>; rel="next"`)
 	}
 
-	//     	respBodyBytes, err = ioutil.ReadAll(resp.Body)
-	//     	if err != nil {
-	//     		log.Fatalln(err)
-	//     	}
-
-	// Read the v1/devices/ directory in the db for multitenancy
-	vouchersDirName := filepath.Join(OcsDbDir, "v1", "devices")
-	deviceDirs, err := os.ReadDir(vouchersDirName)
-	if err != nil {
-		http.Error(w, "Error reading "+vouchersDirName+" directory: "+err.Error(), http.StatusInternalServerError)
+	// ?detail=true returns the details of each device, instead of just the uuids
+	if r.URL.Query().Get("detail") == "true" {
+		details := []VoucherDetail{}
+		for _, device := range devices {
+			details = append(details, device.detail())
+		}
+		outils.WriteJsonResponse(http.StatusOK, w, details)
 		return
 	}
-
 	vouchers := []string{}
-	for _, dir := range deviceDirs {
-		if dir.IsDir() {
-			// Look inside the device dir for orgid.txt to see if is part of the org we are listing
-			orgidTxtStr, httpErr := getOrgidTxtStr(dir.Name())
-			if httpErr != nil {
-				http.Error(w, httpErr.Error(), httpErr.Code)
-				return
-			}
-			if orgidTxtStr == deviceOrgId { // this device is in our org
-				vouchers = append(vouchers, dir.Name())
-			}
-		}
+	for _, device := range devices {
+		vouchers = append(vouchers, device.Uuid)
 	}
-
-	//Verify that each value in vouchers is also in respBodyBytes - THIS IS NOT WORKING RIGHT
-
-	//         dbQuery := bytes.NewBuffer(respBodyBytes).String()
-	//         vouchersString := strings.Join(vouchers,"\n")
-	//         fmt.Println("FDO Db Query: " + dbQuery)
-	//         fmt.Println("Index Query: " + vouchersString)
-	//         result := vouchersString == dbQuery
-	//         fmt.Println(result)
-
-	w.WriteHeader(http.StatusOK) // seems like this has to be before writing the body
-	w.Header().Set("Content-Type", "text/plain")
 	outils.WriteJsonResponse(http.StatusOK, w, vouchers)
-
 }
 
 // GET A SPECIFIED VOUCHER
 // ============= GET /api/orgs/{ord-id}/fdo/vouchers/{deviceUuid} =============
 // Reads/returns a specific imported voucher
 func getFdoVoucherHandler(orgId string, deviceUuid string, w http.ResponseWriter, r *http.Request) {
-	outils.Verbose("GET /api/orgs/%s/fdo/vouchers/%s ...", orgId)
+	outils.LogFor(r).Debug("GET /api/orgs/{org-id}/fdo/vouchers/{device-id}", "org", orgId, "device", deviceUuid)
 
 	var respBodyBytes []byte
 	//var requestBodyBytes []byte
@@ -642,7 +639,7 @@ func getFdoVoucherHandler(orgId string, deviceUuid string, w http.ResponseWriter
 
 	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
 	if fdoOwnerURL == "" {
-		log.Fatalln("HZN_FDO_API_URL is not set")
+		outils.Fatal(1, "HZN_FDO_API_URL is not set")
 	}
 	fdoVoucherURL = fdoOwnerURL + "/api/v1/owner/vouchers/" + deviceUuid
 
@@ -650,7 +647,7 @@ func getFdoVoucherHandler(orgId string, deviceUuid string, w http.ResponseWriter
 	//if not, then return error
 	// Read voucher.json from the db
 	voucherFileName := filepath.Clean(filepath.Join(OcsDbDir, "v1", "devices", deviceUuid, "ownership_voucher.txt"))
-	voucherBytes, err := os.ReadFile(voucherFileName)
+	voucherBytes, err := ocsdb.ReadFile(voucherFileName)
 	if err != nil {
 		http.Error(w, "Error reading "+voucherFileName+": "+err.Error(), http.StatusNotFound)
 		return
@@ -659,10 +656,8 @@ func getFdoVoucherHandler(orgId string, deviceUuid string, w http.ResponseWriter
 	//Getting voucher from FDO DB
 	username, password := outils.GetOwnerServiceApiKey()
 
-	client := &http.Client{
-		Transport: dab.NewDigestTransport(username, password, http.DefaultTransport),
-	}
-	resp, err := client.Get(fdoVoucherURL)
+	client := outils.NewOwnerServiceClient(username, password)
+	resp, err := outils.HttpGet(r.Context(), client, fdoVoucherURL)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -676,8 +671,7 @@ func getFdoVoucherHandler(orgId string, deviceUuid string, w http.ResponseWriter
 		http.Error(w, "Error reading the response body: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	lk := string(respBodyBytes)
-	log.Print(lk)
+	outils.LogFor(r).Debug("owner service response", "status", resp.StatusCode, "bytes", len(respBodyBytes))
 
 	// Confirm this voucher/device is in the client's org. Doing this check after getting the voucher, because if the
 	// voucher doesn't exist, we want them get that error, rather than that it is not in their org
@@ -705,13 +699,10 @@ func getFdoVoucherHandler(orgId string, deviceUuid string, w http.ResponseWriter
 }
 
 // ============= POST /api/orgs/{ord-id}/fdo/redirect =============
-// Configure the Owner Services TO2 address
+// Configure the Owner Services TO2 addresses. The body is the json list of addresses, or (for compatibility) RVTO2Addr in
+// diagnostic form as text/plain. Either way it is validated and sent to the owner service in diagnostic form.
 func postFdoRedirectHandler(orgId string, w http.ResponseWriter, r *http.Request) {
-	outils.Verbose("POST /api/orgs/%s/fdo/redirect ... ...", orgId)
-
-	var respBodyBytes []byte
-	var bodyBytes []byte
-	var fdoTo2URL string
+	outils.LogFor(r).Debug("POST /api/orgs/{org-id}/fdo/redirect", "org", orgId)
 
 	// Determine the org id to use for the device, based on various inputs
 	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
@@ -730,63 +721,57 @@ func postFdoRedirectHandler(orgId string, w http.ResponseWriter, r *http.Request
 	}
 
 	// Verify content type
-	if httpErr := outils.IsValidPostPlainTxt(r); httpErr != nil {
-		//http.Error(w, "Error: This API only accepts plain text", http.StatusBadRequest)
-		http.Error(w, httpErr.Error(), httpErr.Code)
+	jsonBody := outils.IsValidPostJson(r) == nil
+	if !jsonBody && outils.IsValidPostPlainTxt(r) != nil {
+		http.Error(w, "Error: content-type must be application/json or text/plain", http.StatusBadRequest)
 		return
 	}
 
-	bodyBytes, err := io.ReadAll(r.Body) // we need the request body so get it as bytes
+	bodyBytes, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxTo2BodyKB*1024)) // we need the request body so get it as bytes
 	if err != nil {
 		http.Error(w, "Error reading the request body: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	st := string(bodyBytes)
-	log.Print(st)
-
-	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
-	if fdoOwnerURL == "" {
-		log.Fatalln("HZN_FDO_API_URL is not set")
-	}
-	fdoTo2URL = fdoOwnerURL + "/api/v1/owner/redirect"
-	username, password := outils.GetOwnerServiceApiKey()
+	outils.LogFor(r).Debug("request body received", "bytes", len(bodyBytes))
 
-	client := &http.Client{
-		Transport: dab.NewDigestTransport(username, password, http.DefaultTransport),
+	var addresses []To2Address
+	if jsonBody {
+		if httpErr := outils.ParseJsonString(bodyBytes, &addresses); httpErr != nil {
+			http.Error(w, httpErr.Error(), httpErr.Code)
+			return
+		}
+	} else if addresses, err = decodeTo2Addresses(string(bodyBytes)); err != nil {
+		http.Error(w, "invalid RVTO2Addr: "+err.Error(), http.StatusBadRequest)
+		return
 	}
-
-	resp, err := client.Post(fdoTo2URL, "text/plain", bytes.NewReader(bodyBytes))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if httpErr := validateTo2Addresses(addresses); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
 	}
 
-	if resp.Body != nil {
-		defer resp.Body.Close()
+	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
+	if fdoOwnerURL == "" {
+		outils.Fatal(1, "HZN_FDO_API_URL is not set")
 	}
+	username, password := outils.GetOwnerServiceApiKey()
 
-	respBodyBytes, err = io.ReadAll(resp.Body)
-	if err != nil {
-		http.Error(w, "Error reading the response body: "+err.Error(), http.StatusInternalServerError)
+	client := outils.NewOwnerServiceClient(username, password)
+
+	rvTo2Addr := encodeTo2Addresses(addresses)
+	if _, httpErr := ownerServiceRequest(r.Context(), client, http.MethodPost, fdoOwnerURL+"/api/v1/owner/redirect", []byte(rvTo2Addr)); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
 	}
+	outils.LogFor(r).Info("TO2 addresses updated", "org", deviceOrgId, "rvto2addr", rvTo2Addr)
 
-	sb := string(respBodyBytes)
-	log.Print(sb)
-
-	w.WriteHeader(http.StatusOK) // seems like this has to be before writing the body
-	w.Header().Set("Content-Type", "text/plain")
-	outils.WriteResponse(http.StatusOK, w, respBodyBytes)
+	outils.WriteJsonResponse(http.StatusOK, w, addresses)
 }
 
 // ============= GET /api/orgs/{ord-id}/fdo/redirect =============
-// Get the Owner Services TO2 address
+// Get the Owner Services TO2 addresses as json, or as RVTO2Addr in diagnostic form if the Accept header is text/plain
 func getFdoRedirectHandler(orgId string, w http.ResponseWriter, r *http.Request) {
-	outils.Verbose("GET /api/orgs/%s/fdo/redirect ... ...", orgId)
-
-	var respBodyBytes []byte
-	var fdoTo2URL string
+	outils.LogFor(r).Debug("GET /api/orgs/{org-id}/fdo/redirect", "org", orgId)
 
 	// Determine the org id to use for the device, based on various inputs
 	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
@@ -806,47 +791,39 @@ func getFdoRedirectHandler(orgId string, w http.ResponseWriter, r *http.Request)
 
 	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
 	if fdoOwnerURL == "" {
-		log.Fatalln("HZN_FDO_API_URL is not set")
+		outils.Fatal(1, "HZN_FDO_API_URL is not set")
 	}
-	fdoTo2URL = fdoOwnerURL + "/api/v1/owner/redirect"
 	username, password := outils.GetOwnerServiceApiKey()
 
-	client := &http.Client{
-		Transport: dab.NewDigestTransport(username, password, http.DefaultTransport),
-	}
+	client := outils.NewOwnerServiceClient(username, password)
 
-	resp, err := client.Get(fdoTo2URL)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	respBodyBytes, httpErr := ownerServiceRequest(r.Context(), client, http.MethodGet, fdoOwnerURL+"/api/v1/owner/redirect", nil)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
 	}
 
-	if resp.Body != nil {
-		defer resp.Body.Close()
-	}
-
-	respBodyBytes, err = io.ReadAll(resp.Body)
-	if err != nil {
-		http.Error(w, "Error reading the response body: "+err.Error(), http.StatusInternalServerError)
+	if strings.HasPrefix(r.Header.Get("Accept"), "text/plain") {
+		w.Header().Set("Content-Type", "text/plain")
+		outils.WriteResponse(http.StatusOK, w, respBodyBytes)
 		return
 	}
-
-	sb := string(respBodyBytes)
-	log.Print(sb)
-
-	w.WriteHeader(http.StatusOK) // seems like this has to be before writing the body
-	w.Header().Set("Content-Type", "text/plain")
-	outils.WriteResponse(http.StatusOK, w, respBodyBytes)
+	addresses := []To2Address{}
+	if len(bytes.TrimSpace(respBodyBytes)) > 0 {
+		var err error
+		if addresses, err = decodeTo2Addresses(string(respBodyBytes)); err != nil {
+			http.Error(w, "the owner service returned an invalid RVTO2Addr: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	outils.WriteJsonResponse(http.StatusOK, w, addresses)
 }
 
 // ============= GET /api/orgs/{ord-id}/fdo/to0/{deviceUuid} =============
 // Initiates TO0 from Owner service
 func getFdoTo0Handler(orgId string, deviceUuid string, w http.ResponseWriter, r *http.Request) {
-	outils.Verbose("GET /api/orgs/%s/fdo/to0/%s ...", orgId)
+	outils.LogFor(r).Debug("GET /api/orgs/{org-id}/fdo/to0/{device-id}", "org", orgId, "device", deviceUuid)
 
-	var respBodyBytes []byte
-	//var requestBodyBytes []byte
-	var fdoTo0URL string
 	// Determine the org id to use for the device, based on various inputs
 	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
 	if httpErr != nil {
@@ -862,42 +839,64 @@ func getFdoTo0Handler(orgId string, deviceUuid string, w http.ResponseWriter, r
 		return
 	}
 
+	respBodyBytes, _, httpErr := initiateTo0(r.Context(), deviceUuid)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK) // seems like this has to be before writing the body
+	w.Header().Set("Content-Type", "text/plain")
+	outils.WriteResponse(http.StatusOK, w, respBodyBytes)
+}
+
+// Ask the owner service to register this device with the rendezvous server, and record the new state of the device if it
+// succeeded. Returns the owner service response body and status code.
+func initiateTo0(ctx context.Context, deviceUuid string) ([]byte, int, *outils.HttpError) {
 	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
 	if fdoOwnerURL == "" {
-		log.Fatalln("HZN_FDO_API_URL is not set")
+		outils.Fatal(1, "HZN_FDO_API_URL is not set")
 	}
-	fdoTo0URL = fdoOwnerURL + "/api/v1/to0/" + deviceUuid
-	username, password := outils.GetOwnerServiceApiKey()
-	client := &http.Client{
-		Transport: dab.NewDigestTransport(username, password, http.DefaultTransport),
+	if state, httpErr := getDeviceState(deviceUuid); httpErr != nil {
+		return nil, 0, httpErr
+	} else if state.State == DeviceStateTransferred {
+		return nil, 0, outils.NewHttpError(http.StatusConflict, "the voucher of device %s was extended to another owner, so this owner can not register it", deviceUuid)
 	}
-	resp, err := client.Get(fdoTo0URL)
+	fdoTo0URL := fdoOwnerURL + "/api/v1/to0/" + deviceUuid
+	username, password := outils.GetOwnerServiceApiKey()
+	client := outils.NewOwnerServiceClient(username, password)
+	resp, err := outils.HttpGet(ctx, client, fdoTo0URL)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		metrics.To0Requests.WithLabelValues(metrics.ResultFailure).Inc()
+		return nil, 0, outils.NewHttpError(http.StatusBadRequest, "%v", err)
 	}
 	if resp.Body != nil {
 		defer resp.Body.Close()
 	}
 
-	respBodyBytes, err = io.ReadAll(resp.Body)
+	respBodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		http.Error(w, "Error reading the response body: "+err.Error(), http.StatusInternalServerError)
-		return
+		metrics.To0Requests.WithLabelValues(metrics.ResultFailure).Inc()
+		return nil, 0, outils.NewHttpError(http.StatusInternalServerError, "Error reading the response body: %v", err)
 	}
-	sb := string(respBodyBytes)
-	log.Print(sb)
+	outils.LogCtx(ctx).Debug("owner service response", "status", resp.StatusCode, "bytes", len(respBodyBytes))
 
-	w.WriteHeader(http.StatusOK) // seems like this has to be before writing the body
-	w.Header().Set("Content-Type", "text/plain")
-	outils.WriteResponse(http.StatusOK, w, respBodyBytes)
+	if resp.StatusCode == http.StatusOK {
+		metrics.To0Requests.WithLabelValues(metrics.ResultSuccess).Inc()
+		if httpErr := setDeviceState(ctx, deviceUuid, DeviceStateTo0Registered, "", ""); httpErr != nil {
+			outils.LogCtx(ctx).Warn("could not set device state", "device", deviceUuid, "error", httpErr.Error())
+		}
+	} else {
+		metrics.To0Requests.WithLabelValues(metrics.ResultFailure).Inc()
+	}
+	return respBodyBytes, resp.StatusCode, nil
 }
 
 // IMPORT RESOURCE FILE (agent-install-wrapper.sh) TO OWNER DB FOR SERVICE INFO PACKAGE
 // ============= POST /api/orgs/{ord-id}/fdo/resource/{resourceFile} =============
 // Imports a resource file to the DB in order to use for service info package
 func postFdoResourceHandler(orgId string, resourceFile string, w http.ResponseWriter, r *http.Request) {
-	outils.Verbose("POST /api/orgs/%s/fdo/resource/%s ... ...", orgId)
+	outils.LogFor(r).Debug("POST /api/orgs/{org-id}/fdo/resource/{resource-file}", "org", orgId, "file", resourceFile)
 
 	var respBodyBytes []byte
 	var bodyBytes []byte
@@ -931,22 +930,19 @@ func postFdoResourceHandler(orgId string, resourceFile string, w http.ResponseWr
 		return
 	}
 
-	st := string(bodyBytes)
-	log.Print(st)
+	outils.LogFor(r).Debug("request body received", "bytes", len(bodyBytes))
 
 	//resourceFile in URL must = file name in request body
 
 	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
 	if fdoOwnerURL == "" {
-		log.Fatalln("HZN_FDO_API_URL is not set")
+		outils.Fatal(1, "HZN_FDO_API_URL is not set")
 	}
 	fdoResourceURL = fdoOwnerURL + "/api/v1/owner/resource?filename=" + resourceFile
 	username, password := outils.GetOwnerServiceApiKey()
-	client := &http.Client{
-		Transport: dab.NewDigestTransport(username, password, http.DefaultTransport),
-	}
+	client := outils.NewOwnerServiceClient(username, password)
 
-	resp, err := client.Post(fdoResourceURL, "text/plain", bytes.NewReader(bodyBytes))
+	resp, err := outils.HttpPost(r.Context(), client, fdoResourceURL, "text/plain", bytes.NewReader(bodyBytes))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -962,8 +958,7 @@ func postFdoResourceHandler(orgId string, resourceFile string, w http.ResponseWr
 		return
 	}
 
-	sb := string(respBodyBytes)
-	log.Print(sb)
+	outils.LogFor(r).Debug("owner service response", "status", resp.StatusCode, "bytes", len(respBodyBytes))
 
 	w.WriteHeader(http.StatusOK) // seems like this has to be before writing the body
 	w.Header().Set("Content-Type", "text/plain")
@@ -973,7 +968,7 @@ func postFdoResourceHandler(orgId string, resourceFile string, w http.ResponseWr
 // ============= GET /api/orgs/{ord-id}/fdo/resource/{resourceFile} =============
 // Gets a resource file that was imported to the DB in order to use for service info package
 func getFdoResourceHandler(orgId string, resourceFile string, w http.ResponseWriter, r *http.Request) {
-	outils.Verbose("GET /api/orgs/%s/fdo/resource/%s ... ...", orgId)
+	outils.LogFor(r).Debug("GET /api/orgs/{org-id}/fdo/resource/{resource-file}", "org", orgId, "file", resourceFile)
 
 	var respBodyBytes []byte
 	var bodyBytes []byte
@@ -1008,21 +1003,18 @@ func getFdoResourceHandler(orgId string, resourceFile string, w http.ResponseWri
 		return
 	}
 
-	st := string(bodyBytes)
-	log.Print(st)
+	outils.LogFor(r).Debug("request body received", "bytes", len(bodyBytes))
 
 	//resourceFile in URL must = file name in request body
 
 	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
 	if fdoOwnerURL == "" {
-		log.Fatalln("HZN_FDO_API_URL is not set")
+		outils.Fatal(1, "HZN_FDO_API_URL is not set")
 	}
 	fdoResourceURL = fdoOwnerURL + "/api/v1/owner/resource?filename=" + resourceFile
 	username, password := outils.GetOwnerServiceApiKey()
-	client := &http.Client{
-		Transport: dab.NewDigestTransport(username, password, http.DefaultTransport),
-	}
-	resp, err := client.Get(fdoResourceURL)
+	client := outils.NewOwnerServiceClient(username, password)
+	resp, err := outils.HttpGet(r.Context(), client, fdoResourceURL)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -1037,8 +1029,7 @@ func getFdoResourceHandler(orgId string, resourceFile string, w http.ResponseWri
 		return
 	}
 
-	sb := string(respBodyBytes)
-	log.Print(sb)
+	outils.LogFor(r).Debug("owner service response", "status", resp.StatusCode, "bytes", len(respBodyBytes))
 
 	w.WriteHeader(http.StatusOK) // seems like this has to be before writing the body
 	w.Header().Set("Content-Type", "text/plain")
@@ -1048,7 +1039,7 @@ func getFdoResourceHandler(orgId string, resourceFile string, w http.ResponseWri
 // ============= POST /api/orgs/{ord-id}/fdo/svi =============
 // Uploads SVI instructions to SYSTEM_PACKAGE table in owner db.
 func postFdoSVIHandler(orgId string, w http.ResponseWriter, r *http.Request) {
-	outils.Verbose("POST /api/orgs/%s/fdo/svi ... ...", orgId)
+	outils.LogFor(r).Debug("POST /api/orgs/{org-id}/fdo/svi", "org", orgId)
 
 	var respBodyBytes []byte
 	var bodyBytes []byte
@@ -1085,15 +1076,13 @@ func postFdoSVIHandler(orgId string, w http.ResponseWriter, r *http.Request) {
 
 	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
 	if fdoOwnerURL == "" {
-		log.Fatalln("HZN_FDO_API_URL is not set")
+		outils.Fatal(1, "HZN_FDO_API_URL is not set")
 	}
 	fdoSVIURL = fdoOwnerURL + "/api/v1/owner/svi"
 	username, password := outils.GetOwnerServiceApiKey()
-	client := &http.Client{
-		Transport: dab.NewDigestTransport(username, password, http.DefaultTransport),
-	}
+	client := outils.NewOwnerServiceClient(username, password)
 
-	resp, err := client.Post(fdoSVIURL, "text/plain", bytes.NewReader(bodyBytes))
+	resp, err := outils.HttpPost(r.Context(), client, fdoSVIURL, "text/plain", bytes.NewReader(bodyBytes))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -1109,8 +1098,7 @@ func postFdoSVIHandler(orgId string, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sb := string(respBodyBytes)
-	log.Print(sb)
+	outils.LogFor(r).Debug("owner service response", "status", resp.StatusCode, "bytes", len(respBodyBytes))
 
 	w.WriteHeader(http.StatusOK) // seems like this has to be before writing the body
 	w.Header().Set("Content-Type", "text/plain")
@@ -1164,7 +1152,7 @@ func getOrgidTxtStr(deviceId string) (string, *outils.HttpError) {
 		var orgidTxtBytes []byte
 		var err error
 		if orgidTxtBytes, err = os.ReadFile(orgidTxtFileName); err != nil {
-			return "", outils.NewHttpError(http.StatusInternalServerError, "Error reading "+orgidTxtFileName+": "+err.Error())
+			return "", outils.NewHttpError(http.StatusInternalServerError, "Error reading %s: %v", orgidTxtFileName, err)
 		} else {
 			orgidTxtStr = string(orgidTxtBytes)
 			orgidTxtStr = strings.TrimSuffix(orgidTxtStr, "\n")
@@ -1173,21 +1161,19 @@ func getOrgidTxtStr(deviceId string) (string, *outils.HttpError) {
 	return orgidTxtStr, nil
 }
 
-// Return the org of this device based on the orgid.txt file stored with it, or return ""
+// Return the node token of this device based on the (encrypted) nodeToken.txt file stored with it, or return ""
 func getNodeTokenTxtStr(deviceId string) (string, *outils.HttpError) {
-	// Look inside the device dir for orgid.txt to what org it belongs to
+	// Look inside the device dir for nodeToken.txt
 	vouchersDirName := filepath.Join(OcsDbDir, "v1", "devices")
 	nodeTokenTxtFileName := filepath.Clean(vouchersDirName + "/" + deviceId + "/nodeToken.txt")
 	nodeTokenTxtStr := "" // default if we don't find it in the nodeToken.txt
 	if outils.PathExists(nodeTokenTxtFileName) {
 		var nodeTokenTxtBytes []byte
 		var err error
-		if nodeTokenTxtBytes, err = os.ReadFile(nodeTokenTxtFileName); err != nil {
-			return "", outils.NewHttpError(http.StatusInternalServerError, "Error reading "+nodeTokenTxtFileName+": "+err.Error())
-		} else {
-			nodeTokenTxtStr = string(nodeTokenTxtBytes)
-			nodeTokenTxtStr = strings.TrimSuffix(nodeTokenTxtStr, "\n")
+		if nodeTokenTxtBytes, err = ocsdb.ReadFile(nodeTokenTxtFileName); err != nil {
+			return "", outils.NewHttpError(http.StatusInternalServerError, "Error reading %s: %v", nodeTokenTxtFileName, err)
 		}
+		nodeTokenTxtStr = strings.TrimSuffix(string(nodeTokenTxtBytes), "\n")
 	}
 	return nodeTokenTxtStr, nil
 }
@@ -1208,7 +1194,7 @@ func createConfigFiles() *outils.HttpError {
 		var err error
 		crt, err = base64.StdEncoding.DecodeString(os.Getenv("HZN_MGMT_HUB_CERT"))
 		if err != nil {
-			outils.Verbose("Base64 decoding HZN_MGMT_HUB_CERT was unsuccessful (%s), using it as not encoded ...", err.Error())
+			outils.Log.Debug("base64 decoding HZN_MGMT_HUB_CERT was unsuccessful, using it as not encoded", "error", err)
 			// Note: supposedly we could instead use this regex to check for base64 encoding: ^([A-Za-z0-9+/]{4})*([A-Za-z0-9+/]{3}=|[A-Za-z0-9+/]{2}==)?$
 			crt = []byte(os.Getenv("HZN_MGMT_HUB_CERT"))
 			//return outils.NewHttpError(http.StatusBadRequest, "could not base64 decode HZN_MGMT_HUB_CERT: "+err.Error())
@@ -1216,16 +1202,16 @@ func createConfigFiles() *outils.HttpError {
 	}
 	if len(crt) > 0 {
 		fileName = filepath.Clean(filepath.Join(valuesDir, "agent-install.crt"))
-		outils.Verbose("Creating %s ...", fileName)
+		outils.Log.Debug("creating file", "file", fileName)
 		if err := os.WriteFile(fileName, crt, 0644); err != nil {
-			return outils.NewHttpError(http.StatusInternalServerError, "could not create "+fileName+": "+err.Error())
+			return outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
 		}
 
 		fileName = filepath.Clean(filepath.Join(valuesDir, "agent-install-crt_name"))
-		outils.Verbose("Creating %s ...", fileName)
+		outils.Log.Debug("creating file", "file", fileName)
 		dataStr = "agent-install.crt"
 		if err := os.WriteFile(fileName, []byte(dataStr), 0644); err != nil {
-			return outils.NewHttpError(http.StatusInternalServerError, "could not create "+fileName+": "+err.Error())
+			return outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
 		}
 	}
 
@@ -1239,47 +1225,47 @@ func createConfigFiles() *outils.HttpError {
 	}
 	CssUrl = os.Getenv("HZN_FSS_CSSURL")
 	fileName = filepath.Join(valuesDir, "agent-install.cfg")
-	outils.Verbose("Creating %s ...", fileName)
+	outils.Log.Debug("creating file", "file", fileName)
 	dataStr = "HZN_EXCHANGE_URL=" + ExchangeUrl + "\nHZN_FSS_CSSURL=" + CssUrl + "\n" // we now explicitly set the org via the agent-install.sh -O flag
 	if len(crt) > 0 {
 		// only add this if we actually created the agent-install.crt file above
 		dataStr += "HZN_MGMT_HUB_CERT_PATH=agent-install.crt\n"
 	}
 	if err := os.WriteFile(fileName, []byte(dataStr), 0644); err != nil {
-		return outils.NewHttpError(http.StatusInternalServerError, "could not create "+fileName+": "+err.Error())
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
 	}
-	fmt.Printf("Will be configuring devices to use config:\n%s\n", dataStr)
+	outils.Log.Info("will be configuring devices to use config", "exchange_url", ExchangeUrl, "css_url", CssUrl, "mgmt_hub_cert_set", len(crt) > 0)
 
 	fileName = filepath.Clean(filepath.Join(valuesDir, "agent-install-cfg_name"))
-	outils.Verbose("Creating %s ...", fileName)
+	outils.Log.Debug("creating file", "file", fileName)
 	dataStr = "agent-install.cfg"
 	if err := os.WriteFile(fileName, []byte(dataStr), 0644); err != nil {
-		return outils.NewHttpError(http.StatusInternalServerError, "could not create "+fileName+": "+err.Error())
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
 	}
 
 	// Create agent-install-wrapper.sh and its name file
 	fileName = filepath.Clean(filepath.Join(valuesDir, "agent-install-wrapper.sh"))
-	outils.Verbose("Copying ./agent-install-wrapper.sh to %s ...", fileName)
+	outils.Log.Debug("copying ./agent-install-wrapper.sh", "file", fileName)
 	if err := outils.CopyFile("./scripts/agent-install-wrapper.sh", fileName, 0750); err != nil {
-		return outils.NewHttpError(http.StatusInternalServerError, "could not copy ./agent-install-wrapper.sh to "+fileName+": "+err.Error())
+		return outils.NewHttpError(http.StatusInternalServerError, "could not copy ./agent-install-wrapper.sh to %s: %v", fileName, err)
 	}
 
 	fileName = filepath.Clean(filepath.Join(valuesDir, "agent-install-wrapper-sh_name"))
-	outils.Verbose("Creating %s ...", fileName)
+	outils.Log.Debug("creating file", "file", fileName)
 	dataStr = "agent-install-wrapper.sh"
 	if err := os.WriteFile(fileName, []byte(dataStr), 0644); err != nil {
 
-		return outils.NewHttpError(http.StatusInternalServerError, "could not create "+fileName+": "+err.Error())
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
 	}
 
 	PkgsFrom = os.Getenv("FDO_GET_PKGS_FROM")
 	if PkgsFrom == "" {
 		PkgsFrom = "https://github.com/open-horizon/anax/releases/latest/download" // default
 	}
-	fmt.Printf("Will be configuring devices to get horizon packages from %s\n", PkgsFrom)
+	outils.Log.Info("will be configuring devices to get horizon packages", "from", PkgsFrom)
 	// try to ensure they didn't give us a bad value for SDO_GET_PKGS_FROM
 	if !strings.HasPrefix(PkgsFrom, "https://github.com/open-horizon/anax/releases") && !strings.HasPrefix(PkgsFrom, "css:") {
-		outils.Warning("Unrecognized value specified for FDO_GET_PKGS_FROM: %s", PkgsFrom)
+		outils.Log.Warn("unrecognized value specified for FDO_GET_PKGS_FROM", "value", PkgsFrom)
 		// continue, because maybe this is a value for the agent-install.sh -i flag that we don't know about yet
 	}
 
@@ -1287,10 +1273,10 @@ func createConfigFiles() *outils.HttpError {
 	if CfgFileFrom == "" {
 		CfgFileFrom = "css:" // default
 	}
-	fmt.Printf("Will be configuring devices to get agent-install.cfg from %s\n", CfgFileFrom)
+	outils.Log.Info("will be configuring devices to get agent-install.cfg", "from", CfgFileFrom)
 	// try to ensure they didn't give us a bad value for FDO_GET_CFG_FILE_FROM
 	if !strings.HasPrefix(CfgFileFrom, "agent-install.cfg") && !strings.HasPrefix(CfgFileFrom, "css:") {
-		outils.Warning("Unrecognized value specified for FDO_GET_CFG_FILE_FROM: %s", CfgFileFrom)
+		outils.Log.Warn("unrecognized value specified for FDO_GET_CFG_FILE_FROM", "value", CfgFileFrom)
 		// continue, because maybe this is a value for the agent-install.sh -i flag that we don't know about yet
 	}
 
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/open-horizon/FDO-support/ocs-api/metrics"
+	"github.com/open-horizon/FDO-support/ocs-api/ocsdb"
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+)
+
+/*
+Pulling vouchers directly from FDO manufacturer services, instead of copying them off of the devices by hand. The exchange root
+user registers the manufacturer services of each org (url and digest credentials), which are stored in
+v1/manufacturers/<org>/<name>/manufacturer.json. A pull lists the devices that completed DI since the watermark of the
+manufacturer (GET /api/v1/deviceinfo/{seconds}), and then a job gets the voucher of each new device extended to our owner
+certificate (POST /api/v1/mfg/vouchers/{serial}) and imports it.
+*/
+
+const (
+	MaxManufacturersPerOrg       = 100
+	MaxManufacturerBodyKB        = 64
+	DefaultManufacturerLookbackS = 7 * 24 * 60 * 60 // how far back the first pull from a manufacturer looks
+	manufacturerPullOverlapS     = 60               // each pull overlaps the previous one a little, in case the clocks differ
+)
+
+// The owner key types (aliases) of the owner service, that vouchers can be extended to
+var ownerKeyTypes = []string{"SECP256R1", "SECP384R1", "RSAPKCS3072", "RSAPKCS2048", "RSA2048RESTR"}
+
+// Manufacturer names are used as directory names
+var manufacturerNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]{0,63}$`)
+
+type Manufacturer struct {
+	Name      string `json:"name"`
+	Url       string `json:"url"` // the base url of the manufacturer service, e.g. http://mfg.example.com:8039
+	Username  string `json:"username"`
+	Password  string `json:"password,omitempty"` // never returned by the api
+	KeyType   string `json:"keyType"`            // the owner key type the vouchers are extended to
+	Watermark string `json:"watermark,omitempty"`
+	Updated   string `json:"updated"`
+}
+
+// A device that completed DI in the manufacturer service
+type ManufacturedDevice struct {
+	SerialNumber string `json:"serialNumber"`
+	Uuid         string `json:"uuid,omitempty"`
+	Timestamp    string `json:"timestamp,omitempty"`
+}
+
+// The input of each item of a manufacturer pull job
+type manufacturerPullItem struct {
+	Manufacturer string `json:"manufacturer"`
+	SerialNumber string `json:"serialNumber"`
+}
+
+// Serializes the changes to each manufacturer (keyed by org and name), so concurrent pulls don't both move the watermark
+var manufacturerLocks = newKeyedMutex()
+
+func getManufacturersDir(orgId string) string {
+	return filepath.Clean(filepath.Join(OcsDbDir, "v1", "manufacturers", orgId))
+}
+
+func getManufacturerFileName(orgId, name string) string {
+	return filepath.Join(getManufacturersDir(orgId), name, "manufacturer.json")
+}
+
+// Returns a copy of the manufacturer without the password, for the api responses
+func (m *Manufacturer) redacted() *Manufacturer {
+	c := *m
+	c.Password = ""
+	return &c
+}
+
+// Read the manufacturer with this name, or return a 404 error if it is not registered in this org
+func getManufacturer(orgId, name string) (*Manufacturer, *outils.HttpError) {
+	if !manufacturerNameRegex.MatchString(name) {
+		return nil, outils.NewHttpError(http.StatusNotFound, "manufacturer %s not found in org %s", name, orgId)
+	}
+	fileName := getManufacturerFileName(orgId, name)
+	if !outils.PathExists(fileName) {
+		return nil, outils.NewHttpError(http.StatusNotFound, "manufacturer %s not found in org %s", name, orgId)
+	}
+	mBytes, err := ocsdb.ReadFile(fileName)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error reading %s: %v", fileName, err)
+	}
+	m := &Manufacturer{}
+	if err := json.Unmarshal(mBytes, m); err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error parsing %s: %v", fileName, err)
+	}
+	return m, nil
+}
+
+// Returns the manufacturers registered in this org, sorted by name
+func listManufacturers(orgId string) ([]*Manufacturer, *outils.HttpError) {
+	manufacturers := []*Manufacturer{}
+	dirs, err := os.ReadDir(getManufacturersDir(orgId))
+	if os.IsNotExist(err) {
+		return manufacturers, nil
+	} else if err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error reading the manufacturers of org %s: %v", orgId, err)
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		m, httpErr := getManufacturer(orgId, dir.Name())
+		if httpErr != nil {
+			return nil, httpErr
+		}
+		manufacturers = append(manufacturers, m)
+	}
+	sort.Slice(manufacturers, func(i, j int) bool { return manufacturers[i].Name < manufacturers[j].Name })
+	return manufacturers, nil
+}
+
+func saveManufacturer(ctx context.Context, orgId string, m *Manufacturer) *outils.HttpError {
+	m.Updated = time.Now().UTC().Format(time.RFC3339)
+	mBytes, err := json.Marshal(m)
+	if err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "Error marshaling manufacturer %s: %v", m.Name, err)
+	}
+	fileName := getManufacturerFileName(orgId, m.Name)
+	if err := os.MkdirAll(filepath.Dir(fileName), 0750); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create directory %s: %v", filepath.Dir(fileName), err)
+	}
+	if err := ocsdb.WriteFile(ctx, fileName, mBytes, 0600); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
+	}
+	return nil
+}
+
+// Return an error if this manufacturer can't be used
+func validateManufacturer(m *Manufacturer) *outils.HttpError {
+	if u, err := url.Parse(m.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return outils.NewHttpError(http.StatusBadRequest, "invalid url %q, it must be the http or https url of the manufacturer service", m.Url)
+	} else if m.Username == "" {
+		return outils.NewHttpError(http.StatusBadRequest, "username must be specified")
+	} else if !slices.Contains(ownerKeyTypes, m.KeyType) {
+		return outils.NewHttpError(http.StatusBadRequest, "invalid keyType %s, must be one of: %s", m.KeyType, strings.Join(ownerKeyTypes, ", "))
+	}
+	return nil
+}
+
+// Returns the owner service certificate of this key type, which vouchers are extended to
+func getOwnerCertificate(ctx context.Context, keyType string) ([]byte, *outils.HttpError) {
+	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
+	if fdoOwnerURL == "" {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "HZN_FDO_API_URL is not set")
+	}
+	username, password := outils.GetOwnerServiceApiKey()
+	client := outils.NewOwnerServiceClient(username, password)
+	return ownerServiceRequest(ctx, client, http.MethodGet, fdoOwnerURL+"/api/v1/certificate?alias="+keyType, nil)
+}
+
+// Ask the manufacturer service for the devices that completed DI in the last number of seconds
+func listManufacturedDevices(ctx context.Context, m *Manufacturer, seconds int) ([]ManufacturedDevice, *outils.HttpError) {
+	client := outils.NewManufacturerServiceClient(m.Username, m.Password)
+	respBodyBytes, httpErr := upstreamRequest(ctx, client, "manufacturer service", http.MethodGet, strings.TrimSuffix(m.Url, "/")+"/api/v1/deviceinfo/"+strconv.Itoa(seconds), nil)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	return parseManufacturedDevices(respBodyBytes)
+}
+
+// Get the devices from the manufacturer service device info. Different manufacturer service versions use slightly different field
+// names, so match them loosely, like parseOwnerDeviceState.
+func parseManufacturedDevices(deviceInfoBytes []byte) ([]ManufacturedDevice, *outils.HttpError) {
+	deviceInfos := []map[string]interface{}{}
+	if err := json.Unmarshal(deviceInfoBytes, &deviceInfos); err != nil {
+		return nil, outils.NewHttpError(http.StatusBadGateway, "invalid device info from the manufacturer service: %v", err)
+	}
+	devices := []ManufacturedDevice{}
+	for _, deviceInfo := range deviceInfos {
+		device := ManufacturedDevice{}
+		for k, v := range deviceInfo {
+			if v == nil {
+				continue
+			}
+			value := strings.TrimSpace(strings.Trim(jsonValueString(v), `"`))
+			switch strings.ToLower(strings.ReplaceAll(k, "_", "")) {
+			case "serialno", "serialnumber", "serial":
+				device.SerialNumber = value
+			case "uuid", "guid":
+				device.Uuid = normalizeDeviceGuid(value)
+			case "timestamp", "ditimestamp":
+				device.Timestamp = value
+			}
+		}
+		if device.SerialNumber != "" {
+			devices = append(devices, device)
+		}
+	}
+	return devices, nil
+}
+
+// Returns the guid in the form the owner service uses (with dashes), or "" if it is not a guid
+func normalizeDeviceGuid(guid string) string {
+	if len(guid) == 32 {
+		guid = guid[:8] + "-" + guid[8:12] + "-" + guid[12:16] + "-" + guid[16:20] + "-" + guid[20:]
+	}
+	if !deviceGuidRegex.MatchString(guid) {
+		return ""
+	}
+	return strings.ToLower(guid)
+}
+
+// Ask the manufacturer service for the voucher of this device, extended to this owner certificate
+func getManufacturerVoucher(ctx context.Context, m *Manufacturer, serialNumber string, ownerCert []byte) ([]byte, *outils.HttpError) {
+	client := outils.NewManufacturerServiceClient(m.Username, m.Password)
+	return upstreamRequest(ctx, client, "manufacturer service", http.MethodPost, strings.TrimSuffix(m.Url, "/")+"/api/v1/mfg/vouchers/"+url.PathEscape(serialNumber), ownerCert)
+}
+
+// Import the voucher of 1 device of a manufacturer pull. The item id is the device guid, or the serial number if the manufacturer
+// service didn't report the guid.
+func runManufacturerPullJobItem(ctx context.Context, orgId, user, itemId string, input []byte) (map[string]string, *outils.HttpError) {
+	item := manufacturerPullItem{}
+	if err := json.Unmarshal(input, &item); err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "invalid input for job item %s: %v", itemId, err)
+	}
+	result := map[string]string{"serialNumber": item.SerialNumber}
+
+	// The manufacturer extends the voucher again each time, so a device that was already imported would conflict with itself
+	if deviceGuidRegex.MatchString(itemId) && outils.PathExists(filepath.Join(OcsDbDir, "v1", "devices", itemId)) {
+		if httpErr := verifyDeviceInOrg(itemId, orgId); httpErr != nil {
+			return nil, httpErr
+		}
+		result["deviceUuid"] = itemId
+		result["existing"] = "true"
+		return result, nil
+	}
+
+	// The pull that created this job may still be saving the manufacturer's watermark
+	unlock := manufacturerLocks.lock(orgId + "/" + item.Manufacturer)
+	m, httpErr := getManufacturer(orgId, item.Manufacturer)
+	unlock()
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	ownerCert, httpErr := getOwnerCertificate(ctx, m.KeyType)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	voucherBytes, httpErr := getManufacturerVoucher(ctx, m, item.SerialNumber, ownerCert)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	if voucherHeader, err := outils.ParseVoucher(voucherBytes); err != nil {
+		return nil, outils.NewHttpError(http.StatusBadGateway, "the manufacturer service returned an invalid voucher for device %s: %v", item.SerialNumber, err)
+	} else if deviceGuidRegex.MatchString(itemId) && !strings.EqualFold(voucherHeader.Guid, itemId) {
+		return nil, outils.NewHttpError(http.StatusBadGateway, "the manufacturer service returned the voucher of device %s for device %s", voucherHeader.Guid, itemId)
+	}
+
+	deviceUuid, _, existing, httpErr := importVoucher(ctx, orgId, user, voucherBytes, false)
+	if httpErr != nil {
+		metrics.VoucherImports.WithLabelValues(orgId, metrics.ResultFailure).Inc()
+		return nil, httpErr
+	}
+	metrics.VoucherImports.WithLabelValues(orgId, metrics.ResultSuccess).Inc()
+	result["deviceUuid"] = deviceUuid
+	if existing {
+		result["existing"] = "true"
+	}
+	return result, nil
+}
+
+// ============= GET /api/orgs/{ord-id}/fdo/manufacturers =============
+// Returns the manufacturer services registered in the org, without their passwords
+func getFdoManufacturersHandler(orgId string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("GET /api/orgs/{org-id}/fdo/manufacturers", "org", orgId)
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Authenticate this user with the exchange
+	if authenticated, _, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
+		return
+	}
+
+	manufacturers, httpErr := listManufacturers(deviceOrgId)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	for i, m := range manufacturers {
+		manufacturers[i] = m.redacted()
+	}
+	outils.WriteJsonResponse(http.StatusOK, w, manufacturers)
+}
+
+// ============= GET /api/orgs/{ord-id}/fdo/manufacturers/{name} =============
+// Returns the manufacturer service, without its password
+func getFdoManufacturerHandler(orgId string, name string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("GET /api/orgs/{org-id}/fdo/manufacturers/{name}", "org", orgId, "manufacturer", name)
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Authenticate this user with the exchange
+	if authenticated, _, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
+		return
+	}
+
+	m, httpErr := getManufacturer(deviceOrgId, name)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	outils.WriteJsonResponse(http.StatusOK, w, m.redacted())
+}
+
+// ============= PUT /api/orgs/{ord-id}/fdo/manufacturers/{name} =============
+// Registers a manufacturer service in the org, or updates it ({"url", "username", "password", "keyType"}). If the password is
+// omitted when updating, the current one is kept. The watermark is kept, unless it is set in the body. Only the exchange root user
+// can register manufacturers, because the url makes this service connect to any host (see the note at the end of apiHandler).
+func putFdoManufacturerHandler(orgId string, name string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("PUT /api/orgs/{org-id}/fdo/manufacturers/{name}", "org", orgId, "manufacturer", name)
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Authenticate this user with the exchange, and ensure they are the exchange root user
+	if authenticated, httpErr := outils.ExchangeAuthenticateRoot(r, ExchangeInternalUrl, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided or the user is not the exchange root user", http.StatusUnauthorized)
+		return
+	}
+
+	if !manufacturerNameRegex.MatchString(name) {
+		http.Error(w, "invalid manufacturer name "+name+", it must be 1 to 64 letters, digits, '_', '-', or '.'", http.StatusBadRequest)
+		return
+	}
+
+	// Verify content type
+	if httpErr := outils.IsValidPostJson(r); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, MaxManufacturerBodyKB*1024)
+	m := &Manufacturer{}
+	if httpErr := outils.ReadJsonBody(r, m); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	m.Name = name
+	if m.KeyType == "" {
+		m.KeyType = "SECP256R1"
+	}
+	if m.Watermark != "" {
+		if _, err := time.Parse(time.RFC3339, m.Watermark); err != nil {
+			http.Error(w, "invalid watermark "+m.Watermark+", must be an RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+
+	unlock := manufacturerLocks.lock(deviceOrgId + "/" + name)
+	defer unlock()
+	status := http.StatusCreated
+	if existing, httpErr := getManufacturer(deviceOrgId, name); httpErr == nil {
+		status = http.StatusOK
+		if m.Password == "" {
+			m.Password = existing.Password
+		}
+		if m.Watermark == "" {
+			m.Watermark = existing.Watermark
+		}
+	} else if httpErr.Code != http.StatusNotFound {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if manufacturers, httpErr := listManufacturers(deviceOrgId); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if len(manufacturers) >= MaxManufacturersPerOrg {
+		http.Error(w, "an org can have at most "+strconv.Itoa(MaxManufacturersPerOrg)+" manufacturers", http.StatusBadRequest)
+		return
+	}
+	if httpErr := validateManufacturer(m); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	if httpErr := saveManufacturer(r.Context(), deviceOrgId, m); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	outils.LogFor(r).Info("manufacturer registered", "org", deviceOrgId, "manufacturer", name, "url", outils.SafeUrl(m.Url))
+	outils.WriteJsonResponse(status, w, m.redacted())
+}
+
+// ============= DELETE /api/orgs/{ord-id}/fdo/manufacturers/{name} =============
+// Removes the manufacturer service from the org. The devices already pulled from it are not affected. Only org admins can remove
+// manufacturers.
+func deleteFdoManufacturerHandler(orgId string, name string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("DELETE /api/orgs/{org-id}/fdo/manufacturers/{name}", "org", orgId, "manufacturer", name)
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Authenticate this user with the exchange, and ensure they are an admin
+	if authenticated, _, httpErr := outils.ExchangeAuthenticateAdmin(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided or the user is not an org admin", http.StatusUnauthorized)
+		return
+	}
+
+	unlock := manufacturerLocks.lock(deviceOrgId + "/" + name)
+	defer unlock()
+	if _, httpErr := getManufacturer(deviceOrgId, name); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	manufacturerDir := filepath.Dir(getManufacturerFileName(deviceOrgId, name))
+	if err := os.RemoveAll(manufacturerDir); err != nil {
+		http.Error(w, "Error removing "+manufacturerDir+": "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	outils.LogFor(r).Info("manufacturer removed", "org", deviceOrgId, "manufacturer", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ============= POST /api/orgs/{ord-id}/fdo/manufacturers/{name}/pull =============
+// Lists the devices that completed DI in the manufacturer service since its watermark (or since ?since=<RFC3339>), and imports
+// the vouchers of the ones that are not imported yet in a job. Returns 202 with the job, or 204 if there are no new devices.
+// The watermark is then moved to the time of this pull, so devices whose import fails can be pulled again with ?since.
+func postFdoManufacturerPullHandler(orgId string, name string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("POST /api/orgs/{org-id}/fdo/manufacturers/{name}/pull", "org", orgId, "manufacturer", name)
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Authenticate this user with the exchange
+	authenticated, user, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
+		return
+	}
+
+	unlock := manufacturerLocks.lock(deviceOrgId + "/" + name)
+	defer unlock()
+	m, httpErr := getManufacturer(deviceOrgId, name)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Determine how far back to look
+	pullTime := time.Now().UTC()
+	since := pullTime.Add(-DefaultManufacturerLookbackS * time.Second)
+	sinceStr := r.URL.Query().Get("since")
+	if sinceStr == "" {
+		sinceStr = m.Watermark
+	}
+	if sinceStr != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, sinceStr); err != nil {
+			http.Error(w, "invalid since "+sinceStr+", must be an RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	seconds := int(math.Ceil(pullTime.Sub(since).Seconds())) + manufacturerPullOverlapS
+	if seconds <= manufacturerPullOverlapS {
+		seconds = manufacturerPullOverlapS
+	}
+
+	devices, httpErr := listManufacturedDevices(r.Context(), m, seconds)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Only the devices that are not imported yet need a job item
+	itemIds := []string{}
+	inputs := map[string][]byte{}
+	for _, device := range devices {
+		itemId := device.Uuid
+		if itemId == "" {
+			itemId = device.SerialNumber
+		} else if outils.PathExists(filepath.Join(OcsDbDir, "v1", "devices", itemId)) {
+			continue
+		}
+		if _, ok := inputs[itemId]; ok {
+			continue
+		}
+		input, err := json.Marshal(manufacturerPullItem{Manufacturer: name, SerialNumber: device.SerialNumber})
+		if err != nil {
+			http.Error(w, "Error marshaling the job input: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		itemIds = append(itemIds, itemId)
+		inputs[itemId] = input
+	}
+	outils.LogFor(r).Info("listed the devices of the manufacturer", "org", deviceOrgId, "manufacturer", name, "since", since.Format(time.RFC3339), "devices", len(devices), "new_devices", len(itemIds))
+
+	var job *Job
+	if len(itemIds) > 0 {
+		if job, httpErr = createJob(r.Context(), deviceOrgId, user, JobTypeManufacturerPull, itemIds, inputs); httpErr != nil {
+			http.Error(w, httpErr.Error(), httpErr.Code)
+			return
+		}
+	}
+	m.Watermark = pullTime.Format(time.RFC3339)
+	if httpErr := saveManufacturer(r.Context(), deviceOrgId, m); httpErr != nil {
+		outils.LogFor(r).Warn("could not save the manufacturer watermark", "org", deviceOrgId, "manufacturer", name, "error", httpErr.Error())
+	}
+
+	if job == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJobAccepted(w, job)
+}
@@ -0,0 +1,179 @@
+package metrics
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics for ocs-api, served on /metrics
+
+const namespace = "ocs_api"
+
+var (
+	HttpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "http_requests_total",
+		Help: "Number of API requests handled, by route, method, and HTTP status code.",
+	}, []string{"route", "method", "code"})
+
+	HttpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Name: "http_request_duration_seconds",
+		Help:    "Latency of API requests, by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	UpstreamRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "upstream_requests_total",
+		Help: "Number of requests to the FDO owner service and the exchange, by upstream, operation, and HTTP status code (\"error\" if no response was received).",
+	}, []string{"upstream", "operation", "code"})
+
+	UpstreamRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Name: "upstream_request_duration_seconds",
+		Help:    "Latency of requests to the FDO owner service and the exchange, by upstream and operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"upstream", "operation"})
+
+	ExchangeAuthCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "exchange_auth_cache_total",
+		Help: "Number of exchange authentications answered from the credential cache (hit) or by calling the exchange (miss).",
+	}, []string{"result"})
+
+	VoucherImports = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "voucher_imports_total",
+		Help: "Number of voucher imports by authenticated users, by org and result.",
+	}, []string{"org", "result"})
+
+	To0Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "to0_requests_total",
+		Help: "Number of TO0 initiations sent to the owner service, by result.",
+	}, []string{"result"})
+
+	OwnerCertificateExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Name: "owner_certificate_expiry_timestamp_seconds",
+		Help: "Expiry time of the owner certificate of each owner key type, as a unix timestamp.",
+	}, []string{"alias"})
+)
+
+// The upstream names used in the upstream metrics labels
+const (
+	UpstreamOwner        = "owner"
+	UpstreamExchange     = "exchange"
+	UpstreamManufacturer = "manufacturer"
+	UpstreamRendezvous   = "rendezvous"
+)
+
+// Metric label values for results
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+func init() {
+	prometheus.MustRegister(HttpRequests, HttpRequestDuration, UpstreamRequests, UpstreamRequestDuration, ExchangeAuthCache, VoucherImports, To0Requests, OwnerCertificateExpiry)
+}
+
+// Returns the handler for the /metrics route
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Register a collector that is evaluated each time the metrics are scraped (e.g. for the devices per state gauge)
+func RegisterCollector(c prometheus.Collector) {
+	prometheus.MustRegister(c)
+}
+
+// Captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Wrap a handler to count and time each request. routeFunc returns the route template for the request, so the route label has a
+// bounded number of values.
+func InstrumentHandler(routeFunc func(*http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := routeFunc(r)
+		HttpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+		HttpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Path segments that are device GUIDs, so they can be removed from the operation label
+var guidRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// Returns the method and path of this request with GUIDs replaced, for use as the operation label (or span name)
+func OperationOf(r *http.Request) string {
+	segments := strings.Split(r.URL.Path, "/")
+	for i, s := range segments {
+		if guidRegex.MatchString(s) {
+			segments[i] = "{guid}"
+		}
+	}
+	return r.Method + " " + strings.Join(segments, "/")
+}
+
+// Manufacturer service paths that end with a serial number or a number of seconds
+var manufacturerIdPathRegex = regexp.MustCompile(`(/api/v1/(?:mfg/vouchers|deviceinfo))/[^/]+$`)
+
+// Returns the method and path of this manufacturer service request with the serial number or number of seconds replaced, for use
+// as the operation label (or span name)
+func ManufacturerOperationOf(r *http.Request) string {
+	return r.Method + " " + manufacturerIdPathRegex.ReplaceAllString(r.URL.Path, "$1/{id}")
+}
+
+type instrumentedTransport struct {
+	upstream      string
+	operationFunc func(*http.Request) string
+	next          http.RoundTripper
+}
+
+// Wrap a transport to count and time the requests to this upstream. If operationFunc is nil, the operation label is the method
+// and path of the request (with device GUIDs replaced).
+func InstrumentTransport(upstream string, operationFunc func(*http.Request) string, next http.RoundTripper) http.RoundTripper {
+	if operationFunc == nil {
+		operationFunc = OperationOf
+	}
+	return &instrumentedTransport{upstream: upstream, operationFunc: operationFunc, next: next}
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	operation := t.operationFunc(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	UpstreamRequests.WithLabelValues(t.upstream, operation, code).Inc()
+	UpstreamRequestDuration.WithLabelValues(t.upstream, operation).Observe(time.Since(start).Seconds())
+	return resp, err
+}
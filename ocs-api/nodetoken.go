@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/open-horizon/FDO-support/ocs-api/ocsdb"
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+)
+
+// ============= GET /api/orgs/{ord-id}/fdo/vouchers/{deviceUuid}/nodetoken =============
+// Returns the node token that was generated for this device when its voucher was imported. Only org admins can get it.
+func getFdoNodeTokenHandler(orgId string, deviceUuid string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("GET /api/orgs/{org-id}/fdo/vouchers/{device-id}/nodetoken", "org", orgId, "device", deviceUuid)
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Authenticate this user with the exchange, and ensure they are an admin
+	if authenticated, _, httpErr := outils.ExchangeAuthenticateAdmin(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided or the user is not an org admin", http.StatusUnauthorized)
+		return
+	}
+
+	if httpErr := verifyDeviceInOrg(deviceUuid, deviceOrgId); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	nodeToken, httpErr := getNodeTokenTxtStr(deviceUuid)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	if nodeToken == "" {
+		http.Error(w, "no node token stored for device "+deviceUuid, http.StatusNotFound)
+		return
+	}
+
+	respBody := map[string]interface{}{
+		"deviceUuid": deviceUuid,
+		"nodeToken":  nodeToken,
+	}
+	outils.WriteJsonResponse(http.StatusOK, w, respBody)
+}
+
+// ============= POST /api/orgs/{ord-id}/fdo/vouchers/{deviceUuid}/nodetoken/rotate =============
+// Generates a new node token for this device, updates the device exec file resource in the owner service, and updates the
+// exchange node (if it has already been created). Only devices that have not onboarded or been transferred to another owner can
+// get a new token. Only org admins can do this.
+func postFdoNodeTokenRotateHandler(orgId string, deviceUuid string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("POST /api/orgs/{org-id}/fdo/vouchers/{device-id}/nodetoken/rotate", "org", orgId, "device", deviceUuid)
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Authenticate this user with the exchange, and ensure they are an admin
+	if authenticated, _, httpErr := outils.ExchangeAuthenticateAdmin(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided or the user is not an org admin", http.StatusUnauthorized)
+		return
+	}
+
+	nodeToken, nodeUpdated, httpErr := rotateNodeToken(r, deviceUuid, deviceOrgId)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	outils.LogFor(r).Info("node token rotated", "org", deviceOrgId, "device", deviceUuid, "exchange_node_updated", nodeUpdated)
+
+	respBody := map[string]interface{}{
+		"deviceUuid":          deviceUuid,
+		"nodeToken":           nodeToken,
+		"exchangeNodeUpdated": nodeUpdated,
+	}
+	outils.WriteJsonResponse(http.StatusOK, w, respBody)
+}
+
+//============= Non-Route Functions =============
+
+// Give this device a new node token: update the exec file the device will run and its owner service resource, store the new token,
+// and update the exchange node (if it was already created). If a step fails, the steps already done are undone, so the device
+// keeps working with its old token.
+func rotateNodeToken(r *http.Request, deviceUuid, deviceOrgId string) (nodeToken string, nodeUpdated bool, httpErr *outils.HttpError) {
+	ctx := r.Context()
+	unlock := lockDevice(deviceUuid)
+	defer unlock()
+
+	if httpErr := verifyDeviceInOrg(deviceUuid, deviceOrgId); httpErr != nil {
+		return "", false, httpErr
+	}
+	state, httpErr := getDeviceState(deviceUuid)
+	if httpErr != nil {
+		return "", false, httpErr
+	} else if state.State == DeviceStateOnboarded {
+		return "", false, outils.NewHttpError(http.StatusConflict, "device %s has already onboarded with its node token", deviceUuid)
+	} else if state.State == DeviceStateTransferred {
+		return "", false, outils.NewHttpError(http.StatusConflict, "the voucher of device %s was extended to another owner", deviceUuid)
+	}
+
+	// Keep the current token and exec file, to put them back if the rotation fails
+	oldNodeToken, httpErr := getNodeTokenTxtStr(deviceUuid)
+	if httpErr != nil {
+		return "", false, httpErr
+	}
+	execFileName := filepath.Clean(filepath.Join(OcsDbDir, "v1", "values", deviceUuid+"_exec"))
+	oldExecBytes, err := ocsdb.ReadFile(execFileName)
+	if err != nil {
+		return "", false, outils.NewHttpError(http.StatusInternalServerError, "Error reading %s: %v", execFileName, err)
+	}
+	if nodeToken, httpErr = outils.GenerateNodeToken(); httpErr != nil {
+		return "", false, httpErr
+	}
+
+	s := &saga{ctx: ctx, name: "node token rotation"}
+	defer func() {
+		if httpErr != nil {
+			s.rollback()
+		}
+	}()
+
+	// Update the exec file the device will run during onboarding, and the owner service resource for it
+	if httpErr := createDeviceExecFile(ctx, deviceUuid, nodeToken, deviceOrgId); httpErr != nil {
+		return "", false, httpErr
+	}
+	s.done("update the device exec file", func(ctx context.Context) error {
+		if err := ocsdb.WriteFile(ctx, execFileName, oldExecBytes, 0600); err != nil {
+			return err
+		}
+		return httpErrOrNil(postDeviceExecResource(ctx, deviceUuid))
+	})
+	if httpErr := postDeviceExecResource(ctx, deviceUuid); httpErr != nil {
+		return "", false, httpErr
+	}
+
+	if httpErr := storeNodeToken(ctx, deviceUuid, nodeToken); httpErr != nil {
+		return "", false, httpErr
+	}
+	s.done("store the node token", func(ctx context.Context) error {
+		if oldNodeToken == "" {
+			return os.Remove(filepath.Clean(filepath.Join(OcsDbDir, "v1", "devices", deviceUuid, "nodeToken.txt")))
+		}
+		return httpErrOrNil(storeNodeToken(ctx, deviceUuid, oldNodeToken))
+	})
+
+	// If the node was already created in the exchange, its token has to match the new one
+	if nodeUpdated, httpErr = outils.ExchangeUpdateNodeToken(r, ExchangeInternalUrl, deviceOrgId, deviceUuid, nodeToken, ExchangeInternalCertPath); httpErr != nil {
+		return "", false, outils.NewHttpError(httpErr.Code, "updating the exchange node failed, so the node token was not rotated: %s", httpErr.Error())
+	}
+	return nodeToken, nodeUpdated, nil
+}
+
+// Return an error if this device does not exist or is not in this org
+func verifyDeviceInOrg(deviceUuid, deviceOrgId string) *outils.HttpError {
+	orgidTxtStr, httpErr := getOrgidTxtStr(deviceUuid)
+	if httpErr != nil {
+		return httpErr
+	}
+	if orgidTxtStr == "" {
+		return outils.NewHttpError(http.StatusNotFound, "device %s not found", deviceUuid)
+	}
+	if orgidTxtStr != deviceOrgId {
+		return outils.NewHttpError(http.StatusForbidden, "Device %s is not in org %s", deviceUuid, deviceOrgId)
+	}
+	return nil
+}
+
+// Save the node token (encrypted) in the device dir of the OCS DB
+func storeNodeToken(ctx context.Context, deviceUuid, nodeToken string) *outils.HttpError {
+	fileName := filepath.Clean(filepath.Join(OcsDbDir, "v1", "devices", deviceUuid, "nodeToken.txt"))
+	outils.LogCtx(ctx).Debug("creating file", "file", fileName)
+	if err := ocsdb.WriteFile(ctx, fileName, []byte(nodeToken), 0600); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
+	}
+	return nil
+}
+
+// Create the device specific exec file that runs agent-install-wrapper.sh with the device's node id, token, and org. If the labels
+// are propagated to the exchange node, it first writes them to a node policy file for agent-install.sh.
+func createDeviceExecFile(ctx context.Context, deviceUuid, nodeToken, deviceOrgId string) *outils.HttpError {
+	// Note: currently agent-install-wrapper.sh requires that the flags be in this order!!!!
+	execCmd := fmt.Sprintf("/bin/sh agent-install-wrapper.sh -i %s -a %s:%s -O %s -k %s", PkgsFrom, deviceUuid, nodeToken, deviceOrgId, CfgFileFrom)
+	if labelsAsNodeProperties() {
+		labels, httpErr := getDeviceLabels(deviceUuid)
+		if httpErr != nil {
+			return httpErr
+		}
+		policyCmds, err := nodePolicyCommands(labels)
+		if err != nil {
+			return outils.NewHttpError(http.StatusInternalServerError, "Error creating the node policy of device %s: %v", deviceUuid, err)
+		} else if policyCmds != "" {
+			execCmd = policyCmds + execCmd + " -n " + nodePolicyFileName
+		}
+	}
+	fileName := filepath.Clean(filepath.Join(OcsDbDir, "v1", "values", deviceUuid+"_exec"))
+	outils.LogCtx(ctx).Debug("creating file", "file", fileName)
+	if err := ocsdb.WriteFile(ctx, fileName, []byte(execCmd), 0600); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
+	}
+	return nil
+}
+
+// Post the device specific exec file to the FDO owner service as the <deviceUuid>_exec resource
+func postDeviceExecResource(ctx context.Context, deviceUuid string) *outils.HttpError {
+	fileName := filepath.Clean(filepath.Join(OcsDbDir, "v1", "values", deviceUuid+"_exec"))
+	wrapperFile, err := ocsdb.ReadFile(fileName)
+	if err != nil {
+		return outils.NewHttpError(http.StatusNotFound, "Error reading %s: %v", fileName, err)
+	}
+
+	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
+	if fdoOwnerURL == "" {
+		return outils.NewHttpError(http.StatusInternalServerError, "HZN_FDO_API_URL is not set")
+	}
+	wrapperResource := deviceUuid + "_exec"
+	fdoResourceURL := fdoOwnerURL + "/api/v1/owner/resource?filename=" + wrapperResource
+	outils.LogCtx(ctx).Debug("posting the device exec file to the owner service", "device", deviceUuid, "url", outils.SafeUrl(fdoResourceURL))
+
+	username, password := outils.GetOwnerServiceApiKey()
+	client := outils.NewOwnerServiceClient(username, password)
+	resp, err := outils.HttpPost(ctx, client, fdoResourceURL, "text/plain", bytes.NewReader(wrapperFile))
+	if err != nil {
+		return outils.NewHttpError(http.StatusBadRequest, "%v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respBodyBytes, _ := io.ReadAll(resp.Body)
+		return outils.NewHttpError(http.StatusBadGateway, "posting %s to the owner service returned HTTP code %d: %s", wrapperResource, resp.StatusCode, string(respBodyBytes))
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package ocsdb
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+	"github.com/open-horizon/FDO-support/ocs-api/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Reading and writing OCS DB files. The files that hold sensitive values are encrypted at rest, so handlers just use
+// WriteFile and ReadFile instead of os.WriteFile and os.ReadFile, and don't need to know which files are encrypted.
+
+// The base names of the OCS DB files that are encrypted. A name starting with * matches any file with that suffix.
+var sensitiveFiles = []string{
+	"ownership_voucher.txt", // v1/devices/<uuid>/
+	"nodeToken.txt",         // v1/devices/<uuid>/
+	"*_exec",                // v1/values/<uuid>_exec contains the node token
+	"job_input.json",        // v1/jobs/<id>/ contains the vouchers of a bulk import
+	"instance_key.pem",      // v1/creds/ the private key that signs exported device bundles
+	"manufacturer.json",     // v1/manufacturers/<org>/<name>/ contains the manufacturer service credentials
+	"handoff.json",          // v1/handoffs/<uuid>/ contains the voucher of a resold or exported device
+}
+
+// Returns true if this OCS DB file holds sensitive values and should be encrypted
+func IsSensitive(fileName string) bool {
+	baseName := filepath.Base(fileName)
+	for _, s := range sensitiveFiles {
+		if strings.HasPrefix(s, "*") {
+			if strings.HasSuffix(baseName, s[1:]) {
+				return true
+			}
+		} else if baseName == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Write an OCS DB file, encrypting the content if the file is sensitive. Sensitive files are always only readable by the owner.
+// Each write is recorded as a span in the trace of this context.
+func WriteFile(ctx context.Context, fileName string, data []byte, perm os.FileMode) (err error) {
+	sensitive := IsSensitive(fileName)
+	_, span := tracing.Start(ctx, "ocsdb.WriteFile", attribute.String("file", fileName), attribute.Bool("encrypted", sensitive))
+	defer func() { tracing.End(span, err) }()
+
+	if !sensitive {
+		return os.WriteFile(fileName, data, perm)
+	}
+	return writeEncrypted(fileName, dbPath(dbDir, fileName), data)
+}
+
+func writeEncrypted(fileName, path string, data []byte) error {
+	encrypted, err := Encrypt(data, path)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(fileName, encrypted, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(fileName, 0600) // in case the file already existed with wider permissions
+}
+
+// Read an OCS DB file, decrypting the content if it is encrypted
+func ReadFile(fileName string) ([]byte, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return Decrypt(data, dbPath(dbDir, fileName))
+}
+
+// Returns the path of this file relative to the OCS DB dir (or the whole path if it isn't in it), which is bound to the encrypted
+// content of the file
+func dbPath(ocsDbDir, fileName string) string {
+	absDir, err := filepath.Abs(ocsDbDir)
+	if err != nil {
+		return filepath.ToSlash(filepath.Clean(fileName))
+	}
+	absFile, err := filepath.Abs(fileName)
+	if err != nil {
+		return filepath.ToSlash(filepath.Clean(fileName))
+	}
+	if relPath, err := filepath.Rel(absDir, absFile); err == nil && relPath != ".." && !strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return filepath.ToSlash(relPath)
+	}
+	return filepath.ToSlash(absFile)
+}
+
+// Re-encrypt all sensitive OCS DB files with the active key. Files that are not encrypted yet, or were encrypted w/o their path,
+// are encrypted, bound to their path. Returns the number of files that were rewritten.
+func ReEncrypt(ocsDbDir string) (int, error) {
+	count := 0
+	v1Dir := filepath.Join(ocsDbDir, "v1")
+	err := filepath.WalkDir(v1Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !IsSensitive(path) {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", path, err)
+		}
+		if strings.HasPrefix(string(data), envelopePrefix) && KeyIdOf(data) == ActiveKeyId() {
+			return nil // already encrypted with the active key and bound to its path
+		}
+		relPath := dbPath(ocsDbDir, path)
+		plainText, err := Decrypt(data, relPath)
+		if err != nil {
+			return fmt.Errorf("could not decrypt %s: %v", path, err)
+		}
+		if err := writeEncrypted(path, relPath, plainText); err != nil {
+			return fmt.Errorf("could not write %s: %v", path, err)
+		}
+		outils.Log.Debug("re-encrypted OCS DB file", "file", path, "key_id", ActiveKeyId())
+		count++
+		return nil
+	})
+	return count, err
+}
@@ -0,0 +1,143 @@
+package ocsdb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write this content to this OCS DB file as is, creating its dir
+func writeRawTestFile(t *testing.T, fileName string, content []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(fileName), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fileName, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readRawTestFile(t *testing.T, fileName string) []byte {
+	t.Helper()
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestDbPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		ocsDbDir string
+		fileName string
+		want     string
+	}{
+		{"in the dir", "/var/ocs-db", "/var/ocs-db/v1/devices/d1/nodeToken.txt", "v1/devices/d1/nodeToken.txt"},
+		{"not clean", "/var/ocs-db/", "/var/ocs-db/v1/devices/../values/d1_exec", "v1/values/d1_exec"},
+		{"relative dir", "ocs-db", "ocs-db/v1/devices/d1/nodeToken.txt", "v1/devices/d1/nodeToken.txt"},
+		{"not in the dir", "/var/ocs-db", "/tmp/nodeToken.txt", "/tmp/nodeToken.txt"},
+		{"sibling dir", "/var/ocs-db", "/var/ocs-db2/v1/devices/d1/nodeToken.txt", "/var/ocs-db2/v1/devices/d1/nodeToken.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dbPath(tt.ocsDbDir, tt.fileName); got != tt.want {
+				t.Errorf("dbPath(%q, %q) = %q, want %q", tt.ocsDbDir, tt.fileName, got, tt.want)
+			}
+		})
+	}
+}
+
+// An encrypted file copied to another device dir must not decrypt
+func TestReadFileCopiedToAnotherDevice(t *testing.T) {
+	ocsDbDir := t.TempDir()
+	initTestKeysIn(t, ocsDbDir, "a="+testKeyA, "")
+	fileName := filepath.Join(ocsDbDir, "v1", "devices", "d1", "nodeToken.txt")
+	writeRawTestFile(t, fileName, nil)
+	if err := WriteFile(context.Background(), fileName, []byte("token1"), 0600); err != nil {
+		t.Fatalf("WriteFile() returned error: %v", err)
+	}
+	if got, err := ReadFile(fileName); err != nil {
+		t.Fatalf("ReadFile() returned error: %v", err)
+	} else if string(got) != "token1" {
+		t.Errorf("ReadFile() = %q, want %q", got, "token1")
+	}
+
+	copiedFileName := filepath.Join(ocsDbDir, "v1", "devices", "d2", "nodeToken.txt")
+	writeRawTestFile(t, copiedFileName, readRawTestFile(t, fileName))
+	if got, err := ReadFile(copiedFileName); err == nil {
+		t.Errorf("ReadFile() of the copied file = %q, want error", got)
+	}
+}
+
+func TestReEncrypt(t *testing.T) {
+	ocsDbDir := t.TempDir()
+	initTestKeysIn(t, ocsDbDir, "a="+testKeyA, "")
+	activeFileName := filepath.Join(ocsDbDir, "v1", "devices", "d1", "nodeToken.txt")
+	writeRawTestFile(t, activeFileName, nil)
+	if err := WriteFile(context.Background(), activeFileName, []byte("token1"), 0600); err != nil {
+		t.Fatalf("WriteFile() returned error: %v", err)
+	}
+	keyIdOnlyFileName := filepath.Join(ocsDbDir, "v1", "devices", "d2", "nodeToken.txt")
+	writeRawTestFile(t, keyIdOnlyFileName, encryptKeyIdOnly(t, []byte("token2")))
+	plainFileName := filepath.Join(ocsDbDir, "v1", "values", "d3_exec")
+	writeRawTestFile(t, plainFileName, []byte("exec3"))
+	otherFileName := filepath.Join(ocsDbDir, "v1", "devices", "d1", "orgid.txt")
+	writeRawTestFile(t, otherFileName, []byte("myorg"))
+
+	// The file encrypted with the active key and its path is left as is
+	activeContent := readRawTestFile(t, activeFileName)
+	count, err := ReEncrypt(ocsDbDir)
+	if err != nil {
+		t.Fatalf("ReEncrypt() returned error: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("ReEncrypt() rewrote %d files, want 2", count)
+	}
+	if got := readRawTestFile(t, activeFileName); string(got) != string(activeContent) {
+		t.Errorf("ReEncrypt() rewrote the file that was already encrypted with the active key")
+	}
+	if got := readRawTestFile(t, otherFileName); string(got) != "myorg" {
+		t.Errorf("ReEncrypt() changed the file that is not sensitive to %q", got)
+	}
+
+	for fileName, want := range map[string]string{activeFileName: "token1", keyIdOnlyFileName: "token2", plainFileName: "exec3"} {
+		content := readRawTestFile(t, fileName)
+		if !strings.HasPrefix(string(content), envelopePrefix) {
+			t.Errorf("%s is %q after ReEncrypt(), want it encrypted in the %s format", fileName, content, envelopePrefix)
+		}
+		if got, err := ReadFile(fileName); err != nil {
+			t.Errorf("ReadFile(%s) returned error: %v", fileName, err)
+		} else if string(got) != want {
+			t.Errorf("ReadFile(%s) = %q, want %q", fileName, got, want)
+		}
+	}
+
+	// The re-encrypted files are bound to their paths
+	copiedFileName := filepath.Join(ocsDbDir, "v1", "devices", "d4", "nodeToken.txt")
+	writeRawTestFile(t, copiedFileName, readRawTestFile(t, keyIdOnlyFileName))
+	if got, err := ReadFile(copiedFileName); err == nil {
+		t.Errorf("ReadFile() of a re-encrypted file copied to another device = %q, want error", got)
+	}
+
+	// After a key rotation all of the files are re-encrypted with the new key, and keep their paths
+	initTestKeysIn(t, ocsDbDir, "a="+testKeyA+",b="+testKeyB, "b")
+	if err := os.Remove(copiedFileName); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := ReEncrypt(ocsDbDir); err != nil {
+		t.Fatalf("ReEncrypt() after the key rotation returned error: %v", err)
+	} else if count != 3 {
+		t.Errorf("ReEncrypt() after the key rotation rewrote %d files, want 3", count)
+	}
+	initTestKeysIn(t, ocsDbDir, "b="+testKeyB, "")
+	for fileName, want := range map[string]string{activeFileName: "token1", keyIdOnlyFileName: "token2", plainFileName: "exec3"} {
+		if got, err := ReadFile(fileName); err != nil {
+			t.Errorf("ReadFile(%s) with only the new key returned error: %v", fileName, err)
+		} else if string(got) != want {
+			t.Errorf("ReadFile(%s) = %q, want %q", fileName, got, want)
+		}
+	}
+}
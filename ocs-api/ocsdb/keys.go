@@ -0,0 +1,300 @@
+package ocsdb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+)
+
+// Envelope encryption of the sensitive fields of the OCS DB. Each value is encrypted with its own random data key, and the data
+// key is wrapped with one of the key encryption keys (KEKs) configured for ocs-api. The id of the KEK is stored with the value,
+// so KEKs can be rotated: add the new key, make it active, and run "ocs-api reencrypt <ocs-db-path>". The path of the file in the OCS
+// DB is bound to the value (as AEAD additional data), so an encrypted value copied to another file (e.g. the node token of another
+// device) does not decrypt.
+
+const (
+	KeysFileEnvVar      = "OCS_DB_KEYS_FILE"       // file with 1 key per line: <key-id>=<base64 encoded 32 byte key>
+	KeysEnvVar          = "OCS_DB_KEYS"            // comma separated list of: <key-id>=<base64 encoded 32 byte key>
+	ActiveKeyIdEnvVar   = "OCS_DB_ACTIVE_KEY_ID"   // the key used to encrypt new values. Defaults to the 1st key listed.
+	SecretKeyEnvVar     = "OCS_DB_SECRET_KEY"      // a single base64 encoded 32 byte key, with key id "default"
+	AllowLocalKeyEnvVar = "OCS_DB_ALLOW_LOCAL_KEY" // if true and no keys are configured, use (and create) the local key file
+	LocalKeyFileName    = "ocs-db-secret.key"      // in the v1/creds dir of the OCS DB, with key id "local"
+	encryptedPrefix     = "enc:"
+	envelopePrefix      = "enc:v3:" // the additional data is the key id and the path of the file
+	keyIdEnvelopePrefix = "enc:v2:" // the additional data is only the key id. Still read, and upgraded by "ocs-api reencrypt".
+)
+
+type keyRing struct {
+	keys     map[string][]byte
+	order    []string
+	activeId string
+}
+
+var ring *keyRing
+var dbDir string // the OCS DB dir, that the paths bound to encrypted values are relative to
+
+// The envelope stored (base64 encoded json) for each encrypted value
+type envelope struct {
+	KeyId      string `json:"kid"`
+	WrappedKey string `json:"dek"`  // base64 of nonce + data key encrypted with the KEK
+	Data       string `json:"data"` // base64 of nonce + value encrypted with the data key
+}
+
+// Load the key encryption keys from (in precedence order) OCS_DB_KEYS_FILE, OCS_DB_KEYS, or OCS_DB_SECRET_KEY. One of them must be
+// set, unless OCS_DB_ALLOW_LOCAL_KEY=true, which uses a local key file in the OCS DB creds dir (created if it doesn't exist). That key
+// is in the same volume as the values it encrypts, so it only protects against leaking single files, not the volume or its backups.
+func InitKeys(ocsDbDir string) error {
+	r := &keyRing{keys: map[string][]byte{}}
+	if outils.IsEnvVarSet(KeysFileEnvVar) {
+		fileName := filepath.Clean(os.Getenv(KeysFileEnvVar))
+		keysBytes, err := os.ReadFile(fileName)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", fileName, err)
+		}
+		if err := r.addKeys(strings.Split(string(keysBytes), "\n"), fileName); err != nil {
+			return err
+		}
+	} else if outils.IsEnvVarSet(KeysEnvVar) {
+		if err := r.addKeys(strings.Split(os.Getenv(KeysEnvVar), ","), KeysEnvVar); err != nil {
+			return err
+		}
+	} else if outils.IsEnvVarSet(SecretKeyEnvVar) {
+		if err := r.addKeys([]string{"default=" + os.Getenv(SecretKeyEnvVar)}, SecretKeyEnvVar); err != nil {
+			return err
+		}
+	}
+
+	localKeyFileName := filepath.Clean(filepath.Join(ocsDbDir, "v1", "creds", LocalKeyFileName))
+	allowLocalKey := outils.GetEnvVarBoolWithDefault(AllowLocalKeyEnvVar, false)
+	if len(r.order) == 0 {
+		if !allowLocalKey {
+			return fmt.Errorf("no OCS DB key is configured: set %s, %s, or %s (or %s=true to use a key stored in the OCS DB)", KeysFileEnvVar, KeysEnvVar, SecretKeyEnvVar, AllowLocalKeyEnvVar)
+		}
+		outils.Log.Warn("using the local OCS DB key, which is stored in the same volume as the values it encrypts. Configure a key with "+KeysEnvVar+" instead.", "file", localKeyFileName)
+		if !outils.PathExists(localKeyFileName) {
+			outils.Log.Info("creating the local OCS DB key", "file", localKeyFileName)
+			key := make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				return fmt.Errorf("could not generate the OCS DB key: %v", err)
+			}
+			if err := os.WriteFile(localKeyFileName, []byte(base64.StdEncoding.EncodeToString(key)), 0600); err != nil {
+				return fmt.Errorf("could not create %s: %v", localKeyFileName, err)
+			}
+		}
+	}
+
+	// If the local key exists, it is loaded after the configured keys, so the values encrypted with it can still be read, and
+	// re-encrypted with "ocs-api reencrypt", after switching to configured keys
+	if outils.PathExists(localKeyFileName) {
+		keyBytes, err := os.ReadFile(localKeyFileName)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", localKeyFileName, err)
+		}
+		if _, ok := r.keys["local"]; !ok {
+			if err := r.addKeys([]string{"local=" + strings.TrimSpace(string(keyBytes))}, localKeyFileName); err != nil {
+				return err
+			}
+		}
+	}
+
+	r.activeId = outils.GetEnvVarWithDefault(ActiveKeyIdEnvVar, r.order[0])
+	if _, ok := r.keys[r.activeId]; !ok {
+		return fmt.Errorf("the active OCS DB key id %s (from %s) is not one of the configured keys", r.activeId, ActiveKeyIdEnvVar)
+	}
+	outils.Log.Debug("using OCS DB key to encrypt sensitive values", "key_id", r.activeId)
+	ring = r
+	dbDir = ocsDbDir
+	return nil
+}
+
+// Parse key lines of the form <key-id>=<base64 key>. Blank lines and lines starting with # are ignored.
+func (r *keyRing) addKeys(lines []string, from string) error {
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keyId, keyStr, found := strings.Cut(line, "=")
+		keyId = strings.TrimSpace(keyId)
+		if !found || keyId == "" {
+			return fmt.Errorf("invalid key entry in %s: must be in the form <key-id>=<base64 key>", from)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(keyStr))
+		if err != nil {
+			return fmt.Errorf("could not base64 decode key %s from %s: %v", keyId, from, err)
+		}
+		if len(key) != 32 {
+			return fmt.Errorf("key %s from %s must be 32 bytes, not %d", keyId, from, len(key))
+		}
+		if _, ok := r.keys[keyId]; ok {
+			return fmt.Errorf("duplicate key id %s in %s", keyId, from)
+		}
+		r.keys[keyId] = key
+		r.order = append(r.order, keyId)
+	}
+	return nil
+}
+
+// Returns the id of the key that new values are encrypted with
+func ActiveKeyId() string {
+	if ring == nil {
+		return ""
+	}
+	return ring.activeId
+}
+
+// Returns true if this value was encrypted by Encrypt (with any key)
+func IsEncrypted(value []byte) bool {
+	return strings.HasPrefix(string(value), envelopePrefix) || strings.HasPrefix(string(value), keyIdEnvelopePrefix)
+}
+
+// Returns the key id this value was encrypted with, or "" if it is not encrypted or was encrypted w/o a key id
+func KeyIdOf(value []byte) string {
+	if !IsEncrypted(value) {
+		return ""
+	}
+	env, err := decodeEnvelope(value)
+	if err != nil {
+		return ""
+	}
+	return env.KeyId
+}
+
+// Encrypt this value with a new data key, wrapped with the active KEK. The value can only be decrypted with the same path, which is
+// the path of its file relative to the OCS DB dir.
+func Encrypt(plainText []byte, path string) ([]byte, error) {
+	if ring == nil {
+		return nil, errors.New("the OCS DB keys have not been initialized")
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("could not generate data key: %v", err)
+	}
+	aad := additionalData(ring.activeId, path)
+	sealedData, err := seal(dataKey, plainText, aad)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := seal(ring.keys[ring.activeId], dataKey, aad)
+	if err != nil {
+		return nil, err
+	}
+	envBytes, err := json.Marshal(envelope{
+		KeyId:      ring.activeId,
+		WrappedKey: base64.StdEncoding.EncodeToString(wrappedKey),
+		Data:       base64.StdEncoding.EncodeToString(sealedData),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal encryption envelope: %v", err)
+	}
+	return []byte(envelopePrefix + base64.StdEncoding.EncodeToString(envBytes)), nil
+}
+
+// Decrypt a value that was encrypted with Encrypt with this path. Values that are not encrypted are returned as is.
+func Decrypt(value []byte, path string) ([]byte, error) {
+	if ring == nil {
+		return nil, errors.New("the OCS DB keys have not been initialized")
+	}
+	valueStr := strings.TrimSpace(string(value))
+	switch {
+	case IsEncrypted([]byte(valueStr)):
+		env, err := decodeEnvelope([]byte(valueStr))
+		if err != nil {
+			return nil, err
+		}
+		aad := additionalData(env.KeyId, path)
+		if strings.HasPrefix(valueStr, keyIdEnvelopePrefix) {
+			aad = []byte(env.KeyId)
+		}
+		kek, ok := ring.keys[env.KeyId]
+		if !ok {
+			return nil, fmt.Errorf("value was encrypted with key id %s, which is not one of the configured keys", env.KeyId)
+		}
+		wrappedKey, err := base64.StdEncoding.DecodeString(env.WrappedKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not base64 decode the wrapped data key: %v", err)
+		}
+		dataKey, err := open(kek, wrappedKey, aad)
+		if err != nil {
+			return nil, fmt.Errorf("could not unwrap the data key with key id %s: %v", env.KeyId, err)
+		}
+		sealedData, err := base64.StdEncoding.DecodeString(env.Data)
+		if err != nil {
+			return nil, fmt.Errorf("could not base64 decode the encrypted value: %v", err)
+		}
+		return open(dataKey, sealedData, aad)
+	case strings.HasPrefix(valueStr, encryptedPrefix):
+		format, _, _ := strings.Cut(strings.TrimPrefix(valueStr, encryptedPrefix), ":")
+		return nil, fmt.Errorf("value is encrypted in the unsupported format %s", format)
+	default:
+		return value, nil
+	}
+}
+
+// Returns the additional data that binds an encrypted value to its key id and path
+func additionalData(keyId, path string) []byte {
+	return []byte(keyId + "\n" + path)
+}
+
+func decodeEnvelope(value []byte) (*envelope, error) {
+	envStr := strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(string(value)), envelopePrefix), keyIdEnvelopePrefix)
+	envBytes, err := base64.StdEncoding.DecodeString(envStr)
+	if err != nil {
+		return nil, fmt.Errorf("could not base64 decode the encryption envelope: %v", err)
+	}
+	env := &envelope{}
+	if err := json.Unmarshal(envBytes, env); err != nil {
+		return nil, fmt.Errorf("could not unmarshal the encryption envelope: %v", err)
+	}
+	return env, nil
+}
+
+// AES-GCM encrypt, returning nonce + cipher text
+func seal(key, plainText, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("could not generate nonce: %v", err)
+	}
+	return gcm.Seal(nonce, nonce, plainText, additionalData), nil
+}
+
+// AES-GCM decrypt nonce + cipher text
+func open(key, sealed, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+	plainText, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt value: %v", err)
+	}
+	return plainText, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("could not create GCM cipher: %v", err)
+	}
+	return gcm, nil
+}
@@ -0,0 +1,368 @@
+package ocsdb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+)
+
+var (
+	testKeyA = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{'a'}, 32))
+	testKeyB = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{'b'}, 32))
+)
+
+const testPath = "v1/devices/0a1b2c3d-0000-1111-2222-000000000011/nodeToken.txt"
+
+// Initialize the keys from OCS_DB_KEYS, with all of the other key env vars unset
+func initTestKeys(t *testing.T, keys, activeId string) {
+	t.Helper()
+	initTestKeysIn(t, t.TempDir(), keys, activeId)
+}
+
+// Initialize the keys from OCS_DB_KEYS for this OCS DB dir, with all of the other key env vars unset
+func initTestKeysIn(t *testing.T, ocsDbDir, keys, activeId string) {
+	t.Helper()
+	t.Setenv(KeysFileEnvVar, "")
+	t.Setenv(SecretKeyEnvVar, "")
+	t.Setenv(AllowLocalKeyEnvVar, "")
+	t.Setenv(KeysEnvVar, keys)
+	t.Setenv(ActiveKeyIdEnvVar, activeId)
+	if err := InitKeys(ocsDbDir); err != nil {
+		t.Fatalf("InitKeys(%q) returned error: %v", keys, err)
+	}
+}
+
+// Returns the value encrypted in the enc:v2 format, whose additional data is only the key id
+func encryptKeyIdOnly(t *testing.T, plainText []byte) []byte {
+	t.Helper()
+	dataKey := bytes.Repeat([]byte{'d'}, 32)
+	sealedData, err := seal(dataKey, plainText, []byte(ring.activeId))
+	if err != nil {
+		t.Fatalf("seal() returned error: %v", err)
+	}
+	wrappedKey, err := seal(ring.keys[ring.activeId], dataKey, []byte(ring.activeId))
+	if err != nil {
+		t.Fatalf("seal() returned error: %v", err)
+	}
+	envBytes, err := json.Marshal(envelope{
+		KeyId:      ring.activeId,
+		WrappedKey: base64.StdEncoding.EncodeToString(wrappedKey),
+		Data:       base64.StdEncoding.EncodeToString(sealedData),
+	})
+	if err != nil {
+		t.Fatalf("could not marshal envelope: %v", err)
+	}
+	return []byte(keyIdEnvelopePrefix + base64.StdEncoding.EncodeToString(envBytes))
+}
+
+// Apply this change to the envelope of the encrypted value, and return the re-encoded value
+func tamper(t *testing.T, value []byte, change func(env *envelope)) []byte {
+	t.Helper()
+	env, err := decodeEnvelope(value)
+	if err != nil {
+		t.Fatalf("could not decode envelope: %v", err)
+	}
+	change(env)
+	envBytes, err := json.Marshal(env)
+	if err != nil {
+		t.Fatalf("could not marshal envelope: %v", err)
+	}
+	return []byte(envelopePrefix + base64.StdEncoding.EncodeToString(envBytes))
+}
+
+// Flip the last byte of this base64 encoded value
+func flipLastByte(t *testing.T, b64 string) string {
+	t.Helper()
+	b, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		t.Fatalf("could not base64 decode: %v", err)
+	}
+	b[len(b)-1] ^= 0xff
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	initTestKeys(t, "a="+testKeyA, "")
+
+	tests := []struct {
+		name      string
+		plainText []byte
+	}{
+		{"empty", []byte{}},
+		{"node token", []byte("abcdefghijklmnopqrstuvwxyz0123456789")},
+		{"voucher", []byte("-----BEGIN OWNERSHIP VOUCHER-----\nhQGGGFxQ\n-----END OWNERSHIP VOUCHER-----\n")},
+		{"binary", []byte{0, 1, 2, 0xfe, 0xff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encrypted, err := Encrypt(tt.plainText, testPath)
+			if err != nil {
+				t.Fatalf("Encrypt() returned error: %v", err)
+			}
+			if !IsEncrypted(encrypted) {
+				t.Errorf("IsEncrypted(%q) = false, want true", encrypted)
+			}
+			if len(tt.plainText) > 0 && bytes.Contains(encrypted, tt.plainText) {
+				t.Errorf("Encrypt() output contains the plain text")
+			}
+			if got := KeyIdOf(encrypted); got != "a" {
+				t.Errorf("KeyIdOf() = %q, want %q", got, "a")
+			}
+			decrypted, err := Decrypt(encrypted, testPath)
+			if err != nil {
+				t.Fatalf("Decrypt() returned error: %v", err)
+			}
+			if !bytes.Equal(decrypted, tt.plainText) {
+				t.Errorf("Decrypt() = %q, want %q", decrypted, tt.plainText)
+			}
+		})
+	}
+}
+
+func TestEncryptUsesNewDataKeys(t *testing.T) {
+	initTestKeys(t, "a="+testKeyA, "")
+
+	first, err := Encrypt([]byte("token"), testPath)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %v", err)
+	}
+	second, err := Encrypt([]byte("token"), testPath)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %v", err)
+	}
+	if bytes.Equal(first, second) {
+		t.Errorf("Encrypt() returned the same value twice for the same plain text")
+	}
+}
+
+func TestDecryptPlainValue(t *testing.T) {
+	initTestKeys(t, "a="+testKeyA, "")
+
+	for _, value := range []string{"", "plain token", "{\"url\":\"http://mfg\"}"} {
+		got, err := Decrypt([]byte(value), testPath)
+		if err != nil {
+			t.Errorf("Decrypt(%q) returned error: %v", value, err)
+		} else if string(got) != value {
+			t.Errorf("Decrypt(%q) = %q, want it unchanged", value, got)
+		}
+	}
+}
+
+func TestDecryptAfterKeyRotation(t *testing.T) {
+	initTestKeys(t, "a="+testKeyA, "")
+	oldValue, err := Encrypt([]byte("old secret"), testPath)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %v", err)
+	}
+
+	// Add key b and make it active. Values encrypted with a can still be read, and new values use b.
+	initTestKeys(t, "a="+testKeyA+",b="+testKeyB, "b")
+	if got, err := Decrypt(oldValue, testPath); err != nil {
+		t.Fatalf("Decrypt() of the value encrypted with the old key returned error: %v", err)
+	} else if string(got) != "old secret" {
+		t.Errorf("Decrypt() = %q, want %q", got, "old secret")
+	}
+	newValue, err := Encrypt([]byte("new secret"), testPath)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %v", err)
+	}
+	if got := KeyIdOf(newValue); got != "b" {
+		t.Errorf("KeyIdOf() of a new value = %q, want %q", got, "b")
+	}
+	if got := KeyIdOf(oldValue); got != "a" {
+		t.Errorf("KeyIdOf() of the old value = %q, want %q", got, "a")
+	}
+
+	// Once key a is removed, only the values that were re-encrypted with b can be read
+	initTestKeys(t, "b="+testKeyB, "")
+	if _, err := Decrypt(oldValue, testPath); err == nil {
+		t.Errorf("Decrypt() of a value encrypted with a removed key succeeded, want error")
+	}
+	if got, err := Decrypt(newValue, testPath); err != nil {
+		t.Errorf("Decrypt() returned error: %v", err)
+	} else if string(got) != "new secret" {
+		t.Errorf("Decrypt() = %q, want %q", got, "new secret")
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	initTestKeys(t, "a="+testKeyA+",b="+testKeyB, "a")
+	encrypted, err := Encrypt([]byte("secret"), testPath)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		value []byte
+	}{
+		{"data", tamper(t, encrypted, func(env *envelope) { env.Data = flipLastByte(t, env.Data) })},
+		{"wrapped key", tamper(t, encrypted, func(env *envelope) { env.WrappedKey = flipLastByte(t, env.WrappedKey) })},
+		{"key id", tamper(t, encrypted, func(env *envelope) { env.KeyId = "b" })},
+		{"unknown key id", tamper(t, encrypted, func(env *envelope) { env.KeyId = "c" })},
+		{"truncated data", tamper(t, encrypted, func(env *envelope) { env.Data = base64.StdEncoding.EncodeToString([]byte("short")) })},
+		{"invalid base64 data", tamper(t, encrypted, func(env *envelope) { env.Data = "!!!" })},
+		{"invalid envelope", []byte(envelopePrefix + "not base64!")},
+		{"invalid envelope json", []byte(envelopePrefix + base64.StdEncoding.EncodeToString([]byte("{")))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := Decrypt(tt.value, testPath); err == nil {
+				t.Errorf("Decrypt() = %q, want error", got)
+			}
+		})
+	}
+}
+
+// A value copied to another file, e.g. the node token of another device, must not decrypt
+func TestDecryptOtherPath(t *testing.T) {
+	initTestKeys(t, "a="+testKeyA, "")
+	encrypted, err := Encrypt([]byte("secret"), testPath)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %v", err)
+	}
+
+	for _, path := range []string{
+		"v1/devices/0a1b2c3d-0000-1111-2222-000000000012/nodeToken.txt",
+		"v1/devices/0a1b2c3d-0000-1111-2222-000000000011/ownership_voucher.txt",
+		"v1/values/0a1b2c3d-0000-1111-2222-000000000011_exec",
+		"",
+	} {
+		if got, err := Decrypt(encrypted, path); err == nil {
+			t.Errorf("Decrypt() with path %q = %q, want error", path, got)
+		}
+	}
+}
+
+func TestDecryptKeyIdOnlyFormat(t *testing.T) {
+	initTestKeys(t, "a="+testKeyA, "")
+
+	// Values encrypted before the path was bound to them can still be read (with any path), until they are re-encrypted
+	value := encryptKeyIdOnly(t, []byte("old token"))
+	if !IsEncrypted(value) {
+		t.Errorf("IsEncrypted() of an enc:v2 value = false, want true")
+	}
+	if got := KeyIdOf(value); got != "a" {
+		t.Errorf("KeyIdOf() of an enc:v2 value = %q, want %q", got, "a")
+	}
+	if got, err := Decrypt(value, testPath); err != nil {
+		t.Fatalf("Decrypt() of an enc:v2 value returned error: %v", err)
+	} else if string(got) != "old token" {
+		t.Errorf("Decrypt() = %q, want %q", got, "old token")
+	}
+}
+
+func TestDecryptLegacyFormatRejected(t *testing.T) {
+	initTestKeys(t, "a="+testKeyA, "")
+
+	// The enc:v1 format (a value sealed directly with the key, w/o a key id) is not supported, and must not be returned as plain text
+	sealed, err := seal(ring.keys["a"], []byte("legacy token"), nil)
+	if err != nil {
+		t.Fatalf("seal() returned error: %v", err)
+	}
+	legacyValue := []byte("enc:v1:" + base64.StdEncoding.EncodeToString(sealed))
+	if IsEncrypted(legacyValue) {
+		t.Errorf("IsEncrypted() of an enc:v1 value = true, want false")
+	}
+	if got, err := Decrypt(legacyValue, testPath); err == nil {
+		t.Errorf("Decrypt() of an enc:v1 value = %q, want error", got)
+	} else if !strings.Contains(err.Error(), "v1") {
+		t.Errorf("Decrypt() error = %v, want it to name the v1 format", err)
+	}
+}
+
+func TestInitKeys(t *testing.T) {
+	tests := []struct {
+		name          string
+		keys          string
+		secretKey     string
+		activeId      string
+		allowLocalKey string
+		wantActiveId  string
+		wantLocalKey  bool
+		wantErr       bool
+	}{
+		{name: "no keys", wantErr: true},
+		{name: "local key allowed", allowLocalKey: "true", wantActiveId: "local", wantLocalKey: true},
+		{name: "local key not allowed", allowLocalKey: "false", wantErr: true},
+		{name: "keys", keys: "a=" + testKeyA + ",b=" + testKeyB, wantActiveId: "a"},
+		{name: "active key id", keys: "a=" + testKeyA + ",b=" + testKeyB, activeId: "b", wantActiveId: "b"},
+		{name: "keys with local key allowed", keys: "a=" + testKeyA, allowLocalKey: "true", wantActiveId: "a"},
+		{name: "secret key", secretKey: testKeyA, wantActiveId: "default"},
+		{name: "unknown active key id", keys: "a=" + testKeyA, activeId: "c", wantErr: true},
+		{name: "duplicate key id", keys: "a=" + testKeyA + ",a=" + testKeyB, wantErr: true},
+		{name: "short key", keys: "a=" + base64.StdEncoding.EncodeToString([]byte("short")), wantErr: true},
+		{name: "invalid base64", keys: "a=!!!", wantErr: true},
+		{name: "no key id", keys: testKeyA, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ocsDbDir := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(ocsDbDir, "v1", "creds"), 0750); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv(KeysFileEnvVar, "")
+			t.Setenv(KeysEnvVar, tt.keys)
+			t.Setenv(SecretKeyEnvVar, tt.secretKey)
+			t.Setenv(ActiveKeyIdEnvVar, tt.activeId)
+			t.Setenv(AllowLocalKeyEnvVar, tt.allowLocalKey)
+
+			err := InitKeys(ocsDbDir)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("InitKeys() succeeded, want error")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("InitKeys() returned error: %v", err)
+			}
+			if got := ActiveKeyId(); got != tt.wantActiveId {
+				t.Errorf("ActiveKeyId() = %q, want %q", got, tt.wantActiveId)
+			}
+			localKeyFileName := filepath.Join(ocsDbDir, "v1", "creds", LocalKeyFileName)
+			if got := outils.PathExists(localKeyFileName); got != tt.wantLocalKey {
+				t.Errorf("local key file exists = %v, want %v", got, tt.wantLocalKey)
+			}
+		})
+	}
+}
+
+func TestInitKeysLoadsExistingLocalKey(t *testing.T) {
+	ocsDbDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(ocsDbDir, "v1", "creds"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(KeysFileEnvVar, "")
+	t.Setenv(SecretKeyEnvVar, "")
+	t.Setenv(ActiveKeyIdEnvVar, "")
+	t.Setenv(KeysEnvVar, "")
+	t.Setenv(AllowLocalKeyEnvVar, "true")
+	if err := InitKeys(ocsDbDir); err != nil {
+		t.Fatalf("InitKeys() returned error: %v", err)
+	}
+	localValue, err := Encrypt([]byte("local secret"), testPath)
+	if err != nil {
+		t.Fatalf("Encrypt() returned error: %v", err)
+	}
+
+	// After switching to a configured key, the values encrypted with the local key can still be read, so they can be re-encrypted
+	t.Setenv(KeysEnvVar, "a="+testKeyA)
+	t.Setenv(AllowLocalKeyEnvVar, "")
+	if err := InitKeys(ocsDbDir); err != nil {
+		t.Fatalf("InitKeys() returned error: %v", err)
+	}
+	if got := ActiveKeyId(); got != "a" {
+		t.Errorf("ActiveKeyId() = %q, want %q", got, "a")
+	}
+	if got, err := Decrypt(localValue, testPath); err != nil {
+		t.Errorf("Decrypt() of a value encrypted with the local key returned error: %v", err)
+	} else if string(got) != "local secret" {
+		t.Errorf("Decrypt() = %q, want %q", got, "local secret")
+	}
+}
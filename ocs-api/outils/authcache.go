@@ -0,0 +1,84 @@
+package outils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-horizon/FDO-support/ocs-api/metrics"
+)
+
+// Cache of successful exchange authentications, so a client making several calls in a row doesn't cause an exchange call for each.
+// Entries are keyed by a hash of the credentials, so the cache never holds a password or key. The ttl is set by the
+// EXCHANGE_AUTH_CACHE_TTL env var (in seconds, default 60). Setting it to 0 disables the cache.
+
+const DefaultAuthCacheTtlS = 60
+const maxAuthCacheEntries = 1000
+
+type authCacheEntry struct {
+	user    string
+	isAdmin bool
+	expires time.Time
+}
+
+type authCacheType struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	entries map[string]authCacheEntry
+}
+
+var authCache *authCacheType
+var authCacheOnce sync.Once
+
+func getAuthCache() *authCacheType {
+	authCacheOnce.Do(func() {
+		authCache = &authCacheType{
+			ttl:     time.Duration(GetEnvVarIntWithDefault("EXCHANGE_AUTH_CACHE_TTL", DefaultAuthCacheTtlS)) * time.Second,
+			entries: map[string]authCacheEntry{},
+		}
+	})
+	return authCache
+}
+
+func authCacheKey(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *authCacheType) get(key string) (authCacheEntry, bool) {
+	if c.ttl <= 0 {
+		return authCacheEntry{}, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		metrics.ExchangeAuthCache.WithLabelValues("miss").Inc()
+		return authCacheEntry{}, false
+	}
+	metrics.ExchangeAuthCache.WithLabelValues("hit").Inc()
+	return entry, true
+}
+
+func (c *authCacheType) put(key, user string, isAdmin bool) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if len(c.entries) >= maxAuthCacheEntries {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxAuthCacheEntries {
+			c.entries = map[string]authCacheEntry{} // all still valid, so just start over
+		}
+	}
+	c.entries[key] = authCacheEntry{user: user, isAdmin: isAdmin, expires: now.Add(c.ttl)}
+}
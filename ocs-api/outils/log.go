@@ -0,0 +1,213 @@
+package outils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	urlpkg "net/url"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Structured logging for ocs-api. Settings come from these env vars:
+//	LOG_LEVEL:             debug, info (the default), warn, or error. VERBOSE=true is the same as LOG_LEVEL=debug.
+//	LOG_FORMAT:            text (the default) or json
+//	LOG_MAX_PAYLOAD_BYTES: string values longer than this are truncated in the log. Default is 512.
+// Attributes with sensitive names (tokens, passwords, voucher and resource contents, etc.) are always redacted, and PEM blocks and
+// URL credentials are removed from all logged strings.
+
+const (
+	RequestIdHeader        = "X-Request-ID"
+	DefaultMaxPayloadBytes = 512
+	redacted               = "[REDACTED]"
+)
+
+// The global logger. Use LogFor(r) in route handlers, so the log entries include the request id.
+var Log = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{ReplaceAttr: redactAttr}))
+
+var IsVerbose bool
+var maxPayloadBytes = DefaultMaxPayloadBytes
+
+// Attribute keys whose values are never logged. Keys are compared in snake case, so nodeToken, node-token, and node_token are the
+// same. The generic words only match the whole key, so e.g. key_id and cert_expiry are still logged.
+var sensitiveKeys = []string{"token", "password", "pw", "pwd", "api_key", "apikey", "authorization", "secret", "secret_key", "private_key", "key", "voucher", "body", "content", "resource", "exec_cmd", "certificate", "cert"}
+
+// Attribute key suffixes (after a separator) whose values are never logged, e.g. node_token and owner_api_password
+var sensitiveKeySuffixes = []string{"_token", "_password", "_pw", "_pwd", "_api_key", "_apikey", "_secret", "_secret_key", "_private_key", "_voucher"}
+
+var pemRegex = regexp.MustCompile(`(?s)-----BEGIN [A-Z0-9 ]+-----.*?(-----END [A-Z0-9 ]+-----|$)`)
+var urlCredsRegex = regexp.MustCompile(`(https?://)[^/@\s]+@`)
+var nodeAuthRegex = regexp.MustCompile(`(-a\s+[^:\s]+:)\S+`) // the node id and token passed to agent-install-wrapper.sh
+
+type requestIdKey struct{}
+
+// Initialize the global logger from the env vars
+func InitLogger() {
+	level := slog.LevelInfo
+	switch strings.ToLower(GetEnvVarWithDefault("LOG_LEVEL", "info")) {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn", "warning":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	}
+	v := GetEnvVarWithDefault("VERBOSE", "false")
+	if v == "1" || strings.ToLower(v) == "true" {
+		level = slog.LevelDebug
+	}
+	IsVerbose = level == slog.LevelDebug
+	maxPayloadBytes = GetEnvVarIntWithDefault("LOG_MAX_PAYLOAD_BYTES", DefaultMaxPayloadBytes)
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	if strings.ToLower(GetEnvVarWithDefault("LOG_FORMAT", "text")) == "json" {
+		Log = slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	} else {
+		Log = slog.New(slog.NewTextHandler(os.Stderr, opts))
+	}
+	slog.SetDefault(Log)
+}
+
+// Returns the logger for this request, which includes the request id
+func LogFor(r *http.Request) *slog.Logger {
+	return LogCtx(r.Context())
+}
+
+// Returns the logger for this context, which includes the request id and trace id (if they are in the context)
+func LogCtx(ctx context.Context) *slog.Logger {
+	logger := Log
+	if reqId, ok := ctx.Value(requestIdKey{}).(string); ok {
+		logger = logger.With("request_id", reqId)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		logger = logger.With("trace_id", sc.TraceID().String())
+	}
+	return logger
+}
+
+// Returns the request id stored in this context, or ""
+func RequestId(ctx context.Context) string {
+	reqId, _ := ctx.Value(requestIdKey{}).(string)
+	return reqId
+}
+
+// Wrap a handler so each request gets a request id (from the X-Request-ID header if the client gave a valid one), which is
+// returned in the response header and included in all log entries for the request.
+func WithRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqId := r.Header.Get(RequestIdHeader)
+		if !isValidRequestId(reqId) {
+			reqId = newRequestId()
+		}
+		w.Header().Set(RequestIdHeader, reqId)
+		r = r.WithContext(context.WithValue(r.Context(), requestIdKey{}, reqId))
+		LogFor(r).Debug("handling request", "method", r.Method, "path", r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isValidRequestId(reqId string) bool {
+	if reqId == "" || len(reqId) > 64 {
+		return false
+	}
+	for _, c := range reqId {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// Returns a version of this url that is safe to log: no credentials and no query parameters
+func SafeUrl(url string) string {
+	parsedUrl, err := urlpkg.Parse(url)
+	if err != nil {
+		return Scrub(url)
+	}
+	parsedUrl.User = nil
+	parsedUrl.RawQuery = ""
+	return parsedUrl.String()
+}
+
+// Remove PEM blocks, url credentials, and node tokens from this string, and truncate it to the max payload size
+func Scrub(s string) string {
+	s = pemRegex.ReplaceAllString(s, "[REDACTED PEM]")
+	s = urlCredsRegex.ReplaceAllString(s, "${1}"+redacted+"@")
+	s = nodeAuthRegex.ReplaceAllString(s, "${1}"+redacted)
+	if maxPayloadBytes > 0 && len(s) > maxPayloadBytes {
+		s = fmt.Sprintf("%s...(truncated %d bytes)", s[:maxPayloadBytes], len(s)-maxPayloadBytes)
+	}
+	return s
+}
+
+// Returns true if this attribute key is in sensitiveKeys, or ends with one of sensitiveKeySuffixes
+func isSensitiveKey(key string) bool {
+	k := snakeCase(key)
+	for _, s := range sensitiveKeys {
+		if k == s {
+			return true
+		}
+	}
+	for _, s := range sensitiveKeySuffixes {
+		if strings.HasSuffix(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Convert a camelCase, kebab-case, or snake_case key to lower snake case
+func snakeCase(key string) string {
+	var b strings.Builder
+	for i, c := range key {
+		switch {
+		case c == '-':
+			b.WriteByte('_')
+		case unicode.IsUpper(c):
+			if i > 0 && (unicode.IsLower(rune(key[i-1])) || unicode.IsDigit(rune(key[i-1]))) {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToLower(c))
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// slog ReplaceAttr func that redacts sensitive attributes and scrubs all string values
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.TimeKey || a.Key == slog.LevelKey {
+		return a
+	}
+	if a.Key != slog.MessageKey && isSensitiveKey(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Scrub(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, Scrub(err.Error()))
+		}
+		if b, ok := a.Value.Any().([]byte); ok {
+			return slog.String(a.Key, Scrub(string(b)))
+		}
+	}
+	return a
+}
@@ -1,6 +1,7 @@
 package outils
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
@@ -9,7 +10,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	mrand "math/rand"
 	"net"
 	"net/http"
@@ -20,6 +20,11 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	dab "github.com/Snawoot/go-http-digest-auth-client"
+	"github.com/open-horizon/FDO-support/ocs-api/metrics"
+	"github.com/open-horizon/FDO-support/ocs-api/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Utilities for ocs-api
@@ -30,7 +35,6 @@ const (
 	HTTPIdleConnectionTimeoutS = 120
 )
 
-var IsVerbose bool
 var HttpClient *http.Client
 
 // A "subclass" of error that also contains the http code that should be sent to the client
@@ -81,7 +85,7 @@ func IsValidPostBinary(r *http.Request) *HttpError {
 func ParseJsonString(jsonBytes []byte, bodyStruct interface{}) *HttpError {
 	err := json.Unmarshal(jsonBytes, bodyStruct)
 	if err != nil {
-		return NewHttpError(http.StatusBadRequest, "Error parsing request body json bytes: "+err.Error())
+		return NewHttpError(http.StatusBadRequest, "Error parsing request body json bytes: %v", err)
 	}
 	return nil
 }
@@ -94,9 +98,9 @@ func ReadJsonBody(r *http.Request, bodyStruct interface{}) *HttpError {
 	err := decoder.Decode(bodyStruct)
 	if err != nil {
 		if errors.As(err, &unmarshalErr) {
-			return NewHttpError(http.StatusBadRequest, "Bad Request. Wrong Type provided for field "+unmarshalErr.Field)
+			return NewHttpError(http.StatusBadRequest, "Bad Request. Wrong Type provided for field %s", unmarshalErr.Field)
 		} else {
-			return NewHttpError(http.StatusBadRequest, "Bad Request "+err.Error())
+			return NewHttpError(http.StatusBadRequest, "Bad Request %v", err)
 		}
 	}
 	return nil
@@ -118,7 +122,7 @@ func WriteResponse(httpCode int, w http.ResponseWriter, bodyBytes []byte) {
 	w.WriteHeader(httpCode) // seems like this has to be before writing the body
 	_, err := w.Write(bodyBytes)
 	if err != nil {
-		Error(err.Error())
+		Log.Error("could not write response", "error", err)
 	}
 }
 
@@ -136,7 +140,7 @@ func GenerateNodeToken() (string, *HttpError) {
 	// pad out the password to make it <=15 chars
 	bytes := make([]byte, 63)
 	if _, err := rand.Read(bytes); err != nil {
-		return "", NewHttpError(http.StatusInternalServerError, "Error reading random bytes for node token: "+err.Error())
+		return "", NewHttpError(http.StatusInternalServerError, "Error reading random bytes for node token: %v", err)
 	}
 	randStr += base64.URLEncoding.EncodeToString(bytes)
 
@@ -152,7 +156,7 @@ func GenerateNodeToken() (string, *HttpError) {
 	bytes := make([]byte, 22) // 44 hex chars
 	_, err := rand.Read(bytes)
 	if err != nil {
-		return "", NewHttpError(http.StatusInternalServerError, "Error creating random bytes for node token: "+err.Error())
+		return "", NewHttpError(http.StatusInternalServerError, "Error creating random bytes for node token: %v", err)
 	}
 	return hex.EncodeToString(bytes), nil
 	*/
@@ -167,48 +171,9 @@ func MakeExecCmd(execString string) string {
 	return returnStr + "\x00"
 }
 
-// Initialize the verbose setting
-func SetVerbose() {
-	v := GetEnvVarWithDefault("VERBOSE", "false")
-	if v == "1" || strings.ToLower(v) == "true" {
-		IsVerbose = true
-	} else {
-		IsVerbose = false
-	}
-}
-
-// Print error msg to stderr
-func Verbose(msg string, args ...interface{}) {
-	if !IsVerbose {
-		return
-	}
-	if !strings.HasSuffix(msg, "\n") {
-		msg += "\n"
-	}
-	fmt.Printf("Verbose: "+msg, args...)
-}
-
-// Print warning msg to stderr
-func Warning(msg string, args ...interface{}) {
-	if !strings.HasSuffix(msg, "\n") {
-		msg += "\n"
-	}
-	l := log.New(os.Stderr, "", 0)
-	l.Printf("Warning: "+msg, args...)
-}
-
-// Print error msg to stderr
-func Error(msg string, args ...interface{}) {
-	if !strings.HasSuffix(msg, "\n") {
-		msg += "\n"
-	}
-	l := log.New(os.Stderr, "", 0)
-	l.Printf("Error: "+msg, args...)
-}
-
-// Print error msg to stderr and exit with the specified code
+// Log error msg and exit with the specified code
 func Fatal(exitCode int, msg string, args ...interface{}) {
-	Error(msg, args...)
+	Log.Error(fmt.Sprintf(msg, args...))
 	os.Exit(exitCode)
 }
 
@@ -234,6 +199,19 @@ func GetEnvVarIntWithDefault(envVarName string, defaultValue int) int {
 	return envVarInt
 }
 
+// Get this environment variable as a bool (true/false or 1/0) or use this default. Exits with error if the value is not a valid bool.
+func GetEnvVarBoolWithDefault(envVarName string, defaultValue bool) bool {
+	envVarStr := os.Getenv(envVarName)
+	if envVarStr == "" {
+		return defaultValue
+	}
+	envVarBool, err := strconv.ParseBool(envVarStr)
+	if err != nil {
+		Fatal(1, "environment variable %s value %s must be true or false", envVarName, envVarStr)
+	}
+	return envVarBool
+}
+
 // Returns true if this env var is set
 func IsEnvVarSet(envVarName string) bool {
 	return os.Getenv(envVarName) != ""
@@ -274,10 +252,10 @@ func CopyFile(fromFileName, toFileName string, perm os.FileMode) *HttpError {
 	var content []byte
 	var err error
 	if content, err = os.ReadFile(fromFileName); err != nil {
-		return NewHttpError(http.StatusInternalServerError, "could not read "+fromFileName+": "+err.Error())
+		return NewHttpError(http.StatusInternalServerError, "could not read %s: %v", fromFileName, err)
 	}
 	if err = os.WriteFile(toFileName, content, perm); err != nil {
-		return NewHttpError(http.StatusInternalServerError, "could not write "+toFileName+": "+err.Error())
+		return NewHttpError(http.StatusInternalServerError, "could not write %s: %v", toFileName, err)
 	}
 	return nil
 }
@@ -314,53 +292,89 @@ type GetUsersResponse struct {
 	LastIndex int                       `json:"lastIndex"`
 }
 
-// Verify (with retries) we can communicate with the exchange with the specified connection info. Exits with fatal error if we can't.
-func VerifyExchangeConnection(currentExchangeUrl, certificatePath string, retries, interval int) {
-	method := http.MethodGet
+// Try once to communicate with the exchange with the specified connection info, by getting its version
+func CheckExchangeConnection(ctx context.Context, currentExchangeUrl, certificatePath string) error {
 	url := fmt.Sprintf("%v/admin/version", currentExchangeUrl)
-	fmt.Printf("Verifying connection to Exchange %s ...\n", currentExchangeUrl)
-
-	// Create an HTTP request object to the exchange.
-	req, err := http.NewRequest(method, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		Fatal(3, "unable to create HTTP request for %s, error: %v", url, err)
+		return fmt.Errorf("unable to create HTTP request for %s, error: %v", url, err)
 	}
 	httpClient, httpErr := GetHTTPClient(certificatePath) // if certificatePath=="" then it won't use a cert
 	if httpErr != nil {
-		Fatal(3, "unable to get HTTP client for %s, error: %v", url, httpErr.Error())
+		return fmt.Errorf("unable to get HTTP client for %s, error: %v", url, httpErr.Error())
 	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to send HTTP request to %s, error: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected http status code received from %s: %d", url, resp.StatusCode)
+	}
+	return nil
+}
 
-	// Send the request to get the version
-	success := false
-	for i := 1; i <= retries; i++ {
-		whatsNext := fmt.Sprintf("Will retry in %d seconds.", interval)
-		if i == retries {
-			whatsNext = "Number of retries exhausted, giving up."
-		}
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			fmt.Printf("Unable to send HTTP request to %s, message: %v . %s\n", url, err, whatsNext)
-		} else if resp.StatusCode != http.StatusOK {
-			fmt.Printf("Unable to connect to the %s and get its version. HTTP code: %d . %s\n", url, resp.StatusCode, whatsNext)
-		} else { // the connection to the exchange succeeded
-			success = true
-			break
-		}
-		time.Sleep(time.Duration(interval) * time.Second)
+// Verify the request credentials with the exchange. Returns true/false and the user (if true), or error
+func ExchangeAuthenticate(r *http.Request, currentExchangeUrl, deviceOrgId, certificatePath string) (bool, string, *HttpError) {
+	authenticated, user, _, httpErr := exchangeAuthenticateUser(r, currentExchangeUrl, deviceOrgId, certificatePath)
+	return authenticated, user, httpErr
+}
+
+// Verify the request credentials with the exchange and that the user is an admin of the device org (or is the exchange root user).
+// Returns true/false and the user (if true), or error
+func ExchangeAuthenticateAdmin(r *http.Request, currentExchangeUrl, deviceOrgId, certificatePath string) (bool, string, *HttpError) {
+	authenticated, user, isAdmin, httpErr := exchangeAuthenticateUser(r, currentExchangeUrl, deviceOrgId, certificatePath)
+	if httpErr != nil || !authenticated {
+		return false, "", httpErr
 	}
+	return isAdmin, user, nil
+}
+
+// Verify the request credentials are the exchange root user's, for the routes that manage the whole service instead of 1 org.
+// Returns true/false, or error
+func ExchangeAuthenticateRoot(r *http.Request, currentExchangeUrl, certificatePath string) (bool, *HttpError) {
+	credOrgId, user, _, ok := GetBasicAuth(r)
+	if !ok || credOrgId != "root" || user != "root" {
+		return false, nil
+	}
+	authenticated, _, _, httpErr := exchangeAuthenticateUser(r, currentExchangeUrl, "root", certificatePath)
+	return authenticated, httpErr
+}
 
-	if success {
-		fmt.Printf("Successfully connected to Exchange %s\n", currentExchangeUrl)
+// Verify the request credentials with the exchange (or the cache of recent successful authentications). Returns true/false, the
+// user (if true), whether the user is an org admin, or error
+func exchangeAuthenticateUser(r *http.Request, currentExchangeUrl, deviceOrgId, certificatePath string) (bool, string, bool, *HttpError) {
+	credOrgId, user, pwOrKey, ok := GetBasicAuth(r)
+	if !ok {
+		return false, "", false, nil
+	}
+
+	ctx, span := tracing.Start(r.Context(), "ExchangeAuthenticate", attribute.String("org", deviceOrgId))
+	cache := getAuthCache()
+	cacheKey := authCacheKey(currentExchangeUrl, deviceOrgId, credOrgId, user, pwOrKey)
+	if entry, ok := cache.get(cacheKey); ok {
+		span.SetAttributes(attribute.Bool("cache_hit", true), attribute.Bool("authenticated", true))
+		tracing.End(span, nil)
+		return true, entry.user, entry.isAdmin, nil
+	}
+	authenticated, exUser, isAdmin, httpErr := exchangeConfirmUser(r.WithContext(ctx), currentExchangeUrl, deviceOrgId, certificatePath)
+	if httpErr == nil && authenticated {
+		cache.put(cacheKey, exUser, isAdmin)
+	}
+	span.SetAttributes(attribute.Bool("cache_hit", false), attribute.Bool("authenticated", authenticated))
+	if httpErr != nil {
+		tracing.End(span, httpErr)
 	} else {
-		Fatal(3, "could not connect to Exchange %s in %d attempts", currentExchangeUrl, retries)
+		tracing.End(span, nil)
 	}
+	return authenticated, exUser, isAdmin, httpErr
 }
 
-// Verify the request credentials with the exchange. Returns true/false and the user (if true), or error
-func ExchangeAuthenticate(r *http.Request, currentExchangeUrl, deviceOrgId, certificatePath string) (bool, string, *HttpError) {
+// Call the exchange to verify the request credentials. Returns true/false, the user (if true), whether the user is an org admin, or error
+func exchangeConfirmUser(r *http.Request, currentExchangeUrl, deviceOrgId, certificatePath string) (bool, string, bool, *HttpError) {
 	credOrgId, user, pwOrKey, ok := GetBasicAuth(r)
 	if !ok {
-		return false, "", nil
+		return false, "", false, nil
 	}
 
 	// Get certificate
@@ -383,7 +397,7 @@ func ExchangeAuthenticate(r *http.Request, currentExchangeUrl, deviceOrgId, cert
 
 		parsedUrl, err := urlpkg.Parse(fmt.Sprintf("%v/orgs/%v/users", currentExchangeUrl, deviceOrgId))
 		if err != nil {
-			return false, "", NewHttpError(http.StatusBadRequest, "invalid URL: %v", err)
+			return false, "", false, NewHttpError(http.StatusBadRequest, "invalid URL: %v", err)
 		}
 		url = parsedUrl.String()
 		goodStatusCode = http.StatusOK
@@ -392,7 +406,7 @@ func ExchangeAuthenticate(r *http.Request, currentExchangeUrl, deviceOrgId, cert
 		// Note: POST /orgs/{orgid}/users/{username}/confirm only confirms that the creds can read its own user resource. This is sufficient if the creds are in
 		//		the same org as the device, so we need to catch the case when the aren't.
 		if credOrgId != deviceOrgId {
-			return false, "", NewHttpError(http.StatusUnauthorized, "the org id of the credentials ("+credOrgId+") does not match the org id of the SDO device ("+deviceOrgId+")")
+			return false, "", false, NewHttpError(http.StatusUnauthorized, "the org id of the credentials (%s) does not match the org id of the SDO device (%s)", credOrgId, deviceOrgId)
 		}
 		//method = http.MethodPost
 		//url = fmt.Sprintf("%v/orgs/%v/users/%v/confirm", currentExchangeUrl, credOrgId, user)
@@ -404,18 +418,18 @@ func ExchangeAuthenticate(r *http.Request, currentExchangeUrl, deviceOrgId, cert
 
 		parsedUrl, err := urlpkg.Parse(fmt.Sprintf("%v/orgs/%v/users/%v", currentExchangeUrl, credOrgId, user))
 		if err != nil {
-			return false, "", NewHttpError(http.StatusBadRequest, "invalid URL: %v", err)
+			return false, "", false, NewHttpError(http.StatusBadRequest, "invalid URL: %v", err)
 		}
 		url = parsedUrl.String()
 		goodStatusCode = http.StatusOK
 	}
 	apiMsg := fmt.Sprintf("%v %v", method, url)
-	Verbose("confirming credentials via %s", apiMsg)
+	LogFor(r).Debug("confirming credentials with the exchange", "method", method, "url", url)
 
 	// Create an outgoing HTTP request to the exchange.
-	req, err := http.NewRequest(method, url, nil)
+	req, err := http.NewRequestWithContext(r.Context(), method, url, nil)
 	if err != nil {
-		return false, "", NewHttpError(http.StatusInternalServerError, "unable to create HTTP request for %s, error: %v", apiMsg, err)
+		return false, "", false, NewHttpError(http.StatusInternalServerError, "unable to create HTTP request for %s, error: %v", apiMsg, err)
 	}
 
 	// Add the basic auth header so that the exchange will authenticate.
@@ -425,43 +439,204 @@ func ExchangeAuthenticate(r *http.Request, currentExchangeUrl, deviceOrgId, cert
 	// Send the request to verify the user.
 	httpClient, httpErr := GetHTTPClient(certPath)
 	if httpErr != nil {
-		return false, "", httpErr
+		return false, "", false, httpErr
 	}
 	resp, err := httpClient.Do(req) //todo: retry, when necessary, like CSS does
 	if err != nil {
-		return false, "", NewHttpError(http.StatusInternalServerError, "unable to send HTTP request for %s, error: %v", apiMsg, err)
+		return false, "", false, NewHttpError(http.StatusInternalServerError, "unable to send HTTP request for %s, error: %v", apiMsg, err)
 	} else if resp.StatusCode == goodStatusCode {
 		// They are authenticated, not get the real user (because the cred user could be iamapikey)
 		if credOrgId == "root" && user == "root" {
-			return true, "root", nil
+			return true, "root", true, nil
 		}
 		// Non-root user, parse the response body to get the real user
 		users := new(GetUsersResponse)
 		if bodyBytes, err := io.ReadAll(resp.Body); err != nil {
-			return false, "", NewHttpError(http.StatusInternalServerError, "unable to read HTTP response body for %s, error: %v", apiMsg, err)
+			return false, "", false, NewHttpError(http.StatusInternalServerError, "unable to read HTTP response body for %s, error: %v", apiMsg, err)
 		} else if err = json.Unmarshal(bodyBytes, users); err != nil {
-			return false, "", NewHttpError(http.StatusInternalServerError, "unable to unmarshal HTTP response body for %s, error: %v", apiMsg, err)
+			return false, "", false, NewHttpError(http.StatusInternalServerError, "unable to unmarshal HTTP response body for %s, error: %v", apiMsg, err)
 		} else {
 			for key, userInfo := range users.Users { // there is only 1 entry in this map, but we don't know the key, so loop thru the 1st one
 				// key is {orgid}/{username}
 				orgAndUsername := strings.Split(key, "/")
 				if len(orgAndUsername) != 2 {
-					return false, "", NewHttpError(http.StatusInternalServerError, "user response from exchange in unexpected format for %s, error: %v", apiMsg, err)
+					return false, "", false, NewHttpError(http.StatusInternalServerError, "user response from exchange in unexpected format for %s, error: %v", apiMsg, err)
 				}
 				exUsername := orgAndUsername[1]
 				if userInfo.HubAdmin {
-					return false, "", nil // hub admins can't manage devices
+					return false, "", false, nil // hub admins can't manage devices
 				} else {
-					return true, exUsername, nil
+					return true, exUsername, userInfo.Admin, nil
 				}
 			}
-			return false, "", nil // will never get here, but have to satisfy the compiler
+			return false, "", false, nil // will never get here, but have to satisfy the compiler
 		}
 	} else if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
-		return false, "", nil
+		return false, "", false, nil
 	} else {
-		return false, "", NewHttpError(resp.StatusCode, "unexpected http status code received from %s: %d", apiMsg, resp.StatusCode)
+		return false, "", false, NewHttpError(resp.StatusCode, "unexpected http status code received from %s: %d", apiMsg, resp.StatusCode)
+	}
+}
+
+// Update the token of the exchange node for this device, using the credentials of the request. Returns false (and no error) if the
+// node does not exist in the exchange yet, which is the normal case before the device has been onboarded.
+func ExchangeUpdateNodeToken(r *http.Request, currentExchangeUrl, deviceOrgId, nodeId, nodeToken, certificatePath string) (bool, *HttpError) {
+	credOrgId, user, pwOrKey, ok := GetBasicAuth(r)
+	if !ok {
+		return false, NewHttpError(http.StatusUnauthorized, "invalid exchange credentials provided")
+	}
+
+	certPath := ""
+	if PathExists(certificatePath) {
+		certPath = certificatePath
+	}
+	if !strings.HasPrefix(currentExchangeUrl, "http://") && !strings.HasPrefix(currentExchangeUrl, "https://") {
+		currentExchangeUrl = "http://" + currentExchangeUrl
+	}
+	parsedUrl, err := urlpkg.Parse(fmt.Sprintf("%v/orgs/%v/nodes/%v", currentExchangeUrl, deviceOrgId, urlpkg.PathEscape(nodeId)))
+	if err != nil {
+		return false, NewHttpError(http.StatusBadRequest, "invalid URL: %v", err)
+	}
+	apiMsg := fmt.Sprintf("%v %v", http.MethodPatch, parsedUrl.String())
+	LogFor(r).Debug("updating exchange node token", "method", http.MethodPatch, "url", parsedUrl.String())
+
+	bodyBytes, err := json.Marshal(map[string]string{"token": nodeToken})
+	if err != nil {
+		return false, NewHttpError(http.StatusInternalServerError, "unable to marshal body for %s, error: %v", apiMsg, err)
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPatch, parsedUrl.String(), strings.NewReader(string(bodyBytes)))
+	if err != nil {
+		return false, NewHttpError(http.StatusInternalServerError, "unable to create HTTP request for %s, error: %v", apiMsg, err)
+	}
+	req.SetBasicAuth(credOrgId+"/"+user, pwOrKey)
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", "application/json")
+
+	httpClient, httpErr := GetHTTPClient(certPath)
+	if httpErr != nil {
+		return false, httpErr
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, NewHttpError(http.StatusInternalServerError, "unable to send HTTP request for %s, error: %v", apiMsg, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return false, NewHttpError(resp.StatusCode, "not authorized to update exchange node %s/%s", deviceOrgId, nodeId)
+	default:
+		return false, NewHttpError(http.StatusBadGateway, "unexpected http status code received from %s: %d", apiMsg, resp.StatusCode)
+	}
+}
+
+// Move the exchange node for this device from one org to another, with a new token, using the credentials of the request (which
+// must be allowed to manage nodes in both orgs). The exchange can't change the org of a node, so it is created in the new org and
+// deleted from the old one. Returns false (and no error) if the node does not exist in the exchange yet.
+func ExchangeMoveNode(r *http.Request, currentExchangeUrl, fromOrgId, toOrgId, nodeId, nodeToken, certificatePath string) (bool, *HttpError) {
+	respBytes, statusCode, httpErr := exchangeNodeRequest(r, currentExchangeUrl, http.MethodGet, fromOrgId, nodeId, nil, certificatePath)
+	if httpErr != nil {
+		return false, httpErr
+	} else if statusCode == http.StatusNotFound {
+		return false, nil
+	}
+	nodes := struct {
+		Nodes map[string]struct {
+			Name     string `json:"name"`
+			NodeType string `json:"nodeType"`
+			Arch     string `json:"arch"`
+		} `json:"nodes"`
+	}{}
+	if err := json.Unmarshal(respBytes, &nodes); err != nil {
+		return false, NewHttpError(http.StatusBadGateway, "unable to unmarshal exchange node %s/%s, error: %v", fromOrgId, nodeId, err)
+	}
+	node, ok := nodes.Nodes[fromOrgId+"/"+nodeId]
+	if !ok {
+		return false, nil
+	}
+
+	// The node has not registered yet, so the pattern, services, and key are empty, and the agent will set them when it does
+	newNode := map[string]interface{}{
+		"token":     nodeToken,
+		"name":      node.Name,
+		"nodeType":  node.NodeType,
+		"arch":      node.Arch,
+		"pattern":   "",
+		"publicKey": "",
+	}
+	if _, statusCode, httpErr = exchangeNodeRequest(r, currentExchangeUrl, http.MethodPut, toOrgId, nodeId, newNode, certificatePath); httpErr != nil {
+		return false, httpErr
+	} else if statusCode != http.StatusOK && statusCode != http.StatusCreated {
+		return false, NewHttpError(http.StatusBadGateway, "unexpected http status code received creating exchange node %s/%s: %d", toOrgId, nodeId, statusCode)
+	}
+	if _, statusCode, httpErr = exchangeNodeRequest(r, currentExchangeUrl, http.MethodDelete, fromOrgId, nodeId, nil, certificatePath); httpErr != nil {
+		return false, httpErr
+	} else if statusCode != http.StatusNoContent && statusCode != http.StatusOK && statusCode != http.StatusNotFound {
+		return false, NewHttpError(http.StatusBadGateway, "exchange node %s/%s was created, but deleting %s/%s returned http status code %d", toOrgId, nodeId, fromOrgId, nodeId, statusCode)
+	}
+	return true, nil
+}
+
+// Send a request for this exchange node, using the credentials of the request. Returns the response body and status code, or an
+// error if the request could not be sent or was not authorized.
+func exchangeNodeRequest(r *http.Request, currentExchangeUrl, method, orgId, nodeId string, body interface{}, certificatePath string) ([]byte, int, *HttpError) {
+	credOrgId, user, pwOrKey, ok := GetBasicAuth(r)
+	if !ok {
+		return nil, 0, NewHttpError(http.StatusUnauthorized, "invalid exchange credentials provided")
+	}
+
+	certPath := ""
+	if PathExists(certificatePath) {
+		certPath = certificatePath
+	}
+	if !strings.HasPrefix(currentExchangeUrl, "http://") && !strings.HasPrefix(currentExchangeUrl, "https://") {
+		currentExchangeUrl = "http://" + currentExchangeUrl
+	}
+	parsedUrl, err := urlpkg.Parse(fmt.Sprintf("%v/orgs/%v/nodes/%v", currentExchangeUrl, orgId, urlpkg.PathEscape(nodeId)))
+	if err != nil {
+		return nil, 0, NewHttpError(http.StatusBadRequest, "invalid URL: %v", err)
+	}
+	apiMsg := fmt.Sprintf("%v %v", method, parsedUrl.String())
+	LogFor(r).Debug("sending exchange node request", "method", method, "url", parsedUrl.String())
+
+	var bodyReader io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return nil, 0, NewHttpError(http.StatusInternalServerError, "unable to marshal body for %s, error: %v", apiMsg, err)
+		}
+		bodyReader = strings.NewReader(string(bodyBytes))
+	}
+	req, err := http.NewRequestWithContext(r.Context(), method, parsedUrl.String(), bodyReader)
+	if err != nil {
+		return nil, 0, NewHttpError(http.StatusInternalServerError, "unable to create HTTP request for %s, error: %v", apiMsg, err)
 	}
+	req.SetBasicAuth(credOrgId+"/"+user, pwOrKey)
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	req.Header.Add("Accept", "application/json")
+
+	httpClient, httpErr := GetHTTPClient(certPath)
+	if httpErr != nil {
+		return nil, 0, httpErr
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, 0, NewHttpError(http.StatusInternalServerError, "unable to send HTTP request for %s, error: %v", apiMsg, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, resp.StatusCode, NewHttpError(resp.StatusCode, "not authorized for %s", apiMsg)
+	}
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, NewHttpError(http.StatusBadGateway, "unable to read HTTP response body for %s, error: %v", apiMsg, err)
+	}
+	return respBytes, resp.StatusCode, nil
 }
 
 func GetHTTPClient(certPath string) (*http.Client, *HttpError) {
@@ -498,10 +673,25 @@ func NewHTTPClient(certPath string) (*http.Client, *HttpError) {
 	if httpErr := TrustIcpCert(httpClient.Transport.(*http.Transport), certPath); httpErr != nil {
 		return nil, httpErr
 	}
+	httpClient.Transport = metrics.InstrumentTransport(metrics.UpstreamExchange, exchangeOperation, httpClient.Transport)
+	httpClient.Transport = tracing.InstrumentTransport(metrics.UpstreamExchange, exchangeOperation, httpClient.Transport)
 
 	return httpClient, nil
 }
 
+// Returns the method and path of this exchange request with the org, user, and node ids replaced, for use as a metrics label
+// (or span name)
+func exchangeOperation(r *http.Request) string {
+	segments := strings.Split(r.URL.Path, "/")
+	for i := 1; i < len(segments); i++ {
+		switch segments[i-1] {
+		case "orgs", "users", "nodes":
+			segments[i] = "{" + strings.TrimSuffix(segments[i-1], "s") + "}"
+		}
+	}
+	return r.Method + " " + strings.Join(segments, "/")
+}
+
 /*
 	TrustIcpCert adds the icp cert file to be trusted (if exists) in calls made by the given http client. 3 cases:
 
@@ -615,16 +805,59 @@ func RunCmd(options RunCmdOpts, commandString string, args ...string) ([]byte, [
 func GetOwnerServiceApiKey() (string, string) {
 	apiKey := os.Getenv("FDO_API_PWD")
 	if apiKey == "" {
-		log.Fatalln("FDO_API_PWD NOT SET")
+		Fatal(1, "FDO_API_PWD NOT SET")
 	}
 
 	return SplitIdToken(apiKey)
 }
 
+// Returns a client for the FDO owner service, that uses digest auth and records the request metrics
+func NewOwnerServiceClient(username, password string) *http.Client {
+	return &http.Client{
+		Transport: tracing.InstrumentTransport(metrics.UpstreamOwner, metrics.OperationOf,
+			metrics.InstrumentTransport(metrics.UpstreamOwner, nil, dab.NewDigestTransport(username, password, http.DefaultTransport))),
+	}
+}
+
+// Returns a client for an FDO manufacturer service, that uses digest auth and records the request metrics
+func NewManufacturerServiceClient(username, password string) *http.Client {
+	return &http.Client{
+		Transport: tracing.InstrumentTransport(metrics.UpstreamManufacturer, metrics.ManufacturerOperationOf,
+			metrics.InstrumentTransport(metrics.UpstreamManufacturer, metrics.ManufacturerOperationOf, dab.NewDigestTransport(username, password, http.DefaultTransport))),
+	}
+}
+
+// Returns a client for an FDO rendezvous service, that uses digest auth and records the request metrics
+func NewRendezvousServiceClient(username, password string) *http.Client {
+	return &http.Client{
+		Transport: tracing.InstrumentTransport(metrics.UpstreamRendezvous, metrics.OperationOf,
+			metrics.InstrumentTransport(metrics.UpstreamRendezvous, nil, dab.NewDigestTransport(username, password, http.DefaultTransport))),
+	}
+}
+
+// Send a GET request with this context, so the trace context is propagated to the server
+func HttpGet(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
+
+// Send a POST request with this context, so the trace context is propagated to the server
+func HttpPost(ctx context.Context, client *http.Client, url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return client.Do(req)
+}
+
 func GetTo2OwnerHost() (string, string) {
 	To2Host := os.Getenv("FDO_OPS_SVC_HOST")
 	if To2Host == "" {
-		log.Fatalln("FDO_OPS_SVC_HOST NOT SET")
+		Fatal(1, "FDO_OPS_SVC_HOST NOT SET")
 	}
 
 	return SplitIdToken(To2Host)
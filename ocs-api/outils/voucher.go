@@ -0,0 +1,299 @@
+package outils
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Parsing of the FDO ownership voucher, so we can tell which device a voucher is for before importing it in the owner service.
+// The voucher is a PEM block that contains the CBOR encoding of:
+//   OwnershipVoucher = [ OVProtVer, OVHeader (bstr containing the CBOR of the header), OVHeaderHMac, OVDevCertChain, OVEntryArray ]
+//   OVHeader = [ OVHProtVer, OVGuid (bstr of 16 bytes), OVRVInfo, OVDeviceInfo (tstr), OVPubKey, OVDevCertChainHash ]
+//   OVEntry = COSE_Sign1 [ protected, unprotected, payload (bstr containing the CBOR of [ ..., OVEPubKey ]), signature ]
+//   PublicKey = [ pkType, pkEnc, pkBody ]
+
+const VoucherPemType = "OWNERSHIP VOUCHER"
+
+// The names of the FDO public key types, the same as the owner service uses
+var publicKeyTypeNames = map[uint64]string{
+	1:  "RSA2048RESTR",
+	5:  "RSAPKCS",
+	6:  "RSAPSS",
+	10: "SECP256R1",
+	11: "SECP384R1",
+}
+
+// The parts of an ownership voucher that ocs-api uses
+type VoucherHeader struct {
+	ProtocolVersion uint64
+	Guid            string // formatted like a uuid, the same way the owner service reports it
+	DeviceInfo      string
+	NumEntries      int    // the number of ownership transfers the voucher has been extended with
+	Manufacturer    string // the organization in the device certificate, or its issuer
+	SerialNumber    string // the serial number in the subject of the device certificate, or its common name
+	OwnerKeyType    string // the type of the key of the current owner: the key of the last entry, or the manufacturer's if none
+}
+
+// Parse the header of this PEM encoded ownership voucher
+func ParseVoucher(voucherBytes []byte) (*VoucherHeader, error) {
+	var block *pem.Block
+	rest := voucherBytes
+	for {
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, errors.New("the voucher does not contain an " + VoucherPemType + " PEM block")
+		} else if block.Type == VoucherPemType {
+			break
+		}
+	}
+
+	voucher, err := decodeCbor(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode the voucher: %v", err)
+	}
+	voucherArray, ok := voucher.([]interface{})
+	if !ok || len(voucherArray) < 5 {
+		return nil, errors.New("the voucher is not a CBOR array of 5 elements")
+	}
+	headerBytes, ok := voucherArray[1].([]byte)
+	if !ok {
+		return nil, errors.New("the voucher header is not a CBOR byte string")
+	}
+	header, err := decodeCbor(headerBytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode the voucher header: %v", err)
+	}
+	headerArray, ok := header.([]interface{})
+	if !ok || len(headerArray) < 4 {
+		return nil, errors.New("the voucher header is not a CBOR array of at least 4 elements")
+	}
+
+	vh := &VoucherHeader{}
+	if vh.ProtocolVersion, ok = headerArray[0].(uint64); !ok {
+		return nil, errors.New("the voucher header protocol version is not an unsigned integer")
+	}
+	guid, ok := headerArray[1].([]byte)
+	if !ok || len(guid) != 16 {
+		return nil, errors.New("the voucher guid is not a CBOR byte string of 16 bytes")
+	}
+	vh.Guid = fmt.Sprintf("%x-%x-%x-%x-%x", guid[0:4], guid[4:6], guid[6:8], guid[8:10], guid[10:16])
+	vh.DeviceInfo, _ = headerArray[3].(string)
+	if len(headerArray) > 4 {
+		vh.OwnerKeyType = publicKeyTypeName(headerArray[4])
+	}
+	if entries, ok := voucherArray[4].([]interface{}); ok {
+		vh.NumEntries = len(entries)
+		if len(entries) > 0 {
+			if keyType := entryPublicKeyTypeName(entries[len(entries)-1]); keyType != "" {
+				vh.OwnerKeyType = keyType
+			}
+		}
+	}
+
+	// The device certificate is the 1st cert of the chain. It is null for devices that use symmetric keys.
+	if certChain, ok := voucherArray[3].([]interface{}); ok && len(certChain) > 0 {
+		if certBytes, ok := certChain[0].([]byte); ok {
+			if cert, err := x509.ParseCertificate(certBytes); err == nil {
+				vh.Manufacturer = firstNonEmpty(cert.Subject.Organization...)
+				if vh.Manufacturer == "" {
+					vh.Manufacturer = firstNonEmpty(append(cert.Issuer.Organization, cert.Issuer.CommonName)...)
+				}
+				vh.SerialNumber = firstNonEmpty(cert.Subject.SerialNumber, cert.Subject.CommonName)
+			}
+		}
+	}
+	return vh, nil
+}
+
+// Returns the name of the type of this decoded PublicKey, or "" if it isn't one
+func publicKeyTypeName(publicKey interface{}) string {
+	keyArray, ok := publicKey.([]interface{})
+	if !ok || len(keyArray) < 3 {
+		return ""
+	}
+	keyType, ok := keyArray[0].(uint64)
+	if !ok {
+		return ""
+	}
+	if name, ok := publicKeyTypeNames[keyType]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", keyType)
+}
+
+// Returns the name of the type of the public key in this decoded voucher entry, or "" if it can't be found
+func entryPublicKeyTypeName(entry interface{}) string {
+	sign1, ok := entry.([]interface{})
+	if !ok || len(sign1) != 4 {
+		return ""
+	}
+	payloadBytes, ok := sign1[2].([]byte)
+	if !ok {
+		return ""
+	}
+	payload, err := decodeCbor(payloadBytes)
+	if err != nil {
+		return ""
+	}
+	payloadArray, ok := payload.([]interface{})
+	if !ok || len(payloadArray) == 0 {
+		return ""
+	}
+	return publicKeyTypeName(payloadArray[len(payloadArray)-1]) // the key is the last element in all protocol versions
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// A minimal CBOR (RFC 8949) decoder for the data types used in vouchers. Decodes to uint64, int64, []byte, string,
+// []interface{}, map[interface{}]interface{} (with string or integer keys), bool, float64, or nil. Tags are skipped and their
+// content is returned. Indefinite length items are not supported, because FDO requires the deterministic encoding.
+func decodeCbor(data []byte) (interface{}, error) {
+	d := &cborDecoder{data: data}
+	v, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("%d extra bytes after the CBOR item", len(d.data)-d.pos)
+	}
+	return v, nil
+}
+
+const maxCborDepth = 32
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// Read the initial byte and argument of the next item
+func (d *cborDecoder) head() (byte, uint64, error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, errors.New("unexpected end of CBOR data")
+	}
+	b := d.data[d.pos]
+	d.pos++
+	major, info := b>>5, b&0x1f
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, fmt.Errorf("unsupported CBOR additional info %d", info)
+	}
+	buf, err := d.bytes(uint64(size))
+	if err != nil {
+		return 0, 0, err
+	}
+	var arg uint64
+	for _, c := range buf {
+		arg = arg<<8 | uint64(c)
+	}
+	return major, arg, nil
+}
+
+// Read the next n bytes
+func (d *cborDecoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errors.New("unexpected end of CBOR data")
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+func (d *cborDecoder) decode(depth int) (interface{}, error) {
+	if depth > maxCborDepth {
+		return nil, errors.New("CBOR data is nested too deeply")
+	}
+	start := d.pos
+	major, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case 0: // unsigned int
+		return arg, nil
+	case 1: // negative int
+		if arg > math.MaxInt64 {
+			return nil, errors.New("CBOR negative integer overflows int64")
+		}
+		return -1 - int64(arg), nil
+	case 2: // byte string
+		return d.bytes(arg)
+	case 3: // text string
+		b, err := d.bytes(arg)
+		return string(b), err
+	case 4: // array
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, errors.New("CBOR array is longer than the data")
+		}
+		a := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		return a, nil
+	case 5: // map
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, errors.New("CBOR map is longer than the data")
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch key := k.(type) {
+			case []byte:
+				k = string(key) // byte slices can't be map keys
+			case string, uint64, int64:
+			default:
+				return nil, fmt.Errorf("unsupported CBOR map key of type %T, it must be a string, byte string, or integer", k)
+			}
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = v
+		}
+		return m, nil
+	case 6: // tag
+		return d.decode(depth + 1)
+	default: // simple values and floats
+		switch info := d.data[start] & 0x1f; {
+		case info == 26:
+			return float64(math.Float32frombits(uint32(arg))), nil
+		case info == 27:
+			return math.Float64frombits(arg), nil
+		case arg == 20:
+			return false, nil
+		case arg == 21:
+			return true, nil
+		case arg == 22 || arg == 23:
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unsupported CBOR simple value %d", arg)
+	}
+}
@@ -0,0 +1,215 @@
+package outils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/pem"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Returns the CBOR head of an item of this major type and argument
+func cborHead(major byte, arg int) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg < 0x100:
+		return []byte{major<<5 | 24, byte(arg)}
+	default:
+		return []byte{major<<5 | 25, byte(arg >> 8), byte(arg)}
+	}
+}
+
+// Returns the CBOR of an array of these encoded items
+func cborArray(items ...[]byte) []byte {
+	return append(cborHead(4, len(items)), bytes.Join(items, nil)...)
+}
+
+func cborBytes(b []byte) []byte {
+	return append(cborHead(2, len(b)), b...)
+}
+
+func cborText(s string) []byte {
+	return append(cborHead(3, len(s)), s...)
+}
+
+func cborUint(n int) []byte {
+	return cborHead(0, n)
+}
+
+// Returns a PEM voucher for this guid, whose manufacturer key and entry keys have these FDO key types
+func newTestVoucher(guid []byte, deviceInfo string, mfgKeyType int, entryKeyTypes ...int) []byte {
+	publicKey := func(keyType int) []byte {
+		return cborArray(cborUint(keyType), cborUint(1), cborBytes([]byte{1, 2, 3}))
+	}
+	header := cborArray(cborUint(101), cborBytes(guid), cborArray(), cborText(deviceInfo), publicKey(mfgKeyType), []byte{0xf6})
+	entries := [][]byte{}
+	for _, keyType := range entryKeyTypes {
+		payload := cborArray(cborBytes([]byte{0}), cborBytes([]byte{0}), publicKey(keyType))
+		entries = append(entries, cborArray(cborBytes(nil), []byte{0xa0}, cborBytes(payload), cborBytes([]byte{9})))
+	}
+	voucher := cborArray(cborUint(101), cborBytes(header), cborBytes([]byte{0}), []byte{0xf6}, cborArray(entries...))
+	return pem.EncodeToMemory(&pem.Block{Type: VoucherPemType, Bytes: voucher})
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid hex %q: %v", s, err)
+	}
+	return b
+}
+
+func TestDecodeCbor(t *testing.T) {
+	tests := []struct {
+		name string
+		hex  string
+		want interface{}
+	}{
+		{"small uint", "17", uint64(23)},
+		{"uint8", "1818", uint64(24)},
+		{"uint64", "1bffffffffffffffff", uint64(0xffffffffffffffff)},
+		{"negative int", "20", int64(-1)},
+		{"min int64", "3b7fffffffffffffff", int64(-1 << 63)},
+		{"byte string", "43010203", []byte{1, 2, 3}},
+		{"text string", "6461626364", "abcd"},
+		{"array", "83010203", []interface{}{uint64(1), uint64(2), uint64(3)}},
+		{"map with int and text keys", "a201026161f5", map[interface{}]interface{}{uint64(1): uint64(2), "a": true}},
+		{"map with byte string key", "a1426162f4", map[interface{}]interface{}{"ab": false}},
+		{"map with negative key", "a12001", map[interface{}]interface{}{int64(-1): uint64(1)}},
+		{"tag", "c24101", []byte{1}},
+		{"null", "f6", nil},
+		{"float32", "fa3fc00000", float64(1.5)},
+		{"float64", "fb3ff8000000000000", float64(1.5)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := decodeCbor(mustDecodeHex(t, tt.hex))
+			if err != nil {
+				t.Fatalf("decodeCbor(%s) returned error: %v", tt.hex, err)
+			}
+			if !reflect.DeepEqual(v, tt.want) {
+				t.Errorf("decodeCbor(%s) = %#v, want %#v", tt.hex, v, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCborInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"empty", nil, "unexpected end"},
+		{"truncated uint", mustDecodeHex(t, "19ff"), "unexpected end"},
+		{"truncated byte string", mustDecodeHex(t, "4401"), "unexpected end"},
+		{"truncated text string", mustDecodeHex(t, "6361"), "unexpected end"},
+		{"truncated array", mustDecodeHex(t, "830102"), "array is longer than the data"},
+		{"truncated array element", mustDecodeHex(t, "820119"), "unexpected end"},
+		{"truncated map", mustDecodeHex(t, "a201"), "map is longer than the data"},
+		{"truncated map value", mustDecodeHex(t, "a10142"), "unexpected end"},
+		{"truncated tag", mustDecodeHex(t, "c2"), "unexpected end"},
+		{"array longer than the data", mustDecodeHex(t, "9bffffffffffffffff"), "longer than the data"},
+		{"map longer than the data", mustDecodeHex(t, "bb00000000ffffffff00"), "longer than the data"},
+		{"byte string longer than the data", mustDecodeHex(t, "5bffffffffffffffff"), "unexpected end"},
+		{"indefinite length array", mustDecodeHex(t, "9f01ff"), "unsupported CBOR additional info 31"},
+		{"reserved additional info", mustDecodeHex(t, "1c"), "unsupported CBOR additional info 28"},
+		{"negative int overflow", mustDecodeHex(t, "3bffffffffffffffff"), "overflows int64"},
+		{"unsupported simple value", mustDecodeHex(t, "f0"), "unsupported CBOR simple value"},
+		{"extra bytes", mustDecodeHex(t, "0102"), "1 extra bytes"},
+		{"array map key", mustDecodeHex(t, "a18000"), "unsupported CBOR map key"},
+		{"map map key", mustDecodeHex(t, "a1a000"), "unsupported CBOR map key"},
+		{"null map key", mustDecodeHex(t, "a1f600"), "unsupported CBOR map key"},
+		{"nested array map key", mustDecodeHex(t, "81a1810100"), "unsupported CBOR map key"},
+		{"deeply nested arrays", append(bytes.Repeat([]byte{0x81}, maxCborDepth+1), 0x00), "nested too deeply"},
+		{"deeply nested maps", append(bytes.Repeat([]byte{0xa1, 0x00}, maxCborDepth+1), 0x00), "nested too deeply"},
+		{"deeply nested tags", append(bytes.Repeat([]byte{0xc2}, maxCborDepth+1), 0x00), "nested too deeply"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := decodeCbor(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("decodeCbor(%x) = %#v, %v, want an error containing %q", tt.data, v, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// The decoder must not panic on any truncation of a valid voucher
+func TestDecodeCborTruncatedVoucher(t *testing.T) {
+	block, _ := pem.Decode(newTestVoucher(bytes.Repeat([]byte{0xab}, 16), "dev1", 10, 11))
+	for n := 0; n < len(block.Bytes); n++ {
+		if _, err := decodeCbor(block.Bytes[:n]); err == nil {
+			t.Errorf("decodeCbor() of the first %d of %d bytes of the voucher returned no error", n, len(block.Bytes))
+		}
+	}
+}
+
+func TestParseVoucher(t *testing.T) {
+	guid := mustDecodeHex(t, "0a1b2c3d000011112222000000000011")
+	tests := []struct {
+		name           string
+		voucher        []byte
+		wantEntries    int
+		wantKeyType    string
+		wantDeviceInfo string
+	}{
+		{"no entries", newTestVoucher(guid, "dev11", 10), 0, "SECP256R1", "dev11"},
+		{"extended", newTestVoucher(guid, "dev11", 10, 11, 1), 2, "RSA2048RESTR", "dev11"},
+		{"unknown key type", newTestVoucher(guid, "", 10, 99), 1, "unknown(99)", ""},
+		{"after another PEM block", append(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{1}}), newTestVoucher(guid, "dev11", 11)...), 0, "SECP384R1", "dev11"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vh, err := ParseVoucher(tt.voucher)
+			if err != nil {
+				t.Fatalf("ParseVoucher() returned error: %v", err)
+			}
+			if vh.Guid != "0a1b2c3d-0000-1111-2222-000000000011" {
+				t.Errorf("ParseVoucher().Guid = %s, want 0a1b2c3d-0000-1111-2222-000000000011", vh.Guid)
+			}
+			if vh.ProtocolVersion != 101 || vh.NumEntries != tt.wantEntries || vh.OwnerKeyType != tt.wantKeyType || vh.DeviceInfo != tt.wantDeviceInfo {
+				t.Errorf("ParseVoucher() = %+v, want protocol 101, %d entries, owner key type %s, and device info %q", vh, tt.wantEntries, tt.wantKeyType, tt.wantDeviceInfo)
+			}
+		})
+	}
+}
+
+func TestParseVoucherInvalid(t *testing.T) {
+	voucherPem := func(cbor []byte) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: VoucherPemType, Bytes: cbor})
+	}
+	header := func(guid []byte) []byte {
+		return cborArray(cborUint(101), cborBytes(guid), cborArray(), cborText("dev"))
+	}
+	tests := []struct {
+		name    string
+		voucher []byte
+		wantErr string
+	}{
+		{"not PEM", []byte("hello"), "does not contain an OWNERSHIP VOUCHER PEM block"},
+		{"other PEM type", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{0x80}}), "does not contain"},
+		{"unhashable map key", voucherPem(mustDecodeHex(t, "a18000")), "could not decode the voucher"},
+		{"truncated", voucherPem(mustDecodeHex(t, "8501")), "could not decode the voucher"},
+		{"not an array", voucherPem(cborUint(1)), "not a CBOR array of 5 elements"},
+		{"short array", voucherPem(cborArray(cborUint(101))), "not a CBOR array of 5 elements"},
+		{"header not bytes", voucherPem(cborArray(cborUint(101), cborUint(1), cborUint(0), cborUint(0), cborArray())), "header is not a CBOR byte string"},
+		{"header not CBOR", voucherPem(cborArray(cborUint(101), cborBytes([]byte{0x1c}), cborUint(0), cborUint(0), cborArray())), "could not decode the voucher header"},
+		{"header with a map key array", voucherPem(cborArray(cborUint(101), cborBytes(mustDecodeHex(t, "a18000")), cborUint(0), cborUint(0), cborArray())), "could not decode the voucher header"},
+		{"short header", voucherPem(cborArray(cborUint(101), cborBytes(cborArray(cborUint(101))), cborUint(0), cborUint(0), cborArray())), "at least 4 elements"},
+		{"text protocol version", voucherPem(cborArray(cborUint(101), cborBytes(cborArray(cborText("101"), cborBytes(make([]byte, 16)), cborArray(), cborText("dev"))), cborUint(0), cborUint(0), cborArray())), "protocol version"},
+		{"short guid", voucherPem(cborArray(cborUint(101), cborBytes(header(make([]byte, 15))), cborUint(0), cborUint(0), cborArray())), "guid is not a CBOR byte string of 16 bytes"},
+		{"deeply nested entries", voucherPem(cborArray(cborUint(101), cborBytes(header(make([]byte, 16))), cborUint(0), cborUint(0), append(bytes.Repeat([]byte{0x81}, maxCborDepth), 0x00))), "nested too deeply"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vh, err := ParseVoucher(tt.voucher)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ParseVoucher() = %+v, %v, want an error containing %q", vh, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-horizon/FDO-support/ocs-api/metrics"
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+)
+
+/*
+Lifecycle of the owner certificates, 1 per owner key type (alias). The owner service keeps the owner keys in PKCS12 keystores, that
+can be replaced with POST /api/v1/certificate?filename=, and issues the owner certificates with the validity in
+/api/v1/certificate/validity. A background checker periodically reads all of the owner certificates, so /readyz and the
+ocs_api_owner_certificate_expiry_timestamp_seconds gauge can warn when one of them is close to expiring.
+*/
+
+const (
+	DefaultOwnerCertCheckIntervalS = 3600
+	MaxKeystoreBodyKB              = 1024
+	MaxOwnerCertValidityDays       = 3650
+)
+
+var keystoreFileNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,62}\.p12$`)
+
+type OwnerCertificate struct {
+	Alias         string `json:"alias"`
+	Subject       string `json:"subject,omitempty"`
+	Issuer        string `json:"issuer,omitempty"`
+	PublicKey     string `json:"publicKey,omitempty"` // the key algorithm and size, e.g. ECDSA P-256
+	Sha256        string `json:"sha256,omitempty"`    // fingerprint of the DER certificate
+	NotBefore     string `json:"notBefore,omitempty"`
+	NotAfter      string `json:"notAfter,omitempty"`
+	ExpiresInDays int    `json:"expiresInDays"` // negative if it has expired
+	Error         string `json:"error,omitempty"`
+
+	cert *x509.Certificate // the parsed certificate, nil if there is an error
+}
+
+type OwnerCertificateValidity struct {
+	Days int `json:"days"`
+}
+
+// The owner certificates from the last check, for /readyz
+var ownerCertsChecked time.Time
+var ownerCerts []OwnerCertificate
+var ownerCertsLock sync.RWMutex
+
+// Returns a description of the public key of this certificate, e.g. ECDSA P-256 or RSA 3072
+func publicKeyDescription(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		return "ECDSA " + key.Curve.Params().Name
+	case *rsa.PublicKey:
+		return "RSA " + strconv.Itoa(key.N.BitLen())
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return cert.PublicKeyAlgorithm.String()
+	}
+}
+
+// Returns the details of this PEM encoded owner certificate. If it can't be parsed, only the alias and the error are set.
+func describeOwnerCertificate(alias string, certBytes []byte) OwnerCertificate {
+	ownerCert := OwnerCertificate{Alias: alias}
+	block, _ := pem.Decode(certBytes)
+	if block == nil || block.Type != "CERTIFICATE" {
+		ownerCert.Error = "the owner service did not return a PEM encoded certificate"
+		return ownerCert
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		ownerCert.Error = "invalid certificate: " + err.Error()
+		return ownerCert
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	ownerCert.Subject = cert.Subject.String()
+	ownerCert.Issuer = cert.Issuer.String()
+	ownerCert.PublicKey = publicKeyDescription(cert)
+	ownerCert.Sha256 = hex.EncodeToString(fingerprint[:])
+	ownerCert.NotBefore = cert.NotBefore.UTC().Format(time.RFC3339)
+	ownerCert.NotAfter = cert.NotAfter.UTC().Format(time.RFC3339)
+	ownerCert.ExpiresInDays = int(time.Until(cert.NotAfter).Hours() / 24)
+	ownerCert.cert = cert
+	return ownerCert
+}
+
+// Read the owner certificate of each key type from the owner service, record them for /readyz, and set the expiry gauge
+func refreshOwnerCertificates(ctx context.Context) []OwnerCertificate {
+	certs := make([]OwnerCertificate, 0, len(ownerKeyTypes))
+	for _, keyType := range ownerKeyTypes {
+		certBytes, httpErr := getOwnerCertificate(ctx, keyType)
+		if httpErr != nil {
+			certs = append(certs, OwnerCertificate{Alias: keyType, Error: httpErr.Error()})
+			metrics.OwnerCertificateExpiry.DeleteLabelValues(keyType)
+			continue
+		}
+		ownerCert := describeOwnerCertificate(keyType, certBytes)
+		if notAfter, err := time.Parse(time.RFC3339, ownerCert.NotAfter); err == nil {
+			metrics.OwnerCertificateExpiry.WithLabelValues(keyType).Set(float64(notAfter.Unix()))
+		} else {
+			metrics.OwnerCertificateExpiry.DeleteLabelValues(keyType)
+		}
+		certs = append(certs, ownerCert)
+	}
+
+	ownerCertsLock.Lock()
+	defer ownerCertsLock.Unlock()
+	ownerCertsChecked = time.Now()
+	ownerCerts = certs
+	return certs
+}
+
+// Periodically check the owner certificates. The interval is set by FDO_OWNER_CERT_CHECK_INTERVAL (in seconds), and 0 disables
+// the checks.
+func startOwnerCertChecker(ctx context.Context) {
+	interval := outils.GetEnvVarIntWithDefault("FDO_OWNER_CERT_CHECK_INTERVAL", DefaultOwnerCertCheckIntervalS)
+	if interval <= 0 {
+		outils.Log.Info("owner certificate checks are disabled")
+		return
+	}
+	startBackgroundWorker(ctx, "owner certificate checker", func(ctx context.Context) {
+		for {
+			// The owner service settings are bootstrapped first, so don't report it as unreachable while it starts
+			if IsReady() {
+				for _, ownerCert := range refreshOwnerCertificates(ctx) {
+					if ownerCert.Error != "" {
+						outils.Log.Warn("could not check the owner certificate", "alias", ownerCert.Alias, "error", ownerCert.Error)
+					}
+				}
+			}
+			if !sleepCtx(ctx, time.Duration(interval)*time.Second) {
+				return
+			}
+		}
+	})
+}
+
+// Check the owner certificates from the last check. It is only a warning if one of them expires soon or has expired, because
+// making ocs-api not ready would also stop the routes that replace them. The warning period is set by CERT_EXPIRY_WARNING_DAYS.
+func checkOwnerCerts(_ context.Context) (string, string) {
+	ownerCertsLock.RLock()
+	defer ownerCertsLock.RUnlock()
+	if ownerCertsChecked.IsZero() {
+		return CheckStatusSkipped, "the owner certificates have not been checked yet"
+	}
+
+	warningDays := outils.GetEnvVarIntWithDefault("CERT_EXPIRY_WARNING_DAYS", DefaultCertExpiryWarningDays)
+	var problems []string
+	soonest := ""
+	for _, ownerCert := range ownerCerts {
+		if ownerCert.Error != "" {
+			problems = append(problems, ownerCert.Alias+" could not be checked")
+		} else if notAfter, _ := time.Parse(time.RFC3339, ownerCert.NotAfter); time.Now().After(notAfter) {
+			problems = append(problems, ownerCert.Alias+" expired "+ownerCert.NotAfter)
+		} else if ownerCert.ExpiresInDays < warningDays {
+			problems = append(problems, ownerCert.Alias+" expires "+ownerCert.NotAfter)
+		}
+		if ownerCert.NotAfter != "" && (soonest == "" || ownerCert.NotAfter < soonest) {
+			soonest = ownerCert.NotAfter
+		}
+	}
+	if len(problems) > 0 {
+		return CheckStatusWarning, "owner certificate " + strings.Join(problems, ", ")
+	}
+	return CheckStatusOk, "the first owner certificate expires " + soonest
+}
+
+// Verify that this is a PKCS12 keystore (a PFX structure of version 3), so a wrong file isn't given to the owner service. The
+// keystore is encrypted with the owner service's password, so its content can't be checked.
+func validateKeystore(keystoreBytes []byte) *outils.HttpError {
+	var pfx struct {
+		Version  int
+		AuthSafe asn1.RawValue
+		MacData  asn1.RawValue `asn1:"optional"`
+	}
+	if rest, err := asn1.Unmarshal(keystoreBytes, &pfx); err != nil || len(rest) > 0 || pfx.Version != 3 {
+		return outils.NewHttpError(http.StatusBadRequest, "the body must be a PKCS12 keystore")
+	}
+	return nil
+}
+
+// Returns the owner service client and url, for the owner certificate lifecycle routes
+func ownerCertificateApi() (*http.Client, string, *outils.HttpError) {
+	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
+	if fdoOwnerURL == "" {
+		return nil, "", outils.NewHttpError(http.StatusInternalServerError, "HZN_FDO_API_URL is not set")
+	}
+	username, password := outils.GetOwnerServiceApiKey()
+	return outils.NewOwnerServiceClient(username, password), fdoOwnerURL + "/api/v1/certificate", nil
+}
+
+// ============= GET /api/fdo/certificates =============
+// Returns the subject, public key, fingerprint, and validity of the owner certificate of each key type. Only the exchange root
+// user can do this.
+func getFdoCertificatesHandler(w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("GET /api/fdo/certificates")
+
+	if authenticated, httpErr := outils.ExchangeAuthenticateRoot(r, ExchangeInternalUrl, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided or the user is not the exchange root user", http.StatusUnauthorized)
+		return
+	}
+
+	outils.WriteJsonResponse(http.StatusOK, w, refreshOwnerCertificates(r.Context()))
+}
+
+// ============= POST /api/fdo/certificates/keystores/{filename} =============
+// Uploads a PKCS12 keystore (application/octet-stream) to the owner service, replacing the one with this file name, and returns
+// the owner certificates. Only the exchange root user can do this.
+func postFdoKeystoreHandler(fileName string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("POST /api/fdo/certificates/keystores/{filename}", "filename", fileName)
+
+	if authenticated, httpErr := outils.ExchangeAuthenticateRoot(r, ExchangeInternalUrl, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided or the user is not the exchange root user", http.StatusUnauthorized)
+		return
+	}
+
+	if !keystoreFileNameRegex.MatchString(fileName) {
+		http.Error(w, "the keystore file name must end in .p12 and only contain letters, numbers, '.', '_', and '-'", http.StatusBadRequest)
+		return
+	}
+
+	// Verify content type
+	if httpErr := outils.IsValidPostBinary(r); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	keystoreBytes, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxKeystoreBodyKB*1024))
+	if err != nil {
+		http.Error(w, "Error reading the request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if httpErr := validateKeystore(keystoreBytes); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	client, certificateUrl, httpErr := ownerCertificateApi()
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	if _, httpErr := ownerServiceRequest(r.Context(), client, http.MethodPost, certificateUrl+"?filename="+fileName, keystoreBytes); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	sum := sha256.Sum256(keystoreBytes)
+	outils.LogFor(r).Info("owner keystore replaced", "filename", fileName, "bytes", len(keystoreBytes), "sha256", hex.EncodeToString(sum[:]))
+
+	outils.WriteJsonResponse(http.StatusOK, w, refreshOwnerCertificates(r.Context()))
+}
+
+// ============= GET /api/fdo/certificates/validity =============
+// Returns the number of days the owner service makes new certificates valid for. Only the exchange root user can do this.
+func getFdoCertificateValidityHandler(w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("GET /api/fdo/certificates/validity")
+
+	if authenticated, httpErr := outils.ExchangeAuthenticateRoot(r, ExchangeInternalUrl, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided or the user is not the exchange root user", http.StatusUnauthorized)
+		return
+	}
+
+	client, certificateUrl, httpErr := ownerCertificateApi()
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	respBodyBytes, httpErr := ownerServiceRequest(r.Context(), client, http.MethodGet, certificateUrl+"/validity", nil)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	days, err := strconv.Atoi(strings.TrimSpace(string(respBodyBytes)))
+	if err != nil {
+		http.Error(w, "the owner service returned an invalid certificate validity: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	outils.WriteJsonResponse(http.StatusOK, w, OwnerCertificateValidity{Days: days})
+}
+
+// ============= PUT /api/fdo/certificates/validity =============
+// Sets the number of days the owner service makes new certificates valid for. Only the exchange root user can do this.
+func putFdoCertificateValidityHandler(w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("PUT /api/fdo/certificates/validity")
+
+	if authenticated, httpErr := outils.ExchangeAuthenticateRoot(r, ExchangeInternalUrl, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided or the user is not the exchange root user", http.StatusUnauthorized)
+		return
+	}
+
+	// Verify content type
+	if httpErr := outils.IsValidPostJson(r); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	validity := OwnerCertificateValidity{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&validity); err != nil {
+		http.Error(w, "Error parsing the request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if validity.Days < 1 || validity.Days > MaxOwnerCertValidityDays {
+		http.Error(w, fmt.Sprintf("days must be between 1 and %d", MaxOwnerCertValidityDays), http.StatusBadRequest)
+		return
+	}
+
+	client, certificateUrl, httpErr := ownerCertificateApi()
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	if _, httpErr := ownerServiceRequest(r.Context(), client, http.MethodPost, certificateUrl+"/validity?days="+strconv.Itoa(validity.Days), []byte{}); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	outils.LogFor(r).Info("owner certificate validity set", "days", validity.Days)
+
+	outils.WriteJsonResponse(http.StatusOK, w, validity)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+)
+
+/*
+The owner service log, from its GET /api/v1/logs. The log is global across orgs, so org users only get the entries of their own
+devices, and only the exchange root user gets the whole log. An entry is a line that starts with a timestamp, with the lines after
+it that don't (e.g. stack traces). The entries that are about a TO0 or TO2 message have the protocol and message type.
+*/
+
+const (
+	DefaultOwnerLogEntries = 1000
+	MaxOwnerLogEntries     = 10000
+	MaxOwnerLogLineKB      = 1024
+)
+
+// The FDO message types of TO0 and TO2, by name
+var fdoMessageTypes = map[string]int{
+	"TO0.Hello": 20, "TO0.HelloAck": 21, "TO0.OwnerSign": 22, "TO0.AcceptOwner": 23,
+	"TO2.HelloDevice": 60, "TO2.ProveOVHdr": 61, "TO2.GetOVNextEntry": 62, "TO2.OVNextEntry": 63, "TO2.ProveDevice": 64,
+	"TO2.SetupDevice": 65, "TO2.DeviceServiceInfoReady": 66, "TO2.OwnerServiceInfoReady": 67, "TO2.DeviceServiceInfo": 68,
+	"TO2.OwnerServiceInfo": 69, "TO2.Done": 70, "TO2.Done2": 71,
+}
+
+var ownerLogTimeRegex = regexp.MustCompile(`^\[?(\d{4}-\d{2}-\d{2}[ T]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?)`)
+var ownerLogMessageNameRegex = regexp.MustCompile(`\b(TO[02])[._ ]?([A-Z][A-Za-z0-9]*)`)
+var ownerLogMessageTypeRegex = regexp.MustCompile(`(?i)\b(?:msg|message)[ _-]?(?:type|id)\b\D{0,3}(\d{1,3})\b`)
+
+type OwnerLogEntry struct {
+	Time        string `json:"time,omitempty"`
+	Protocol    string `json:"protocol,omitempty"`    // TO0 or TO2
+	MessageType int    `json:"messageType,omitempty"` // the FDO message type
+	Text        string `json:"text"`
+}
+
+type OwnerLog struct {
+	Device    string          `json:"device,omitempty"`
+	Entries   []OwnerLogEntry `json:"entries"`
+	Truncated bool            `json:"truncated"` // only the last limit entries are returned
+}
+
+// Which owner log entries to return
+type ownerLogQuery struct {
+	since    time.Time
+	until    time.Time
+	protocol string // TO0 or TO2, or empty for all
+	guids    []string
+	limit    int
+}
+
+// Get the time range, protocol, and limit from the query parameters
+func parseOwnerLogQuery(r *http.Request) (*ownerLogQuery, *outils.HttpError) {
+	q := &ownerLogQuery{limit: DefaultOwnerLogEntries}
+	for name, t := range map[string]*time.Time{"since": &q.since, "until": &q.until} {
+		if value := r.URL.Query().Get(name); value != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				return nil, outils.NewHttpError(http.StatusBadRequest, "invalid %s %s, must be an RFC3339 timestamp", name, value)
+			}
+		}
+	}
+	if !q.since.IsZero() && !q.until.IsZero() && q.until.Before(q.since) {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "until must not be before since")
+	}
+	switch protocol := strings.ToUpper(r.URL.Query().Get("protocol")); protocol {
+	case "", "TO0", "TO2":
+		q.protocol = protocol
+	default:
+		return nil, outils.NewHttpError(http.StatusBadRequest, "protocol must be to0 or to2")
+	}
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > MaxOwnerLogEntries {
+			return nil, outils.NewHttpError(http.StatusBadRequest, "limit must be between 1 and %d", MaxOwnerLogEntries)
+		}
+		q.limit = limit
+	}
+	return q, nil
+}
+
+// Parse the timestamp at the start of an owner log line. Timestamps without a zone are in UTC.
+func parseOwnerLogTime(line string) (time.Time, bool) {
+	matches := ownerLogTimeRegex.FindStringSubmatch(line)
+	if len(matches) < 2 {
+		return time.Time{}, false
+	}
+	value := strings.Replace(strings.Replace(matches[1], "T", " ", 1), ",", ".", 1)
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999Z07:00", "2006-01-02 15:04:05.999999999Z0700", "2006-01-02 15:04:05.999999999"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Set the protocol and message type of the entry, if it is about a TO0 or TO2 message
+func classifyOwnerLogEntry(entry *OwnerLogEntry) {
+	if matches := ownerLogMessageNameRegex.FindStringSubmatch(entry.Text); len(matches) >= 3 {
+		entry.Protocol = matches[1]
+		entry.MessageType = fdoMessageTypes[matches[1]+"."+matches[2]]
+		return
+	}
+	if matches := ownerLogMessageTypeRegex.FindStringSubmatch(entry.Text); len(matches) >= 2 {
+		msgType, _ := strconv.Atoi(matches[1])
+		switch {
+		case msgType >= 20 && msgType <= 23:
+			entry.Protocol = "TO0"
+		case msgType >= 60 && msgType <= 71:
+			entry.Protocol = "TO2"
+		default:
+			return
+		}
+		entry.MessageType = msgType
+	}
+}
+
+// Returns whether the entry is in the time range, protocol, and mentions 1 of the guids
+func (q *ownerLogQuery) matches(entry *OwnerLogEntry, t time.Time) bool {
+	if !q.since.IsZero() || !q.until.IsZero() {
+		if t.IsZero() || (!q.since.IsZero() && t.Before(q.since)) || (!q.until.IsZero() && t.After(q.until)) {
+			return false
+		}
+	}
+	if len(q.guids) > 0 {
+		text := strings.ToLower(entry.Text)
+		found := false
+		for _, guid := range q.guids {
+			if strings.Contains(text, guid) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return q.protocol == "" || entry.Protocol == q.protocol
+}
+
+// Read the owner service log and return the last entries that match the query. The log is read as a stream, so it is not all in
+// memory at once.
+func readOwnerLog(ctx context.Context, q *ownerLogQuery) (*OwnerLog, *outils.HttpError) {
+	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
+	if fdoOwnerURL == "" {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "HZN_FDO_API_URL is not set")
+	}
+	username, password := outils.GetOwnerServiceApiKey()
+	client := outils.NewOwnerServiceClient(username, password)
+	url := fdoOwnerURL + "/api/v1/logs"
+	resp, err := outils.HttpGet(ctx, client, url)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusBadGateway, "unable to send HTTP request for GET %s: %v", outils.SafeUrl(url), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respBodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, outils.NewHttpError(http.StatusBadGateway, "owner service returned HTTP code %d for GET %s: %s", resp.StatusCode, outils.SafeUrl(url), string(respBodyBytes))
+	}
+
+	log := &OwnerLog{Entries: []OwnerLogEntry{}}
+	var entry *OwnerLogEntry
+	var entryTime time.Time
+	var lines []string
+	addEntry := func() {
+		if entry == nil {
+			return
+		}
+		entry.Text = strings.Join(lines, "\n")
+		classifyOwnerLogEntry(entry)
+		if q.matches(entry, entryTime) {
+			if len(log.Entries) >= q.limit {
+				log.Entries = log.Entries[1:]
+				log.Truncated = true
+			}
+			log.Entries = append(log.Entries, *entry)
+		}
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), MaxOwnerLogLineKB*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if t, ok := parseOwnerLogTime(line); ok || entry == nil {
+			addEntry()
+			entry, entryTime, lines = &OwnerLogEntry{}, t, nil
+			if ok {
+				entry.Time = t.Format(time.RFC3339Nano)
+			}
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, outils.NewHttpError(http.StatusBadGateway, "Error reading the owner service log: %v", err)
+	}
+	addEntry()
+	return log, nil
+}
+
+// Write the owner log as json, or as the log text if the client accepts text/plain
+func writeOwnerLog(w http.ResponseWriter, r *http.Request, log *OwnerLog) {
+	if strings.HasPrefix(r.Header.Get("Accept"), "text/plain") {
+		var sb strings.Builder
+		for _, entry := range log.Entries {
+			sb.WriteString(entry.Text)
+			sb.WriteString("\n")
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		outils.WriteResponse(http.StatusOK, w, []byte(sb.String()))
+		return
+	}
+	outils.WriteJsonResponse(http.StatusOK, w, log)
+}
+
+// ============= GET /api/orgs/{org-id}/fdo/vouchers/{device-id}/logs =============
+// Returns the owner service log entries that mention this device's guid, e.g. its TO0 and TO2 messages. The entries can be
+// filtered with ?since=, ?until=, and ?protocol=to0|to2, and only the last ?limit= of them are returned.
+func getFdoVoucherLogsHandler(orgId, deviceUuid string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("GET /api/orgs/{org-id}/fdo/vouchers/{device-id}/logs", "org", orgId, "device", deviceUuid)
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Authenticate this user with the exchange
+	if authenticated, _, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
+		return
+	}
+
+	if httpErr := verifyDeviceInOrg(deviceUuid, deviceOrgId); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	q, httpErr := parseOwnerLogQuery(r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	// The owner service may log the guid with or without the dashes
+	guid := strings.ToLower(deviceUuid)
+	q.guids = []string{guid}
+	if undashed := strings.ReplaceAll(guid, "-", ""); undashed != guid {
+		q.guids = append(q.guids, undashed)
+	}
+
+	log, httpErr := readOwnerLog(r.Context(), q)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	log.Device = deviceUuid
+	writeOwnerLog(w, r, log)
+}
+
+// ============= GET /api/fdo/logs =============
+// Returns the owner service log entries of all of the devices. The entries can be filtered with ?since=, ?until=, and
+// ?protocol=to0|to2, and only the last ?limit= of them are returned. Only the exchange root user can do this, because the log is
+// global across orgs.
+func getFdoLogsHandler(w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("GET /api/fdo/logs")
+
+	if authenticated, httpErr := outils.ExchangeAuthenticateRoot(r, ExchangeInternalUrl, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided or the user is not the exchange root user", http.StatusUnauthorized)
+		return
+	}
+
+	q, httpErr := parseOwnerLogQuery(r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	log, httpErr := readOwnerLog(r.Context(), q)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	writeOwnerLog(w, r, log)
+}
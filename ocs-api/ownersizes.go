@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+)
+
+/*
+The sizes the owner service uses in TO2: the max message size, and the service info (SVI) MTU, that the device log shows as
+"SVI MTU value". The FDO default of 1300 is too small for large SVI payloads. Both can be set at startup with
+FDO_OWNER_MESSAGE_SIZE and FDO_OWNER_SVI_SIZE, which the bootstrap reconciles in the owner service, or changed with the
+/api/fdo/messagesize and /api/fdo/svisize routes. A route change lasts until the next restart, when the env vars are applied again.
+*/
+
+const (
+	MinOwnerSize = 1300  // the FDO default MTU
+	MaxOwnerSize = 65535 // the sizes are uint16 in the FDO messages
+)
+
+// An owner service size setting
+type ownerSizeSetting struct {
+	name   string // the name in the owner service api and the ocs-api routes
+	envVar string
+}
+
+var ownerMessageSize = ownerSizeSetting{name: "messagesize", envVar: "FDO_OWNER_MESSAGE_SIZE"}
+var ownerSviSize = ownerSizeSetting{name: "svisize", envVar: "FDO_OWNER_SVI_SIZE"}
+
+type OwnerSize struct {
+	Size int `json:"size"` // 0 if the owner service doesn't have a value, so it uses its default
+}
+
+func (s ownerSizeSetting) url() string {
+	return os.Getenv("HZN_FDO_API_URL") + "/api/v1/owner/" + s.name
+}
+
+// Verify the size is in range
+func validateOwnerSize(s ownerSizeSetting, size int) *outils.HttpError {
+	if size < MinOwnerSize || size > MaxOwnerSize {
+		return outils.NewHttpError(http.StatusBadRequest, "%s must be between %d and %d", s.name, MinOwnerSize, MaxOwnerSize)
+	}
+	return nil
+}
+
+// Verify the SVI size fits in the message size
+func validateOwnerSizes(messageSize, sviSize int) *outils.HttpError {
+	if messageSize > 0 && sviSize > messageSize {
+		return outils.NewHttpError(http.StatusBadRequest, "svisize %d must not be greater than messagesize %d", sviSize, messageSize)
+	}
+	return nil
+}
+
+// Returns the size from the env var of this setting, or 0 if it is not set
+func getOwnerSizeFromEnv(s ownerSizeSetting) (int, error) {
+	value := os.Getenv(s.envVar)
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number, not %q", s.envVar, value)
+	}
+	if httpErr := validateOwnerSize(s, size); httpErr != nil {
+		return 0, fmt.Errorf("%s: %s", s.envVar, httpErr.Error())
+	}
+	return size, nil
+}
+
+// Verify FDO_OWNER_MESSAGE_SIZE and FDO_OWNER_SVI_SIZE, so main() can exit if they are invalid
+func checkOwnerSizeEnvVars() error {
+	messageSize, err := getOwnerSizeFromEnv(ownerMessageSize)
+	if err != nil {
+		return err
+	}
+	sviSize, err := getOwnerSizeFromEnv(ownerSviSize)
+	if err != nil {
+		return err
+	}
+	if httpErr := validateOwnerSizes(messageSize, sviSize); httpErr != nil {
+		return fmt.Errorf("%s and %s: %s", ownerMessageSize.envVar, ownerSviSize.envVar, httpErr.Error())
+	}
+	return nil
+}
+
+// Returns the bootstrap items of the sizes that are set with env vars. The message size is first, so the SVI size fits in it.
+func getOwnerSizeBootstrapItems() ([]bootstrapItem, error) {
+	items := []bootstrapItem{}
+	for _, s := range []ownerSizeSetting{ownerMessageSize, ownerSviSize} {
+		size, err := getOwnerSizeFromEnv(s)
+		if err != nil {
+			return nil, err
+		} else if size == 0 {
+			continue
+		}
+		items = append(items, bootstrapItem{name: s.name, getUrl: s.url(), postUrl: s.url(), desired: []byte(strconv.Itoa(size)), normalize: bytes.TrimSpace})
+	}
+	return items, nil
+}
+
+// Read this size from the owner service. Returns 0 if it doesn't have a value.
+func getOwnerSize(ctx context.Context, client *http.Client, s ownerSizeSetting) (int, *outils.HttpError) {
+	respBodyBytes, err := getFromOwnerService(ctx, client, s.url())
+	if err != nil {
+		return 0, outils.NewHttpError(http.StatusBadGateway, "unable to get the %s from the owner service: %v", s.name, err)
+	}
+	value := strings.TrimSpace(string(respBodyBytes))
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, outils.NewHttpError(http.StatusBadGateway, "the owner service returned an invalid %s: %v", s.name, err)
+	}
+	return size, nil
+}
+
+// ============= GET /api/fdo/messagesize and GET /api/fdo/svisize =============
+// Returns the max message size or the SVI MTU of the owner service. Only the exchange root user can do this.
+func getFdoOwnerSizeHandler(s ownerSizeSetting, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("GET /api/fdo/" + s.name)
+
+	if authenticated, httpErr := outils.ExchangeAuthenticateRoot(r, ExchangeInternalUrl, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided or the user is not the exchange root user", http.StatusUnauthorized)
+		return
+	}
+
+	username, password := outils.GetOwnerServiceApiKey()
+	size, httpErr := getOwnerSize(r.Context(), outils.NewOwnerServiceClient(username, password), s)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	outils.WriteJsonResponse(http.StatusOK, w, OwnerSize{Size: size})
+}
+
+// ============= PUT /api/fdo/messagesize and PUT /api/fdo/svisize =============
+// Sets the max message size or the SVI MTU of the owner service. The SVI MTU must fit in the max message size. Only the exchange
+// root user can do this.
+func putFdoOwnerSizeHandler(s ownerSizeSetting, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("PUT /api/fdo/" + s.name)
+
+	if authenticated, httpErr := outils.ExchangeAuthenticateRoot(r, ExchangeInternalUrl, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided or the user is not the exchange root user", http.StatusUnauthorized)
+		return
+	}
+
+	// Verify content type
+	if httpErr := outils.IsValidPostJson(r); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	ownerSize := OwnerSize{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&ownerSize); err != nil {
+		http.Error(w, "Error parsing the request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if httpErr := validateOwnerSize(s, ownerSize.Size); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	username, password := outils.GetOwnerServiceApiKey()
+	client := outils.NewOwnerServiceClient(username, password)
+	var httpErr *outils.HttpError
+	if s == ownerSviSize {
+		var messageSize int
+		if messageSize, httpErr = getOwnerSize(r.Context(), client, ownerMessageSize); httpErr == nil {
+			httpErr = validateOwnerSizes(messageSize, ownerSize.Size)
+		}
+	} else {
+		var sviSize int
+		if sviSize, httpErr = getOwnerSize(r.Context(), client, ownerSviSize); httpErr == nil {
+			httpErr = validateOwnerSizes(ownerSize.Size, sviSize)
+		}
+	}
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	if _, httpErr := ownerServiceRequest(r.Context(), client, http.MethodPost, s.url(), []byte(strconv.Itoa(ownerSize.Size))); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	outils.LogFor(r).Info("owner service "+s.name+" set", "size", ownerSize.Size)
+
+	outils.WriteJsonResponse(http.StatusOK, w, ownerSize)
+}
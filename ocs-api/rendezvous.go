@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-horizon/FDO-support/ocs-api/ocsdb"
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+)
+
+/*
+Management of the owner certificates in the allow and deny lists of the rendezvous (RV) servers. The RV servers are configured with
+FDO_RV_SERVERS (<name>=<url>,...) and the credentials of their api with FDO_RV_SVC_AUTH. The RV api can't report what is in its
+lists, so the last change made to each RV server for each owner key type is recorded in v1/rv/state.json.
+*/
+
+const rvHealthTimeoutS = 10
+
+// The states of an owner certificate in an RV server
+const (
+	RvKeyAllowed = "allowed" // in the allow list
+	RvKeyRemoved = "removed" // removed from the allow list
+	RvKeyDenied  = "denied"  // in the deny list
+)
+
+type RvServer struct {
+	Name string `json:"name"`
+	Url  string `json:"url"`
+}
+
+// The last change made to the lists of an RV server for an owner key type
+type RvKeyState struct {
+	KeyType    string `json:"keyType"`
+	State      string `json:"state,omitempty"`      // of the last change that succeeded
+	CertSha256 string `json:"certSha256,omitempty"` // of the owner certificate that was sent
+	Updated    string `json:"updated,omitempty"`
+	Error      string `json:"error,omitempty"` // of the last change, if it failed
+}
+
+// The result of a change to the lists of an RV server
+type RvKeyResult struct {
+	Rv string `json:"rv"`
+	RvKeyState
+}
+
+type RvServerStatus struct {
+	RvServer
+	Reachable bool         `json:"reachable"`
+	Version   string       `json:"version,omitempty"` // from the RV health api
+	Error     string       `json:"error,omitempty"`
+	Keys      []RvKeyState `json:"keys"`
+}
+
+// A change to the lists of the RV servers
+type rvAction struct {
+	method string
+	path   string
+	state  string
+}
+
+var (
+	rvAllow  = rvAction{http.MethodPost, "/api/v1/rv/allow", RvKeyAllowed}
+	rvRemove = rvAction{http.MethodDelete, "/api/v1/rv/allow", RvKeyRemoved}
+	rvDeny   = rvAction{http.MethodPost, "/api/v1/rv/deny", RvKeyDenied}
+)
+
+var rvServers []RvServer
+
+// Serializes the changes to the RV servers, and the read-modify-write of the state file
+var rvStateLock sync.Mutex
+
+func getRvStateFileName() string {
+	return filepath.Join(OcsDbDir, "v1", "rv", "state.json")
+}
+
+// Parse the RV servers from FDO_RV_SERVERS. Their credentials are required if there are any.
+func initRvServers() error {
+	rvServers = nil
+	for _, entry := range strings.Split(os.Getenv("FDO_RV_SERVERS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rvUrl, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid FDO_RV_SERVERS entry %q, it must be <name>=<url>", entry)
+		}
+		if u, err := url.Parse(rvUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid url %q for RV server %s in FDO_RV_SERVERS", rvUrl, name)
+		}
+		if slices.ContainsFunc(rvServers, func(rv RvServer) bool { return rv.Name == name }) {
+			return fmt.Errorf("RV server %s is in FDO_RV_SERVERS more than once", name)
+		}
+		rvServers = append(rvServers, RvServer{Name: name, Url: strings.TrimSuffix(rvUrl, "/")})
+	}
+	if len(rvServers) > 0 && os.Getenv("FDO_RV_SVC_AUTH") == "" {
+		return fmt.Errorf("FDO_RV_SVC_AUTH must be set when FDO_RV_SERVERS is set")
+	}
+	outils.Log.Info("configured the RV servers", "rv_servers", len(rvServers))
+	return nil
+}
+
+// Returns the RV servers with these names, or all of them if there are no names
+func selectRvServers(names []string) ([]RvServer, *outils.HttpError) {
+	if len(rvServers) == 0 {
+		return nil, outils.NewHttpError(http.StatusNotFound, "no RV servers are configured in FDO_RV_SERVERS")
+	} else if len(names) == 0 {
+		return rvServers, nil
+	}
+	selected := []RvServer{}
+	for _, name := range names {
+		i := slices.IndexFunc(rvServers, func(rv RvServer) bool { return rv.Name == name })
+		if i < 0 {
+			return nil, outils.NewHttpError(http.StatusNotFound, "RV server %s is not configured in FDO_RV_SERVERS", name)
+		}
+		selected = append(selected, rvServers[i])
+	}
+	return selected, nil
+}
+
+// Read the recorded state of the RV servers, by RV server name and owner key type
+func getRvState() (map[string]map[string]*RvKeyState, *outils.HttpError) {
+	state := map[string]map[string]*RvKeyState{}
+	fileName := getRvStateFileName()
+	if !outils.PathExists(fileName) {
+		return state, nil
+	}
+	stateBytes, err := ocsdb.ReadFile(fileName)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error reading %s: %v", fileName, err)
+	}
+	if err := json.Unmarshal(stateBytes, &state); err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error parsing %s: %v", fileName, err)
+	}
+	return state, nil
+}
+
+func saveRvState(ctx context.Context, state map[string]map[string]*RvKeyState) *outils.HttpError {
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "Error marshaling the RV server state: %v", err)
+	}
+	fileName := getRvStateFileName()
+	if err := os.MkdirAll(filepath.Dir(fileName), 0750); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create directory %s: %v", filepath.Dir(fileName), err)
+	}
+	if err := ocsdb.WriteFile(ctx, fileName, stateBytes, 0644); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
+	}
+	return nil
+}
+
+func newRvServiceClient() *http.Client {
+	username, password := outils.SplitIdToken(os.Getenv("FDO_RV_SVC_AUTH"))
+	return outils.NewRendezvousServiceClient(username, password)
+}
+
+// Returns the sha256 of the first certificate in this PEM, so the state shows which owner certificate was sent
+func ownerCertificateSha256(certBytes []byte) string {
+	sum := sha256.Sum256(certBytes)
+	if block, _ := pem.Decode(certBytes); block != nil {
+		sum = sha256.Sum256(block.Bytes)
+	}
+	return hex.EncodeToString(sum[:])
+}
+
+// Make this change to the lists of these RV servers with the owner certificate of this key type, and record the result. Returns the
+// new state of the key in each of the RV servers, and whether they all succeeded.
+func updateRvServers(ctx context.Context, action rvAction, keyType string, servers []RvServer) ([]RvKeyResult, bool, *outils.HttpError) {
+	ownerCert, httpErr := getOwnerCertificate(ctx, keyType)
+	if httpErr != nil {
+		return nil, false, httpErr
+	}
+	certSha256 := ownerCertificateSha256(ownerCert)
+
+	rvStateLock.Lock()
+	defer rvStateLock.Unlock()
+	state, httpErr := getRvState()
+	if httpErr != nil {
+		return nil, false, httpErr
+	}
+	client := newRvServiceClient()
+	results := []RvKeyResult{}
+	allSucceeded := true
+	for _, rv := range servers {
+		if state[rv.Name] == nil {
+			state[rv.Name] = map[string]*RvKeyState{}
+		}
+		keyState := state[rv.Name][keyType]
+		if keyState == nil {
+			keyState = &RvKeyState{KeyType: keyType}
+			state[rv.Name][keyType] = keyState
+		}
+		if _, httpErr := upstreamRequest(ctx, client, "RV server "+rv.Name, action.method, rv.Url+action.path, ownerCert); httpErr != nil {
+			outils.LogCtx(ctx).Warn("could not update the RV server", "rv", rv.Name, "key_type", keyType, "state", action.state, "error", httpErr.Error())
+			keyState.Error = httpErr.Error()
+			allSucceeded = false
+		} else {
+			outils.LogCtx(ctx).Info("updated the RV server", "rv", rv.Name, "key_type", keyType, "state", action.state)
+			keyState.State = action.state
+			keyState.CertSha256 = certSha256
+			keyState.Updated = time.Now().UTC().Format(time.RFC3339)
+			keyState.Error = ""
+		}
+		results = append(results, RvKeyResult{Rv: rv.Name, RvKeyState: *keyState})
+	}
+	if httpErr := saveRvState(ctx, state); httpErr != nil {
+		return nil, false, httpErr
+	}
+	return results, allSucceeded, nil
+}
+
+// Returns the status of each configured RV server: whether it is reachable, and the recorded state of each owner key type
+func getRvServerStatuses(ctx context.Context) ([]RvServerStatus, *outils.HttpError) {
+	rvStateLock.Lock()
+	state, httpErr := getRvState()
+	rvStateLock.Unlock()
+	if httpErr != nil {
+		return nil, httpErr
+	}
+
+	statuses := make([]RvServerStatus, len(rvServers))
+	client := newRvServiceClient()
+	var wg sync.WaitGroup
+	for i, rv := range rvServers {
+		statuses[i] = RvServerStatus{RvServer: rv, Keys: []RvKeyState{}}
+		for _, keyType := range ownerKeyTypes {
+			if keyState := state[rv.Name][keyType]; keyState != nil {
+				statuses[i].Keys = append(statuses[i].Keys, *keyState)
+			}
+		}
+		wg.Add(1)
+		go func(status *RvServerStatus) {
+			defer wg.Done()
+			healthCtx, cancel := context.WithTimeout(ctx, rvHealthTimeoutS*time.Second)
+			defer cancel()
+			versionBytes, httpErr := upstreamRequest(healthCtx, client, "RV server "+status.Name, http.MethodGet, status.Url+"/health", nil)
+			if httpErr != nil {
+				status.Error = httpErr.Error()
+				return
+			}
+			status.Reachable = true
+			status.Version = strings.TrimSpace(string(versionBytes))
+		}(&statuses[i])
+	}
+	wg.Wait()
+	return statuses, nil
+}
+
+// ============= GET /api/fdo/rv =============
+// Returns the status of each configured RV server, including the last change made to its lists for each owner key type. Only the
+// exchange root user can do this, because the RV servers are for the whole service.
+func getFdoRvHandler(w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("GET /api/fdo/rv")
+
+	if authenticated, httpErr := outils.ExchangeAuthenticateRoot(r, ExchangeInternalUrl, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided or the user is not the exchange root user", http.StatusUnauthorized)
+		return
+	}
+
+	statuses, httpErr := getRvServerStatuses(r.Context())
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	outils.WriteJsonResponse(http.StatusOK, w, statuses)
+}
+
+// ============= POST /api/fdo/rv/allow/{alias}, DELETE /api/fdo/rv/allow/{alias}, and POST /api/fdo/rv/deny/{alias} =============
+// Adds the owner certificate of this key type to the allow list of the RV servers, removes it from the allow list, or adds it to
+// the deny list. It is done in all of the configured RV servers, or the ones in ?rv=<name>[,<name>]. Returns the new state of
+// the key in each of them, with status 502 if any of them failed. Only the exchange root user can do this.
+func postFdoRvKeyHandler(action rvAction, publicKeyType string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug(r.Method+" "+r.URL.Path, "alias", publicKeyType)
+
+	if authenticated, httpErr := outils.ExchangeAuthenticateRoot(r, ExchangeInternalUrl, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided or the user is not the exchange root user", http.StatusUnauthorized)
+		return
+	}
+
+	if !slices.Contains(ownerKeyTypes, publicKeyType) {
+		http.Error(w, "Public key type must be one of these supported alias': "+strings.Join(ownerKeyTypes, ", "), http.StatusBadRequest)
+		return
+	}
+	var names []string
+	if rvParam := r.URL.Query().Get("rv"); rvParam != "" {
+		names = strings.Split(rvParam, ",")
+	}
+	servers, httpErr := selectRvServers(names)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	results, allSucceeded, httpErr := updateRvServers(r.Context(), action, publicKeyType, servers)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	status := http.StatusOK
+	if !allSucceeded {
+		status = http.StatusBadGateway
+	}
+	outils.WriteJsonResponse(status, w, results)
+}
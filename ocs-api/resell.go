@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+)
+
+/*
+Resale of devices to another owner. The owner service extends the voucher of the device to the owner certificate of the new owner
+(POST /api/v1/resell/{guid}), and the extended voucher is returned so it can be given to the new owner, who imports it in their
+own owner service. The device is then marked as transferred in the OCS DB, or removed from it (?delete=true). The extended voucher
+is kept (see handoff.go), so reselling the device again to the same owner returns it.
+*/
+
+const MaxOwnerCertBodyKB = 64
+
+// Parse the owner certificate of the new owner, so a malformed one is rejected before the voucher is extended
+func parseOwnerCertificate(certBytes []byte) (*x509.Certificate, *outils.HttpError) {
+	block, _ := pem.Decode(certBytes)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "the body must be the PEM encoded owner certificate of the new owner")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "invalid owner certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// Have the owner service extend the voucher of this device to the new owner's certificate, and return the extended voucher
+func resellDevice(ctx context.Context, deviceUuid string, ownerCertBytes []byte) ([]byte, *outils.HttpError) {
+	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
+	if fdoOwnerURL == "" {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "HZN_FDO_API_URL is not set")
+	}
+	username, password := outils.GetOwnerServiceApiKey()
+	client := outils.NewOwnerServiceClient(username, password)
+	voucherBytes, httpErr := ownerServiceRequest(ctx, client, http.MethodPost, fdoOwnerURL+"/api/v1/resell/"+deviceUuid, ownerCertBytes)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	if _, err := outils.ParseVoucher(voucherBytes); err != nil {
+		return nil, outils.NewHttpError(http.StatusBadGateway, "the owner service returned an invalid extended voucher for device %s: %v", deviceUuid, err)
+	}
+	return voucherBytes, nil
+}
+
+// Remove a resold or exported device from the owner service and the OCS DB. The voucher was already given to the new owner, so
+// failures are only logged, and the voucher is still returned.
+func deleteResoldDevice(ctx context.Context, deviceUuid string) {
+	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
+	username, password := outils.GetOwnerServiceApiKey()
+	client := outils.NewOwnerServiceClient(username, password)
+	if _, httpErr := ownerServiceRequest(ctx, client, http.MethodDelete, fdoOwnerURL+"/api/v1/owner/resource?filename="+deviceUuid+"_exec", nil); httpErr != nil {
+		outils.LogCtx(ctx).Warn("could not delete the device exec resource from the owner service", "device", deviceUuid, "error", httpErr.Error())
+	}
+	if _, httpErr := ownerServiceRequest(ctx, client, http.MethodDelete, fdoOwnerURL+"/api/v1/owner/vouchers/"+deviceUuid, nil); httpErr != nil {
+		outils.LogCtx(ctx).Warn("could not delete the voucher from the owner service", "device", deviceUuid, "error", httpErr.Error())
+	}
+
+	unindexDevice(deviceUuid)
+	execFileName := filepath.Clean(filepath.Join(OcsDbDir, "v1", "values", deviceUuid+"_exec"))
+	if err := os.Remove(execFileName); err != nil && !os.IsNotExist(err) {
+		outils.LogCtx(ctx).Warn("could not delete the device exec file", "file", execFileName, "error", err)
+	}
+	deviceDir := filepath.Clean(filepath.Join(OcsDbDir, "v1", "devices", deviceUuid))
+	if err := os.RemoveAll(deviceDir); err != nil {
+		outils.LogCtx(ctx).Warn("could not delete the device directory", "dir", deviceDir, "error", err)
+	}
+}
+
+// ============= POST /api/orgs/{ord-id}/fdo/vouchers/{deviceUuid}/resell =============
+// Extends the voucher of this device to the new owner whose owner certificate (PEM) is the body, and returns the extended voucher.
+// The device is marked as transferred, or with ?delete=true it is removed from the owner service and the OCS DB. The extended
+// voucher is kept, so reselling the device again to the same owner returns it. Only org admins can resell devices.
+func postFdoVoucherResellHandler(orgId string, deviceUuid string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("POST /api/orgs/{org-id}/fdo/vouchers/{device-id}/resell", "org", orgId, "device", deviceUuid)
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Authenticate this user with the exchange, and ensure they are an admin
+	if authenticated, _, httpErr := outils.ExchangeAuthenticateAdmin(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided or the user is not an org admin", http.StatusUnauthorized)
+		return
+	}
+
+	// Verify content type
+	if httpErr := outils.IsValidPostPlainTxt(r); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	bodyBytes, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxOwnerCertBodyKB*1024))
+	if err != nil {
+		http.Error(w, "Error reading the request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ownerCertBytes := bytes.TrimSpace(bodyBytes)
+	ownerCert, httpErr := parseOwnerCertificate(ownerCertBytes)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	fingerprint := sha256.Sum256(ownerCert.Raw)
+	ownerCertSha256 := hex.EncodeToString(fingerprint[:])
+	deleteDevice := r.URL.Query().Get("delete") == "true"
+
+	unlock := lockDevice(deviceUuid)
+	defer unlock()
+	if handoff, httpErr := getRepeatedDeviceHandoff(deviceUuid, deviceOrgId, DeviceHandoffResell); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if handoff != nil {
+		// The response of the first resell may not have reached the client, so return the extended voucher again
+		if handoff.OwnerCertSha256 != ownerCertSha256 {
+			http.Error(w, "the voucher of device "+deviceUuid+" was already extended to another owner", http.StatusConflict)
+			return
+		}
+		outils.LogFor(r).Info("device resold again", "org", deviceOrgId, "device", deviceUuid, "new_owner_sha256", ownerCertSha256)
+		w.Header().Set("Content-Type", "text/plain")
+		outils.WriteResponse(http.StatusOK, w, []byte(handoff.Voucher))
+		return
+	}
+
+	voucherBytes, httpErr := resellDevice(r.Context(), deviceUuid, ownerCertBytes)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	outils.LogFor(r).Info("device resold", "org", deviceOrgId, "device", deviceUuid, "new_owner", ownerCert.Subject.String(), "new_owner_sha256", ownerCertSha256, "deleted", deleteDevice)
+	handoff := &DeviceHandoff{Type: DeviceHandoffResell, OrgId: deviceOrgId, OwnerCertSha256: ownerCertSha256, Voucher: string(voucherBytes)}
+	if httpErr := saveDeviceHandoff(r.Context(), deviceUuid, handoff); httpErr != nil {
+		// The device isn't marked, so the resell can be retried
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	if deleteDevice {
+		deleteResoldDevice(r.Context(), deviceUuid)
+	} else if httpErr := setDeviceState(r.Context(), deviceUuid, DeviceStateTransferred, "", ""); httpErr != nil {
+		outils.LogFor(r).Warn("could not set device state", "device", deviceUuid, "error", httpErr.Error())
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	outils.WriteResponse(http.StatusOK, w, voucherBytes)
+}
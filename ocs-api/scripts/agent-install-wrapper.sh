@@ -8,9 +8,9 @@
 echo "$0 starting...."
 echo "Will be running: ./agent-install.sh $*"
 
-# Verify the number of args is what we are handling below
-maxArgs=8   # the exec statement below is only passing up to this many args to agent-install.sh
-if [ $# -gt $maxArgs -o "$1" != '-i' -o "$3" != '-a' -o "$5" != '-O' -o "$7" != '-k' ]; then
+# Verify the number of args is what we are handling below. The optional -n <node-policy-file> is only passed when the device has labels.
+maxArgs=10   # the exec statement below is only passing up to this many args to agent-install.sh
+if [ $# -gt $maxArgs -o "$1" != '-i' -o "$3" != '-a' -o "$5" != '-O' -o "$7" != '-k' ] || [ $# -gt 8 -a "$9" != '-n' ]; then
     # it is easy to miss this error msg in the midst of the verbose fdo output, so make it more obvious
     echo "~~~~~~~~~~~~~~~~\nError: too many arguments passed to agent-install-wrapper.sh or the arguments are in the wrong order\n~~~~~~~~~~~~~~~~"
     exit 2
@@ -24,7 +24,9 @@ if [ -f /target/boot/inside-fdo-container ]; then
     find . -maxdepth 1 -type f ! -name inside-fdo-container ! -name linux-client ! -name run_csdk_sdo.sh -exec cp -p -t /target/boot/ {} +
     if [ $? -ne 0 ]; then echo "Error: can not copy downloaded files to /target/boot"; fi
     # The <device-uuid>_exec file is not actually saved to disk, so recreate it (with a fixed name)
-    echo "/bin/sh agent-install-wrapper.sh \"$1\" \"$2\" \"$3\" \"$4\" \"$5\" \"$6\" \"$7\" \"$8\" " > /target/boot/device_exec
+    nodePolicyArgs=''
+    if [ $# -gt 8 ]; then nodePolicyArgs="\"$9\" \"${10}\""; fi
+    echo "/bin/sh agent-install-wrapper.sh \"$1\" \"$2\" \"$3\" \"$4\" \"$5\" \"$6\" \"$7\" \"$8\" $nodePolicyArgs" > /target/boot/device_exec
     chmod +x /target/boot/device_exec
     echo "Created /target/boot/device_exec: $(cat /target/boot/device_exec)"
     exit
@@ -96,9 +98,9 @@ echo "Logging all output to $logFile"
 
 # If tee is installed, use it so the output can go to both stdout/stderr and the log file
 if command -v tee >/dev/null 2>&1; then
-    # Note: the individual arg variables need to be listed like this and quoted to handle spaces in an arg
-    exec ./agent-install.sh "$1" "$2" "$3" "$4" "$5" "$6" "$7" "$8" 2>&1 | tee $logFile
+    # Note: "$@" passes each arg quoted, to handle spaces in an arg
+    exec ./agent-install.sh "$@" 2>&1 | tee $logFile
 else
-    exec ./agent-install.sh "$1" "$2" "$3" "$4" "$5" "$6" "$7" "$8" 2>&1 > $logFile
+    exec ./agent-install.sh "$@" 2>&1 > $logFile
 fi
 #exit 2   # it only gets here if exec failed
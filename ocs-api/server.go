@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/open-horizon/FDO-support/ocs-api/metrics"
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+	"github.com/open-horizon/FDO-support/ocs-api/tracing"
+)
+
+/*
+Running the http server and the background workers, and shutting them down cleanly. On SIGTERM (or SIGINT) ocs-api becomes not
+ready, and keeps serving for SHUTDOWN_DELAY seconds so load balancers can stop sending it requests. Then it stops accepting new
+connections, waits up to SHUTDOWN_TIMEOUT seconds for in-flight requests (e.g. voucher imports in the middle of their owner
+service calls) to finish, waits up to SHUTDOWN_WORKERS_TIMEOUT seconds for the background workers to stop, and up to
+SHUTDOWN_TRACING_TIMEOUT seconds to flush the trace spans. The container stop timeout must be longer than all of them together.
+
+The Prometheus metrics are served on their own listener (METRICS_PORT), not with the API, because they name the orgs and aren't
+authenticated. Only expose that port to the network the metrics are scraped from.
+*/
+
+const (
+	DefaultReadHeaderTimeoutS = 10
+	DefaultReadTimeoutS       = 60
+	DefaultWriteTimeoutS      = 120 // an import makes several owner service calls
+	DefaultIdleTimeoutS       = 120
+	DefaultShutdownDelayS     = 5
+	DefaultShutdownTimeoutS   = 30
+	DefaultWorkersTimeoutS    = 10
+	DefaultTracingTimeoutS    = 5
+)
+
+var shuttingDown atomic.Bool
+var inFlightRequests atomic.Int64
+var backgroundWorkers sync.WaitGroup
+
+// Returns true once ocs-api has started shutting down
+func IsShuttingDown() bool {
+	return shuttingDown.Load()
+}
+
+// Run fn in a goroutine that shutdown waits for. fn must return when ctx is canceled. If fn panics, it is logged and fn is
+// started again, so one bad item doesn't stop the worker or the process.
+func startBackgroundWorker(ctx context.Context, name string, fn func(context.Context)) {
+	backgroundWorkers.Add(1)
+	go func() {
+		defer backgroundWorkers.Done()
+		for !runBackgroundWorkerSafely(ctx, name, fn) && sleepCtx(ctx, time.Second) {
+		}
+		outils.Log.Debug("background worker stopped", "worker", name)
+	}()
+}
+
+// Run fn, returning false if it panicked
+func runBackgroundWorkerSafely(ctx context.Context, name string, fn func(context.Context)) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			outils.Log.Error("background worker panicked, restarting it", "worker", name, "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+	fn(ctx)
+	return true
+}
+
+// Sleep for this duration, or until ctx is canceled. Returns false if ctx was canceled.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Wrap a handler to count the requests in progress, so shutdown can report what it is waiting for
+func countInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlightRequests.Add(1)
+		defer inFlightRequests.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns the http server with the timeouts from the env vars
+func newServer(port string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              ":" + port,
+		Handler:           countInFlight(handler),
+		ReadHeaderTimeout: time.Duration(outils.GetEnvVarIntWithDefault("HTTP_READ_HEADER_TIMEOUT", DefaultReadHeaderTimeoutS)) * time.Second,
+		ReadTimeout:       time.Duration(outils.GetEnvVarIntWithDefault("HTTP_READ_TIMEOUT", DefaultReadTimeoutS)) * time.Second,
+		WriteTimeout:      time.Duration(outils.GetEnvVarIntWithDefault("HTTP_WRITE_TIMEOUT", DefaultWriteTimeoutS)) * time.Second,
+		IdleTimeout:       time.Duration(outils.GetEnvVarIntWithDefault("HTTP_IDLE_TIMEOUT", DefaultIdleTimeoutS)) * time.Second,
+	}
+}
+
+// Returns the http server for the Prometheus metrics, or nil if METRICS_PORT is not set
+func newMetricsServer(apiPort string) *http.Server {
+	port := os.Getenv("METRICS_PORT")
+	if port == "" {
+		return nil
+	} else if port == apiPort {
+		outils.Fatal(1, "METRICS_PORT must be different than the API port %s", apiPort)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	return &http.Server{
+		Addr:              ":" + port,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Duration(outils.GetEnvVarIntWithDefault("HTTP_READ_HEADER_TIMEOUT", DefaultReadHeaderTimeoutS)) * time.Second,
+	}
+}
+
+// Start the background workers and serve requests until a shutdown signal is received. If certFile and keyFile are not
+// empty, serves https. Exits the process when done.
+func serve(port, certFile, keyFile, to2Host, to2Port string) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// The background workers get their own context, so they are only stopped after the in-flight requests are done
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	startBackgroundWorker(workerCtx, "bootstrap", func(ctx context.Context) { superviseBootstrap(ctx, to2Host, to2Port) })
+	startDeviceStatePoller(workerCtx)
+	startJobWorkers(workerCtx)
+	startOwnerCertChecker(workerCtx)
+
+	srv := newServer(port, http.DefaultServeMux)
+	serveErr := make(chan error, 1)
+	go func() {
+		if certFile != "" && keyFile != "" {
+			outils.Log.Info("listening on HTTPS", "port", port, "ocs_db", OcsDbDir)
+			serveErr <- srv.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			outils.Log.Info("listening on HTTP", "port", port, "ocs_db", OcsDbDir)
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
+
+	metricsSrv := newMetricsServer(port)
+	if metricsSrv != nil {
+		go func() {
+			outils.Log.Info("serving metrics on HTTP", "port", os.Getenv("METRICS_PORT"))
+			if err := metricsSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				outils.Fatal(1, "metrics server stopped: %v", err)
+			}
+		}()
+	}
+
+	select {
+	case err := <-serveErr:
+		outils.Fatal(1, "server stopped: %v", err)
+	case <-ctx.Done():
+	}
+
+	// Become not ready, but keep serving until the load balancers have noticed
+	shuttingDown.Store(true)
+	shutdownDelay := time.Duration(outils.GetEnvVarIntWithDefault("SHUTDOWN_DELAY", DefaultShutdownDelayS)) * time.Second
+	outils.Log.Info("shutting down", "delay", shutdownDelay.String())
+	time.Sleep(shutdownDelay)
+
+	// Stop getting new requests, and wait for the in-flight ones
+	shutdownTimeout := time.Duration(outils.GetEnvVarIntWithDefault("SHUTDOWN_TIMEOUT", DefaultShutdownTimeoutS)) * time.Second
+	outils.Log.Info("stopping the server", "in_flight_requests", inFlightRequests.Load(), "timeout", shutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	exitCode := 0
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		outils.Log.Error("in-flight requests did not finish before the shutdown timeout", "in_flight_requests", inFlightRequests.Load(), "error", err)
+		exitCode = 1
+	}
+	if err := <-serveErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		outils.Log.Error("server error during shutdown", "error", err)
+	}
+	if metricsSrv != nil {
+		metricsSrv.Close()
+	}
+
+	// Stop the background workers
+	workersTimeout := time.Duration(outils.GetEnvVarIntWithDefault("SHUTDOWN_WORKERS_TIMEOUT", DefaultWorkersTimeoutS)) * time.Second
+	stopWorkers()
+	workersDone := make(chan struct{})
+	go func() {
+		backgroundWorkers.Wait()
+		close(workersDone)
+	}()
+	select {
+	case <-workersDone:
+	case <-time.After(workersTimeout):
+		outils.Log.Error("background workers did not stop before the shutdown timeout", "timeout", workersTimeout.String())
+		exitCode = 1
+	}
+
+	tracingTimeout := time.Duration(outils.GetEnvVarIntWithDefault("SHUTDOWN_TRACING_TIMEOUT", DefaultTracingTimeoutS)) * time.Second
+	tracingCtx, cancelTracing := context.WithTimeout(context.Background(), tracingTimeout)
+	defer cancelTracing()
+	if err := tracing.Shutdown(tracingCtx); err != nil {
+		outils.Log.Warn("could not flush the trace spans", "error", err)
+	}
+	outils.Log.Info("shutdown complete")
+	os.Exit(exitCode)
+}
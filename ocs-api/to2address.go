@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+)
+
+/*
+The TO2 addresses that the owner service gives to the rendezvous server in TO0, so devices know where to do TO2. The owner service
+stores them as RVTO2Addr in CBOR diagnostic form: an array of [RVIP, RVDNS, RVPort, RVProtocol] entries, e.g.
+[[null,"owner.example.com",8042,3],[h'0a000001',null,8043,5]]. The device tries the entries in order, so more than 1 address gives
+it a failover. The OCS API accepts and returns them as json, and does the encoding and decoding.
+*/
+
+const (
+	MaxTo2Addresses = 8
+	MaxTo2BodyKB    = 16
+)
+
+// The TransportProtocol values of the FDO spec
+var to2Protocols = map[string]int64{"tcp": 1, "tls": 2, "http": 3, "coap": 4, "https": 5, "coaps": 6}
+
+var to2DnsRegex = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*$`)
+
+type To2Address struct {
+	Dns      string `json:"dns,omitempty"`
+	Ip       string `json:"ip,omitempty"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+// Returns the TO2 address of FDO_OPS_SVC_HOST, that the bootstrap sets in the owner service
+func newTo2Address(to2Host, to2Port string) (To2Address, error) {
+	port, err := strconv.Atoi(to2Port)
+	if err != nil {
+		return To2Address{}, fmt.Errorf("FDO_OPS_SVC_HOST must be <host>:<port>, the port %q is not a number", to2Port)
+	}
+	address := To2Address{Dns: to2Host, Port: port, Protocol: "http"}
+	if httpErr := validateTo2Addresses([]To2Address{address}); httpErr != nil {
+		return To2Address{}, fmt.Errorf("FDO_OPS_SVC_HOST: %v", httpErr.Error())
+	}
+	return address, nil
+}
+
+// Verify the TO2 addresses before they are sent to the owner service
+func validateTo2Addresses(addresses []To2Address) *outils.HttpError {
+	if len(addresses) == 0 {
+		return outils.NewHttpError(http.StatusBadRequest, "at least 1 TO2 address is required")
+	} else if len(addresses) > MaxTo2Addresses {
+		return outils.NewHttpError(http.StatusBadRequest, "at most %d TO2 addresses are supported", MaxTo2Addresses)
+	}
+	for i, address := range addresses {
+		if address.Dns == "" && address.Ip == "" {
+			return outils.NewHttpError(http.StatusBadRequest, "TO2 address %d: dns or ip is required", i)
+		}
+		if address.Dns != "" && (len(address.Dns) > 253 || !to2DnsRegex.MatchString(address.Dns)) {
+			return outils.NewHttpError(http.StatusBadRequest, "TO2 address %d: invalid dns name %q", i, address.Dns)
+		}
+		if address.Ip != "" && net.ParseIP(address.Ip) == nil {
+			return outils.NewHttpError(http.StatusBadRequest, "TO2 address %d: invalid ip address %q", i, address.Ip)
+		}
+		if address.Port < 1 || address.Port > 65535 {
+			return outils.NewHttpError(http.StatusBadRequest, "TO2 address %d: port must be between 1 and 65535", i)
+		}
+		if _, ok := to2Protocols[address.Protocol]; !ok {
+			return outils.NewHttpError(http.StatusBadRequest, "TO2 address %d: protocol must be one of tcp, tls, http, coap, https, coaps", i)
+		}
+	}
+	return nil
+}
+
+// Encode the TO2 addresses as RVTO2Addr in diagnostic form. The ip is a byte string: 4 bytes for ipv4, 16 for ipv6.
+func encodeTo2Addresses(addresses []To2Address) string {
+	entries := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		ipValue := "null"
+		if ip := net.ParseIP(address.Ip); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			ipValue = "h'" + hex.EncodeToString(ip) + "'"
+		}
+		dnsValue := "null"
+		if address.Dns != "" {
+			dnsValue = strconv.Quote(address.Dns)
+		}
+		entries = append(entries, fmt.Sprintf("[%s,%s,%d,%d]", ipValue, dnsValue, address.Port, to2Protocols[address.Protocol]))
+	}
+	return "[" + strings.Join(entries, ",") + "]"
+}
+
+// Decode RVTO2Addr in diagnostic form, as the owner service returns it. An ip that is a text string is also accepted.
+func decodeTo2Addresses(diag string) ([]To2Address, error) {
+	p := &diagParser{s: diag}
+	value, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.s[p.pos], p.pos)
+	}
+	entries, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("RVTO2Addr must be an array")
+	}
+
+	addresses := make([]To2Address, 0, len(entries))
+	for i, e := range entries {
+		entry, ok := e.([]any)
+		if !ok || len(entry) != 4 {
+			return nil, fmt.Errorf("RVTO2Addr entry %d must be an array of [ip, dns, port, protocol]", i)
+		}
+		var address To2Address
+		switch ip := entry[0].(type) {
+		case nil:
+		case []byte:
+			if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+				return nil, fmt.Errorf("RVTO2Addr entry %d: the ip must be 4 or 16 bytes", i)
+			}
+			address.Ip = net.IP(ip).String()
+		case string:
+			if net.ParseIP(ip) == nil {
+				return nil, fmt.Errorf("RVTO2Addr entry %d: invalid ip address %q", i, ip)
+			}
+			address.Ip = ip
+		default:
+			return nil, fmt.Errorf("RVTO2Addr entry %d: the ip must be a byte string or null", i)
+		}
+		if dns, ok := entry[1].(string); ok {
+			address.Dns = dns
+		} else if entry[1] != nil {
+			return nil, fmt.Errorf("RVTO2Addr entry %d: the dns must be a text string or null", i)
+		}
+		port, ok := entry[2].(int64)
+		if !ok {
+			return nil, fmt.Errorf("RVTO2Addr entry %d: the port must be an integer", i)
+		}
+		address.Port = int(port)
+		protocol, ok := entry[3].(int64)
+		if !ok {
+			return nil, fmt.Errorf("RVTO2Addr entry %d: the protocol must be an integer", i)
+		}
+		for name, value := range to2Protocols {
+			if value == protocol {
+				address.Protocol = name
+			}
+		}
+		if address.Protocol == "" {
+			return nil, fmt.Errorf("RVTO2Addr entry %d: unknown protocol %d", i, protocol)
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// Returns the canonical diagnostic form of RVTO2Addr, so the bootstrap can compare it. Content that can't be decoded is
+// compared as json.
+func normalizeTo2Addresses(content []byte) []byte {
+	addresses, err := decodeTo2Addresses(string(content))
+	if err != nil {
+		return normalizeJson(content)
+	}
+	return []byte(encodeTo2Addresses(addresses))
+}
+
+// A parser for the subset of CBOR diagnostic notation that RVTO2Addr uses: arrays, null, integers, text strings, and hex
+// byte strings. Values are returned as []any, nil, int64, string, and []byte.
+type diagParser struct {
+	s   string
+	pos int
+}
+
+func (p *diagParser) skipSpace() {
+	for p.pos < len(p.s) && strings.ContainsRune(" \t\r\n", rune(p.s[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *diagParser) value() (any, error) {
+	p.skipSpace()
+	if p.pos >= len(p.s) {
+		return nil, fmt.Errorf("unexpected end of RVTO2Addr")
+	}
+	rest := p.s[p.pos:]
+	switch {
+	case rest[0] == '[':
+		p.pos++
+		values := []any{}
+		for {
+			p.skipSpace()
+			if p.pos < len(p.s) && p.s[p.pos] == ']' {
+				p.pos++
+				return values, nil
+			}
+			if len(values) > 0 {
+				if p.pos >= len(p.s) || p.s[p.pos] != ',' {
+					return nil, fmt.Errorf("expected , or ] at offset %d", p.pos)
+				}
+				p.pos++
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+	case strings.HasPrefix(rest, "null"):
+		p.pos += len("null")
+		return nil, nil
+	case rest[0] == '"':
+		end := 1
+		for end < len(rest) && rest[end] != '"' {
+			if rest[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(rest) {
+			return nil, fmt.Errorf("unterminated text string at offset %d", p.pos)
+		}
+		var str string
+		if err := json.Unmarshal([]byte(rest[:end+1]), &str); err != nil {
+			return nil, fmt.Errorf("invalid text string at offset %d: %v", p.pos, err)
+		}
+		p.pos += end + 1
+		return str, nil
+	case strings.HasPrefix(rest, "h'"):
+		end := strings.IndexByte(rest[2:], '\'')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated byte string at offset %d", p.pos)
+		}
+		bytes, err := hex.DecodeString(strings.Join(strings.Fields(rest[2:2+end]), ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid byte string at offset %d: %v", p.pos, err)
+		}
+		p.pos += 2 + end + 1
+		return bytes, nil
+	default:
+		end := 0
+		for end < len(rest) && (rest[end] == '-' || (rest[end] >= '0' && rest[end] <= '9')) {
+			end++
+		}
+		n, err := strconv.ParseInt(rest[:end], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected %q at offset %d", rest[0], p.pos)
+		}
+		p.pos += end
+		return n, nil
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTo2AddressesRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []To2Address
+		diag      string
+	}{
+		{"dns", []To2Address{{Dns: "owner.example.com", Port: 8042, Protocol: "http"}}, `[[null,"owner.example.com",8042,3]]`},
+		{"ipv4", []To2Address{{Ip: "10.0.0.1", Port: 8043, Protocol: "https"}}, `[[h'0a000001',null,8043,5]]`},
+		{"ipv6", []To2Address{{Ip: "2001:db8::1", Port: 443, Protocol: "tls"}}, `[[h'20010db8000000000000000000000001',null,443,2]]`},
+		{"dns and ip", []To2Address{{Dns: "owner", Ip: "192.168.1.2", Port: 1, Protocol: "tcp"}}, `[[h'c0a80102',"owner",1,1]]`},
+		{"failover", []To2Address{
+			{Dns: "owner.example.com", Port: 8042, Protocol: "http"},
+			{Ip: "10.0.0.1", Port: 65535, Protocol: "coaps"},
+		}, `[[null,"owner.example.com",8042,3],[h'0a000001',null,65535,6]]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if httpErr := validateTo2Addresses(tt.addresses); httpErr != nil {
+				t.Fatalf("validateTo2Addresses() returned error: %v", httpErr.Error())
+			}
+			diag := encodeTo2Addresses(tt.addresses)
+			if diag != tt.diag {
+				t.Errorf("encodeTo2Addresses() = %s, want %s", diag, tt.diag)
+			}
+			addresses, err := decodeTo2Addresses(diag)
+			if err != nil {
+				t.Fatalf("decodeTo2Addresses(%s) returned error: %v", diag, err)
+			}
+			if !reflect.DeepEqual(addresses, tt.addresses) {
+				t.Errorf("decodeTo2Addresses(%s) = %+v, want %+v", diag, addresses, tt.addresses)
+			}
+		})
+	}
+}
+
+func TestDecodeTo2Addresses(t *testing.T) {
+	tests := []struct {
+		name    string
+		diag    string
+		want    []To2Address
+		wantErr string // a substring of the error, or "" if it must decode
+	}{
+		{"spaces", " [ [ null , \"owner\" , 8042 , 3 ] ] ", []To2Address{{Dns: "owner", Port: 8042, Protocol: "http"}}, ""},
+		{"text ip", `[["10.0.0.1",null,8042,3]]`, []To2Address{{Ip: "10.0.0.1", Port: 8042, Protocol: "http"}}, ""},
+		{"spaced byte string", `[[h'0a 00 00 01',null,8042,3]]`, []To2Address{{Ip: "10.0.0.1", Port: 8042, Protocol: "http"}}, ""},
+		{"escaped dns", `[[null,"own\"er",8042,3]]`, []To2Address{{Dns: `own"er`, Port: 8042, Protocol: "http"}}, ""},
+		{"empty", `[]`, []To2Address{}, ""},
+		{"not an array", `3`, nil, "must be an array"},
+		{"short entry", `[[null,"owner",8042]]`, nil, "must be an array of [ip, dns, port, protocol]"},
+		{"unknown protocol", `[[null,"owner",8042,7]]`, nil, "unknown protocol 7"},
+		{"text protocol", `[[null,"owner",8042,"http"]]`, nil, "the protocol must be an integer"},
+		{"text port", `[[null,"owner","8042",3]]`, nil, "the port must be an integer"},
+		{"integer dns", `[[null,5,8042,3]]`, nil, "the dns must be a text string or null"},
+		{"bad ip length", `[[h'0a0000',null,8042,3]]`, nil, "the ip must be 4 or 16 bytes"},
+		{"bad text ip", `[["10.0.0",null,8042,3]]`, nil, "invalid ip address"},
+		{"integer ip", `[[1,null,8042,3]]`, nil, "the ip must be a byte string or null"},
+		{"bad hex", `[[h'0g000001',null,8042,3]]`, nil, "invalid byte string"},
+		{"unterminated text", `[[null,"owner,8042,3]]`, nil, "unterminated text string"},
+		{"unterminated byte string", `[[h'0a000001,null,8042,3]]`, nil, "unterminated byte string"},
+		{"missing comma", `[[null "owner",8042,3]]`, nil, "expected , or ]"},
+		{"unterminated array", `[[null,"owner",8042,3]`, nil, "expected , or ] at offset 22"},
+		{"truncated", `[[null,`, nil, "unexpected end"},
+		{"trailing content", `[[null,"owner",8042,3]] x`, nil, "unexpected 'x'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addresses, err := decodeTo2Addresses(tt.diag)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("decodeTo2Addresses(%s) returned error %v, want an error containing %q", tt.diag, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeTo2Addresses(%s) returned error: %v", tt.diag, err)
+			}
+			if !reflect.DeepEqual(addresses, tt.want) {
+				t.Errorf("decodeTo2Addresses(%s) = %+v, want %+v", tt.diag, addresses, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTo2Addresses(t *testing.T) {
+	valid := To2Address{Dns: "owner.example.com", Port: 8042, Protocol: "http"}
+	tooMany := make([]To2Address, MaxTo2Addresses+1)
+	for i := range tooMany {
+		tooMany[i] = valid
+	}
+	tests := []struct {
+		name      string
+		addresses []To2Address
+		wantErr   string // a substring of the error, or "" if it must be valid
+	}{
+		{"valid", []To2Address{valid}, ""},
+		{"max addresses", tooMany[:MaxTo2Addresses], ""},
+		{"ip only", []To2Address{{Ip: "2001:db8::1", Port: 8042, Protocol: "https"}}, ""},
+		{"single label dns", []To2Address{{Dns: "owner", Port: 8042, Protocol: "http"}}, ""},
+		{"none", []To2Address{}, "at least 1 TO2 address is required"},
+		{"too many", tooMany, "at most 8 TO2 addresses"},
+		{"no host", []To2Address{{Port: 8042, Protocol: "http"}}, "dns or ip is required"},
+		{"dns with scheme", []To2Address{{Dns: "http://owner", Port: 8042, Protocol: "http"}}, "invalid dns name"},
+		{"dns with port", []To2Address{{Dns: "owner:8042", Port: 8042, Protocol: "http"}}, "invalid dns name"},
+		{"dns with leading hyphen", []To2Address{{Dns: "-owner.example.com", Port: 8042, Protocol: "http"}}, "invalid dns name"},
+		{"dns with empty label", []To2Address{{Dns: "owner..example.com", Port: 8042, Protocol: "http"}}, "invalid dns name"},
+		{"dns label too long", []To2Address{{Dns: strings.Repeat("a", 64) + ".com", Port: 8042, Protocol: "http"}}, "invalid dns name"},
+		{"dns too long", []To2Address{{Dns: strings.Repeat(strings.Repeat("a", 63)+".", 4) + "com", Port: 8042, Protocol: "http"}}, "invalid dns name"},
+		{"bad ip", []To2Address{{Ip: "10.0.0.256", Port: 8042, Protocol: "http"}}, "invalid ip address"},
+		{"port 0", []To2Address{{Dns: "owner", Port: 0, Protocol: "http"}}, "port must be between 1 and 65535"},
+		{"port too big", []To2Address{{Dns: "owner", Port: 65536, Protocol: "http"}}, "port must be between 1 and 65535"},
+		{"negative port", []To2Address{{Dns: "owner", Port: -1, Protocol: "http"}}, "port must be between 1 and 65535"},
+		{"no protocol", []To2Address{{Dns: "owner", Port: 8042}}, "protocol must be one of"},
+		{"unknown protocol", []To2Address{{Dns: "owner", Port: 8042, Protocol: "ftp"}}, "protocol must be one of"},
+		{"upper case protocol", []To2Address{{Dns: "owner", Port: 8042, Protocol: "HTTP"}}, "protocol must be one of"},
+		{"second address invalid", []To2Address{valid, {Dns: "owner", Port: 8042, Protocol: "ftp"}}, "TO2 address 1:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpErr := validateTo2Addresses(tt.addresses)
+			if tt.wantErr == "" {
+				if httpErr != nil {
+					t.Errorf("validateTo2Addresses() returned error: %v", httpErr.Error())
+				}
+				return
+			}
+			if httpErr == nil || !strings.Contains(httpErr.Error(), tt.wantErr) {
+				t.Fatalf("validateTo2Addresses() returned error %v, want an error containing %q", httpErr, tt.wantErr)
+			}
+			if httpErr.Code != http.StatusBadRequest {
+				t.Errorf("validateTo2Addresses() returned code %d, want %d", httpErr.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestNewTo2Address(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		port    string
+		want    To2Address
+		wantErr string
+	}{
+		{"dns", "owner.example.com", "8042", To2Address{Dns: "owner.example.com", Port: 8042, Protocol: "http"}, ""},
+		{"port not a number", "owner.example.com", "http", To2Address{}, "is not a number"},
+		{"port out of range", "owner.example.com", "70000", To2Address{}, "port must be between 1 and 65535"},
+		{"bad host", "owner_1", "8042", To2Address{}, "invalid dns name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address, err := newTo2Address(tt.host, tt.port)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("newTo2Address(%q, %q) returned error %v, want an error containing %q", tt.host, tt.port, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newTo2Address(%q, %q) returned error: %v", tt.host, tt.port, err)
+			}
+			if address != tt.want {
+				t.Errorf("newTo2Address(%q, %q) = %+v, want %+v", tt.host, tt.port, address, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+OpenTelemetry tracing for ocs-api. Spans are exported with OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT or
+OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set. The exporter and SDK also honor the other standard env vars, e.g.
+OTEL_EXPORTER_OTLP_HEADERS, OTEL_SERVICE_NAME, OTEL_RESOURCE_ATTRIBUTES, and OTEL_TRACES_SAMPLER. W3C trace context is always
+propagated to the exchange and owner service, even when spans are not exported.
+*/
+
+const tracerName = "github.com/open-horizon/FDO-support/ocs-api"
+
+var tracer = otel.Tracer(tracerName)
+var provider *sdktrace.TracerProvider
+
+// Returns true if an OTLP endpoint is configured
+func IsEnabled() bool {
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Set up the trace context propagator, and the OTLP exporter if it is configured
+func Init(ctx context.Context, serviceVersion string) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !IsEnabled() {
+		return nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return err
+	}
+	// The env vars are applied last, so OTEL_SERVICE_NAME can override our default service name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "ocs-api"), attribute.String("service.version", serviceVersion)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return err
+	}
+	provider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer(tracerName)
+	return nil
+}
+
+// Flush the spans that have not been exported yet and stop the exporter
+func Shutdown(ctx context.Context) error {
+	if provider == nil {
+		return nil
+	}
+	return provider.Shutdown(ctx)
+}
+
+// Start a span that is a child of the span in this context. End it with End().
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End this span, recording the error (if not nil) as the span status
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Wrap a handler to create a server span for each request (continuing the client's trace, if it sent a traceparent header).
+// routeFunc returns the route template for the request, which is used as the span name.
+func InstrumentHandler(routeFunc func(*http.Request) string, next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "ocs-api", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return r.Method + " " + routeFunc(r)
+	}))
+}
+
+// Wrap a transport to create a client span for each request to this upstream, and to add the trace context headers to the
+// request. operationFunc returns the span name for the request.
+func InstrumentTransport(upstream string, operationFunc func(*http.Request) string, next http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(next,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return upstream + " " + operationFunc(r)
+		}),
+		otelhttp.WithSpanOptions(trace.WithAttributes(attribute.String("upstream", upstream))),
+	)
+}
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/open-horizon/FDO-support/ocs-api/metrics"
+	"github.com/open-horizon/FDO-support/ocs-api/ocsdb"
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+)
+
+/*
+Moving devices between orgs and between ocs-api instances. A device that has not onboarded yet can be transferred to another
+org of this management hub, which re-binds it to the new org with a new node token. Or it can be exported as a bundle (the voucher,
+labels, and device record) signed with the key of this ocs-api instance, and imported by another ocs-api that trusts this
+instance's public key (FDO_TRUSTED_BUNDLE_KEYS). The owner service of the importing instance must have the owner key that the
+voucher was extended to, because exporting doesn't extend it. The exported device is marked as transferred, or removed.
+
+A bundle is bound to the org and the instance (by its public key) it is exported to, and expires, so it can't be imported into
+another org, or replayed after the device was moved on.
+*/
+
+const DeviceBundleFormat = "ocs-api-device-bundle/v2"
+const MaxDeviceBundleBodyKB = 1024
+const DefaultDeviceBundleTtlH = 72
+const MaxDeviceBundleTtlH = 720
+
+// The private key of this ocs-api instance, in v1/creds. It is created the first time ocs-api starts.
+const instanceKeyFileName = "instance_key.pem"
+
+var instanceKey *ecdsa.PrivateKey
+var instanceKeySha256 string   // the SHA-256 of the DER encoded public key of this instance, that bundles exported to it have
+var trustedBundleKeys [][]byte // the DER encoded public keys of the instances whose bundles can be imported, including this one
+
+// The content of an exported device bundle
+type DeviceBundle struct {
+	Format               string            `json:"format"`
+	Exported             string            `json:"exported"`
+	Expires              string            `json:"expires"`
+	SourceOrgId          string            `json:"sourceOrgId"`
+	TargetOrgId          string            `json:"targetOrgId"`
+	TargetInstanceSha256 string            `json:"targetInstanceSha256"` // the SHA-256 of the public key of the importing instance
+	DeviceUuid           string            `json:"deviceUuid"`
+	Voucher              string            `json:"voucher"` // PEM encoded
+	Labels               map[string]string `json:"labels,omitempty"`
+	Record               DeviceRecord      `json:"record"`
+}
+
+// A device bundle and its signature, as returned by the export route and accepted by the import route
+type SignedDeviceBundle struct {
+	Payload   string `json:"payload"`   // base64 of the json of the DeviceBundle
+	Signature string `json:"signature"` // base64 of the ASN.1 ECDSA signature of the SHA-256 of the payload bytes
+	PublicKey string `json:"publicKey"` // PEM encoded public key of the exporting instance
+}
+
+type transferRequest struct {
+	TargetOrgId string `json:"targetOrgId"`
+}
+
+type exportRequest struct {
+	TargetOrgId       string `json:"targetOrgId"`
+	TargetInstanceKey string `json:"targetInstanceKey"` // PEM encoded, from GET /api/fdo/instance-key of the importing instance
+	ExpiresInHours    int    `json:"expiresInHours,omitempty"`
+}
+
+// Load (or create) the key of this instance, and the public keys of the other instances that bundles can be imported from
+func initBundleKeys(ctx context.Context) error {
+	fileName := filepath.Clean(filepath.Join(OcsDbDir, "v1", "creds", instanceKeyFileName))
+	if !outils.PathExists(fileName) {
+		outils.Log.Info("creating the ocs-api instance key", "file", fileName)
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return fmt.Errorf("could not generate the instance key: %v", err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return fmt.Errorf("could not marshal the instance key: %v", err)
+		}
+		if err := ocsdb.WriteFile(ctx, fileName, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return fmt.Errorf("could not create %s: %v", fileName, err)
+		}
+	}
+	keyBytes, err := ocsdb.ReadFile(fileName)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", fileName, err)
+	}
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return fmt.Errorf("%s does not contain a PEM encoded key", fileName)
+	}
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %v", fileName, err)
+	}
+	key, ok := parsedKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("%s is not an ECDSA key", fileName)
+	}
+	ownDer, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return fmt.Errorf("could not marshal the instance public key: %v", err)
+	}
+
+	trusted := [][]byte{ownDer}
+	if outils.IsEnvVarSet("FDO_TRUSTED_BUNDLE_KEYS") {
+		trustedFileName := filepath.Clean(os.Getenv("FDO_TRUSTED_BUNDLE_KEYS"))
+		pemBytes, err := os.ReadFile(trustedFileName)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", trustedFileName, err)
+		}
+		for rest := pemBytes; ; {
+			if block, rest = pem.Decode(rest); block == nil {
+				break
+			} else if block.Type != "PUBLIC KEY" {
+				continue
+			}
+			if _, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+				return fmt.Errorf("invalid public key in %s: %v", trustedFileName, err)
+			}
+			trusted = append(trusted, block.Bytes)
+		}
+	}
+	ownSha256 := sha256.Sum256(ownDer)
+	instanceKey = key
+	instanceKeySha256 = hex.EncodeToString(ownSha256[:])
+	trustedBundleKeys = trusted
+	outils.Log.Info("loaded the device bundle signing keys", "trusted_instances", len(trusted))
+	return nil
+}
+
+// Sign this bundle with the key of this instance
+func signDeviceBundle(bundle *DeviceBundle) (*SignedDeviceBundle, error) {
+	payload, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, instanceKey, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	publicDer, err := x509.MarshalPKIXPublicKey(&instanceKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedDeviceBundle{
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+		Signature: base64.StdEncoding.EncodeToString(signature),
+		PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer})),
+	}, nil
+}
+
+// Verify that this bundle was signed by a trusted instance, and return its content
+func verifyDeviceBundle(signed *SignedDeviceBundle) (*DeviceBundle, *outils.HttpError) {
+	block, _ := pem.Decode([]byte(signed.PublicKey))
+	if block == nil {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "the bundle public key is not PEM encoded")
+	}
+	trusted := false
+	for _, der := range trustedBundleKeys {
+		if bytes.Equal(der, block.Bytes) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return nil, outils.NewHttpError(http.StatusForbidden, "the bundle was signed by an ocs-api instance that is not trusted, add its public key to FDO_TRUSTED_BUNDLE_KEYS")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "invalid bundle public key: %v", err)
+	}
+	ecdsaKey, ok := publicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "the bundle public key is not an ECDSA key")
+	}
+	payload, err := base64.StdEncoding.DecodeString(signed.Payload)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "the bundle payload is not base64 encoded: %v", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "the bundle signature is not base64 encoded: %v", err)
+	}
+	digest := sha256.Sum256(payload)
+	if !ecdsa.VerifyASN1(ecdsaKey, digest[:], signature) {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "the bundle signature is not valid")
+	}
+
+	bundle := &DeviceBundle{}
+	if err := json.Unmarshal(payload, bundle); err != nil {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "invalid bundle payload: %v", err)
+	} else if bundle.Format != DeviceBundleFormat {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "unsupported bundle format %s, must be %s", bundle.Format, DeviceBundleFormat)
+	}
+	if bundle.TargetInstanceSha256 != instanceKeySha256 {
+		return nil, outils.NewHttpError(http.StatusForbidden, "the bundle was exported to another ocs-api instance")
+	}
+	if expires, err := time.Parse(time.RFC3339, bundle.Expires); err != nil {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "invalid bundle expiry %s: %v", bundle.Expires, err)
+	} else if time.Now().After(expires) {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "the bundle expired at %s, export the device again", bundle.Expires)
+	}
+	return bundle, nil
+}
+
+// Returns the hex SHA-256 of the DER of this PEM encoded public key
+func publicKeySha256(publicKeyPem string) (string, *outils.HttpError) {
+	block, _ := pem.Decode([]byte(publicKeyPem))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return "", outils.NewHttpError(http.StatusBadRequest, "targetInstanceKey must be the PEM encoded public key of the importing instance")
+	}
+	if _, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return "", outils.NewHttpError(http.StatusBadRequest, "invalid targetInstanceKey: %v", err)
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Re-bind this device to another org with a new node token: update the exec file the device will run, move the exchange node
+// (if it was already created), and then update the stored token and org. If a step fails, the steps already done are undone.
+func transferDevice(r *http.Request, deviceUuid, fromOrgId, toOrgId string) (nodeToken string, nodeMoved bool, httpErr *outils.HttpError) {
+	ctx := r.Context()
+	unlock := lockDevice(deviceUuid)
+	defer unlock()
+
+	if httpErr := verifyDeviceInOrg(deviceUuid, fromOrgId); httpErr != nil {
+		return "", false, httpErr
+	}
+	state, httpErr := getDeviceState(deviceUuid)
+	if httpErr != nil {
+		return "", false, httpErr
+	} else if state.State == DeviceStateOnboarded {
+		return "", false, outils.NewHttpError(http.StatusConflict, "device %s has already onboarded, its agent is registered in org %s", deviceUuid, fromOrgId)
+	} else if state.State == DeviceStateTransferred {
+		return "", false, outils.NewHttpError(http.StatusConflict, "the voucher of device %s was extended to another owner", deviceUuid)
+	}
+	oldNodeToken, httpErr := getNodeTokenTxtStr(deviceUuid)
+	if httpErr != nil {
+		return "", false, httpErr
+	}
+	// Keep the exec file and the token file as they are, to put them back exactly if the transfer fails. Devices imported before
+	// the node token was stored don't have a token file.
+	execSnapshot, httpErr := snapshotFiles(filepath.Clean(filepath.Join(OcsDbDir, "v1", "values", deviceUuid+"_exec")))
+	if httpErr != nil {
+		return "", false, httpErr
+	}
+	tokenSnapshot, httpErr := snapshotFiles(filepath.Clean(filepath.Join(OcsDbDir, "v1", "devices", deviceUuid, "nodeToken.txt")))
+	if httpErr != nil {
+		return "", false, httpErr
+	}
+	if nodeToken, httpErr = outils.GenerateNodeToken(); httpErr != nil {
+		return "", false, httpErr
+	}
+
+	s := &saga{ctx: ctx, name: "device transfer"}
+	defer func() {
+		if httpErr != nil {
+			s.rollback()
+		}
+	}()
+
+	// Have the device register in the new org when it onboards
+	if httpErr := createDeviceExecFile(ctx, deviceUuid, nodeToken, toOrgId); httpErr != nil {
+		return "", false, httpErr
+	}
+	s.done("update the device exec file", func(ctx context.Context) error {
+		if err := execSnapshot.restore(); err != nil {
+			return err
+		}
+		return httpErrOrNil(postDeviceExecResource(ctx, deviceUuid))
+	})
+	if httpErr := postDeviceExecResource(ctx, deviceUuid); httpErr != nil {
+		return "", false, httpErr
+	}
+
+	// If the node was already created in the exchange, it has to be in the new org with the new token
+	if nodeMoved, httpErr = outils.ExchangeMoveNode(r, ExchangeInternalUrl, fromOrgId, toOrgId, deviceUuid, nodeToken, ExchangeInternalCertPath); httpErr != nil {
+		return "", false, httpErr
+	} else if nodeMoved {
+		s.done("move the exchange node", func(ctx context.Context) error {
+			_, httpErr := outils.ExchangeMoveNode(r.WithContext(ctx), ExchangeInternalUrl, toOrgId, fromOrgId, deviceUuid, oldNodeToken, ExchangeInternalCertPath)
+			return httpErrOrNil(httpErr)
+		})
+	}
+
+	if httpErr := storeNodeToken(ctx, deviceUuid, nodeToken); httpErr != nil {
+		return "", false, httpErr
+	}
+	s.done("store the node token", func(ctx context.Context) error {
+		return tokenSnapshot.restore()
+	})
+
+	fileName := filepath.Clean(filepath.Join(OcsDbDir, "v1", "devices", deviceUuid, "orgid.txt"))
+	if err := ocsdb.WriteFile(ctx, fileName, []byte(toOrgId), 0644); err != nil {
+		return "", false, outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
+	}
+	indexDevice(ctx, deviceUuid)
+	return nodeToken, nodeMoved, nil
+}
+
+// ============= GET /api/fdo/instance-key =============
+// Returns the public key of this ocs-api instance (PEM encoded), which other instances need in FDO_TRUSTED_BUNDLE_KEYS to import
+// the device bundles exported from this one, and to export bundles to this one
+func getFdoInstanceKeyHandler(w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("GET /api/fdo/instance-key")
+
+	publicDer, err := x509.MarshalPKIXPublicKey(&instanceKey.PublicKey)
+	if err != nil {
+		http.Error(w, "Error marshaling the instance public key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	outils.WriteResponse(http.StatusOK, w, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer}))
+}
+
+// ============= POST /api/orgs/{ord-id}/fdo/vouchers/{deviceUuid}/transfer =============
+// Moves a device that has not onboarded yet to another org ({"targetOrgId": "<org>"}), with a new node token. The user must be an
+// admin of both orgs, which in practice means the exchange root user.
+func postFdoVoucherTransferHandler(orgId string, deviceUuid string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("POST /api/orgs/{org-id}/fdo/vouchers/{device-id}/transfer", "org", orgId, "device", deviceUuid)
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Authenticate this user with the exchange, and ensure they are an admin
+	if authenticated, _, httpErr := outils.ExchangeAuthenticateAdmin(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided or the user is not an org admin", http.StatusUnauthorized)
+		return
+	}
+
+	// Verify content type
+	if httpErr := outils.IsValidPostJson(r); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	transfer := transferRequest{}
+	if httpErr := outils.ReadJsonBody(r, &transfer); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	if transfer.TargetOrgId == "" {
+		http.Error(w, "targetOrgId must be specified", http.StatusBadRequest)
+		return
+	} else if transfer.TargetOrgId == deviceOrgId {
+		http.Error(w, "device "+deviceUuid+" is already in org "+deviceOrgId, http.StatusBadRequest)
+		return
+	}
+
+	// The user has to be able to manage the device in the new org too
+	if authenticated, _, httpErr := outils.ExchangeAuthenticateAdmin(r, ExchangeInternalUrl, transfer.TargetOrgId, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "the user is not an admin of org "+transfer.TargetOrgId, http.StatusForbidden)
+		return
+	}
+
+	nodeToken, nodeMoved, httpErr := transferDevice(r, deviceUuid, deviceOrgId, transfer.TargetOrgId)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	outils.LogFor(r).Info("device transferred to another org", "org", deviceOrgId, "target_org", transfer.TargetOrgId, "device", deviceUuid, "exchange_node_moved", nodeMoved)
+
+	respBody := map[string]interface{}{
+		"deviceUuid":        deviceUuid,
+		"orgId":             transfer.TargetOrgId,
+		"nodeToken":         nodeToken,
+		"exchangeNodeMoved": nodeMoved,
+	}
+	outils.WriteJsonResponse(http.StatusOK, w, respBody)
+}
+
+// ============= POST /api/orgs/{ord-id}/fdo/vouchers/{deviceUuid}/export =============
+// Returns a bundle of the voucher, labels, and record of this device, signed with the key of this instance, that the org and
+// ocs-api instance in the body ({"targetOrgId": "<org>", "targetInstanceKey": "<PEM>", "expiresInHours": 72}) can import until it
+// expires. The voucher is not extended, so the owner service of the importing instance must have the same owner key
+// (to give the device to another owner, resell it instead). The device is marked as transferred, or with ?delete=true it is
+// removed from the owner service and the OCS DB, so it only onboards with the importing instance. The bundle is kept, so
+// exporting the device again to the same target returns it, with a new expiry. Devices that onboarded or were transferred another way can't be exported. Only org
+// admins can export devices.
+func postFdoVoucherExportHandler(orgId string, deviceUuid string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("POST /api/orgs/{org-id}/fdo/vouchers/{device-id}/export", "org", orgId, "device", deviceUuid)
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Authenticate this user with the exchange, and ensure they are an admin
+	if authenticated, _, httpErr := outils.ExchangeAuthenticateAdmin(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided or the user is not an org admin", http.StatusUnauthorized)
+		return
+	}
+
+	// Verify content type
+	if httpErr := outils.IsValidPostJson(r); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	export := exportRequest{}
+	if httpErr := outils.ReadJsonBody(r, &export); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	if export.TargetOrgId == "" {
+		http.Error(w, "targetOrgId must be specified", http.StatusBadRequest)
+		return
+	}
+	targetInstanceSha256, httpErr := publicKeySha256(export.TargetInstanceKey)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	if export.ExpiresInHours == 0 {
+		export.ExpiresInHours = DefaultDeviceBundleTtlH
+	} else if export.ExpiresInHours < 0 || export.ExpiresInHours > MaxDeviceBundleTtlH {
+		http.Error(w, fmt.Sprintf("expiresInHours must be between 1 and %d", MaxDeviceBundleTtlH), http.StatusBadRequest)
+		return
+	}
+	expires := time.Now().UTC().Add(time.Duration(export.ExpiresInHours) * time.Hour).Format(time.RFC3339)
+	deleteDevice := r.URL.Query().Get("delete") == "true"
+
+	unlock := lockDevice(deviceUuid)
+	defer unlock()
+	if handoff, httpErr := getRepeatedDeviceHandoff(deviceUuid, deviceOrgId, DeviceHandoffExport); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if handoff != nil {
+		// The response of the first export may not have reached the client, or the bundle expired before it was imported, so
+		// return it again. It can only go to the target it was exported to, because the device may already be imported there.
+		if handoff.Bundle.TargetOrgId != export.TargetOrgId || handoff.Bundle.TargetInstanceSha256 != targetInstanceSha256 {
+			http.Error(w, "device "+deviceUuid+" was already exported to org "+handoff.Bundle.TargetOrgId+", it can only be exported again to the same org and instance", http.StatusConflict)
+			return
+		}
+		handoff.Bundle.Expires = expires
+		signed, err := signDeviceBundle(handoff.Bundle)
+		if err != nil {
+			http.Error(w, "Error signing the device bundle: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		outils.LogFor(r).Info("device exported again", "org", deviceOrgId, "device", deviceUuid, "exported", handoff.Bundle.Exported)
+		outils.WriteJsonResponse(http.StatusOK, w, signed)
+		return
+	}
+	if state, httpErr := getDeviceState(deviceUuid); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if state.State == DeviceStateOnboarded {
+		http.Error(w, "device "+deviceUuid+" has already onboarded with this instance", http.StatusConflict)
+		return
+	}
+	voucherFileName := filepath.Clean(filepath.Join(OcsDbDir, "v1", "devices", deviceUuid, "ownership_voucher.txt"))
+	voucherBytes, err := ocsdb.ReadFile(voucherFileName)
+	if err != nil {
+		http.Error(w, "Error reading "+voucherFileName+": "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	labels, httpErr := getDeviceLabels(deviceUuid)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	record, httpErr := getDeviceRecord(r.Context(), deviceUuid)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	bundle := &DeviceBundle{
+		Format:               DeviceBundleFormat,
+		Exported:             time.Now().UTC().Format(time.RFC3339),
+		Expires:              expires,
+		SourceOrgId:          deviceOrgId,
+		TargetOrgId:          export.TargetOrgId,
+		TargetInstanceSha256: targetInstanceSha256,
+		DeviceUuid:           deviceUuid,
+		Voucher:              string(voucherBytes),
+		Labels:               labels,
+		Record:               *record,
+	}
+	signed, err := signDeviceBundle(bundle)
+	if err != nil {
+		http.Error(w, "Error signing the device bundle: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if httpErr := saveDeviceHandoff(r.Context(), deviceUuid, &DeviceHandoff{Type: DeviceHandoffExport, OrgId: deviceOrgId, Bundle: bundle}); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	if deleteDevice {
+		deleteResoldDevice(r.Context(), deviceUuid)
+	} else if httpErr := setDeviceState(r.Context(), deviceUuid, DeviceStateTransferred, "", ""); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	outils.LogFor(r).Info("device exported", "org", deviceOrgId, "device", deviceUuid, "target_org", export.TargetOrgId, "expires", expires, "deleted", deleteDevice)
+	outils.WriteJsonResponse(http.StatusOK, w, signed)
+}
+
+// ============= POST /api/orgs/{ord-id}/fdo/vouchers/import =============
+// Imports a device bundle exported to this org and instance by a trusted ocs-api instance: the voucher is imported the same way
+// as POST .../fdo/vouchers (including ?replace=true), and then the labels from the bundle are set. Only org admins can import
+// bundles.
+func postFdoVouchersImportHandler(orgId string, w http.ResponseWriter, r *http.Request) {
+	outils.LogFor(r).Debug("POST /api/orgs/{org-id}/fdo/vouchers/import", "org", orgId)
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Authenticate this user with the exchange, and ensure they are an admin
+	authenticated, user, httpErr := outils.ExchangeAuthenticateAdmin(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if !authenticated {
+		http.Error(w, "invalid exchange credentials provided or the user is not an org admin", http.StatusUnauthorized)
+		return
+	}
+
+	// Count the outcome of this import, now that we know the org is real
+	importResult := metrics.ResultFailure
+	defer func() { metrics.VoucherImports.WithLabelValues(deviceOrgId, importResult).Inc() }()
+
+	// Verify content type
+	if httpErr := outils.IsValidPostJson(r); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	bodyBytes, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxDeviceBundleBodyKB*1024))
+	if err != nil {
+		http.Error(w, "Error reading the request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	signed := &SignedDeviceBundle{}
+	if httpErr := outils.ParseJsonString(bodyBytes, signed); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	bundle, httpErr := verifyDeviceBundle(signed)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	} else if bundle.TargetOrgId != deviceOrgId {
+		http.Error(w, "the bundle was exported to org "+bundle.TargetOrgId+", not "+deviceOrgId, http.StatusForbidden)
+		return
+	}
+
+	// The voucher has to be for the device the bundle says it is
+	voucherHeader, err := outils.ParseVoucher([]byte(bundle.Voucher))
+	if err != nil {
+		http.Error(w, "invalid ownership voucher in the bundle: "+err.Error(), http.StatusBadRequest)
+		return
+	} else if !strings.EqualFold(voucherHeader.Guid, bundle.DeviceUuid) {
+		http.Error(w, fmt.Sprintf("the bundle is for device %s, but its voucher is for device %s", bundle.DeviceUuid, voucherHeader.Guid), http.StatusBadRequest)
+		return
+	}
+	if httpErr := validateDeviceLabels(bundle.Labels); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	replace := r.URL.Query().Get("replace") == "true"
+	deviceUuid, nodeToken, existing, httpErr := importVoucher(r.Context(), deviceOrgId, user, []byte(bundle.Voucher), replace)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	if existing {
+		outils.LogFor(r).Info("voucher was already imported, returning the existing device", "org", deviceOrgId, "device", deviceUuid)
+	} else if len(bundle.Labels) > 0 {
+		deviceMetadataLock.Lock()
+		httpErr := saveDeviceLabels(r.Context(), deviceUuid, deviceOrgId, bundle.Labels)
+		deviceMetadataLock.Unlock()
+		if httpErr != nil {
+			http.Error(w, "the voucher was imported, but setting its labels failed: "+httpErr.Error(), httpErr.Code)
+			return
+		}
+	}
+	outils.LogFor(r).Info("device bundle imported", "org", deviceOrgId, "source_org", bundle.SourceOrgId, "device", deviceUuid, "exported", bundle.Exported)
+
+	respBody := map[string]interface{}{
+		"deviceUuid":  deviceUuid,
+		"nodeToken":   nodeToken,
+		"sourceOrgId": bundle.SourceOrgId,
+	}
+	importResult = metrics.ResultSuccess
+	outils.WriteJsonResponse(http.StatusOK, w, respBody)
+}
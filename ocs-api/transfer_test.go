@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Use a new key as the instance key for the test, trusting it and the other keys
+func setTestInstanceKey(t *testing.T, otherTrusted ...*ecdsa.PrivateKey) *ecdsa.PrivateKey {
+	t.Helper()
+	key := newTestBundleKey(t)
+	savedKey, savedSha256, savedTrusted := instanceKey, instanceKeySha256, trustedBundleKeys
+	instanceKey = key
+	instanceKeySha256 = mustPublicKeySha256(t, &key.PublicKey)
+	trustedBundleKeys = [][]byte{mustMarshalPublicKey(t, &key.PublicKey)}
+	for _, other := range otherTrusted {
+		trustedBundleKeys = append(trustedBundleKeys, mustMarshalPublicKey(t, &other.PublicKey))
+	}
+	t.Cleanup(func() {
+		instanceKey, instanceKeySha256, trustedBundleKeys = savedKey, savedSha256, savedTrusted
+	})
+	return key
+}
+
+func newTestBundleKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey() returned error: %v", err)
+	}
+	return key
+}
+
+func mustMarshalPublicKey(t *testing.T, publicKey *ecdsa.PublicKey) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("x509.MarshalPKIXPublicKey() returned error: %v", err)
+	}
+	return der
+}
+
+func mustPublicKeySha256(t *testing.T, publicKey *ecdsa.PublicKey) string {
+	t.Helper()
+	sum := sha256.Sum256(mustMarshalPublicKey(t, publicKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns a bundle for this instance that expires in an hour
+func newTestBundle(t *testing.T) *DeviceBundle {
+	t.Helper()
+	return &DeviceBundle{
+		Format:               DeviceBundleFormat,
+		Exported:             time.Now().UTC().Format(time.RFC3339),
+		Expires:              time.Now().UTC().Add(time.Hour).Format(time.RFC3339),
+		SourceOrgId:          "myorg",
+		TargetOrgId:          "otherorg",
+		TargetInstanceSha256: instanceKeySha256,
+		DeviceUuid:           "0a1b2c3d-0000-1111-2222-000000000011",
+	}
+}
+
+// Sign the bundle with this key instead of the instance key
+func signTestBundleWith(t *testing.T, key *ecdsa.PrivateKey, bundle *DeviceBundle) *SignedDeviceBundle {
+	t.Helper()
+	saved := instanceKey
+	instanceKey = key
+	defer func() { instanceKey = saved }()
+	signed, err := signDeviceBundle(bundle)
+	if err != nil {
+		t.Fatalf("signDeviceBundle() returned error: %v", err)
+	}
+	return signed
+}
+
+func TestVerifyDeviceBundle(t *testing.T) {
+	exporter := newTestBundleKey(t)
+	key := setTestInstanceKey(t, exporter)
+	untrusted := newTestBundleKey(t)
+
+	tests := []struct {
+		name     string
+		signed   func() *SignedDeviceBundle
+		wantCode int // 0 if it must be valid
+		wantErr  string
+	}{
+		{"signed by this instance", func() *SignedDeviceBundle { return signTestBundleWith(t, key, newTestBundle(t)) }, 0, ""},
+		{"signed by a trusted instance", func() *SignedDeviceBundle { return signTestBundleWith(t, exporter, newTestBundle(t)) }, 0, ""},
+		{"signed by an untrusted instance", func() *SignedDeviceBundle {
+			return signTestBundleWith(t, untrusted, newTestBundle(t))
+		}, http.StatusForbidden, "not trusted"},
+		{"exported to another instance", func() *SignedDeviceBundle {
+			bundle := newTestBundle(t)
+			bundle.TargetInstanceSha256 = mustPublicKeySha256(t, &untrusted.PublicKey)
+			return signTestBundleWith(t, exporter, bundle)
+		}, http.StatusForbidden, "exported to another ocs-api instance"},
+		{"not bound to an instance", func() *SignedDeviceBundle {
+			bundle := newTestBundle(t)
+			bundle.TargetInstanceSha256 = ""
+			return signTestBundleWith(t, exporter, bundle)
+		}, http.StatusForbidden, "exported to another ocs-api instance"},
+		{"expired", func() *SignedDeviceBundle {
+			bundle := newTestBundle(t)
+			bundle.Expires = time.Now().UTC().Add(-time.Minute).Format(time.RFC3339)
+			return signTestBundleWith(t, exporter, bundle)
+		}, http.StatusBadRequest, "the bundle expired"},
+		{"no expiry", func() *SignedDeviceBundle {
+			bundle := newTestBundle(t)
+			bundle.Expires = ""
+			return signTestBundleWith(t, exporter, bundle)
+		}, http.StatusBadRequest, "invalid bundle expiry"},
+		{"old format", func() *SignedDeviceBundle {
+			bundle := newTestBundle(t)
+			bundle.Format = "ocs-api-device-bundle/v1"
+			return signTestBundleWith(t, exporter, bundle)
+		}, http.StatusBadRequest, "unsupported bundle format"},
+		{"payload changed", func() *SignedDeviceBundle {
+			signed := signTestBundleWith(t, exporter, newTestBundle(t))
+			other := newTestBundle(t)
+			other.TargetOrgId = "thirdorg"
+			otherSigned := signTestBundleWith(t, exporter, other)
+			signed.Payload = otherSigned.Payload
+			return signed
+		}, http.StatusBadRequest, "signature is not valid"},
+		{"signature not base64", func() *SignedDeviceBundle {
+			signed := signTestBundleWith(t, exporter, newTestBundle(t))
+			signed.Signature = "not base64!"
+			return signed
+		}, http.StatusBadRequest, "not base64 encoded"},
+		{"public key not PEM", func() *SignedDeviceBundle {
+			signed := signTestBundleWith(t, exporter, newTestBundle(t))
+			signed.PublicKey = base64.StdEncoding.EncodeToString(mustMarshalPublicKey(t, &exporter.PublicKey))
+			return signed
+		}, http.StatusBadRequest, "not PEM encoded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bundle, httpErr := verifyDeviceBundle(tt.signed())
+			if tt.wantCode == 0 {
+				if httpErr != nil {
+					t.Fatalf("verifyDeviceBundle() returned error: %v", httpErr.Error())
+				}
+				if bundle.TargetOrgId != "otherorg" || bundle.DeviceUuid != "0a1b2c3d-0000-1111-2222-000000000011" {
+					t.Errorf("verifyDeviceBundle() = %+v, want the bundle that was signed", bundle)
+				}
+				return
+			}
+			if httpErr == nil || !strings.Contains(httpErr.Error(), tt.wantErr) {
+				t.Fatalf("verifyDeviceBundle() returned error %v, want an error containing %q", httpErr, tt.wantErr)
+			}
+			if httpErr.Code != tt.wantCode {
+				t.Errorf("verifyDeviceBundle() returned code %d, want %d", httpErr.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestPublicKeySha256(t *testing.T) {
+	key := newTestBundleKey(t)
+	der := mustMarshalPublicKey(t, &key.PublicKey)
+	tests := []struct {
+		name    string
+		pem     string
+		wantErr string
+	}{
+		{"public key", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), ""},
+		{"empty", "", "must be the PEM encoded public key"},
+		{"certificate", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), "must be the PEM encoded public key"},
+		{"invalid key", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte{1, 2, 3}})), "invalid targetInstanceKey"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sum, httpErr := publicKeySha256(tt.pem)
+			if tt.wantErr != "" {
+				if httpErr == nil || !strings.Contains(httpErr.Error(), tt.wantErr) {
+					t.Fatalf("publicKeySha256() returned error %v, want an error containing %q", httpErr, tt.wantErr)
+				}
+				return
+			}
+			if httpErr != nil {
+				t.Fatalf("publicKeySha256() returned error: %v", httpErr.Error())
+			}
+			if want := mustPublicKeySha256(t, &key.PublicKey); sum != want {
+				t.Errorf("publicKeySha256() = %s, want %s", sum, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-horizon/FDO-support/ocs-api/ocsdb"
+	"github.com/open-horizon/FDO-support/ocs-api/outils"
+	"github.com/open-horizon/FDO-support/ocs-api/tracing"
+)
+
+/*
+The voucher import pipeline. Each step that changes the owner service or the OCS DB registers a compensating action, and if a
+later step fails the compensations are run in reverse order, so a failed import leaves nothing behind and can be retried.
+
+Import is idempotent, keyed on the device guid in the voucher. Importing the same voucher again returns the existing device
+and node token without changing anything, so nodes that were already provisioned with the node token keep working. Importing
+a different voucher for the same guid is a conflict, unless the caller explicitly asks to replace the existing device.
+*/
+
+// The SVI instructions that every device gets: download the common resources and the device exec file, then run it
+const sviBody = `[{"filedesc" : "agent-install.crt","resource" : "agent-install.crt"},
+            {"filedesc" : "agent-install.cfg","resource" : "agent-install.cfg"},
+            {"filedesc" : "agent-install-wrapper.sh","resource" : "agent-install-wrapper.sh"},
+            {"filedesc" : "setup.sh","resource" : "$(guid)_exec"},
+            {"exec" : ["bash","setup.sh"] }]`
+
+// The owner service returns the device guid when a voucher is imported
+var deviceGuidRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// Serializes the imports of the same device, so concurrent imports of the same voucher can't both create the device. Only lock it
+// with lockDevice and lockIdempotencyKey, so the keys of a device are always the same.
+var importLocks = newKeyedMutex()
+
+// Lock the imports and changes of this device, and return the function that unlocks it. The uuid is lower cased, so the uuid of a
+// route and the guid of a voucher (in any case) lock the same device.
+func lockDevice(deviceUuid string) func() {
+	return importLocks.lock("device\n" + strings.ToLower(deviceUuid))
+}
+
+// Lock the imports with this Idempotency-Key in this org, and return the function that unlocks it. It must be locked before the
+// device.
+func lockIdempotencyKey(orgId, idempotencyKey string) func() {
+	return importLocks.lock("idempotency-key\n" + orgId + "\n" + idempotencyKey)
+}
+
+type sagaStep struct {
+	name       string
+	compensate func(context.Context) error
+}
+
+// The completed steps of a multi-step operation, and how to undo each one
+type saga struct {
+	ctx   context.Context
+	name  string // what the operation is, for the log messages
+	steps []sagaStep
+}
+
+// Record that this step completed, and the action that undoes it
+func (s *saga) done(name string, compensate func(context.Context) error) {
+	s.steps = append(s.steps, sagaStep{name: name, compensate: compensate})
+}
+
+// Undo the completed steps in reverse order. All of the compensations are tried, even if some fail.
+func (s *saga) rollback() {
+	// The request context may have been canceled (which may be why we failed), but the compensations still need to run
+	ctx := context.WithoutCancel(s.ctx)
+	for i := len(s.steps) - 1; i >= 0; i-- {
+		step := s.steps[i]
+		if err := step.compensate(ctx); err != nil {
+			outils.LogCtx(ctx).Error("could not undo "+s.name+" step, manual cleanup may be needed", "step", step.name, "error", err)
+		} else {
+			outils.LogCtx(ctx).Info("undid "+s.name+" step", "step", step.name)
+		}
+	}
+}
+
+// Import this voucher into the owner service and the OCS DB, and set up the device's onboarding files. The importing exchange user
+// is recorded with the device. Returns the device uuid and node token, and whether the device already existed with this same
+// voucher (in which case nothing was changed). If replace is true, a device that already exists in this org is re-imported with a
+// new node token. If any step fails, the steps already done are undone, and a device that was being replaced is put back the way
+// it was.
+func importVoucher(ctx context.Context, deviceOrgId, user string, voucherBytes []byte, replace bool) (deviceUuid string, nodeToken string, existing bool, httpErr *outils.HttpError) {
+	ctx, span := tracing.Start(ctx, "importVoucher")
+	defer func() {
+		if httpErr != nil {
+			tracing.End(span, httpErr)
+		} else {
+			tracing.End(span, nil)
+		}
+	}()
+
+	fdoOwnerURL := os.Getenv("HZN_FDO_API_URL")
+	if fdoOwnerURL == "" {
+		return "", "", false, outils.NewHttpError(http.StatusInternalServerError, "HZN_FDO_API_URL is not set")
+	}
+	username, password := outils.GetOwnerServiceApiKey()
+	client := outils.NewOwnerServiceClient(username, password)
+
+	// Find out which device this voucher is for, and whether we already have it
+	voucherHeader, err := outils.ParseVoucher(voucherBytes)
+	if err != nil {
+		return "", "", false, outils.NewHttpError(http.StatusBadRequest, "invalid ownership voucher: %v", err)
+	}
+	unlock := lockDevice(voucherHeader.Guid)
+	defer unlock()
+	deviceUuid, nodeToken, existing, httpErr = checkExistingDevice(voucherHeader.Guid, deviceOrgId, voucherBytes, replace)
+	if httpErr != nil || existing {
+		return deviceUuid, nodeToken, existing, httpErr
+	}
+
+	// If the device is being replaced, keep its current voucher, to put it back in the owner service if this import fails
+	var existingVoucherBytes []byte
+	existingVoucherFileName := filepath.Clean(filepath.Join(OcsDbDir, "v1", "devices", voucherHeader.Guid, "ownership_voucher.txt"))
+	if outils.PathExists(existingVoucherFileName) {
+		if existingVoucherBytes, err = ocsdb.ReadFile(existingVoucherFileName); err != nil {
+			return "", "", false, outils.NewHttpError(http.StatusInternalServerError, "Error reading %s: %v", existingVoucherFileName, err)
+		}
+	}
+
+	s := &saga{ctx: ctx, name: "voucher import"}
+	defer func() {
+		if httpErr != nil {
+			s.rollback()
+		}
+	}()
+
+	// Import the voucher into the owner service, which returns the device guid
+	respBodyBytes, httpErr := ownerServiceRequest(ctx, client, http.MethodPost, fdoOwnerURL+"/api/v1/owner/vouchers", voucherBytes)
+	if httpErr != nil {
+		return "", "", false, httpErr
+	}
+	deviceUuid = strings.TrimSpace(string(respBodyBytes))
+	if !deviceGuidRegex.MatchString(deviceUuid) {
+		return "", "", false, outils.NewHttpError(http.StatusBadGateway, "the owner service returned an invalid device guid for the imported voucher: %s", deviceUuid)
+	}
+	outils.LogCtx(ctx).Info("voucher imported in the owner service", "org", deviceOrgId, "device", deviceUuid)
+	importedUuid := deviceUuid // the compensations run after the return has cleared deviceUuid
+
+	// A new device is removed if the import fails. A device that is being replaced is put back the way it was, so a failure
+	// doesn't lose the earlier import.
+	deviceDir := filepath.Clean(filepath.Join(OcsDbDir, "v1", "devices", deviceUuid))
+	isNewDevice := !outils.PathExists(deviceDir)
+	undo := func(name string, compensate func(context.Context) error) {
+		if isNewDevice {
+			s.done(name, compensate)
+		}
+	}
+	if isNewDevice || !strings.EqualFold(deviceUuid, voucherHeader.Guid) {
+		s.done("import voucher in the owner service", func(ctx context.Context) error {
+			_, httpErr := ownerServiceRequest(ctx, client, http.MethodDelete, fdoOwnerURL+"/api/v1/owner/vouchers/"+importedUuid, nil)
+			return httpErrOrNil(httpErr)
+		})
+	} else if existingVoucherBytes != nil {
+		s.done("replace voucher in the owner service", func(ctx context.Context) error {
+			_, httpErr := ownerServiceRequest(ctx, client, http.MethodPost, fdoOwnerURL+"/api/v1/owner/vouchers", existingVoucherBytes)
+			return httpErrOrNil(httpErr)
+		})
+	}
+	if !strings.EqualFold(deviceUuid, voucherHeader.Guid) {
+		return "", "", false, outils.NewHttpError(http.StatusBadGateway, "the owner service returned device guid %s for the voucher of device %s", deviceUuid, voucherHeader.Guid)
+	}
+
+	execFileName := filepath.Clean(filepath.Join(OcsDbDir, "v1", "values", deviceUuid+"_exec"))
+	if !isNewDevice {
+		snapshot, httpErr := snapshotFiles(filepath.Join(deviceDir, "ownership_voucher.txt"), filepath.Join(deviceDir, "orgid.txt"),
+			getDeviceRecordFileName(deviceUuid), getDeviceStateFileName(deviceUuid), filepath.Join(deviceDir, "nodeToken.txt"), execFileName)
+		if httpErr != nil {
+			return "", "", false, httpErr
+		}
+		s.done("replace the device files", func(ctx context.Context) error {
+			if err := snapshot.restore(); err != nil {
+				return err
+			}
+			indexDevice(ctx, importedUuid)
+			if snapshot[execFileName] == nil {
+				return nil
+			}
+			return httpErrOrNil(postDeviceExecResource(ctx, importedUuid))
+		})
+	}
+
+	// Create the device directory in the OCS DB. All of the device files are in it, so removing it undoes all of them.
+	if err := os.MkdirAll(deviceDir, 0750); err != nil {
+		return "", "", false, outils.NewHttpError(http.StatusInternalServerError, "could not create directory %s: %v", deviceDir, err)
+	}
+	undo("create the device directory", func(context.Context) error {
+		unindexDevice(importedUuid)
+		return os.RemoveAll(deviceDir)
+	})
+
+	// Put the voucher in the OCS DB
+	fileName := filepath.Join(deviceDir, "ownership_voucher.txt")
+	outils.LogCtx(ctx).Debug("creating file", "org", deviceOrgId, "file", fileName)
+	if err := ocsdb.WriteFile(ctx, fileName, voucherBytes, 0644); err != nil {
+		return "", "", false, outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
+	}
+
+	// Create orgid.txt file to identify what org this device/voucher is part of
+	fileName = filepath.Join(deviceDir, "orgid.txt")
+	outils.LogCtx(ctx).Debug("creating file", "org", deviceOrgId, "file", fileName)
+	if err := ocsdb.WriteFile(ctx, fileName, []byte(deviceOrgId), 0644); err != nil {
+		return "", "", false, outils.NewHttpError(http.StatusInternalServerError, "could not create %s: %v", fileName, err)
+	}
+
+	// Save the parts of the voucher that the device list can be filtered and sorted by
+	if httpErr := saveDeviceRecord(ctx, deviceUuid, voucherHeader, user, time.Now()); httpErr != nil {
+		return "", "", false, httpErr
+	}
+
+	// Start tracking the onboarding state of the device
+	if httpErr := setDeviceState(ctx, deviceUuid, DeviceStateImported, "", ""); httpErr != nil {
+		return "", "", false, httpErr
+	}
+
+	// Generate a node token
+	nodeToken, httpErr = outils.GenerateNodeToken()
+	if httpErr != nil {
+		return "", "", false, httpErr
+	}
+
+	// Create exec file and post it in FDO Owner Services
+	if httpErr := createDeviceExecFile(ctx, deviceUuid, nodeToken, deviceOrgId); httpErr != nil {
+		return "", "", false, httpErr
+	}
+	undo("create the device exec file", func(context.Context) error { return os.Remove(execFileName) })
+
+	if httpErr := postDeviceExecResource(ctx, deviceUuid); httpErr != nil {
+		return "", "", false, httpErr
+	}
+	undo("post the device exec resource to the owner service", func(ctx context.Context) error {
+		_, httpErr := ownerServiceRequest(ctx, client, http.MethodDelete, fdoOwnerURL+"/api/v1/owner/resource?filename="+importedUuid+"_exec", nil)
+		return httpErrOrNil(httpErr)
+	})
+
+	// Save the node token with the device, so authorized admins can get or rotate it later
+	if httpErr := storeNodeToken(ctx, deviceUuid, nodeToken); httpErr != nil {
+		return "", "", false, httpErr
+	}
+
+	// Set the SVI instructions in the owner service. They are the same for every device, so there is nothing to undo.
+	outils.LogCtx(ctx).Debug("setting the SVI instructions in the owner service", "svi", sviBody)
+	if _, httpErr := ownerServiceRequest(ctx, client, http.MethodPost, fdoOwnerURL+"/api/v1/owner/svi", []byte(sviBody)); httpErr != nil {
+		return "", "", false, httpErr
+	}
+
+	indexDevice(ctx, deviceUuid)
+	return deviceUuid, nodeToken, false, nil
+}
+
+// If this device was already imported, decide what to do with this voucher for it. Returns existing true (with the stored node
+// token) if it is the same voucher in the same org, a 409 error if it conflicts with the existing device, and existing false if
+// the import should go ahead.
+func checkExistingDevice(deviceUuid, deviceOrgId string, voucherBytes []byte, replace bool) (string, string, bool, *outils.HttpError) {
+	deviceDir := filepath.Clean(filepath.Join(OcsDbDir, "v1", "devices", deviceUuid))
+	if !outils.PathExists(deviceDir) {
+		return "", "", false, nil
+	}
+
+	// A device can only be in 1 org, even if the caller asks to replace it
+	existingOrgId, httpErr := getOrgidTxtStr(deviceUuid)
+	if httpErr != nil {
+		return "", "", false, httpErr
+	}
+	if existingOrgId != "" && existingOrgId != deviceOrgId {
+		return "", "", false, outils.NewHttpError(http.StatusConflict, "device %s was already imported in another org", deviceUuid)
+	}
+	if replace {
+		return "", "", false, nil
+	}
+
+	voucherFileName := filepath.Join(deviceDir, "ownership_voucher.txt")
+	existingVoucherBytes, err := ocsdb.ReadFile(voucherFileName)
+	if err != nil {
+		return "", "", false, outils.NewHttpError(http.StatusInternalServerError, "Error reading %s: %v", voucherFileName, err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(existingVoucherBytes), bytes.TrimSpace(voucherBytes)) {
+		return "", "", false, outils.NewHttpError(http.StatusConflict, "device %s was already imported with a different voucher, use ?replace=true to replace it", deviceUuid)
+	}
+	nodeToken, httpErr := getNodeTokenTxtStr(deviceUuid)
+	if httpErr != nil {
+		return "", "", false, httpErr
+	}
+	return deviceUuid, nodeToken, true, nil
+}
+
+// Send a request to the owner service and return the response body. Any status other than 2xx is an error.
+func ownerServiceRequest(ctx context.Context, client *http.Client, method, url string, body []byte) ([]byte, *outils.HttpError) {
+	return upstreamRequest(ctx, client, "owner service", method, url, body)
+}
+
+// Send a request to an FDO service and return the response body. Any status other than 2xx is an error, that names the service.
+func upstreamRequest(ctx context.Context, client *http.Client, service, method, url string, body []byte) ([]byte, *outils.HttpError) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "unable to create HTTP request for %s %s: %v", method, outils.SafeUrl(url), err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "text/plain")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusBadGateway, "unable to send HTTP request for %s %s: %v", method, outils.SafeUrl(url), err)
+	}
+	defer resp.Body.Close()
+	respBodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusBadGateway, "Error reading the response body of %s %s: %v", method, outils.SafeUrl(url), err)
+	}
+	outils.LogCtx(ctx).Debug(service+" response", "method", method, "url", outils.SafeUrl(url), "status", resp.StatusCode, "bytes", len(respBodyBytes))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, outils.NewHttpError(http.StatusBadGateway, "%s returned HTTP code %d for %s %s: %s", service, resp.StatusCode, method, outils.SafeUrl(url), string(respBodyBytes))
+	}
+	return respBodyBytes, nil
+}
+
+// A set of mutexes, 1 per key, that are removed when they are not used
+type keyedMutex struct {
+	mu      sync.Mutex
+	entries map[string]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	mutex sync.Mutex
+	users int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{entries: map[string]*keyedMutexEntry{}}
+}
+
+// Lock the mutex of this key, and return the function that unlocks it
+func (k *keyedMutex) lock(key string) func() {
+	k.mu.Lock()
+	entry, ok := k.entries[key]
+	if !ok {
+		entry = &keyedMutexEntry{}
+		k.entries[key] = entry
+	}
+	entry.users++
+	k.mu.Unlock()
+
+	entry.mutex.Lock()
+	return func() {
+		entry.mutex.Unlock()
+		k.mu.Lock()
+		entry.users--
+		if entry.users == 0 {
+			delete(k.entries, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// The raw (still encrypted) content and permissions of files, to put them back exactly as they were
+type fileSnapshot map[string]*fileSnapshotEntry
+
+type fileSnapshotEntry struct {
+	data []byte
+	perm os.FileMode
+}
+
+// Read these files. The files that don't exist are recorded as missing, so restore removes them.
+func snapshotFiles(fileNames ...string) (fileSnapshot, *outils.HttpError) {
+	snapshot := fileSnapshot{}
+	for _, fileName := range fileNames {
+		info, err := os.Stat(fileName)
+		if errors.Is(err, fs.ErrNotExist) {
+			snapshot[fileName] = nil
+			continue
+		} else if err != nil {
+			return nil, outils.NewHttpError(http.StatusInternalServerError, "Error reading %s: %v", fileName, err)
+		}
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			return nil, outils.NewHttpError(http.StatusInternalServerError, "Error reading %s: %v", fileName, err)
+		}
+		snapshot[fileName] = &fileSnapshotEntry{data: data, perm: info.Mode().Perm()}
+	}
+	return snapshot, nil
+}
+
+// Put the files back the way they were when the snapshot was taken
+func (snapshot fileSnapshot) restore() error {
+	for fileName, entry := range snapshot {
+		if entry == nil {
+			if err := os.Remove(fileName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		} else if err := os.WriteFile(fileName, entry.data, entry.perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Convert a nil *HttpError to a nil error, so it is not a non-nil error interface
+func httpErrOrNil(httpErr *outils.HttpError) error {
+	if httpErr == nil {
+		return nil
+	}
+	return httpErr
+}